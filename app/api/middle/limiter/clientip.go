@@ -0,0 +1,259 @@
+package limiter
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/rsb/failure"
+	"net"
+	"strings"
+)
+
+const (
+	HeaderForwarded     = "Forwarded"
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderXRealIP       = "X-Real-IP"
+)
+
+// DefaultProxyHeaders is the header the client ip is read from when none is
+// configured. Only one header is read, a client could otherwise send a header
+// the proxy does not write and pick its own address.
+var DefaultProxyHeaders = []string{HeaderXForwardedFor}
+
+// ClientIPConfig controls how the ip of a client is resolved and keyed
+//
+// TrustedProxies - ips or networks in CIDR notation of the proxies allowed
+// 									to report the client ip, none when empty
+// ProxyHeaders   - the header the client ip is read from, exactly the one the
+// 									proxy writes, defaults to DefaultProxyHeaders. Supported
+// 									headers are X-Forwarded-For, Forwarded and X-Real-IP
+// IPv4Prefix     - length of the network an ipv4 client is keyed on, like 24,
+// 									the whole address when 0
+// IPv6Prefix     - length of the network an ipv6 client is keyed on, like 64
+// 									or 56, the whole address when 0
+type ClientIPConfig struct {
+	TrustedProxies []string
+	ProxyHeaders   []string
+	IPv4Prefix     int
+	IPv6Prefix     int
+}
+
+// ClientIP resolves the address of the client behind trusted proxies, like a
+// load balancer or an ingress. The proxy headers are only used when the peer
+// of the connection is a trusted proxy, and their hops are walked from the
+// nearest one back until the first address that is not a trusted proxy,
+// which is the client. A client can not spoof its address by sending the
+// header itself, any hop it adds is behind the first untrusted one. Only the
+// header the proxy writes is read, any other one is under the control of the
+// client.
+//
+// Clients are keyed on their network when a prefix is configured, an ipv6
+// client usually holds a whole /64 and would get a fresh bucket for every
+// address it rotates through.
+//
+// trusted - the networks of the trusted proxies
+// header  - the proxy header the client ip is read from
+// ipv4    - the mask of the network an ipv4 client is keyed on, nil for the
+// 					 whole address
+// ipv6    - the mask of the network an ipv6 client is keyed on, nil for the
+// 					 whole address
+type ClientIP struct {
+	trusted []*net.IPNet
+	header  string
+	ipv4    net.IPMask
+	ipv6    net.IPMask
+}
+
+// NewClientIP creates a resolver of the client ip from the config
+func NewClientIP(config ClientIPConfig) (*ClientIP, error) {
+	trusted := make([]*net.IPNet, 0, len(config.TrustedProxies))
+	for _, p := range config.TrustedProxies {
+		network, err := parseNetwork(p)
+		if err != nil {
+			return nil, failure.Wrap(err, "parseNetwork failed")
+		}
+		trusted = append(trusted, network)
+	}
+
+	headers := config.ProxyHeaders
+	if len(headers) == 0 {
+		headers = DefaultProxyHeaders
+	}
+
+	if len(headers) > 1 {
+		return nil, failure.InvalidParam("proxy headers (%s) are more than one, only the header the proxy writes can be trusted", strings.Join(headers, ", "))
+	}
+
+	var header string
+	switch h := headers[0]; {
+	case strings.EqualFold(h, HeaderXForwardedFor):
+		header = HeaderXForwardedFor
+	case strings.EqualFold(h, HeaderForwarded):
+		header = HeaderForwarded
+	case strings.EqualFold(h, HeaderXRealIP):
+		header = HeaderXRealIP
+	default:
+		return nil, failure.InvalidParam("proxy header (%s) is not supported", h)
+	}
+
+	ipv4, err := prefixMask(config.IPv4Prefix, 8*net.IPv4len)
+	if err != nil {
+		return nil, failure.Wrap(err, "prefixMask failed for ipv4")
+	}
+
+	ipv6, err := prefixMask(config.IPv6Prefix, 8*net.IPv6len)
+	if err != nil {
+		return nil, failure.Wrap(err, "prefixMask failed for ipv6")
+	}
+
+	return &ClientIP{trusted: trusted, header: header, ipv4: ipv4, ipv6: ipv6}, nil
+}
+
+// Resolve is the address of the client of the request
+func (r *ClientIP) Resolve(c *fiber.Ctx) net.IP {
+	remote := c.Context().RemoteIP()
+	if !r.IsTrusted(remote) {
+		return remote
+	}
+
+	// the nearest hop is the last one, the client is the first hop not added
+	// by a trusted proxy
+	hops := r.hops(c, r.header)
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHop(hops[i])
+		if ip == nil {
+			break
+		}
+
+		client = ip
+		if !r.IsTrusted(ip) {
+			break
+		}
+	}
+
+	return client
+}
+
+// KeyGenerator keys the requests on the address of their client, or on its
+// network in CIDR notation when a prefix is configured
+func (r *ClientIP) KeyGenerator(c *fiber.Ctx) string {
+	return r.Key(r.Resolve(c))
+}
+
+// Key is the ip, or its network in CIDR notation when a prefix is configured.
+// An ipv4 address mapped in ipv6 is keyed as ipv4.
+func (r *ClientIP) Key(ip net.IP) string {
+	mask := r.ipv6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, mask = ip4, r.ipv4
+	}
+
+	if mask == nil {
+		return ip.String()
+	}
+
+	network := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	return network.String()
+}
+
+// IsTrusted reports whether the ip belongs to a trusted proxy
+func (r *ClientIP) IsTrusted(ip net.IP) bool {
+	for _, network := range r.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hops are the addresses listed by every instance of the header, in order
+func (r *ClientIP) hops(c *fiber.Ctx, header string) []string {
+	var hops []string
+	c.Request().Header.VisitAll(func(key, value []byte) {
+		if !strings.EqualFold(string(key), header) {
+			return
+		}
+
+		switch header {
+		case HeaderForwarded:
+			hops = append(hops, forwardedFor(string(value))...)
+		case HeaderXRealIP:
+			hops = append(hops, strings.TrimSpace(string(value)))
+		default:
+			for _, hop := range strings.Split(string(value), ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	})
+
+	return hops
+}
+
+// forwardedFor is the for parameter of every element of a Forwarded header,
+// see RFC 7239
+func forwardedFor(value string) []string {
+	var hops []string
+	for _, element := range strings.Split(value, ",") {
+		for _, pair := range strings.Split(element, ";") {
+			name, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(name, "for") {
+				hops = append(hops, strings.Trim(v, `"`))
+			}
+		}
+	}
+
+	return hops
+}
+
+// parseHop parses the address of a hop, with or without a port, and ipv6
+// addresses with or without brackets. It is nil for an invalid, unknown or
+// obfuscated hop.
+func parseHop(hop string) net.IP {
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return net.ParseIP(host)
+	}
+
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+}
+
+// prefixMask is the mask of a network prefix of the given length, nil when
+// the length is 0 or covers the whole address
+func prefixMask(length, bits int) (net.IPMask, error) {
+	if length < 0 || length > bits {
+		return nil, failure.InvalidParam("prefix length (%d) is not between 0 and (%d)", length, bits)
+	}
+
+	if length == 0 || length == bits {
+		return nil, nil
+	}
+
+	return net.CIDRMask(length, bits), nil
+}
+
+// parseNetwork parses a network in CIDR notation, or a single ip
+func parseNetwork(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, failure.ToInvalidParam(err, "net.ParseCIDR failed for (%s)", s)
+		}
+		return network, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, failure.InvalidParam("(%s) is not an ip or a CIDR", s)
+	}
+
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
@@ -3,6 +3,7 @@ package limiter
 import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/failure"
 	"time"
 )
 
@@ -16,6 +17,31 @@ import (
 // MinTTL     	- inactivity period before deletion
 // StorageSize  - Initial size of data store
 // Exceeded     - Is called when the limit is exceeded
+// Algorithm    - rate limit algorithm used by the default store
+// Burst        - token bucket or gcra burst, defaults to Limit
+// MaxQueue     - leaky bucket queue depth, defaults to Limit
+// MaxWait      - longest a request is held by the leaky bucket, defaults to Interval
+// Cost         - number of tokens a request consumes, defaults to 1 per request
+// SkipFailedRequests     - return the tokens of requests that failed, status >= 400
+// SkipSuccessfulRequests - return the tokens of requests that succeeded, status < 400
+// Store        - storage backend used to track limits, defaults to a MemoryStore
+// Clock        - source of the current time for the default store
+// Shards       - when above 1 the default store is a ShardedStore with this many shards
+// MaxKeys      - max number of keys held by the default store, unbounded when 0
+// Overflow     - what happens to a new key when the default store is full, defaults to evict
+// Windows      - limits all enforced on each key by the default store, replacing Limit and Interval
+// TrustedProxies - ips or CIDRs of the proxies allowed to report the client ip, see ClientIP
+// ProxyHeaders   - the header the client ip is read from, the one the proxy writes, defaults to DefaultProxyHeaders
+// IPv4Prefix     - length of the network an ipv4 client is keyed on, the whole address when 0
+// IPv6Prefix     - length of the network an ipv6 client is keyed on, the whole address when 0
+//
+// When Store is nil a MemoryStore is created from this config and its garbage
+// collector is started. An injected store is owned by the caller, who is
+// responsible for running its GarbageCollector and closing it. With Windows
+// the headers report the window closest to exhaustion. When TrustedProxies or
+// a prefix are set and no KeyGenerator is given, requests are keyed on the ip
+// of the client behind the proxies, or its network, instead of the ip of the
+// connection. Invalid proxies or prefixes are a programming error and panic.
 type Config struct {
 	Next         func(c *fiber.Ctx) bool
 	Limit        uint64
@@ -25,6 +51,25 @@ type Config struct {
 	MinTTL       time.Duration
 	StorageSize  int
 	Exceeded     fiber.Handler
+	Algorithm    limits.Algorithm
+	Burst        uint64
+	MaxQueue     uint64
+	MaxWait      time.Duration
+	Cost         func(c *fiber.Ctx) uint64
+	Store        limits.Store
+	Clock        limits.Clock
+	Shards       int
+	MaxKeys      int
+	Overflow     limits.OverflowPolicy
+	Windows      []limits.Window
+
+	TrustedProxies []string
+	ProxyHeaders   []string
+	IPv4Prefix     int
+	IPv6Prefix     int
+
+	SkipFailedRequests     bool
+	SkipSuccessfulRequests bool
 }
 
 func NewDefaultConfig() Config {
@@ -34,12 +79,16 @@ func NewDefaultConfig() Config {
 		TTLInterval: 24 * time.Hour,
 		MinTTL:      24 * time.Hour,
 		StorageSize: 4096,
+		Algorithm:   limits.DefaultAlgorithm,
 		KeyGenerator: func(c *fiber.Ctx) string {
 			return c.IP()
 		},
 		Exceeded: func(c *fiber.Ctx) error {
 			return c.SendStatus(fiber.StatusTooManyRequests)
 		},
+		Cost: func(c *fiber.Ctx) uint64 {
+			return 1
+		},
 	}
 }
 
@@ -50,12 +99,20 @@ func ToLimitsConfig(config Config) *limits.Config {
 		TTLInterval: config.TTLInterval,
 		MinTTL:      config.MinTTL,
 		InitialSize: config.StorageSize,
+		Algorithm:   config.Algorithm,
+		Burst:       config.Burst,
+		MaxQueue:    config.MaxQueue,
+		MaxWait:     config.MaxWait,
+		Clock:       config.Clock,
+		Shards:      config.Shards,
+		MaxKeys:     config.MaxKeys,
+		Overflow:    config.Overflow,
 	}
 }
 
 func configure(config ...Config) Config {
 	defaults := NewDefaultConfig()
-	if len(config) > 1 {
+	if len(config) != 1 {
 		return defaults
 	}
 
@@ -81,6 +138,10 @@ func configure(config ...Config) Config {
 		cfg.StorageSize = defaults.StorageSize
 	}
 
+	if cfg.Algorithm == "" {
+		cfg.Algorithm = defaults.Algorithm
+	}
+
 	if cfg.Exceeded == nil {
 		cfg.Exceeded = defaults.Exceeded
 	}
@@ -89,9 +150,26 @@ func configure(config ...Config) Config {
 		cfg.Next = defaults.Next
 	}
 
+	if cfg.KeyGenerator == nil && (len(cfg.TrustedProxies) > 0 || cfg.IPv4Prefix != 0 || cfg.IPv6Prefix != 0) {
+		resolver, err := NewClientIP(ClientIPConfig{
+			TrustedProxies: cfg.TrustedProxies,
+			ProxyHeaders:   cfg.ProxyHeaders,
+			IPv4Prefix:     cfg.IPv4Prefix,
+			IPv6Prefix:     cfg.IPv6Prefix,
+		})
+		if err != nil {
+			panic(failure.Wrap(err, "NewClientIP failed"))
+		}
+		cfg.KeyGenerator = resolver.KeyGenerator
+	}
+
 	if cfg.KeyGenerator == nil {
 		cfg.KeyGenerator = defaults.KeyGenerator
 	}
 
+	if cfg.Cost == nil {
+		cfg.Cost = defaults.Cost
+	}
+
 	return cfg
 }
@@ -4,6 +4,7 @@ package limiter
 
 import (
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
 	"github.com/rsb/api_rate_limiter/foundation/limits"
 	"github.com/rsb/failure"
 	"strconv"
@@ -20,32 +21,116 @@ const (
 func New(opts ...Config) fiber.Handler {
 	cfg := configure(opts...)
 
-	store := limits.NewMemoryStore(ToLimitsConfig(cfg))
-	go store.GarbageCollector()
+	store := cfg.Store
+	if store == nil {
+		store = newStore(cfg)
+		go store.GarbageCollector()
+	}
+
 	return func(c *fiber.Ctx) error {
 		if cfg.Next != nil && cfg.Next(c) {
 			return c.Next()
 		}
 
-		// Defaults to IP
-		key := cfg.KeyGenerator(c)
+		// Defaults to IP. The key outlives the request in the store, so it
+		// must not share the memory fiber reuses for the next request
+		key := utils.CopyString(cfg.KeyGenerator(c))
 
-		info, err := store.Take(key)
+		cost := cfg.Cost(c)
+		info, err := store.TakeN(key, cost)
 		if err != nil {
-			return failure.Wrap(err, "store.Take failed for (%s)", key)
+			return failure.Wrap(err, "store.TakeN failed for (%s)", key)
 		}
 
-		reset := time.Unix(0, int64(info.Reset)).UTC().Format(time.RFC1123)
-
-		c.Set(HeaderRateLimitLimit, strconv.FormatUint(info.LimitSize, 10))
-		c.Set(HeaderRateLimitRemaining, strconv.FormatUint(info.Remaining, 10))
-		c.Set(HeaderRateLimitReset, reset)
-
+		setHeaders(c, info)
 		if !info.OperationOk {
-			c.Set(HeaderRetryAfter, reset)
 			return cfg.Exceeded(c)
 		}
 
-		return c.Next()
+		// The leaky bucket shapes traffic, hold the request until its turn
+		if info.Delay > 0 {
+			if err = wait(c, info.Delay); err != nil {
+				return failure.Wrap(err, "wait failed for (%s)", key)
+			}
+		}
+
+		if !cfg.SkipFailedRequests && !cfg.SkipSuccessfulRequests {
+			return c.Next()
+		}
+
+		// Refund the request when the client should not be charged for it
+		err = c.Next()
+		failed := err != nil || c.Response().StatusCode() >= fiber.StatusBadRequest
+		if (failed && cfg.SkipFailedRequests) || (!failed && cfg.SkipSuccessfulRequests) {
+			if rErr := store.Return(key, cost); rErr != nil {
+				return failure.Wrap(rErr, "store.Return failed for (%s)", key)
+			}
+		}
+
+		return err
+	}
+}
+
+// setHeaders reports the state of the limit to the client, with the time to
+// retry after when the request is rejected
+func setHeaders(c *fiber.Ctx, info limits.RateInfo) {
+	reset := time.Unix(0, int64(info.Reset)).UTC().Format(time.RFC1123)
+
+	c.Set(HeaderRateLimitLimit, strconv.FormatUint(info.LimitSize, 10))
+	c.Set(HeaderRateLimitRemaining, strconv.FormatUint(info.Remaining, 10))
+	c.Set(HeaderRateLimitReset, reset)
+
+	if !info.OperationOk {
+		c.Set(HeaderRetryAfter, reset)
+	}
+}
+
+// newStore creates the default store, see NewStore. Invalid windows are a
+// programming error and panic.
+func newStore(cfg Config) limits.Store {
+	store, err := NewStore(cfg)
+	if err != nil {
+		panic(failure.Wrap(err, "NewStore failed"))
+	}
+
+	return store
+}
+
+// NewStore creates the default store of the config, sharded when more than
+// one shard is configured and with a tier per window when windows are
+// configured. The caller owns the store.
+func NewStore(cfg Config) (limits.Store, error) {
+	if len(cfg.Windows) == 0 {
+		return newMemoryStore(ToLimitsConfig(cfg)), nil
+	}
+
+	store, err := limits.NewWindowStore(ToLimitsConfig(cfg), cfg.Windows, func(c *limits.Config, _ limits.Window) (limits.Store, error) {
+		return newMemoryStore(c), nil
+	})
+	if err != nil {
+		return nil, failure.Wrap(err, "limits.NewWindowStore failed")
+	}
+
+	return store, nil
+}
+
+func newMemoryStore(config *limits.Config) limits.Store {
+	if config.Shards > 1 {
+		return limits.NewShardedStore(config)
+	}
+
+	return limits.NewMemoryStore(config)
+}
+
+// wait blocks for the given delay or until the server shuts down
+func wait(c *fiber.Ctx, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-c.Context().Done():
+		return failure.Shutdown("server shutdown while request was queued")
 	}
 }
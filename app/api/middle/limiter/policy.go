@@ -0,0 +1,867 @@
+package limiter
+
+import (
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pelletier/go-toml"
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/failure"
+	"gopkg.in/yaml.v3"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	PolicyFormatTOML = "toml"
+	PolicyFormatYAML = "yaml"
+)
+
+const (
+	PolicyMatchFirst = "first"
+	PolicyMatchAll   = "all"
+)
+
+// tomlPosition is the position go-toml prefixes its errors with
+var tomlPosition = regexp.MustCompile(`^\((\d+), (\d+)\): `)
+
+// yamlPosition is the position yaml prefixes its errors with
+var yamlPosition = regexp.MustCompile(`^yaml: line (\d+): `)
+
+// LoadPolicy reads a policy file and parses it in the rule set config it
+// defines, the format is given by the extension of the file: .toml, .yaml or
+// .yml. See ParsePolicy.
+func LoadPolicy(path string) (RuleSetConfig, error) {
+	format, err := PolicyFormat(path)
+	if err != nil {
+		return RuleSetConfig{}, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return RuleSetConfig{}, failure.ToSystem(err, "os.ReadFile failed for (%s)", path)
+	}
+
+	return ParsePolicy(path, format, data)
+}
+
+// PolicyFormat is the format of a policy file given by its extension
+func PolicyFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		return PolicyFormatTOML, nil
+	case ".yaml", ".yml":
+		return PolicyFormatYAML, nil
+	}
+
+	return "", failure.InvalidParam("policy file (%s) is not .toml, .yaml or .yml", path)
+}
+
+// ParsePolicy parses and validates a policy in TOML or YAML. A policy defines
+// named rules, the key strategies they are keyed on, their tiers and the
+// overrides of some keys:
+//
+//	match = "first"              # or all, see RuleSetConfig.MatchAll
+//
+//	[client_ip]                  # see ClientIPConfig
+//	trusted_proxies = ["10.0.0.0/8"]
+//	proxy_headers   = ["X-Forwarded-For"]
+//	ipv4_prefix     = 24
+//	ipv6_prefix     = 64
+//
+//	[keys]                       # named key strategies, see Rule.Key
+//	api_key = "header:X-Api-Key"
+//	tenant  = "header:X-Tenant"
+//
+//	[[rules]]
+//	name      = "auth"
+//	path      = "/v1/auth/**"
+//	methods   = ["POST"]
+//	key       = "ip"             # a key strategy or a key source
+//	algorithm = "gcra"
+//	limit     = 5
+//	interval  = "1m"
+//	max_keys  = 100000           # see Config.MaxKeys
+//	overflow  = "evict"
+//
+//	[[rules]]
+//	name = "api"
+//	path = "/v1/**"
+//	key  = "api_key"
+//
+//	  [[rules.tiers]]
+//	  name     = "key"
+//	  key      = "api_key"
+//	  limit    = 100
+//	  interval = "1s"
+//
+//	  [[rules.tiers]]
+//	  name    = "tenant"
+//	  key     = "tenant"
+//	  windows = ["1000/1s", "100000/24h"]
+//
+//	  [[rules.overrides]]
+//	  keys     = ["acme-key"]
+//	  limit    = 1000
+//	  interval = "1s"
+//
+// The limits of a rule, a tier or an override are either a limit and an
+// interval, windows, or tiers for rules and overrides, along with algorithm,
+// burst, max_queue, max_wait, max_keys, overflow and shards. Rules also take
+// headers, cost, skip_failed_requests and skip_successful_requests. Unknown
+// fields are an error. Every error is prefixed with the name and the line of
+// the policy where it was found, like policy.toml:12.
+func ParsePolicy(name, format string, data []byte) (RuleSetConfig, error) {
+	var root *node
+	var err error
+	switch format {
+	case PolicyFormatTOML:
+		root, err = parseTOML(name, data)
+	case PolicyFormatYAML:
+		root, err = parseYAML(name, data)
+	default:
+		return RuleSetConfig{}, failure.InvalidParam("policy format (%s) is not supported", format)
+	}
+	if err != nil {
+		return RuleSetConfig{}, err
+	}
+
+	d := policyDecoder{name: name, keys: map[string]string{}}
+	return d.policy(root)
+}
+
+// node is a value of a policy with the line it is defined on, a value is a
+// map[string]*node, a []*node, a string, an int64, a float64, a bool or nil
+//
+// line  - line of the value, 0 when unknown
+// value - the decoded value
+// keys  - the keys of a map in the order they are defined
+type node struct {
+	line  int
+	value interface{}
+	keys  []string
+}
+
+// parseTOML parses a TOML policy in nodes
+func parseTOML(name string, data []byte) (*node, error) {
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		msg := err.Error()
+		if m := tomlPosition.FindStringSubmatch(msg); m != nil {
+			return nil, failure.InvalidParam("%s:%s:%s: %s", name, m[1], m[2], strings.TrimPrefix(msg, m[0]))
+		}
+		return nil, failure.InvalidParam("%s: %s", name, msg)
+	}
+
+	return tomlNode(tree, 1), nil
+}
+
+// tomlNode converts a toml value, line is used when the position of the value
+// is unknown
+func tomlNode(value interface{}, line int) *node {
+	switch v := value.(type) {
+	case *toml.Tree:
+		if pos := v.Position(); pos.Line > 0 {
+			line = pos.Line
+		}
+
+		n := node{line: line}
+		values := make(map[string]*node)
+		for _, k := range v.Keys() {
+			kLine := line
+			if pos := v.GetPositionPath([]string{k}); pos.Line > 0 {
+				kLine = pos.Line
+			}
+			values[k] = tomlNode(v.GetPath([]string{k}), kLine)
+			n.keys = append(n.keys, k)
+		}
+
+		// the tree does not keep the order of the keys
+		sort.SliceStable(n.keys, func(i, j int) bool {
+			return values[n.keys[i]].line < values[n.keys[j]].line
+		})
+		n.value = values
+		return &n
+	case []*toml.Tree:
+		list := make([]*node, 0, len(v))
+		for _, t := range v {
+			list = append(list, tomlNode(t, line))
+		}
+		return &node{line: line, value: list}
+	case []interface{}:
+		list := make([]*node, 0, len(v))
+		for _, item := range v {
+			list = append(list, tomlNode(item, line))
+		}
+		return &node{line: line, value: list}
+	case int64, float64, string, bool:
+		return &node{line: line, value: v}
+	}
+
+	return &node{line: line, value: fmt.Sprint(value)}
+}
+
+// parseYAML parses a YAML policy in nodes
+func parseYAML(name string, data []byte) (*node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		msg := err.Error()
+		if m := yamlPosition.FindStringSubmatch(msg); m != nil {
+			return nil, failure.InvalidParam("%s:%s: %s", name, m[1], strings.TrimPrefix(msg, m[0]))
+		}
+		return nil, failure.InvalidParam("%s: %s", name, msg)
+	}
+
+	if len(doc.Content) == 0 {
+		return &node{line: 1, value: map[string]*node{}}, nil
+	}
+
+	return yamlNode(name, doc.Content[0])
+}
+
+// yamlNode converts a yaml node
+func yamlNode(name string, y *yaml.Node) (*node, error) {
+	switch y.Kind {
+	case yaml.AliasNode:
+		return yamlNode(name, y.Alias)
+	case yaml.MappingNode:
+		n := node{line: y.Line}
+		values := make(map[string]*node, len(y.Content)/2)
+		for i := 0; i+1 < len(y.Content); i += 2 {
+			k := y.Content[i]
+			if _, ok := values[k.Value]; ok {
+				return nil, failure.InvalidParam("%s:%d: field (%s) is defined more than once", name, k.Line, k.Value)
+			}
+
+			v, err := yamlNode(name, y.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			values[k.Value] = v
+			n.keys = append(n.keys, k.Value)
+		}
+		n.value = values
+		return &n, nil
+	case yaml.SequenceNode:
+		list := make([]*node, 0, len(y.Content))
+		for _, item := range y.Content {
+			v, err := yamlNode(name, item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return &node{line: y.Line, value: list}, nil
+	case yaml.ScalarNode:
+		var v interface{}
+		if err := y.Decode(&v); err != nil {
+			return nil, failure.InvalidParam("%s:%d: %s", name, y.Line, err)
+		}
+
+		switch s := v.(type) {
+		case int:
+			v = int64(s)
+		case uint64:
+			if s > math.MaxInt64 {
+				return nil, failure.InvalidParam("%s:%d: number (%d) is too large", name, y.Line, s)
+			}
+			v = int64(s)
+		case time.Time:
+			v = y.Value
+		}
+		return &node{line: y.Line, value: v}, nil
+	}
+
+	return nil, failure.InvalidParam("%s:%d: value is not supported", name, y.Line)
+}
+
+// policyDecoder decodes the nodes of a policy in a rule set config
+//
+// name - name of the policy, prefixed to the errors
+// keys - the key strategies of the policy
+type policyDecoder struct {
+	name string
+	keys map[string]string
+}
+
+// errorf is an invalid policy error at the line of the node
+func (d *policyDecoder) errorf(n *node, format string, args ...interface{}) error {
+	return failure.InvalidParam("%s:%d: %s", d.name, n.line, fmt.Sprintf(format, args...))
+}
+
+func (d *policyDecoder) policy(root *node) (RuleSetConfig, error) {
+	var config RuleSetConfig
+	fields, err := d.fields(root, "policy", "match", "client_ip", "keys", "rules")
+	if err != nil {
+		return config, err
+	}
+
+	if n, ok := fields["match"]; ok {
+		match, err := d.str(n, "match")
+		if err != nil {
+			return config, err
+		}
+
+		switch match {
+		case PolicyMatchFirst:
+		case PolicyMatchAll:
+			config.MatchAll = true
+		default:
+			return config, d.errorf(n, "match (%s) is not first or all", match)
+		}
+	}
+
+	if n, ok := fields["client_ip"]; ok {
+		if config.ClientIP, err = d.clientIP(n); err != nil {
+			return config, err
+		}
+	}
+
+	if n, ok := fields["keys"]; ok {
+		if err = d.strategies(n); err != nil {
+			return config, err
+		}
+	}
+
+	n, ok := fields["rules"]
+	if !ok {
+		return config, d.errorf(root, "policy has no rules")
+	}
+
+	list, err := d.list(n, "rules")
+	if err != nil {
+		return config, err
+	}
+
+	names := make(map[string]struct{}, len(list))
+	for _, item := range list {
+		r, err := d.rule(item)
+		if err != nil {
+			return config, err
+		}
+
+		if _, ok := names[r.Name]; ok {
+			return config, d.errorf(item, "rule (%s) is defined more than once", r.Name)
+		}
+		names[r.Name] = struct{}{}
+
+		config.Rules = append(config.Rules, r)
+	}
+
+	return config, nil
+}
+
+func (d *policyDecoder) clientIP(n *node) (ClientIPConfig, error) {
+	var config ClientIPConfig
+	fields, err := d.fields(n, "client_ip", "trusted_proxies", "proxy_headers", "ipv4_prefix", "ipv6_prefix")
+	if err != nil {
+		return config, err
+	}
+
+	if v, ok := fields["trusted_proxies"]; ok {
+		if config.TrustedProxies, err = d.strs(v, "trusted_proxies"); err != nil {
+			return config, err
+		}
+	}
+
+	if v, ok := fields["proxy_headers"]; ok {
+		if config.ProxyHeaders, err = d.strs(v, "proxy_headers"); err != nil {
+			return config, err
+		}
+	}
+
+	if v, ok := fields["ipv4_prefix"]; ok {
+		if config.IPv4Prefix, err = d.int(v, "ipv4_prefix"); err != nil {
+			return config, err
+		}
+	}
+
+	if v, ok := fields["ipv6_prefix"]; ok {
+		if config.IPv6Prefix, err = d.int(v, "ipv6_prefix"); err != nil {
+			return config, err
+		}
+	}
+
+	if _, err = NewClientIP(config); err != nil {
+		return config, d.errorf(n, "client_ip is invalid: %s", err)
+	}
+
+	return config, nil
+}
+
+// strategies decodes the named key strategies
+func (d *policyDecoder) strategies(n *node) error {
+	fields, err := d.fields(n, "keys")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range n.keys {
+		v := fields[name]
+		source, err := d.str(v, "key "+name)
+		if err != nil {
+			return err
+		}
+
+		if name == KeySourceIP || name == KeySourceGlobal || strings.Contains(name, ":") {
+			return d.errorf(v, "key strategy (%s) is not a valid name", name)
+		}
+
+		if _, _, err = newKeyValue(source, nil); err != nil {
+			return d.errorf(v, "key source (%s) of (%s) is not ip, global, header:<name> or query:<name>", source, name)
+		}
+
+		d.keys[name] = source
+	}
+
+	return nil
+}
+
+// key is the key source of a key strategy or of a key source
+func (d *policyDecoder) key(n *node) (string, error) {
+	key, err := d.str(n, "key")
+	if err != nil {
+		return "", err
+	}
+
+	if source, ok := d.keys[key]; ok {
+		return source, nil
+	}
+
+	if _, _, err = newKeyValue(key, nil); err != nil {
+		return "", d.errorf(n, "key (%s) is not a key strategy nor ip, global, header:<name> or query:<name>", key)
+	}
+
+	return key, nil
+}
+
+// limitFields are the fields of the limits of a rule, a tier or an override
+var limitFields = []string{
+	"algorithm", "limit", "interval", "windows", "burst", "max_queue", "max_wait", "max_keys", "overflow", "shards",
+}
+
+func (d *policyDecoder) rule(n *node) (Rule, error) {
+	var r Rule
+	allowed := append([]string{
+		"name", "path", "methods", "headers", "key", "cost", "skip_failed_requests",
+		"skip_successful_requests", "tiers", "overrides",
+	}, limitFields...)
+	fields, err := d.fields(n, "rule", allowed...)
+	if err != nil {
+		return r, err
+	}
+
+	v, ok := fields["name"]
+	if !ok {
+		return r, d.errorf(n, "rule has no name")
+	}
+	if r.Name, err = d.str(v, "name"); err != nil {
+		return r, err
+	}
+	if r.Name == "" {
+		return r, d.errorf(v, "name of rule is empty")
+	}
+
+	if v, ok = fields["path"]; ok {
+		if r.Path, err = d.str(v, "path"); err != nil {
+			return r, err
+		}
+		if _, err = compilePath(r.Path); err != nil {
+			return r, d.errorf(v, "path (%s) of rule (%s) is invalid: %s", r.Path, r.Name, err)
+		}
+	}
+
+	if v, ok = fields["methods"]; ok {
+		if r.Methods, err = d.strs(v, "methods"); err != nil {
+			return r, err
+		}
+	}
+
+	if v, ok = fields["headers"]; ok {
+		headers, err := d.fields(v, "headers")
+		if err != nil {
+			return r, err
+		}
+
+		r.Headers = make(map[string]string, len(headers))
+		for _, name := range v.keys {
+			if r.Headers[name], err = d.str(headers[name], "header "+name); err != nil {
+				return r, err
+			}
+		}
+	}
+
+	if v, ok = fields["key"]; ok {
+		if r.Key, err = d.key(v); err != nil {
+			return r, err
+		}
+	}
+
+	if v, ok = fields["cost"]; ok {
+		cost, err := d.uint(v, "cost")
+		if err != nil {
+			return r, err
+		}
+		if cost == 0 {
+			return r, d.errorf(v, "cost of rule (%s) is zero", r.Name)
+		}
+		r.Config.Cost = func(*fiber.Ctx) uint64 {
+			return cost
+		}
+	}
+
+	if v, ok = fields["skip_failed_requests"]; ok {
+		if r.Config.SkipFailedRequests, err = d.bool(v, "skip_failed_requests"); err != nil {
+			return r, err
+		}
+	}
+
+	if v, ok = fields["skip_successful_requests"]; ok {
+		if r.Config.SkipSuccessfulRequests, err = d.bool(v, "skip_successful_requests"); err != nil {
+			return r, err
+		}
+	}
+
+	what := fmt.Sprintf("rule (%s)", r.Name)
+	if r.Tiers, err = d.limits(n, fields, what, &r.Config, true); err != nil {
+		return r, err
+	}
+
+	if v, ok = fields["overrides"]; ok {
+		if r.Key == KeySourceGlobal {
+			return r, d.errorf(v, "overrides of rule (%s) are not supported with the global key", r.Name)
+		}
+
+		list, err := d.list(v, "overrides")
+		if err != nil {
+			return r, err
+		}
+
+		for _, item := range list {
+			o, err := d.override(item, r.Name)
+			if err != nil {
+				return r, err
+			}
+			r.Overrides = append(r.Overrides, o)
+		}
+	}
+
+	return r, nil
+}
+
+func (d *policyDecoder) override(n *node, rule string) (Override, error) {
+	var o Override
+	fields, err := d.fields(n, "override", append([]string{"keys", "tiers"}, limitFields...)...)
+	if err != nil {
+		return o, err
+	}
+
+	v, ok := fields["keys"]
+	if !ok {
+		return o, d.errorf(n, "override of rule (%s) has no keys", rule)
+	}
+	if o.Keys, err = d.strs(v, "keys"); err != nil {
+		return o, err
+	}
+	if len(o.Keys) == 0 {
+		return o, d.errorf(v, "keys of override of rule (%s) are empty", rule)
+	}
+
+	o.Tiers, err = d.limits(n, fields, fmt.Sprintf("override of rule (%s)", rule), &o.Config, true)
+	return o, err
+}
+
+func (d *policyDecoder) tier(n *node, what string) (Tier, error) {
+	var t Tier
+	fields, err := d.fields(n, "tier", append([]string{"name", "key"}, limitFields...)...)
+	if err != nil {
+		return t, err
+	}
+
+	v, ok := fields["name"]
+	if !ok {
+		return t, d.errorf(n, "tier of %s has no name", what)
+	}
+	if t.Name, err = d.str(v, "name"); err != nil {
+		return t, err
+	}
+	if t.Name == "" {
+		return t, d.errorf(v, "name of tier of %s is empty", what)
+	}
+
+	if v, ok = fields["key"]; ok {
+		if t.Key, err = d.key(v); err != nil {
+			return t, err
+		}
+	}
+
+	_, err = d.limits(n, fields, fmt.Sprintf("tier (%s) of %s", t.Name, what), &t.Config, false)
+	return t, err
+}
+
+// limits decodes the limits of a rule, an override or a tier in config, and
+// the tiers when they are allowed. The limits are either a limit and an
+// interval, windows or tiers.
+func (d *policyDecoder) limits(n *node, fields map[string]*node, what string, config *Config, tiers bool) ([]Tier, error) {
+	limit, hasLimit := fields["limit"]
+	interval, hasInterval := fields["interval"]
+	windows, hasWindows := fields["windows"]
+	tierList, hasTiers := fields["tiers"]
+	var err error
+
+	switch {
+	case hasTiers && !tiers:
+		return nil, d.errorf(tierList, "tiers of %s are not supported", what)
+	case hasTiers && (hasLimit || hasInterval || hasWindows):
+		return nil, d.errorf(tierList, "%s has both tiers and a limit or windows", what)
+	case hasWindows && (hasLimit || hasInterval):
+		return nil, d.errorf(windows, "%s has both windows and a limit or an interval", what)
+	case hasLimit != hasInterval:
+		return nil, d.errorf(n, "%s needs both a limit and an interval", what)
+	case !hasTiers && !hasWindows && !hasLimit:
+		return nil, d.errorf(n, "%s has no limit, windows or tiers", what)
+	}
+
+	if hasLimit {
+		if config.Limit, err = d.uint(limit, "limit"); err != nil {
+			return nil, err
+		}
+		if config.Limit == 0 {
+			return nil, d.errorf(limit, "limit of %s is zero", what)
+		}
+
+		if config.Interval, err = d.duration(interval, "interval"); err != nil {
+			return nil, err
+		}
+	}
+
+	if hasWindows {
+		list, err := d.strs(windows, "windows")
+		if err != nil {
+			return nil, err
+		}
+		if len(list) == 0 {
+			return nil, d.errorf(windows, "windows of %s are empty", what)
+		}
+
+		intervals := make(map[time.Duration]struct{}, len(list))
+		for _, s := range list {
+			w, err := limits.ParseWindow(s)
+			if err == nil {
+				err = w.Validate()
+			}
+			if err != nil {
+				return nil, d.errorf(windows, "window (%s) of %s is invalid: %s", s, what, err)
+			}
+
+			if _, ok := intervals[w.Interval]; ok {
+				return nil, d.errorf(windows, "interval (%s) is used by more than one window of %s", w.Interval, what)
+			}
+			intervals[w.Interval] = struct{}{}
+			config.Windows = append(config.Windows, w)
+		}
+	}
+
+	if v, ok := fields["algorithm"]; ok {
+		algorithm, err := d.str(v, "algorithm")
+		if err != nil {
+			return nil, err
+		}
+
+		config.Algorithm = limits.Algorithm(algorithm)
+		if !config.Algorithm.IsValid() {
+			return nil, d.errorf(v, "algorithm (%s) of %s is not supported", algorithm, what)
+		}
+	}
+
+	if v, ok := fields["burst"]; ok {
+		if config.Burst, err = d.uint(v, "burst"); err != nil {
+			return nil, err
+		}
+	}
+
+	if v, ok := fields["max_queue"]; ok {
+		if config.MaxQueue, err = d.uint(v, "max_queue"); err != nil {
+			return nil, err
+		}
+	}
+
+	if v, ok := fields["max_wait"]; ok {
+		if config.MaxWait, err = d.duration(v, "max_wait"); err != nil {
+			return nil, err
+		}
+	}
+
+	if v, ok := fields["max_keys"]; ok {
+		if config.MaxKeys, err = d.count(v, "max_keys"); err != nil {
+			return nil, err
+		}
+	}
+
+	if v, ok := fields["overflow"]; ok {
+		overflow, err := d.str(v, "overflow")
+		if err != nil {
+			return nil, err
+		}
+
+		config.Overflow = limits.OverflowPolicy(overflow)
+		if !config.Overflow.IsValid() {
+			return nil, d.errorf(v, "overflow (%s) of %s is not evict, admit or reject", overflow, what)
+		}
+	}
+
+	if v, ok := fields["shards"]; ok {
+		if config.Shards, err = d.count(v, "shards"); err != nil {
+			return nil, err
+		}
+	}
+
+	if !hasTiers {
+		return nil, nil
+	}
+
+	list, err := d.list(tierList, "tiers")
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, d.errorf(tierList, "tiers of %s are empty", what)
+	}
+
+	result := make([]Tier, 0, len(list))
+	names := make(map[string]struct{}, len(list))
+	for _, item := range list {
+		t, err := d.tier(item, what)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := names[t.Name]; ok {
+			return nil, d.errorf(item, "tier (%s) of %s is defined more than once", t.Name, what)
+		}
+		names[t.Name] = struct{}{}
+		result = append(result, t)
+	}
+
+	return result, nil
+}
+
+// fields are the fields of a map node, any field not allowed is an error.
+// Every field is allowed when none are given.
+func (d *policyDecoder) fields(n *node, what string, allowed ...string) (map[string]*node, error) {
+	values, ok := n.value.(map[string]*node)
+	if !ok {
+		return nil, d.errorf(n, "%s is not a table", what)
+	}
+
+	if len(allowed) == 0 {
+		return values, nil
+	}
+
+	for _, k := range n.keys {
+		if !contains(allowed, k) {
+			return nil, d.errorf(values[k], "field (%s) of %s is not supported", k, what)
+		}
+	}
+
+	return values, nil
+}
+
+func (d *policyDecoder) list(n *node, what string) ([]*node, error) {
+	list, ok := n.value.([]*node)
+	if !ok {
+		return nil, d.errorf(n, "%s is not a list", what)
+	}
+
+	return list, nil
+}
+
+func (d *policyDecoder) str(n *node, what string) (string, error) {
+	s, ok := n.value.(string)
+	if !ok {
+		return "", d.errorf(n, "%s is not a string", what)
+	}
+
+	return s, nil
+}
+
+func (d *policyDecoder) strs(n *node, what string) ([]string, error) {
+	list, err := d.list(n, what)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, len(list))
+	for _, item := range list {
+		s, err := d.str(item, what)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+
+	return result, nil
+}
+
+func (d *policyDecoder) int(n *node, what string) (int, error) {
+	i, ok := n.value.(int64)
+	if !ok || i < math.MinInt32 || i > math.MaxInt32 {
+		return 0, d.errorf(n, "%s is not an integer", what)
+	}
+
+	return int(i), nil
+}
+
+// count is an integer that is not negative, like a number of keys
+func (d *policyDecoder) count(n *node, what string) (int, error) {
+	i, ok := n.value.(int64)
+	if !ok || i < 0 || i > math.MaxInt32 {
+		return 0, d.errorf(n, "%s is not a positive integer", what)
+	}
+
+	return int(i), nil
+}
+
+func (d *policyDecoder) uint(n *node, what string) (uint64, error) {
+	i, ok := n.value.(int64)
+	if !ok || i < 0 {
+		return 0, d.errorf(n, "%s is not a positive integer", what)
+	}
+
+	return uint64(i), nil
+}
+
+func (d *policyDecoder) bool(n *node, what string) (bool, error) {
+	b, ok := n.value.(bool)
+	if !ok {
+		return false, d.errorf(n, "%s is not true or false", what)
+	}
+
+	return b, nil
+}
+
+// duration parses a positive duration like 1s or 1h30m, a number is seconds
+func (d *policyDecoder) duration(n *node, what string) (time.Duration, error) {
+	var dur time.Duration
+	switch v := n.value.(type) {
+	case int64:
+		dur = time.Duration(v) * time.Second
+	case string:
+		var err error
+		if dur, err = time.ParseDuration(v); err != nil {
+			return 0, d.errorf(n, "%s (%s) is not a duration like 1s or 1m30s", what, v)
+		}
+	default:
+		return 0, d.errorf(n, "%s is not a duration like 1s or 1m30s", what)
+	}
+
+	if dur <= 0 {
+		return 0, d.errorf(n, "%s (%s) is not positive", what, dur)
+	}
+
+	return dur, nil
+}
@@ -0,0 +1,140 @@
+package limiter
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/failure"
+	"sync"
+	"sync/atomic"
+)
+
+// ReloadResult is the outcome of a reload
+//
+// Rules   - number of rules of the new rule set
+// Kept    - stores adopted from the previous rule set, with the state of
+// 					 their keys, their limits did not change
+// Created - stores created for new or changed limits
+// Closed  - stores of the previous rule set no rule uses anymore
+type ReloadResult struct {
+	Rules   int
+	Kept    int
+	Created int
+	Closed  int
+}
+
+// Reloader enforces a RuleSet which can be replaced without restarting, like
+// when the limit of a tenant changes in the policy. The new rule set is
+// swapped in atomically, requests see either the previous or the new rules,
+// and the stores of the limits that did not change are adopted by the new
+// rule set so their keys keep their state.
+//
+// The stores of the previous rule set nothing uses anymore are closed once
+// the requests taking or returning their tokens are done. A reload does not
+// wait for the requests to be handled, a request still handled by the previous
+// rule set when it is replaced gets no refund of SkipFailedRequests or
+// SkipSuccessfulRequests.
+//
+// reloading - serializes the reloads and Close
+// current   - the *RuleSet enforced
+// closed    - Close was called, reloads are refused
+type Reloader struct {
+	reloading sync.Mutex
+	current   atomic.Value
+	closed    bool
+}
+
+// NewReloader creates the rule set of the config and enforces it until the
+// next reload
+func NewReloader(config RuleSetConfig) (*Reloader, error) {
+	rules, err := NewRuleSet(config)
+	if err != nil {
+		return nil, failure.Wrap(err, "NewRuleSet failed")
+	}
+
+	var r Reloader
+	r.current.Store(rules)
+	return &r, nil
+}
+
+// Handler is the middleware enforcing the current rule set
+func (r *Reloader) Handler() fiber.Handler {
+	return r.handle
+}
+
+// Reload replaces the rule set with the rules of the config. The current rule
+// set is kept when the config is invalid. It returns once the stores that are
+// no longer used are closed.
+func (r *Reloader) Reload(config RuleSetConfig) (ReloadResult, error) {
+	r.reloading.Lock()
+	defer r.reloading.Unlock()
+
+	var result ReloadResult
+	if r.closed {
+		return result, failure.InvalidState("Reloader is closed")
+	}
+
+	previous := r.rules()
+	next, err := newRuleSet(config, previous)
+	if err != nil {
+		return result, failure.Wrap(err, "newRuleSet failed")
+	}
+
+	result.Rules = len(next.rules)
+	used := make(map[limits.Store]struct{}, len(next.owned))
+	for _, o := range next.owned {
+		used[o.store] = struct{}{}
+		if o.adopted {
+			result.Kept++
+		} else {
+			result.Created++
+		}
+	}
+
+	r.current.Store(next)
+
+	// wait for the requests still using the stores of the previous rule set
+	previous.serving.Lock()
+	previous.retired = true
+	previous.serving.Unlock()
+
+	for _, o := range previous.owned {
+		if _, ok := used[o.store]; ok {
+			continue
+		}
+
+		result.Closed++
+		if cErr := o.store.Close(); cErr != nil && err == nil {
+			err = failure.Wrap(cErr, "store.Close failed")
+		}
+	}
+
+	return result, err
+}
+
+// Close closes the stores of the current rule set
+func (r *Reloader) Close() error {
+	r.reloading.Lock()
+	defer r.reloading.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	return r.rules().Close()
+}
+
+// rules is the current rule set
+func (r *Reloader) rules() *RuleSet {
+	return r.current.Load().(*RuleSet)
+}
+
+// handle enforces the current rule set, a rule set replaced while the request
+// was loading it is retired and the request moves to the new one
+func (r *Reloader) handle(c *fiber.Ctx) error {
+	for {
+		if ok, err := r.rules().serve(c); ok {
+			return err
+		}
+	}
+}
@@ -0,0 +1,886 @@
+package limiter
+
+import (
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/failure"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	KeySourceIP     = "ip"
+	KeySourceGlobal = "global"
+	KeySourceHeader = "header:"
+	KeySourceQuery  = "query:"
+)
+
+// Rule limits the requests it matches with limits of its own. A request
+// matches when its path matches Path, its method is one of Methods and it
+// carries every header of Headers.
+//
+// Name    - identifies the rule, every key of the rule is prefixed with it
+// Path    - pattern of the path, segments are matched exactly apart from *
+// 					 and :name which match any single segment, and a final ** which
+// 					 matches any remaining segments. Every path matches when empty
+// Methods - http methods matched, any method when empty
+// Headers - headers a request must carry, with the given value or with any
+// 					 value when the value is *
+// Key     - source of the key: ip, global for a single key shared by every
+// 					 request, header:<name> or query:<name>. Header and query keys
+// 					 fall back to the client ip when missing. Defaults to ip and is
+// 					 ignored when Config.KeyGenerator is set
+// Tiers     - limits enforced together on every request, each on a key of
+// 						 its own, replacing the limits of Config
+// Overrides - limits of some values of the key source, like the api keys of
+// 						 a tenant on a custom plan, the first one listing the value of a
+// 						 request replaces the limits of the rule
+// Config    - the algorithm, limits, windows, cost and exceeded handler of
+// 						 the rule, like the config of New. A store is created for the
+// 						 rule when Config.Store is nil
+type Rule struct {
+	Name      string
+	Path      string
+	Methods   []string
+	Headers   map[string]string
+	Key       string
+	Tiers     []Tier
+	Overrides []Override
+	Config    Config
+}
+
+// Override replaces the limits of a rule for the requests whose value of the
+// key source of the rule is one of Keys. Only the limits of Config are used,
+// the cost, skips and exceeded handler are the ones of the rule.
+//
+// Keys   - values of the key source, an ip or a network in CIDR notation for
+// 					the ip source
+// Tiers  - limits enforced together, see Rule.Tiers
+// Config - the algorithm and limits, a store is created when Config.Store is
+// 					nil
+type Override struct {
+	Keys   []string
+	Tiers  []Tier
+	Config Config
+}
+
+// Tier is one of the limits of a rule enforced together, like 100 requests a
+// second per api key and 1000 per tenant. The tiers of a rule are a
+// limits.CompositeStore, a request rejected by one tier is not charged to the
+// others.
+//
+// Name   - identifies the tier, every key of the tier is prefixed with it
+// Key    - source of the key of the tier, see Rule.Key
+// Config - the algorithm and limits of the tier, its store is always created
+// 					by the rule set
+type Tier struct {
+	Name   string
+	Key    string
+	Config Config
+}
+
+// RuleSetConfig controls how the rules of a RuleSet are evaluated
+//
+// Rules    - evaluated in order
+// MatchAll - every matching rule is enforced and a request is permitted only
+// 						when all of them permit it, otherwise only the first matching
+// 						rule is enforced
+// ClientIP - how the client ip of the ip keys is resolved
+type RuleSetConfig struct {
+	Rules    []Rule
+	MatchAll bool
+	ClientIP ClientIPConfig
+}
+
+// RuleSet enforces per route limits, like a low limit on auth endpoints and
+// a higher one on bulk endpoints. Requests no rule matches are not limited.
+//
+// With MatchAll the rules are enforced in order and, like the tiers of a
+// limits.CompositeStore, the tokens taken by the previous rules are returned
+// when a rule rejects the request. The headers report the most restrictive
+// rule.
+//
+// rules    - the compiled rules, in order
+// matchAll - every matching rule is enforced
+// owned    - the stores created by the rule set or adopted from a previous one
+// reuse    - the stores of a previous rule set by fingerprint, while compiling
+// serving  - held for reading while a request uses the stores, see take
+// retired  - the rule set was replaced by a Reloader, its stores are no
+// 					 longer used
+type RuleSet struct {
+	rules    []*rule
+	matchAll bool
+	owned    []ownedStore
+	reuse    map[string][]limits.Store
+	serving  sync.RWMutex
+	retired  bool
+}
+
+// ownedStore is a store owned by a rule set
+//
+// fingerprint - the limits the store enforces, see fingerprint
+// store       - the store
+// adopted     - the store was adopted from a previous rule set, its garbage
+// 							 collector is already running
+type ownedStore struct {
+	fingerprint string
+	store       limits.Store
+	adopted     bool
+}
+
+// rule is a Rule ready to be evaluated
+type rule struct {
+	name      string
+	path      []string
+	methods   []string
+	headers   map[string]string
+	value     func(c *fiber.Ctx) string
+	ip        func(c *fiber.Ctx) net.IP
+	overrides []override
+	cfg       Config
+	store     limits.Store
+}
+
+// override is an Override ready to be evaluated, the keys of the ip source
+// are networks
+type override struct {
+	keys     []string
+	networks []*net.IPNet
+	key      func(c *fiber.Ctx) string
+	store    limits.Store
+}
+
+// NewRuleSet validates the rules and creates the store of every rule without
+// one. The rule set owns the stores it creates, it runs their garbage
+// collectors and closes them on Close.
+func NewRuleSet(config RuleSetConfig) (*RuleSet, error) {
+	return newRuleSet(config, nil)
+}
+
+// newRuleSet creates a rule set which adopts the stores of the previous rule
+// set enforcing the same limits, keeping the state of their keys. The adopted
+// stores are not closed when the rule set is invalid.
+func newRuleSet(config RuleSetConfig, previous *RuleSet) (*RuleSet, error) {
+	resolver, err := NewClientIP(config.ClientIP)
+	if err != nil {
+		return nil, failure.Wrap(err, "NewClientIP failed")
+	}
+
+	s := RuleSet{
+		rules:    make([]*rule, 0, len(config.Rules)),
+		matchAll: config.MatchAll,
+	}
+
+	if previous != nil {
+		s.reuse = make(map[string][]limits.Store, len(previous.owned))
+		for _, o := range previous.owned {
+			s.reuse[o.fingerprint] = append(s.reuse[o.fingerprint], o.store)
+		}
+	}
+
+	names := make(map[string]struct{}, len(config.Rules))
+	for i, r := range config.Rules {
+		if r.Name == "" {
+			_ = s.closeCreated()
+			return nil, failure.InvalidParam("name of rule (%d) is empty", i)
+		}
+
+		if _, ok := names[r.Name]; ok {
+			_ = s.closeCreated()
+			return nil, failure.InvalidParam("rule (%s) is defined more than once", r.Name)
+		}
+		names[r.Name] = struct{}{}
+
+		compiled, err := s.compile(r, resolver)
+		if err != nil {
+			_ = s.closeCreated()
+			return nil, failure.Wrap(err, "rule (%s) is invalid", r.Name)
+		}
+
+		s.rules = append(s.rules, compiled)
+	}
+	s.reuse = nil
+
+	for _, o := range s.owned {
+		if !o.adopted {
+			go o.store.GarbageCollector()
+		}
+	}
+
+	return &s, nil
+}
+
+// Handler is the middleware enforcing the rules
+func (s *RuleSet) Handler() fiber.Handler {
+	return s.handle
+}
+
+// Close closes the stores owned by the rule set
+func (s *RuleSet) Close() error {
+	var err error
+	for _, o := range s.owned {
+		if cErr := o.store.Close(); cErr != nil && err == nil {
+			err = failure.Wrap(cErr, "store.Close failed")
+		}
+	}
+
+	return err
+}
+
+// closeCreated closes the stores created by the rule set, not the adopted
+// ones which are still used by the previous rule set
+func (s *RuleSet) closeCreated() error {
+	var err error
+	for _, o := range s.owned {
+		if o.adopted {
+			continue
+		}
+
+		if cErr := o.store.Close(); cErr != nil && err == nil {
+			err = failure.Wrap(cErr, "store.Close failed")
+		}
+	}
+
+	return err
+}
+
+// adopt is a store of the previous rule set enforcing the limits of the
+// fingerprint, nil when there is none
+func (s *RuleSet) adopt(fingerprint string) limits.Store {
+	stores := s.reuse[fingerprint]
+	if len(stores) == 0 {
+		return nil
+	}
+
+	store := stores[0]
+	s.reuse[fingerprint] = stores[1:]
+	s.owned = append(s.owned, ownedStore{fingerprint: fingerprint, store: store, adopted: true})
+	return store
+}
+
+// taken are the tokens taken by a rule for a request
+type taken struct {
+	rule  *rule
+	store limits.Store
+	key   string
+	cost  uint64
+}
+
+// charge is the outcome of taking the tokens of a request
+//
+// took     - the tokens taken by the rules enforced
+// info     - the most restrictive rate info, the one of the rejecting rule
+// 					 when a rule rejected the request
+// delay    - how long the leaky bucket holds the request
+// exceeded - the rule which rejected the request, nil when none did
+type charge struct {
+	took     []taken
+	info     limits.RateInfo
+	delay    time.Duration
+	exceeded *rule
+}
+
+func (s *RuleSet) handle(c *fiber.Ctx) error {
+	_, err := s.serve(c)
+	return err
+}
+
+// serve enforces the rules on the request. It returns false, without
+// touching the request, when the rule set is retired.
+func (s *RuleSet) serve(c *fiber.Ctx) (bool, error) {
+	ch, ok, err := s.take(c, s.match(c))
+	if !ok || err != nil {
+		return ok, err
+	}
+
+	if ch.exceeded != nil {
+		setHeaders(c, ch.info)
+		return true, ch.exceeded.cfg.Exceeded(c)
+	}
+
+	if len(ch.took) == 0 {
+		return true, c.Next()
+	}
+
+	setHeaders(c, ch.info)
+
+	// The leaky bucket shapes traffic, hold the request until its turn
+	if ch.delay > 0 {
+		if err = wait(c, ch.delay); err != nil {
+			return true, failure.Wrap(err, "wait failed")
+		}
+	}
+
+	err = c.Next()
+
+	// Refund the rules that should not charge the client for the request
+	failed := err != nil || c.Response().StatusCode() >= fiber.StatusBadRequest
+	refunds := make([]taken, 0, len(ch.took))
+	for _, t := range ch.took {
+		if (failed && t.rule.cfg.SkipFailedRequests) || (!failed && t.rule.cfg.SkipSuccessfulRequests) {
+			refunds = append(refunds, t)
+		}
+	}
+
+	if rErr := s.refund(refunds); rErr != nil {
+		return true, rErr
+	}
+
+	return true, err
+}
+
+// take takes the tokens of the request from the stores of the matched rules,
+// the tokens already taken are returned when a rule rejects the request. The
+// stores are only used while serving is held, so a Reloader replacing the
+// rule set waits for the stores to be done, not for the requests. It returns
+// false when the rule set is retired, nothing is taken then.
+func (s *RuleSet) take(c *fiber.Ctx, matched []*rule) (charge, bool, error) {
+	s.serving.RLock()
+	defer s.serving.RUnlock()
+
+	var ch charge
+	if s.retired {
+		return ch, false, nil
+	}
+
+	ch.took = make([]taken, 0, len(matched))
+	for _, r := range matched {
+		if r.cfg.Next != nil && r.cfg.Next(c) {
+			continue
+		}
+
+		store, generator := r.limits(c)
+		key := r.name + ":" + generator(c)
+		cost := r.cfg.Cost(c)
+		rInfo, err := store.TakeN(key, cost)
+		if err != nil {
+			err = failure.Wrap(err, "store.TakeN failed for (%s)", key)
+			if rErr := giveBack(ch.took); rErr != nil {
+				err = failure.Append(err, rErr)
+			}
+			return ch, true, err
+		}
+
+		if !rInfo.OperationOk {
+			if rErr := giveBack(ch.took); rErr != nil {
+				return ch, true, rErr
+			}
+			ch.info, ch.exceeded = rInfo, r
+			return ch, true, nil
+		}
+
+		if len(ch.took) == 0 || limits.MoreRestrictive(rInfo, ch.info) {
+			ch.info = rInfo
+		}
+		if rInfo.Delay > ch.delay {
+			ch.delay = rInfo.Delay
+		}
+		ch.took = append(ch.took, taken{rule: r, store: store, key: key, cost: cost})
+	}
+
+	return ch, true, nil
+}
+
+// refund returns the tokens of a served request. The refunds of a retired
+// rule set are dropped, its stores are closed or adopted by the rule set
+// which replaced it.
+func (s *RuleSet) refund(took []taken) error {
+	if len(took) == 0 {
+		return nil
+	}
+
+	s.serving.RLock()
+	defer s.serving.RUnlock()
+
+	if s.retired {
+		return nil
+	}
+
+	for _, t := range took {
+		if err := t.store.Return(t.key, t.cost); err != nil {
+			return failure.Wrap(err, "store.Return failed for (%s)", t.key)
+		}
+	}
+
+	return nil
+}
+
+// match is the rules enforced on the request, only the first matching one
+// unless every matching rule is enforced
+func (s *RuleSet) match(c *fiber.Ctx) []*rule {
+	cfg := c.App().Config()
+	rt := routing{caseSensitive: cfg.CaseSensitive, strict: cfg.StrictRouting}
+
+	var matched []*rule
+	for _, r := range s.rules {
+		if !r.matches(c, rt) {
+			continue
+		}
+
+		matched = append(matched, r)
+		if !s.matchAll {
+			break
+		}
+	}
+
+	return matched
+}
+
+// compile validates the rule and creates its store when it has none
+func (s *RuleSet) compile(r Rule, resolver *ClientIP) (*rule, error) {
+	path, err := compilePath(r.Path)
+	if err != nil {
+		return nil, failure.Wrap(err, "compilePath failed")
+	}
+
+	methods := make([]string, 0, len(r.Methods))
+	for _, m := range r.Methods {
+		methods = append(methods, strings.ToUpper(strings.TrimSpace(m)))
+	}
+
+	value, _, err := newKeyValue(r.Key, resolver)
+	if err != nil {
+		return nil, failure.Wrap(err, "newKeyValue failed")
+	}
+
+	if len(r.Overrides) > 0 && r.Key == KeySourceGlobal {
+		return nil, failure.InvalidParam("overrides are not supported with the global key source")
+	}
+
+	cfg := r.Config
+	if cfg.KeyGenerator == nil {
+		cfg.KeyGenerator, err = NewKeyGenerator(r.Key, resolver)
+		if err != nil {
+			return nil, failure.Wrap(err, "NewKeyGenerator failed")
+		}
+	}
+
+	cfg, err = s.compileLimits(r.Name, "", r.Key, cfg, r.Tiers, resolver)
+	if err != nil {
+		return nil, failure.Wrap(err, "compileLimits failed")
+	}
+
+	var ip func(c *fiber.Ctx) net.IP
+	if r.Key == "" || r.Key == KeySourceIP {
+		ip = resolver.Resolve
+	}
+
+	overrides := make([]override, 0, len(r.Overrides))
+	for i, o := range r.Overrides {
+		if len(o.Keys) == 0 {
+			return nil, failure.InvalidParam("keys of override (%d) are empty", i)
+		}
+
+		var networks []*net.IPNet
+		if ip != nil {
+			networks = make([]*net.IPNet, 0, len(o.Keys))
+			for _, k := range o.Keys {
+				network, nErr := parseNetwork(k)
+				if nErr != nil {
+					return nil, failure.Wrap(nErr, "parseNetwork failed for override (%d)", i)
+				}
+				networks = append(networks, network)
+			}
+		}
+
+		oCfg := o.Config
+		oCfg.KeyGenerator = cfg.KeyGenerator
+		oCfg, err = s.compileLimits(r.Name, "override "+strings.Join(o.Keys, ","), r.Key, oCfg, o.Tiers, resolver)
+		if err != nil {
+			return nil, failure.Wrap(err, "compileLimits failed for override (%d)", i)
+		}
+
+		overrides = append(overrides, override{keys: o.Keys, networks: networks, key: oCfg.KeyGenerator, store: oCfg.Store})
+	}
+
+	return &rule{
+		name:      r.Name,
+		path:      path,
+		methods:   methods,
+		headers:   r.Headers,
+		value:     value,
+		ip:        ip,
+		overrides: overrides,
+		cfg:       cfg,
+		store:     cfg.Store,
+	}, nil
+}
+
+// compileLimits configures the limits of a rule or an override and creates
+// their store when they have none, or adopts the store of the previous rule
+// set enforcing the same limits. The unit is empty for the limits of the rule
+// and identifies an override otherwise, see fingerprint.
+func (s *RuleSet) compileLimits(rule, unit, key string, cfg Config, tiers []Tier, resolver *ClientIP) (Config, error) {
+	var err error
+	if len(tiers) > 0 {
+		cfg.Store = nil
+		cfg.KeyGenerator, err = tierKeyGenerator(tiers, resolver)
+		if err != nil {
+			return cfg, failure.Wrap(err, "tierKeyGenerator failed")
+		}
+	}
+	cfg = configure(cfg)
+
+	if !cfg.Algorithm.IsValid() {
+		return cfg, failure.InvalidParam("algorithm (%s) is not supported", cfg.Algorithm)
+	}
+
+	if cfg.Store != nil {
+		return cfg, nil
+	}
+
+	fp := fingerprint(rule, unit, key, cfg, tiers)
+	if store := s.adopt(fp); store != nil {
+		cfg.Store = store
+		return cfg, nil
+	}
+
+	if len(tiers) > 0 {
+		cfg.Store, err = newTierStore(rule, tiers)
+		if err != nil {
+			return cfg, failure.Wrap(err, "newTierStore failed")
+		}
+	} else {
+		cfg.Store, err = NewStore(cfg)
+		if err != nil {
+			return cfg, failure.Wrap(err, "NewStore failed")
+		}
+	}
+	s.owned = append(s.owned, ownedStore{fingerprint: fp, store: cfg.Store})
+
+	return cfg, nil
+}
+
+// tierKeyGenerator validates the tiers of a rule and creates the key generator
+// joining the key of every tier, which the composite store of the tiers
+// splits back
+func tierKeyGenerator(tiers []Tier, resolver *ClientIP) (func(c *fiber.Ctx) string, error) {
+	generators := make([]func(c *fiber.Ctx) string, 0, len(tiers))
+	names := make(map[string]struct{}, len(tiers))
+	for i, t := range tiers {
+		if t.Name == "" {
+			return nil, failure.InvalidParam("name of tier (%d) is empty", i)
+		}
+
+		if _, ok := names[t.Name]; ok {
+			return nil, failure.InvalidParam("tier (%s) is defined more than once", t.Name)
+		}
+		names[t.Name] = struct{}{}
+
+		gen, err := NewKeyGenerator(t.Key, resolver)
+		if err != nil {
+			return nil, failure.Wrap(err, "NewKeyGenerator failed for tier (%s)", t.Name)
+		}
+
+		if cfg := configure(t.Config); !cfg.Algorithm.IsValid() {
+			return nil, failure.InvalidParam("algorithm (%s) of tier (%s) is not supported", cfg.Algorithm, t.Name)
+		}
+
+		generators = append(generators, gen)
+	}
+
+	return func(c *fiber.Ctx) string {
+		keys := make([]string, len(generators))
+		for i, gen := range generators {
+			keys[i] = gen(c)
+		}
+		return joinKeys(keys)
+	}, nil
+}
+
+// newTierStore creates the composite store of the tiers of a rule, each tier
+// is keyed on its part of the key joined by tierKeyGenerator
+func newTierStore(rule string, config []Tier) (limits.Store, error) {
+	prefix := rule + ":"
+	tiers := make([]limits.Tier, 0, len(config))
+	closeTiers := func() {
+		for _, t := range tiers {
+			_ = t.Store.Close()
+		}
+	}
+
+	for i, t := range config {
+		cfg := t.Config
+		cfg.Store = nil
+		store, err := NewStore(configure(cfg))
+		if err != nil {
+			closeTiers()
+			return nil, failure.Wrap(err, "NewStore failed for tier (%s)", t.Name)
+		}
+
+		index, name := i, t.Name
+		tiers = append(tiers, limits.Tier{
+			Name:  name,
+			Store: store,
+			Key: func(key string) string {
+				part, ok := splitKey(strings.TrimPrefix(key, prefix), index)
+				if !ok {
+					return prefix + name + ":"
+				}
+				return prefix + name + ":" + part
+			},
+		})
+	}
+
+	store, err := limits.NewCompositeStore(tiers...)
+	if err != nil {
+		closeTiers()
+		return nil, failure.Wrap(err, "limits.NewCompositeStore failed")
+	}
+
+	return store, nil
+}
+
+// fingerprint identifies the limits a store enforces, a store of a previous
+// rule set is adopted only when its rule, unit, key source, algorithm, limits
+// and tiers are the same
+func fingerprint(rule, unit, key string, cfg Config, tiers []Tier) string {
+	var b strings.Builder
+	b.WriteString(rule + "|" + unit + "|" + key + "|" + limitsFingerprint(cfg))
+	for _, t := range tiers {
+		b.WriteString("|tier " + t.Name + "|" + t.Key + "|" + limitsFingerprint(configure(t.Config)))
+	}
+
+	return b.String()
+}
+
+// limitsFingerprint are the fields of a config the state of a store depends on
+func limitsFingerprint(cfg Config) string {
+	windows := make([]string, 0, len(cfg.Windows))
+	for _, w := range cfg.Windows {
+		windows = append(windows, w.String())
+	}
+
+	return fmt.Sprintf("%s %d/%s burst=%d queue=%d wait=%s windows=%s ttl=%s/%s size=%d shards=%d keys=%d/%s",
+		cfg.Algorithm, cfg.Limit, cfg.Interval, cfg.Burst, cfg.MaxQueue, cfg.MaxWait, strings.Join(windows, ","),
+		cfg.TTLInterval, cfg.MinTTL, cfg.StorageSize, cfg.Shards, cfg.MaxKeys, cfg.Overflow)
+}
+
+// joinKeys encodes the keys of the tiers of a rule in one key, each prefixed
+// with its length. A header or a query holds any byte, a separator would let
+// a client shift its keys into the tier of another one.
+func joinKeys(keys []string) string {
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(strconv.Itoa(len(k)))
+		b.WriteByte(':')
+		b.WriteString(k)
+	}
+
+	return b.String()
+}
+
+// splitKey is the key at index of the keys encoded by joinKeys, false when
+// the key is not encoded by joinKeys
+func splitKey(key string, index int) (string, bool) {
+	for i := 0; ; i++ {
+		size, rest, ok := strings.Cut(key, ":")
+		if !ok {
+			return "", false
+		}
+
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 0 || n > len(rest) {
+			return "", false
+		}
+
+		if i == index {
+			return rest[:n], true
+		}
+		key = rest[n:]
+	}
+}
+
+// matches reports whether the request matches the path, method and headers
+// of the rule, the path is matched the way the router of the app does
+func (r *rule) matches(c *fiber.Ctx, rt routing) bool {
+	if len(r.methods) > 0 && !contains(r.methods, c.Method()) {
+		return false
+	}
+
+	for name, value := range r.headers {
+		got := c.Get(name)
+		if got == "" || (value != "*" && got != value) {
+			return false
+		}
+	}
+
+	return matchPath(r.path, c.Path(), rt)
+}
+
+// limits are the store and the key generator enforcing the request, the ones
+// of the first override listing its key value, or a network holding the
+// client ip for the ip source, or the ones of the rule
+func (r *rule) limits(c *fiber.Ctx) (limits.Store, func(c *fiber.Ctx) string) {
+	if len(r.overrides) == 0 {
+		return r.store, r.cfg.KeyGenerator
+	}
+
+	if r.ip != nil {
+		if ip := r.ip(c); ip != nil {
+			for _, o := range r.overrides {
+				if containsIP(o.networks, ip) {
+					return o.store, o.key
+				}
+			}
+		}
+
+		return r.store, r.cfg.KeyGenerator
+	}
+
+	if value := r.value(c); value != "" {
+		for _, o := range r.overrides {
+			if contains(o.keys, value) {
+				return o.store, o.key
+			}
+		}
+	}
+
+	return r.store, r.cfg.KeyGenerator
+}
+
+// newKeyValue creates the func reading the value of a key source, which is
+// empty when the header or the query parameter is missing, and the prefix of
+// the keys of the source
+func newKeyValue(source string, resolver *ClientIP) (func(c *fiber.Ctx) string, string, error) {
+	switch {
+	case source == "" || source == KeySourceIP:
+		return resolver.KeyGenerator, "", nil
+	case source == KeySourceGlobal:
+		return func(*fiber.Ctx) string {
+			return KeySourceGlobal
+		}, "", nil
+	case strings.HasPrefix(source, KeySourceHeader) && len(source) > len(KeySourceHeader):
+		name := strings.TrimPrefix(source, KeySourceHeader)
+		return func(c *fiber.Ctx) string {
+			return c.Get(name)
+		}, KeySourceHeader, nil
+	case strings.HasPrefix(source, KeySourceQuery) && len(source) > len(KeySourceQuery):
+		name := strings.TrimPrefix(source, KeySourceQuery)
+		return func(c *fiber.Ctx) string {
+			return c.Query(name)
+		}, KeySourceQuery, nil
+	}
+
+	return nil, "", failure.InvalidParam("key source (%s) is not supported", source)
+}
+
+// NewKeyGenerator creates the key generator of a key source, see Rule.Key
+func NewKeyGenerator(source string, resolver *ClientIP) (func(c *fiber.Ctx) string, error) {
+	value, prefix, err := newKeyValue(source, resolver)
+	if err != nil {
+		return nil, failure.Wrap(err, "newKeyValue failed")
+	}
+
+	if prefix == "" {
+		return value, nil
+	}
+
+	return func(c *fiber.Ctx) string {
+		if v := value(c); v != "" {
+			return prefix + v
+		}
+		return resolver.KeyGenerator(c)
+	}, nil
+}
+
+// compilePath splits a path pattern in segments, ** is only allowed as the
+// last segment
+func compilePath(pattern string) ([]string, error) {
+	if pattern == "" {
+		return []string{"**"}, nil
+	}
+
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, failure.InvalidParam("path (%s) does not start with /", pattern)
+	}
+
+	segments := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	for i, seg := range segments {
+		if seg == "**" && i != len(segments)-1 {
+			return nil, failure.InvalidParam("path (%s) has ** before its last segment", pattern)
+		}
+	}
+
+	return segments, nil
+}
+
+// routing is how the router of the app matches a path, a rule must match
+// every path routed to the same handler or it could be dodged
+//
+// caseSensitive - /Ping and /ping are different paths, see fiber.Config
+// strict        - /ping/ and /ping are different paths, see fiber.Config
+type routing struct {
+	caseSensitive bool
+	strict        bool
+}
+
+// matchPath reports whether the path matches the segments of a pattern
+func matchPath(pattern []string, path string, rt routing) bool {
+	if !rt.strict {
+		if trimmed := strings.TrimRight(path, "/"); trimmed != "" {
+			path = trimmed
+		}
+		if n := len(pattern); n > 1 && pattern[n-1] == "" {
+			pattern = pattern[:n-1]
+		}
+	}
+
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, p := range pattern {
+		if p == "**" {
+			return true
+		}
+
+		if i >= len(segments) {
+			return false
+		}
+
+		if p == "*" || strings.HasPrefix(p, ":") {
+			continue
+		}
+
+		if p != segments[i] && (rt.caseSensitive || !strings.EqualFold(p, segments[i])) {
+			return false
+		}
+	}
+
+	return len(pattern) == len(segments)
+}
+
+// giveBack returns the tokens taken by the previous rules, last rule first
+func giveBack(took []taken) error {
+	var err error
+	for i := len(took) - 1; i >= 0; i-- {
+		t := took[i]
+		if rErr := t.store.Return(t.key, t.cost); rErr != nil && err == nil {
+			err = failure.Wrap(rErr, "store.Return failed for (%s)", t.key)
+		}
+	}
+
+	return err
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,237 @@
+package limiter
+
+import (
+	"crypto/sha256"
+	"github.com/fsnotify/fsnotify"
+	"github.com/rsb/failure"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	ReloadTriggerFile   = "file"
+	ReloadTriggerSignal = "signal"
+)
+
+// DefaultReloadDebounce is how long the watcher waits for the changes of a
+// policy file to settle, editors and config maps write a file in many steps
+const DefaultReloadDebounce = 250 * time.Millisecond
+
+// ReloadEvent is the outcome of a reload of the policy file
+//
+// Trigger - what caused the reload, a change of the file or a signal
+// Path    - the policy file
+// Result  - the outcome, see ReloadResult
+// Err     - why the reload failed, the previous rules are still enforced
+// 					 unless the error happened while closing unused stores
+type ReloadEvent struct {
+	Trigger string
+	Path    string
+	Result  ReloadResult
+	Err     error
+}
+
+// PolicyWatcherConfig controls how a policy file is watched
+//
+// Path     - the policy file
+// Reloader - the reloader of the rules of the policy
+// Prepare  - adjusts the config parsed from the policy before it is loaded,
+// 						like applying defaults. Optional
+// OnReload - called with the outcome of every reload, like to log it
+// Debounce - how long the changes of the file settle before a reload,
+// 						defaults to DefaultReloadDebounce
+type PolicyWatcherConfig struct {
+	Path     string
+	Reloader *Reloader
+	Prepare  func(config RuleSetConfig) RuleSetConfig
+	OnReload func(e ReloadEvent)
+	Debounce time.Duration
+}
+
+// PolicyWatcher reloads the rules of a policy file when the file changes or
+// when a reload is requested, like on SIGHUP. The directory of the file is
+// watched, not the file, so a file replaced by a rename or by the symlink
+// swap of a kubernetes config map is still seen. A change of the file which
+// does not change its content is ignored, a requested reload is not.
+//
+// sum      - sha256 of the content last loaded
+// requests - the triggers of the requested reloads
+// stop     - closed by Close
+type PolicyWatcher struct {
+	path     string
+	format   string
+	reloader *Reloader
+	prepare  func(config RuleSetConfig) RuleSetConfig
+	onReload func(e ReloadEvent)
+	debounce time.Duration
+	watcher  *fsnotify.Watcher
+	sum      [sha256.Size]byte
+	requests chan string
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// NewPolicyWatcher starts watching the directory of the policy file, the
+// reloads happen once Run is called
+func NewPolicyWatcher(config PolicyWatcherConfig) (*PolicyWatcher, error) {
+	if config.Reloader == nil {
+		return nil, failure.InvalidParam("config.Reloader is nil")
+	}
+
+	format, err := PolicyFormat(config.Path)
+	if err != nil {
+		return nil, failure.Wrap(err, "PolicyFormat failed")
+	}
+
+	path, err := filepath.Abs(config.Path)
+	if err != nil {
+		return nil, failure.ToInvalidParam(err, "filepath.Abs failed for (%s)", config.Path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, failure.ToSystem(err, "os.ReadFile failed for (%s)", path)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, failure.ToSystem(err, "fsnotify.NewWatcher failed")
+	}
+
+	if err = watcher.Add(filepath.Dir(path)); err != nil {
+		_ = watcher.Close()
+		return nil, failure.ToSystem(err, "watcher.Add failed for (%s)", filepath.Dir(path))
+	}
+
+	debounce := config.Debounce
+	if debounce <= 0 {
+		debounce = DefaultReloadDebounce
+	}
+
+	onReload := config.OnReload
+	if onReload == nil {
+		onReload = func(ReloadEvent) {}
+	}
+
+	return &PolicyWatcher{
+		path:     path,
+		format:   format,
+		reloader: config.Reloader,
+		prepare:  config.Prepare,
+		onReload: onReload,
+		debounce: debounce,
+		watcher:  watcher,
+		sum:      sha256.Sum256(data),
+		requests: make(chan string, 1),
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+// Run reloads the policy on every change and requested reload until Close is
+// called
+func (w *PolicyWatcher) Run() {
+	var settled <-chan time.Time
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case _, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+
+			if timer == nil {
+				timer = time.NewTimer(w.debounce)
+			} else {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(w.debounce)
+			}
+			settled = timer.C
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.onReload(ReloadEvent{Trigger: ReloadTriggerFile, Path: w.path, Err: failure.ToSystem(err, "watcher failed")})
+		case <-settled:
+			settled = nil
+			w.reload(ReloadTriggerFile, false)
+		case trigger := <-w.requests:
+			w.reload(trigger, true)
+		}
+	}
+}
+
+// Reload requests a reload of the policy, requests made while one is pending
+// are merged
+func (w *PolicyWatcher) Reload(trigger string) {
+	select {
+	case w.requests <- trigger:
+	default:
+	}
+}
+
+// Close stops watching the policy file
+func (w *PolicyWatcher) Close() error {
+	var err error
+	w.once.Do(func() {
+		close(w.stop)
+		if cErr := w.watcher.Close(); cErr != nil {
+			err = failure.ToSystem(cErr, "watcher.Close failed")
+		}
+	})
+
+	return err
+}
+
+// reload loads the policy when its content changed, or always when forced
+func (w *PolicyWatcher) reload(trigger string, force bool) {
+	e := ReloadEvent{Trigger: trigger, Path: w.path}
+
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		// the file is being replaced, the next event reloads it
+		if os.IsNotExist(err) && !force {
+			return
+		}
+		e.Err = failure.ToSystem(err, "os.ReadFile failed for (%s)", w.path)
+		w.onReload(e)
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	if sum == w.sum && !force {
+		return
+	}
+	w.sum = sum
+
+	config, err := ParsePolicy(w.path, w.format, data)
+	if err != nil {
+		e.Err = failure.Wrap(err, "ParsePolicy failed")
+		w.onReload(e)
+		return
+	}
+
+	if w.prepare != nil {
+		config = w.prepare(config)
+	}
+
+	e.Result, err = w.reloader.Reload(config)
+	if err != nil {
+		e.Err = failure.Wrap(err, "reloader.Reload failed")
+	}
+	w.onReload(e)
+}
@@ -3,14 +3,18 @@ package cmd
 import (
 	"context"
 	"expvar"
+	"github.com/gofiber/fiber/v2"
 	"github.com/rsb/api_rate_limiter/app"
+	"github.com/rsb/api_rate_limiter/app/api/middle/limiter"
 	"github.com/rsb/api_rate_limiter/app/conf"
 	"github.com/rsb/api_rate_limiter/app/construct"
+	"github.com/rsb/api_rate_limiter/foundation/limits"
 	"github.com/rsb/failure"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"go.uber.org/automaxprocs/maxprocs"
 	"go.uber.org/zap"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
@@ -102,7 +106,47 @@ func runAPI(config conf.LimiterAPI, log *zap.SugaredLogger) error {
 		}
 	}()
 
-	apiMux := construct.NewAPIMux(config.API, log)
+	// A policy replaces the rate limit of the API with its rules, which are
+	// kept in memory stores owned by the rule set and reloaded without
+	// restarting. A store, snapshot, quota or windows configured along with
+	// a policy fail the startup instead of being silently ignored.
+	var apiMux *fiber.App
+	if config.API.RateLimitPolicy.IsEmpty() {
+		store, closeStore, sErr := startRateLimitStore(config, log)
+		if sErr != nil {
+			return failure.Wrap(sErr, "startRateLimitStore failed")
+		}
+		defer closeStore()
+
+		apiMux = construct.NewAPIMux(config.API, log, store)
+	} else {
+		rules, watcher, rErr := construct.NewPolicyReloader(config.API, log)
+		if rErr != nil {
+			return failure.Wrap(rErr, "construct.NewPolicyReloader failed")
+		}
+
+		// The policy is reloaded when its file changes or on SIGHUP
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go watcher.Run()
+		go func() {
+			for range reload {
+				watcher.Reload(limiter.ReloadTriggerSignal)
+			}
+		}()
+
+		defer func() {
+			signal.Stop(reload)
+			close(reload)
+			_ = watcher.Close()
+			if cErr := rules.Close(); cErr != nil {
+				log.Errorw("shutdown", "status", "rate limit rule set close failed", "ERROR", cErr)
+			}
+		}()
+
+		apiMux = construct.NewAPIMuxWithLimiter(config.API, log, rules.Handler())
+	}
+
 	apiMux = construct.AddAllRoutes(apiMux, &depend)
 	// Make a channel to listen for errors coming from the listener. Use a
 	// buffered channel so the goroutine can exit if we don't collect this error.
@@ -140,6 +184,47 @@ func runAPI(config conf.LimiterAPI, log *zap.SugaredLogger) error {
 	return nil
 }
 
+// startRateLimitStore builds the rate limit store and starts its garbage
+// collector. The store is owned here so its snapshot is saved once the server
+// stopped, by the returned func. In cluster and gossip mode the peers are
+// served on the cluster host.
+func startRateLimitStore(config conf.LimiterAPI, log *zap.SugaredLogger) (limits.Store, func(), error) {
+	store, peerHandler, err := construct.NewRateLimitStore(config, log)
+	if err != nil {
+		return nil, nil, failure.Wrap(err, "construct.NewRateLimitStore failed")
+	}
+
+	var clusterServer *http.Server
+	if peerHandler != nil {
+		clusterServer = &http.Server{
+			Addr:              config.ClusterHost(),
+			Handler:           peerHandler,
+			ReadHeaderTimeout: config.API.ReadTimeout,
+		}
+		go func() {
+			if lErr := clusterServer.ListenAndServe(); lErr != nil && lErr != http.ErrServerClosed {
+				log.Errorw("shutdown",
+					"status", "cluster router closed",
+					"host", config.ClusterHost(),
+					"ERROR", lErr,
+				)
+			}
+		}()
+	}
+
+	go store.GarbageCollector()
+	closeStore := func() {
+		if clusterServer != nil {
+			_ = clusterServer.Close()
+		}
+		if cErr := store.Close(); cErr != nil {
+			log.Errorw("shutdown", "status", "rate limit store close failed", "ERROR", cErr)
+		}
+	}
+
+	return store, closeStore, nil
+}
+
 func logConfig(log *zap.SugaredLogger, cat string, c conf.LimiterAPI) {
 	api := c.API
 	log.Infow(cat,
@@ -150,5 +235,17 @@ func logConfig(log *zap.SugaredLogger, cat string, c conf.LimiterAPI) {
 		"write-timeout", api.WriteTimeout,
 		"idle-timeout", api.IdleTimeout,
 		"shutdown-timeout", api.ShutdownTimeout,
+		"rate-limit", api.RateLimit,
+		"rate-limit-interval", api.RateLimitInterval,
+		"rate-limit-windows", api.RateLimitWindows,
+		"rate-limit-quota", api.RateLimitQuota,
+		"rate-limit-quota-period", api.RateLimitQuotaPeriod,
+		"rate-limit-algorithm", api.RateLimitAlgorithm,
+		"rate-limit-snapshot", api.RateLimitSnapshot.Path,
+		"rate-limit-store", api.RateLimitStore,
+		"rate-limit-policy", api.RateLimitPolicy.Path,
+		"rate-limit-trusted-proxies", api.RateLimitTrustedProxies,
+		"rate-limit-ipv4-prefix", api.RateLimitIPv4Prefix,
+		"rate-limit-ipv6-prefix", api.RateLimitIPv6Prefix,
 	)
 }
@@ -7,6 +7,8 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/mitchellh/go-homedir"
 	"github.com/rsb/failure"
+	"net"
+	"strings"
 	"time"
 )
 
@@ -22,20 +24,60 @@ type Version struct {
 }
 
 type API struct {
-	Host                   string        `conf:"env:API_HOST, cli:api-host, default:0.0.0.0:3000, cli-u:web api host"`
-	DebugHost              string        `conf:"env:API_DEBUG_HOST, cli:debug-host, default:0.0.0.0:4000, cli-u:debug host"`
-	IsCaseSensitive        bool          `conf:"env:API_ROUTE_CASE_SENSITIVE, cli:api-route-case-sensitive, default:false, cli-u:will routes be case sensitive"`
-	IsETag                 bool          `conf:"env:API_ETAG, cli:api-etag, default:false, cli-u:enable/disable etag header generation"`
-	ReadTimeout            time.Duration `conf:"env:API_READ_TIMEOUT,cli:api-read-timeout, default:5s"`
-	WriteTimeout           time.Duration `conf:"env:API_WRITE_TIMEOUT,cli:api-write-timeout, default:20s"`
-	IdleTimeout            time.Duration `conf:"env:API_IDLE_TIMEOUT, cli:api-idle-timeout, default:120s"`
-	ShutdownTimeout        time.Duration `conf:"env:API_SHUTDOWN_TIMEOUT,cli:api-shutdown-timeout, default:20s"`
-	RateLimit              uint64        `conf:"env:API_RATE_LIMIT,cli:api-rate-limit, default:10"`
-	RateLimitInterval      time.Duration `conf:"env:API_RATE_LIMIT_INTERVAL,cli:api-rate-limit-interval, default:60s"`
-	RateLimitCleanStale    time.Duration `conf:"env:API_RATE_CLEAN_STALE, cli:api-rate-limit-clean-stale, default:6h"`
-	RateLimitCleanInactive time.Duration `conf:"env:API_RATE_CLEAN_INACTIVE, cli:api-rate-limit-clean-inactive, default:12h"`
+	Host                      string        `conf:"env:API_HOST, cli:api-host, default:0.0.0.0:3000, cli-u:web api host"`
+	DebugHost                 string        `conf:"env:API_DEBUG_HOST, cli:debug-host, default:0.0.0.0:4000, cli-u:debug host"`
+	IsCaseSensitive           bool          `conf:"env:API_ROUTE_CASE_SENSITIVE, cli:api-route-case-sensitive, default:false, cli-u:will routes be case sensitive"`
+	IsETag                    bool          `conf:"env:API_ETAG, cli:api-etag, default:false, cli-u:enable/disable etag header generation"`
+	ReadTimeout               time.Duration `conf:"env:API_READ_TIMEOUT,cli:api-read-timeout, default:5s"`
+	WriteTimeout              time.Duration `conf:"env:API_WRITE_TIMEOUT,cli:api-write-timeout, default:20s"`
+	IdleTimeout               time.Duration `conf:"env:API_IDLE_TIMEOUT, cli:api-idle-timeout, default:120s"`
+	ShutdownTimeout           time.Duration `conf:"env:API_SHUTDOWN_TIMEOUT,cli:api-shutdown-timeout, default:20s"`
+	RateLimit                 uint64        `conf:"env:API_RATE_LIMIT,cli:api-rate-limit, default:10"`
+	RateLimitInterval         time.Duration `conf:"env:API_RATE_LIMIT_INTERVAL,cli:api-rate-limit-interval, default:60s"`
+	RateLimitWindows          []string      `conf:"env:API_RATE_LIMIT_WINDOWS, cli:api-rate-limit-windows, cli-u:limit/interval windows all enforced on each key like 10/1s replacing the rate limit and interval"`
+	RateLimitQuota            uint64        `conf:"env:API_RATE_LIMIT_QUOTA, cli:api-rate-limit-quota, cli-u:tokens of each key per calendar period on top of the rate limit disabled when 0"`
+	RateLimitQuotaPeriod      string        `conf:"env:API_RATE_LIMIT_QUOTA_PERIOD, cli:api-rate-limit-quota-period, default:daily, cli-u:daily or monthly calendar period of the quota"`
+	RateLimitQuotaTimezone    string        `conf:"env:API_RATE_LIMIT_QUOTA_TIMEZONE, cli:api-rate-limit-quota-timezone, default:UTC, cli-u:time zone whose midnight starts a quota period"`
+	RateLimitTrustedProxies   []string      `conf:"env:API_RATE_LIMIT_TRUSTED_PROXIES, cli:api-rate-limit-trusted-proxies, cli-u:ips or CIDRs of the proxies allowed to report the client ip the key defaults to the connection ip when empty"`
+	RateLimitProxyHeaders     []string      `conf:"env:API_RATE_LIMIT_PROXY_HEADERS, cli:api-rate-limit-proxy-headers, cli-u:the X-Forwarded-For Forwarded or X-Real-IP header the proxy writes the client ip is read from defaults to X-Forwarded-For"`
+	RateLimitIPv4Prefix       int           `conf:"env:API_RATE_LIMIT_IPV4_PREFIX, cli:api-rate-limit-ipv4-prefix, cli-u:length of the network an ipv4 client is keyed on like 24 the whole address when 0"`
+	RateLimitIPv6Prefix       int           `conf:"env:API_RATE_LIMIT_IPV6_PREFIX, cli:api-rate-limit-ipv6-prefix, cli-u:length of the network an ipv6 client is keyed on like 64 or 56 the whole address when 0"`
+	RateLimitPolicy           Filepath      `conf:"env:API_RATE_LIMIT_POLICY, cli:api-rate-limit-policy, cli-u:toml or yaml file of named rate limit rules enforced in place of the rate limit"`
+	RateLimitCleanStale       time.Duration `conf:"env:API_RATE_CLEAN_STALE, cli:api-rate-limit-clean-stale, default:6h"`
+	RateLimitCleanInactive    time.Duration `conf:"env:API_RATE_CLEAN_INACTIVE, cli:api-rate-limit-clean-inactive, default:12h"`
+	RateLimitAlgorithm        string        `conf:"env:API_RATE_LIMIT_ALGORITHM, cli:api-rate-limit-algorithm, default:fixed-window, cli-u:rate limit algorithm used for every key"`
+	RateLimitBurst            uint64        `conf:"env:API_RATE_LIMIT_BURST, cli:api-rate-limit-burst, cli-u:token bucket or gcra burst defaults to the rate limit"`
+	RateLimitMaxQueue         uint64        `conf:"env:API_RATE_LIMIT_MAX_QUEUE, cli:api-rate-limit-max-queue, cli-u:leaky bucket queue depth defaults to the rate limit"`
+	RateLimitMaxWait          time.Duration `conf:"env:API_RATE_LIMIT_MAX_WAIT, cli:api-rate-limit-max-wait, cli-u:longest a request is queued defaults to the interval"`
+	RateLimitShards           int           `conf:"env:API_RATE_LIMIT_SHARDS, cli:api-rate-limit-shards, cli-u:number of independently locked shards in the memory store"`
+	RateLimitMaxKeys          int           `conf:"env:API_RATE_LIMIT_MAX_KEYS, cli:api-rate-limit-max-keys, cli-u:max number of keys held by the memory store unbounded when 0"`
+	RateLimitOverflow         string        `conf:"env:API_RATE_LIMIT_OVERFLOW, cli:api-rate-limit-overflow, default:evict, cli-u:evict admit or reject new keys when the store is full"`
+	RateLimitSnapshot         Filepath      `conf:"env:API_RATE_LIMIT_SNAPSHOT, cli:api-rate-limit-snapshot, cli-u:file the limiter state is saved to on shutdown and restored from on startup"`
+	RateLimitSnapshotInterval time.Duration `conf:"env:API_RATE_LIMIT_SNAPSHOT_INTERVAL, cli:api-rate-limit-snapshot-interval, cli-u:how often the limiter state is also saved while running"`
+	RateLimitStore            string        `conf:"env:API_RATE_LIMIT_STORE, cli:api-rate-limit-store, default:memory, cli-u:memory or redis store holding the limiter state"`
+	RateLimitRedisAddr        string        `conf:"env:API_RATE_LIMIT_REDIS_ADDR, cli:api-rate-limit-redis-addr, default:127.0.0.1:6379, cli-u:host:port of the redis compatible server"`
+	RateLimitRedisPassword    string        `conf:"env:API_RATE_LIMIT_REDIS_PASSWORD, cli:api-rate-limit-redis-password, mask, cli-u:password of the redis compatible server"`
+	RateLimitRedisDB          int           `conf:"env:API_RATE_LIMIT_REDIS_DB, cli:api-rate-limit-redis-db, cli-u:database selected on the redis compatible server"`
+	RateLimitRedisPrefix      string        `conf:"env:API_RATE_LIMIT_REDIS_PREFIX, cli:api-rate-limit-redis-prefix, default:limits:, cli-u:prefix of every key stored on the redis compatible server"`
+	RateLimitClusterHost      string        `conf:"env:API_RATE_LIMIT_CLUSTER_HOST, cli:api-rate-limit-cluster-host, cli-u:host the calls forwarded by the cluster peers are served on defaults to the pod ip or localhost on port 7000"`
+	RateLimitClusterSecret    string        `conf:"env:API_RATE_LIMIT_CLUSTER_SECRET, cli:api-rate-limit-cluster-secret, mask, cli-u:secret shared by the peers required on every call between them in cluster and gossip mode"`
+	RateLimitClusterAdvertise string        `conf:"env:API_RATE_LIMIT_CLUSTER_ADVERTISE, cli:api-rate-limit-cluster-advertise, cli-u:host:port the peers reach this instance at defaults to the pod ip"`
+	RateLimitClusterPeers     []string      `conf:"env:API_RATE_LIMIT_CLUSTER_PEERS, cli:api-rate-limit-cluster-peers, cli-u:static list of peer host:port used when no headless service is configured"`
+	RateLimitClusterRefresh   time.Duration `conf:"env:API_RATE_LIMIT_CLUSTER_REFRESH, cli:api-rate-limit-cluster-refresh, default:30s, cli-u:how often the peers are listed again"`
+	RateLimitGossipInterval   time.Duration `conf:"env:API_RATE_LIMIT_GOSSIP_INTERVAL, cli:api-rate-limit-gossip-interval, default:200ms, cli-u:how often the usage is sent to the peers in gossip mode"`
 }
 
+// DefaultClusterPort is the port the peers are served on when no cluster host
+// is configured
+const DefaultClusterPort = "7000"
+
+const (
+	StoreMemory  = "memory"
+	StoreRedis   = "redis"
+	StoreCluster = "cluster"
+	StoreGossip  = "gossip"
+)
+
 func (a API) NewFiberConfig() fiber.Config {
 	config := fiber.Config{
 		IdleTimeout:   a.IdleTimeout,
@@ -48,6 +90,21 @@ func (a API) NewFiberConfig() fiber.Config {
 	return config
 }
 
+// ClusterHost is the host the peers are served on, RateLimitClusterHost or the
+// pod ip with DefaultClusterPort. Outside kubernetes it defaults to localhost
+// so the peer endpoint is never exposed unless configured.
+func (c LimiterAPI) ClusterHost() string {
+	if c.API.RateLimitClusterHost != "" {
+		return c.API.RateLimitClusterHost
+	}
+
+	if c.Kubernetes.PodIP != "" {
+		return net.JoinHostPort(c.Kubernetes.PodIP, DefaultClusterPort)
+	}
+
+	return net.JoinHostPort("127.0.0.1", DefaultClusterPort)
+}
+
 type HTTPClient struct {
 	Timeout            time.Duration `conf:"default: 5s,  env:LOLA_HTTP_CLIENT_TIMEOUT, cli:http-client-timeout, cli-u:timeout for http clients"`
 	MaxIdleConn        int           `conf:"default: 100, env:LOLA_HTTP_CLIENT_MAX_IDLE_CONN, cli:http-client-max-idle-con, cli-u:http client max idle connections"`
@@ -60,6 +117,17 @@ type Kubernetes struct {
 	PodIP     string `conf:"env:KUBERNETES_NAMESPACE_POD_IP"`
 	Node      string `conf:"env:KUBERNETES_NODENAME"`
 	Namespace string `conf:"env:KUBERNETES_NAMESPACE"`
+	Service   string `conf:"env:KUBERNETES_SERVICE"`
+}
+
+// HeadlessService is the dns name of the headless service listing the pods
+// of the service, empty when no service is configured
+func (k Kubernetes) HeadlessService() string {
+	if k.Service == "" || k.Namespace == "" || strings.Contains(k.Service, ".") {
+		return k.Service
+	}
+
+	return k.Service + "." + k.Namespace + ".svc"
 }
 
 type PingConfig struct {
@@ -7,12 +7,17 @@ import (
 	"github.com/rsb/api_rate_limiter/app/api/handlers/health"
 	"github.com/rsb/api_rate_limiter/app/api/middle/limiter"
 	"github.com/rsb/api_rate_limiter/app/conf"
+	"github.com/rsb/api_rate_limiter/foundation/limits"
 	"github.com/rsb/api_rate_limiter/foundation/logging"
+	"github.com/rsb/api_rate_limiter/foundation/resp"
 	"github.com/rsb/failure"
 	"go.uber.org/zap"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/gofiber/contrib/fiberzap"
 	"github.com/gofiber/fiber/v2"
@@ -81,7 +86,357 @@ func NewHttpClient(config conf.HTTPClient) *http.Client {
 	}
 }
 
-func NewAPIMux(c conf.API, logger *zap.SugaredLogger) *fiber.App {
+// NewLimiterConfig maps the api configuration onto the rate limit middleware
+// configuration
+func NewLimiterConfig(c conf.API) limiter.Config {
+	return limiter.Config{
+		Limit:       c.RateLimit,
+		Interval:    c.RateLimitInterval,
+		TTLInterval: c.RateLimitCleanStale,
+		MinTTL:      c.RateLimitCleanInactive,
+		Algorithm:   limits.Algorithm(c.RateLimitAlgorithm),
+		Burst:       c.RateLimitBurst,
+		MaxQueue:    c.RateLimitMaxQueue,
+		MaxWait:     c.RateLimitMaxWait,
+		Shards:      c.RateLimitShards,
+		MaxKeys:     c.RateLimitMaxKeys,
+		Overflow:    limits.OverflowPolicy(c.RateLimitOverflow),
+
+		TrustedProxies: c.RateLimitTrustedProxies,
+		ProxyHeaders:   c.RateLimitProxyHeaders,
+		IPv4Prefix:     c.RateLimitIPv4Prefix,
+		IPv6Prefix:     c.RateLimitIPv6Prefix,
+	}
+}
+
+// NewLimitWindows parses the RateLimitWindows all enforced on each key, it
+// is empty when a single RateLimit per RateLimitInterval is configured
+func NewLimitWindows(c conf.API) ([]limits.Window, error) {
+	windows := make([]limits.Window, 0, len(c.RateLimitWindows))
+	for _, s := range c.RateLimitWindows {
+		w, err := limits.ParseWindow(s)
+		if err != nil {
+			return nil, failure.Wrap(err, "limits.ParseWindow failed")
+		}
+		windows = append(windows, w)
+	}
+
+	return windows, nil
+}
+
+// NewLimitsStore builds the store used by the rate limiter, a redis store
+// when configured, otherwise a memory store restoring the snapshot when one
+// is configured. In cluster mode it is the local store given to
+// NewClusterStore. A snapshot that can not be restored is logged and the store
+// starts empty. The caller owns the store, it must run its GarbageCollector
+// and Close it on shutdown to save the snapshot.
+//
+// When windows are configured every window is a store of its own, see
+// limits.NewWindowStore, with the interval of the window appended to the
+// redis prefix and the snapshot path. When a quota is configured it is
+// enforced on top of the rate limit, see NewQuotaStore.
+func NewLimitsStore(c conf.API, logger *zap.SugaredLogger) (limits.Store, error) {
+	store, err := newRateStore(c, logger)
+	if err != nil {
+		return nil, failure.Wrap(err, "newRateStore failed")
+	}
+
+	if c.RateLimitQuota == 0 {
+		return store, nil
+	}
+
+	quota, err := NewQuotaStore(c, logger)
+	if err != nil {
+		_ = store.Close()
+		return nil, failure.Wrap(err, "NewQuotaStore failed")
+	}
+
+	composite, err := limits.NewCompositeStore(
+		limits.Tier{Name: "rate", Store: store},
+		limits.Tier{Name: "quota", Store: quota},
+	)
+	if err != nil {
+		_ = store.Close()
+		_ = quota.Close()
+		return nil, failure.Wrap(err, "limits.NewCompositeStore failed")
+	}
+
+	return composite, nil
+}
+
+// NewQuotaStore builds the store enforcing RateLimitQuota per calendar
+// period of the RateLimitQuotaTimezone. The quota is held in memory and
+// saved next to the snapshot, with a .quota suffix, when one is configured.
+// It is not shared by redis instances.
+func NewQuotaStore(c conf.API, logger *zap.SugaredLogger) (*limits.QuotaStore, error) {
+	if c.RateLimitStore == conf.StoreRedis || c.RateLimitStore == conf.StoreGossip {
+		return nil, failure.InvalidParam("rate limit quota is not supported by the (%s) store", c.RateLimitStore)
+	}
+
+	location, err := time.LoadLocation(c.RateLimitQuotaTimezone)
+	if err != nil {
+		return nil, failure.ToInvalidParam(err, "time.LoadLocation failed for (%s)", c.RateLimitQuotaTimezone)
+	}
+
+	lc := limiter.ToLimitsConfig(NewLimiterConfig(c))
+	lc.Limit = c.RateLimitQuota
+	if !c.RateLimitSnapshot.IsEmpty() {
+		lc.SnapshotPath = c.RateLimitSnapshot.Path + ".quota"
+		lc.SnapshotInterval = c.RateLimitSnapshotInterval
+		lc.SnapshotFailed = func(err error) {
+			logger.Errorw("snapshot", "status", "periodic quota snapshot failed", "path", lc.SnapshotPath, "ERROR", err)
+		}
+	}
+
+	store, err := limits.NewQuotaStore(lc, limits.QuotaConfig{
+		Period:   limits.Period(c.RateLimitQuotaPeriod),
+		Location: location,
+	})
+	if err != nil {
+		return nil, failure.Wrap(err, "limits.NewQuotaStore failed")
+	}
+
+	if lc.SnapshotPath == "" {
+		return store, nil
+	}
+
+	count, err := store.LoadFile(lc.SnapshotPath)
+	if err != nil {
+		logger.Warnw("startup", "status", "quota snapshot not restored", "path", lc.SnapshotPath, "ERROR", err)
+		return store, nil
+	}
+
+	logger.Infow("startup", "status", "quota snapshot restored", "path", lc.SnapshotPath, "keys", count)
+	return store, nil
+}
+
+// newRateStore builds the store of the rate limit or of its windows, see
+// NewLimitsStore
+func newRateStore(c conf.API, logger *zap.SugaredLogger) (limits.Store, error) {
+	lc := limiter.ToLimitsConfig(NewLimiterConfig(c))
+
+	windows, err := NewLimitWindows(c)
+	if err != nil {
+		return nil, failure.Wrap(err, "NewLimitWindows failed")
+	}
+
+	if len(windows) == 0 {
+		return newLimitsStore(c, lc, logger)
+	}
+
+	store, err := limits.NewWindowStore(lc, windows, func(wc *limits.Config, w limits.Window) (limits.Store, error) {
+		window := c
+		window.RateLimitRedisPrefix += w.Interval.String() + ":"
+		if !c.RateLimitSnapshot.IsEmpty() {
+			window.RateLimitSnapshot.Path += "." + w.Interval.String()
+		}
+
+		return newLimitsStore(window, wc, logger)
+	})
+	if err != nil {
+		return nil, failure.Wrap(err, "limits.NewWindowStore failed")
+	}
+
+	return store, nil
+}
+
+// newLimitsStore builds the store of a single limit, see NewLimitsStore
+func newLimitsStore(c conf.API, lc *limits.Config, logger *zap.SugaredLogger) (limits.Store, error) {
+	switch c.RateLimitStore {
+	case "", conf.StoreMemory, conf.StoreCluster:
+	case conf.StoreRedis:
+		return NewRedisStore(c, lc, logger)
+	default:
+		return nil, failure.InvalidParam("rate limit store (%s) is not supported", c.RateLimitStore)
+	}
+
+	lc.SnapshotPath = c.RateLimitSnapshot.Path
+	lc.SnapshotInterval = c.RateLimitSnapshotInterval
+	lc.SnapshotFailed = func(err error) {
+		logger.Errorw("snapshot", "status", "periodic snapshot failed", "path", lc.SnapshotPath, "ERROR", err)
+	}
+
+	var store interface {
+		limits.Store
+		limits.Snapshotter
+	}
+	if c.RateLimitShards > 1 {
+		store = limits.NewShardedStore(lc)
+	} else {
+		store = limits.NewMemoryStore(lc)
+	}
+
+	if c.RateLimitSnapshot.IsEmpty() {
+		return store, nil
+	}
+
+	count, err := store.LoadFile(lc.SnapshotPath)
+	if err != nil {
+		logger.Warnw("startup", "status", "snapshot not restored", "path", lc.SnapshotPath, "ERROR", err)
+		return store, nil
+	}
+
+	logger.Infow("startup", "status", "snapshot restored", "path", lc.SnapshotPath, "keys", count)
+	return store, nil
+}
+
+// NewRedisStore builds a store keeping the limiter state on a redis
+// compatible server, shared by every instance using the same server and
+// prefix. Connections are opened when first needed.
+func NewRedisStore(c conf.API, lc *limits.Config, logger *zap.SugaredLogger) (limits.Store, error) {
+	client := resp.NewClient(resp.ClientConfig{
+		Addr:     c.RateLimitRedisAddr,
+		Password: c.RateLimitRedisPassword,
+		DB:       c.RateLimitRedisDB,
+	})
+
+	store, err := limits.NewRedisStore(client, c.RateLimitRedisPrefix, lc)
+	if err != nil {
+		_ = client.Close()
+		return nil, failure.Wrap(err, "limits.NewRedisStore failed")
+	}
+
+	logger.Infow("startup", "status", "redis rate limit store", "addr", c.RateLimitRedisAddr, "prefix", store.Prefix())
+	return store, nil
+}
+
+// NewRateLimitStore builds the store configured by RateLimitStore. In
+// cluster and gossip mode it also returns the handler serving the peers,
+// which the caller must serve on ClusterHost, it is nil otherwise.
+func NewRateLimitStore(c conf.LimiterAPI, logger *zap.SugaredLogger) (limits.Store, http.Handler, error) {
+	if c.API.RateLimitStore == conf.StoreGossip {
+		store, err := NewGossipStore(c, logger)
+		if err != nil {
+			return nil, nil, failure.Wrap(err, "NewGossipStore failed")
+		}
+		return store, store.Handler(), nil
+	}
+
+	store, err := NewLimitsStore(c.API, logger)
+	if err != nil {
+		return nil, nil, failure.Wrap(err, "NewLimitsStore failed")
+	}
+
+	if c.API.RateLimitStore != conf.StoreCluster {
+		return store, nil, nil
+	}
+
+	cluster, err := NewClusterStore(c, store, logger)
+	if err != nil {
+		_ = store.Close()
+		return nil, nil, failure.Wrap(err, "NewClusterStore failed")
+	}
+
+	return cluster, cluster.Handler(), nil
+}
+
+// NewPeerDiscovery returns the address this instance is advertised at and
+// how its peers are listed. Peers are the pods of the kubernetes headless
+// service when one is configured, otherwise the static peer list. This
+// instance is advertised at RateLimitClusterAdvertise, or at the pod ip with
+// the port of ClusterHost.
+func NewPeerDiscovery(c conf.LimiterAPI) (string, limits.PeerDiscovery, error) {
+	host := c.ClusterHost()
+	_, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return "", nil, failure.ToInvalidParam(err, "cluster host (%s) is not a host:port", host)
+	}
+
+	self := c.API.RateLimitClusterAdvertise
+	if self == "" {
+		if c.Kubernetes.PodIP == "" {
+			return "", nil, failure.InvalidParam("cluster advertise address and pod ip are both empty")
+		}
+		self = net.JoinHostPort(c.Kubernetes.PodIP, port)
+	}
+
+	discovery := limits.StaticPeers(c.API.RateLimitClusterPeers...)
+	if service := c.Kubernetes.HeadlessService(); service != "" {
+		discovery = limits.DNSPeers(nil, service, port)
+	}
+
+	return self, discovery, nil
+}
+
+// NewClusterStore builds a store sharing the limits with the other instances
+// of the service, see NewPeerDiscovery. The caller must serve the Handler of
+// the store on ClusterHost.
+func NewClusterStore(c conf.LimiterAPI, local limits.Store, logger *zap.SugaredLogger) (*limits.ClusterStore, error) {
+	self, discovery, err := NewPeerDiscovery(c)
+	if err != nil {
+		return nil, failure.Wrap(err, "NewPeerDiscovery failed")
+	}
+
+	store, err := limits.NewClusterStore(local, limits.ClusterConfig{
+		Self:            self,
+		Secret:          c.API.RateLimitClusterSecret,
+		Discovery:       discovery,
+		RefreshInterval: c.API.RateLimitClusterRefresh,
+		Client:          NewDefaultHTTPClient(),
+		ForwardFailed: func(peer string, err error) {
+			logger.Warnw("cluster", "status", "forward to peer failed, served locally", "peer", peer, "ERROR", err)
+		},
+		RefreshFailed: func(err error) {
+			logger.Warnw("cluster", "status", "peer discovery failed", "ERROR", err)
+		},
+	})
+	if err != nil {
+		return nil, failure.Wrap(err, "limits.NewClusterStore failed")
+	}
+
+	logger.Infow("startup", "status", "rate limit cluster joined", "self", self, "peers", store.Peers())
+	return store, nil
+}
+
+// NewGossipStore builds a store enforcing approximate limits shared with the
+// other instances of the service by exchanging their usage every
+// RateLimitGossipInterval, see NewPeerDiscovery. The caller must serve the
+// Handler of the store on ClusterHost.
+func NewGossipStore(c conf.LimiterAPI, logger *zap.SugaredLogger) (*limits.GossipStore, error) {
+	if len(c.API.RateLimitWindows) > 0 || c.API.RateLimitQuota > 0 {
+		return nil, failure.InvalidParam("rate limit windows and quota are not supported by the gossip store")
+	}
+
+	self, discovery, err := NewPeerDiscovery(c)
+	if err != nil {
+		return nil, failure.Wrap(err, "NewPeerDiscovery failed")
+	}
+
+	store, err := limits.NewGossipStore(limiter.ToLimitsConfig(NewLimiterConfig(c.API)), limits.GossipConfig{
+		Self:            self,
+		Secret:          c.API.RateLimitClusterSecret,
+		Discovery:       discovery,
+		Interval:        c.API.RateLimitGossipInterval,
+		RefreshInterval: c.API.RateLimitClusterRefresh,
+		Client:          NewDefaultHTTPClient(),
+		GossipFailed: func(peer string, err error) {
+			logger.Warnw("gossip", "status", "usage not sent to peer", "peer", peer, "ERROR", err)
+		},
+		RefreshFailed: func(err error) {
+			logger.Warnw("gossip", "status", "peer discovery failed", "ERROR", err)
+		},
+	})
+	if err != nil {
+		return nil, failure.Wrap(err, "limits.NewGossipStore failed")
+	}
+
+	logger.Infow("startup", "status", "rate limit gossip joined", "self", self, "peers", store.Peers())
+	return store, nil
+}
+
+// NewAPIMux builds the api router with its middleware. When store is nil the
+// rate limiter creates and owns a MemoryStore, otherwise the caller owns the
+// store and its lifecycle.
+func NewAPIMux(c conf.API, logger *zap.SugaredLogger, store limits.Store) *fiber.App {
+	lc := NewLimiterConfig(c)
+	lc.Store = store
+
+	return NewAPIMuxWithLimiter(c, logger, limiter.New(lc))
+}
+
+// NewAPIMuxWithLimiter builds the api router with its middleware and the given
+// rate limiter, like the handler of the rule set of a policy.
+func NewAPIMuxWithLimiter(c conf.API, logger *zap.SugaredLogger, limit fiber.Handler) *fiber.App {
 
 	app := fiber.New(c.NewFiberConfig())
 	app.Use(recover.New())
@@ -92,16 +447,209 @@ func NewAPIMux(c conf.API, logger *zap.SugaredLogger) *fiber.App {
 		},
 	))
 
-	app.Use(limiter.New(limiter.Config{
-		Limit:       c.RateLimit,
-		Interval:    c.RateLimitInterval,
-		TTLInterval: c.RateLimitCleanStale,
-		MinTTL:      c.RateLimitCleanInactive,
-	}))
+	app.Use(limit)
 
 	return app
 }
 
+// NewRuleSetConfig loads the policy file of RateLimitPolicy. The client ip
+// settings of the API apply when the policy has no client_ip, and its max
+// keys, overflow and shards to the limits that do not set their own. The
+// settings of the rate limit store a policy can not honour are an error.
+func NewRuleSetConfig(c conf.API) (limiter.RuleSetConfig, error) {
+	if c.RateLimitPolicy.IsEmpty() {
+		return limiter.RuleSetConfig{}, failure.InvalidParam("rate limit policy is not configured")
+	}
+
+	if ignored := PolicyIgnored(c); len(ignored) > 0 {
+		return limiter.RuleSetConfig{}, failure.InvalidParam("rate limit policy can not be used with (%s), the rules are kept in memory", strings.Join(ignored, ", "))
+	}
+
+	config, err := limiter.LoadPolicy(c.RateLimitPolicy.Path)
+	if err != nil {
+		return config, failure.Wrap(err, "limiter.LoadPolicy failed")
+	}
+
+	return withAPIDefaults(c, config), nil
+}
+
+// NewRuleSet loads the policy file of RateLimitPolicy and builds the rule set
+// it defines. The rules are kept in memory stores owned by the rule set.
+func NewRuleSet(c conf.API, logger *zap.SugaredLogger) (*limiter.RuleSet, error) {
+	config, err := NewRuleSetConfig(c)
+	if err != nil {
+		return nil, failure.Wrap(err, "NewRuleSetConfig failed")
+	}
+
+	rules, err := limiter.NewRuleSet(config)
+	if err != nil {
+		return nil, failure.Wrap(err, "limiter.NewRuleSet failed")
+	}
+
+	logger.Infow("startup", "status", "rate limit policy loaded", "policy", c.RateLimitPolicy.Path, "rules", ruleNames(config), "match-all", config.MatchAll)
+	return rules, nil
+}
+
+// NewPolicyReloader builds the rule set of the policy file of RateLimitPolicy
+// and the watcher reloading it when the file changes. The caller runs the
+// watcher and closes both. The outcome of every reload is logged, an invalid
+// policy keeps the previous rules.
+func NewPolicyReloader(c conf.API, logger *zap.SugaredLogger) (*limiter.Reloader, *limiter.PolicyWatcher, error) {
+	config, err := NewRuleSetConfig(c)
+	if err != nil {
+		return nil, nil, failure.Wrap(err, "NewRuleSetConfig failed")
+	}
+
+	reloader, err := limiter.NewReloader(config)
+	if err != nil {
+		return nil, nil, failure.Wrap(err, "limiter.NewReloader failed")
+	}
+
+	watcher, err := limiter.NewPolicyWatcher(limiter.PolicyWatcherConfig{
+		Path:     c.RateLimitPolicy.Path,
+		Reloader: reloader,
+		Prepare: func(config limiter.RuleSetConfig) limiter.RuleSetConfig {
+			return withAPIDefaults(c, config)
+		},
+		OnReload: func(e limiter.ReloadEvent) {
+			if e.Err != nil {
+				logger.Errorw("reload",
+					"status", "rate limit policy reload failed",
+					"policy", e.Path,
+					"trigger", e.Trigger,
+					"ERROR", e.Err,
+				)
+				return
+			}
+
+			logger.Infow("reload",
+				"status", "rate limit policy reloaded",
+				"policy", e.Path,
+				"trigger", e.Trigger,
+				"rules", e.Result.Rules,
+				"kept", e.Result.Kept,
+				"created", e.Result.Created,
+				"closed", e.Result.Closed,
+			)
+		},
+	})
+	if err != nil {
+		_ = reloader.Close()
+		return nil, nil, failure.Wrap(err, "limiter.NewPolicyWatcher failed")
+	}
+
+	logger.Infow("startup", "status", "rate limit policy loaded", "policy", c.RateLimitPolicy.Path, "rules", ruleNames(config), "match-all", config.MatchAll)
+	return reloader, watcher, nil
+}
+
+// PolicyIgnored lists the settings of the rate limit store that are set but
+// would be ignored by a policy. The rules of a policy are kept in memory
+// stores owned by the rule set, they are not shared through redis, a cluster
+// or gossip, not saved to a snapshot and enforce no quota or windows.
+func PolicyIgnored(c conf.API) []string {
+	var ignored []string
+	if c.RateLimitStore != "" && c.RateLimitStore != conf.StoreMemory {
+		ignored = append(ignored, "API_RATE_LIMIT_STORE="+c.RateLimitStore)
+	}
+	if !c.RateLimitSnapshot.IsEmpty() {
+		ignored = append(ignored, "API_RATE_LIMIT_SNAPSHOT")
+	}
+	if c.RateLimitSnapshotInterval > 0 {
+		ignored = append(ignored, "API_RATE_LIMIT_SNAPSHOT_INTERVAL")
+	}
+	if c.RateLimitQuota > 0 {
+		ignored = append(ignored, "API_RATE_LIMIT_QUOTA")
+	}
+	if len(c.RateLimitWindows) > 0 {
+		ignored = append(ignored, "API_RATE_LIMIT_WINDOWS")
+	}
+
+	return ignored
+}
+
+// withAPIDefaults applies the settings of the API the policy does not set
+func withAPIDefaults(c conf.API, config limiter.RuleSetConfig) limiter.RuleSetConfig {
+	return withStoreBounds(c, withClientIP(c, config))
+}
+
+// withClientIP applies the client ip settings of the API to a policy without
+// client_ip
+func withClientIP(c conf.API, config limiter.RuleSetConfig) limiter.RuleSetConfig {
+	ip := config.ClientIP
+	if len(ip.TrustedProxies) == 0 && len(ip.ProxyHeaders) == 0 && ip.IPv4Prefix == 0 && ip.IPv6Prefix == 0 {
+		config.ClientIP = limiter.ClientIPConfig{
+			TrustedProxies: c.RateLimitTrustedProxies,
+			ProxyHeaders:   c.RateLimitProxyHeaders,
+			IPv4Prefix:     c.RateLimitIPv4Prefix,
+			IPv6Prefix:     c.RateLimitIPv6Prefix,
+		}
+	}
+
+	return config
+}
+
+// withStoreBounds applies the max keys, overflow and shards of the API to the
+// rules, tiers and overrides of a policy that do not set their own, so the
+// stores of the rules are bounded like the default store
+func withStoreBounds(c conf.API, config limiter.RuleSetConfig) limiter.RuleSetConfig {
+	bound := func(cfg *limiter.Config) {
+		if cfg.MaxKeys == 0 {
+			cfg.MaxKeys = c.RateLimitMaxKeys
+		}
+		if cfg.Overflow == "" {
+			cfg.Overflow = limits.OverflowPolicy(c.RateLimitOverflow)
+		}
+		if cfg.Shards == 0 {
+			cfg.Shards = c.RateLimitShards
+		}
+	}
+
+	rules := make([]limiter.Rule, len(config.Rules))
+	for i, r := range config.Rules {
+		bound(&r.Config)
+		r.Tiers = boundTiers(r.Tiers, bound)
+
+		overrides := make([]limiter.Override, len(r.Overrides))
+		for j, o := range r.Overrides {
+			bound(&o.Config)
+			o.Tiers = boundTiers(o.Tiers, bound)
+			overrides[j] = o
+		}
+		if r.Overrides != nil {
+			r.Overrides = overrides
+		}
+
+		rules[i] = r
+	}
+	config.Rules = rules
+
+	return config
+}
+
+// boundTiers is a copy of the tiers with the bounds applied
+func boundTiers(tiers []limiter.Tier, bound func(cfg *limiter.Config)) []limiter.Tier {
+	if tiers == nil {
+		return nil
+	}
+
+	result := make([]limiter.Tier, len(tiers))
+	for i, t := range tiers {
+		bound(&t.Config)
+		result[i] = t
+	}
+
+	return result
+}
+
+func ruleNames(config limiter.RuleSetConfig) []string {
+	names := make([]string, 0, len(config.Rules))
+	for _, r := range config.Rules {
+		names = append(names, r.Name)
+	}
+
+	return names
+}
+
 func NewDefaultHTTPClient() *http.Client {
 	config := conf.HTTPClient{
 		Timeout:            DefaultHTTPClientTimeout,
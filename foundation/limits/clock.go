@@ -0,0 +1,33 @@
+package limits
+
+import "time"
+
+// Clock is the source of time for stores and limiters. Reading the time
+// through a Clock instead of time.Now lets tests control window roll overs,
+// refills and garbage collection without sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock reads the time from the operating system
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// clockOrSystem defaults a nil clock to the SystemClock
+func clockOrSystem(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock
+	}
+
+	return clock
+}
+
+// unixNano is the current time of the clock in nanoseconds from unix epoch
+func unixNano(clock Clock) uint64 {
+	return uint64(clock.Now().UnixNano())
+}
@@ -0,0 +1,513 @@
+package limits
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/rsb/failure"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ClusterPath           = "/limits/v1/cluster"
+	PeerSecretHeader      = "X-Limits-Peer-Secret"
+	DefaultClusterRefresh = 30 * time.Second
+	DefaultClusterTimeout = 500 * time.Millisecond
+
+	// MaxPeerBodySize is the largest body the cluster and gossip handlers
+	// read from a peer, larger bodies are refused
+	MaxPeerBodySize = 4 << 20
+)
+
+const (
+	clusterOpTake   = "take"
+	clusterOpPeek   = "peek"
+	clusterOpReturn = "return"
+	clusterOpGet    = "get"
+	clusterOpSet    = "set"
+)
+
+var _ Store = (*ClusterStore)(nil)
+
+// PeerDiscovery lists the host:port cluster address of every peer
+type PeerDiscovery func(ctx context.Context) ([]string, error)
+
+// StaticPeers always lists the same peers
+func StaticPeers(peers ...string) PeerDiscovery {
+	return func(_ context.Context) ([]string, error) {
+		return peers, nil
+	}
+}
+
+// DNSPeers lists the addresses the host resolves to, like the pod ips of a
+// kubernetes headless service, each with the given port. A nil resolver uses
+// the default resolver.
+func DNSPeers(resolver *net.Resolver, host, port string) PeerDiscovery {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	return func(ctx context.Context) ([]string, error) {
+		ips, err := resolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, failure.ToSystem(err, "resolver.LookupHost failed for (%s)", host)
+		}
+
+		peers := make([]string, len(ips))
+		for i, ip := range ips {
+			peers[i] = net.JoinHostPort(ip, port)
+		}
+
+		return peers, nil
+	}
+}
+
+// ClusterConfig controls how an instance joins its peers
+//
+// Self            - host:port the other peers reach the Handler of this
+// 									 instance at, it is always on the ring
+// Secret          - shared by the peers, sent on every call and required by
+// 									 the Handler, which refuses the calls without it
+// Discovery       - lists the peers, only Self when nil
+// Replicas        - points of each peer on the hash ring, defaults to
+// 									 DefaultReplicas
+// RefreshInterval - how often the garbage collector lists the peers again,
+// 									 defaults to DefaultClusterRefresh
+// Timeout         - timeout of a call forwarded to a peer and of the first
+// 									 listing of the peers, defaults to DefaultClusterTimeout
+// Client          - http client used to call the peers, defaults to a client
+// 									 of the default transport
+// ForwardFailed   - called when a peer could not be reached, the call is
+// 									 then served by the local store
+// RefreshFailed   - called when the peers could not be listed, the ring is
+// 									 kept as it was
+type ClusterConfig struct {
+	Self            string
+	Secret          string
+	Discovery       PeerDiscovery
+	Replicas        int
+	RefreshInterval time.Duration
+	Timeout         time.Duration
+	Client          *http.Client
+	ForwardFailed   func(peer string, err error)
+	RefreshFailed   func(err error)
+}
+
+// ClusterStore shares limits between instances without an external store.
+// Every key is owned by a single peer through a HashRing, the owner keeps
+// the state of the key in its local store and the other peers forward their
+// calls to it over http, so the limits hold across the whole cluster. Calls
+// received from a peer are always served locally, an instance with a
+// different view of the ring never forwards them again.
+//
+// When the owner can not be reached the call is served by the local store,
+// the limit is then enforced per instance until the owner is back or the
+// peers are listed again.
+type ClusterStore struct {
+	local    Store
+	self     string
+	secret   string
+	discover PeerDiscovery
+	replicas int
+	refresh  time.Duration
+	timeout  time.Duration
+	client   *http.Client
+
+	forwardFailed func(peer string, err error)
+	refreshFailed func(err error)
+
+	ring *HashRing
+	lock sync.RWMutex
+
+	stopped uint32
+	stop    chan struct{}
+}
+
+// NewClusterStore creates a cluster store keeping the keys owned by this
+// instance in the local store, which it owns from now on. The peers are
+// listed once before returning, within Timeout so a slow discovery does not
+// hold back the startup. A failure is reported to RefreshFailed and the ring
+// only holds Self until the next refresh.
+func NewClusterStore(local Store, config ClusterConfig) (*ClusterStore, error) {
+	if local == nil {
+		return nil, failure.InvalidParam("local(Store) is nil")
+	}
+
+	if config.Self == "" {
+		return nil, failure.InvalidParam("config.Self is empty")
+	}
+
+	if config.Secret == "" {
+		return nil, failure.InvalidParam("config.Secret is empty")
+	}
+
+	discover := config.Discovery
+	if discover == nil {
+		discover = StaticPeers()
+	}
+
+	refresh := DefaultClusterRefresh
+	if config.RefreshInterval > 0 {
+		refresh = config.RefreshInterval
+	}
+
+	timeout := DefaultClusterTimeout
+	if config.Timeout > 0 {
+		timeout = config.Timeout
+	}
+
+	client := config.Client
+	if client == nil {
+		client = &http.Client{}
+	}
+
+	s := ClusterStore{
+		local:         local,
+		self:          config.Self,
+		secret:        config.Secret,
+		discover:      discover,
+		replicas:      config.Replicas,
+		refresh:       refresh,
+		timeout:       timeout,
+		client:        client,
+		forwardFailed: config.ForwardFailed,
+		refreshFailed: config.RefreshFailed,
+		ring:          NewHashRing(config.Replicas, config.Self),
+		stop:          make(chan struct{}),
+	}
+
+	s.refreshPeers(s.timeout)
+
+	return &s, nil
+}
+
+// Refresh lists the peers and replaces the ring when they changed
+func (s *ClusterStore) Refresh(ctx context.Context) error {
+	peers, err := s.discover(ctx)
+	if err != nil {
+		return failure.Wrap(err, "s.discover failed")
+	}
+
+	ring := NewHashRing(s.replicas, append(peers, s.self)...)
+
+	s.lock.Lock()
+	if !s.ring.Equal(ring) {
+		s.ring = ring
+	}
+	s.lock.Unlock()
+
+	return nil
+}
+
+// Peers is the sorted list of peers on the ring, including this instance
+func (s *ClusterStore) Peers() []string {
+	return s.hashRing().Peers()
+}
+
+// Owner is the peer owning the key
+func (s *ClusterStore) Owner(key string) string {
+	return s.hashRing().Owner(key)
+}
+
+// Take consumes a single token for the key
+func (s *ClusterStore) Take(key string) (RateInfo, error) {
+	return s.TakeN(key, 1)
+}
+
+// TakeN consumes n tokens for the key on the peer owning it
+func (s *ClusterStore) TakeN(key string, n uint64) (RateInfo, error) {
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return RateInfo{}, failure.InvalidState("ClusterStore is stopped")
+	}
+
+	owner := s.Owner(key)
+	if owner != s.self {
+		res, err := s.forward(owner, clusterRequest{Op: clusterOpTake, Key: key, N: n})
+		if err == nil {
+			return res.rateInfo(), nil
+		}
+		s.failed(owner, err)
+	}
+
+	return s.local.TakeN(key, n)
+}
+
+// Peek reports the up to date state of the key on the peer owning it
+func (s *ClusterStore) Peek(key string) (RateInfo, error) {
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return RateInfo{}, failure.InvalidState("ClusterStore is stopped")
+	}
+
+	owner := s.Owner(key)
+	if owner != s.self {
+		res, err := s.forward(owner, clusterRequest{Op: clusterOpPeek, Key: key})
+		if err == nil {
+			return res.rateInfo(), nil
+		}
+		s.failed(owner, err)
+	}
+
+	return s.local.Peek(key)
+}
+
+// Return gives n tokens back to the key on the peer owning it
+func (s *ClusterStore) Return(key string, n uint64) error {
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return failure.InvalidState("ClusterStore is stopped")
+	}
+
+	owner := s.Owner(key)
+	if owner != s.self {
+		_, err := s.forward(owner, clusterRequest{Op: clusterOpReturn, Key: key, N: n})
+		if err == nil {
+			return nil
+		}
+		s.failed(owner, err)
+	}
+
+	return s.local.Return(key, n)
+}
+
+// Get returns the limit and remaining tokens of the key on the peer owning it
+func (s *ClusterStore) Get(key string) (uint64, uint64, error) {
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return 0, 0, failure.InvalidState("ClusterStore is stopped")
+	}
+
+	owner := s.Owner(key)
+	if owner != s.self {
+		res, err := s.forward(owner, clusterRequest{Op: clusterOpGet, Key: key})
+		if err == nil {
+			return res.Limit, res.Remaining, nil
+		}
+		s.failed(owner, err)
+	}
+
+	return s.local.Get(key)
+}
+
+// Set replaces the limit and interval used by the key on the peer owning it
+func (s *ClusterStore) Set(key string, tokens uint64, interval time.Duration) error {
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return failure.InvalidState("ClusterStore is stopped")
+	}
+
+	owner := s.Owner(key)
+	if owner != s.self {
+		req := clusterRequest{Op: clusterOpSet, Key: key, N: tokens, Interval: interval}
+		_, err := s.forward(owner, req)
+		if err == nil {
+			return nil
+		}
+		s.failed(owner, err)
+	}
+
+	return s.local.Set(key, tokens, interval)
+}
+
+// Close stops the garbage collector and closes the local store
+func (s *ClusterStore) Close() error {
+	if !atomic.CompareAndSwapUint32(&s.stopped, 0, 1) {
+		return nil
+	}
+
+	close(s.stop)
+
+	if err := s.local.Close(); err != nil {
+		return failure.Wrap(err, "s.local.Close failed")
+	}
+
+	return nil
+}
+
+// GarbageCollector runs the garbage collector of the local store and lists
+// the peers again on every refresh interval until Close is called
+func (s *ClusterStore) GarbageCollector() {
+	go s.local.GarbageCollector()
+
+	ticker := time.NewTicker(s.refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.refreshPeers(s.refresh)
+		}
+	}
+}
+
+// Handler serves the calls forwarded by the other peers on ClusterPath, the
+// calls without the secret of the peers are refused. It should only be
+// reachable by the peers.
+func (s *ClusterStore) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ClusterPath, s.serve)
+	return mux
+}
+
+func (s *ClusterStore) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeClusterResponse(w, http.StatusMethodNotAllowed, clusterResponse{Error: "method not allowed"})
+		return
+	}
+
+	if !peerAuthorized(r, s.secret) {
+		writeClusterResponse(w, http.StatusUnauthorized, clusterResponse{Error: "peer secret is invalid"})
+		return
+	}
+
+	var req clusterRequest
+	body := http.MaxBytesReader(w, r.Body, MaxPeerBodySize)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		writeClusterResponse(w, http.StatusBadRequest, clusterResponse{Error: err.Error()})
+		return
+	}
+
+	var res clusterResponse
+	var info RateInfo
+	var err error
+	switch req.Op {
+	case clusterOpTake:
+		info, err = s.local.TakeN(req.Key, req.N)
+		res = newClusterResponse(info)
+	case clusterOpPeek:
+		info, err = s.local.Peek(req.Key)
+		res = newClusterResponse(info)
+	case clusterOpReturn:
+		err = s.local.Return(req.Key, req.N)
+	case clusterOpGet:
+		res.Limit, res.Remaining, err = s.local.Get(req.Key)
+	case clusterOpSet:
+		err = s.local.Set(req.Key, req.N, req.Interval)
+	default:
+		writeClusterResponse(w, http.StatusBadRequest, clusterResponse{Error: "op (" + req.Op + ") is not supported"})
+		return
+	}
+
+	if err != nil {
+		writeClusterResponse(w, http.StatusInternalServerError, clusterResponse{Error: err.Error()})
+		return
+	}
+
+	writeClusterResponse(w, http.StatusOK, res)
+}
+
+// forward sends the call to the peer
+func (s *ClusterStore) forward(peer string, req clusterRequest) (clusterResponse, error) {
+	var res clusterResponse
+	body, err := json.Marshal(&req)
+	if err != nil {
+		return res, failure.ToSystem(err, "json.Marshal failed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+peer+ClusterPath, bytes.NewReader(body))
+	if err != nil {
+		return res, failure.ToSystem(err, "http.NewRequestWithContext failed for (%s)", peer)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(PeerSecretHeader, s.secret)
+
+	resp, err := s.client.Do(r)
+	if err != nil {
+		return res, failure.ToSystem(err, "s.client.Do failed for (%s)", peer)
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return res, failure.ToSystem(err, "json.Decode failed for (%s) status (%d)", peer, resp.StatusCode)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return res, failure.System("peer (%s) failed with status (%d): %s", peer, resp.StatusCode, res.Error)
+	}
+
+	return res, nil
+}
+
+// peerAuthorized reports whether the call carries the secret of the peers
+func peerAuthorized(r *http.Request, secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(PeerSecretHeader)), []byte(secret)) == 1
+}
+
+func (s *ClusterStore) failed(peer string, err error) {
+	if s.forwardFailed != nil {
+		s.forwardFailed(peer, err)
+	}
+}
+
+// refreshPeers lists the peers again, giving up after the timeout
+func (s *ClusterStore) refreshPeers(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := s.Refresh(ctx); err != nil && s.refreshFailed != nil {
+		s.refreshFailed(err)
+	}
+}
+
+func (s *ClusterStore) hashRing() *HashRing {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.ring
+}
+
+// clusterRequest is a call forwarded to the owner of the key, N is the
+// number of tokens of a set
+type clusterRequest struct {
+	Op       string        `json:"op"`
+	Key      string        `json:"key"`
+	N        uint64        `json:"n,omitempty"`
+	Interval time.Duration `json:"interval,omitempty"`
+}
+
+// clusterResponse is the outcome of a forwarded call
+type clusterResponse struct {
+	Limit     uint64        `json:"limit"`
+	Remaining uint64        `json:"remaining"`
+	Reset     uint64        `json:"reset,omitempty"`
+	Delay     time.Duration `json:"delay,omitempty"`
+	Ok        bool          `json:"ok"`
+	Error     string        `json:"error,omitempty"`
+}
+
+func newClusterResponse(info RateInfo) clusterResponse {
+	return clusterResponse{
+		Limit:     info.LimitSize,
+		Remaining: info.Remaining,
+		Reset:     info.Reset,
+		Delay:     info.Delay,
+		Ok:        info.OperationOk,
+	}
+}
+
+func (r clusterResponse) rateInfo() RateInfo {
+	return RateInfo{
+		LimitSize:   r.Limit,
+		Remaining:   r.Remaining,
+		Reset:       r.Reset,
+		Delay:       r.Delay,
+		OperationOk: r.Ok,
+	}
+}
+
+func writeClusterResponse(w http.ResponseWriter, status int, res clusterResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(&res)
+}
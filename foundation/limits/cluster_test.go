@@ -0,0 +1,354 @@
+package limits_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/failure"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClusterStore_GlobalLimit(t *testing.T) {
+	t.Parallel()
+
+	peers, _, _ := newCluster(t, 3, &limits.Config{Limit: 10, Interval: time.Hour})
+
+	var wg sync.WaitGroup
+	var allowed int64
+	for i := 0; i < 60; i++ {
+		store := peers[i%len(peers)]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			info, err := store.Take("shared")
+			if err == nil && info.OperationOk {
+				atomic.AddInt64(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// every instance agrees on the limit of the key
+	require.Equal(t, int64(10), allowed)
+	for _, store := range peers {
+		limit, remaining, err := store.Get("shared")
+		require.NoError(t, err)
+		require.Equal(t, uint64(10), limit)
+		require.Zero(t, remaining)
+
+		info, err := store.Peek("shared")
+		require.NoError(t, err)
+		require.False(t, info.OperationOk)
+	}
+}
+
+func TestClusterStore_ForwardsToOwner(t *testing.T) {
+	t.Parallel()
+
+	peers, locals, addrs := newCluster(t, 3, &limits.Config{Limit: 5, Interval: time.Hour})
+
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owner := peers[0].Owner(key)
+		for _, store := range peers {
+			require.Equal(t, owner, store.Owner(key))
+		}
+
+		_, err := peers[i%3].TakeN(key, 2)
+		require.NoError(t, err)
+		require.NoError(t, peers[(i+1)%3].Return(key, 1))
+
+		// only the owner holds the key
+		for j := range peers {
+			_, remaining, err := locals[j].Get(key)
+			require.NoError(t, err)
+			if addrs[j] == owner {
+				require.Equal(t, uint64(4), remaining)
+			} else {
+				require.Zero(t, remaining)
+			}
+		}
+	}
+
+	require.NoError(t, peers[1].Set("custom", 50, time.Hour))
+	info, err := peers[2].Take("custom")
+	require.NoError(t, err)
+	require.Equal(t, uint64(50), info.LimitSize)
+	require.Equal(t, uint64(49), info.Remaining)
+}
+
+func TestClusterStore_OwnerDown(t *testing.T) {
+	t.Parallel()
+
+	down := unusedAddr(t)
+	var failed int64
+	store, err := limits.NewClusterStore(limits.NewMemoryStore(&limits.Config{Limit: 1, Interval: time.Hour}), limits.ClusterConfig{
+		Self:      "127.0.0.1:1",
+		Secret:    testPeerSecret,
+		Discovery: limits.StaticPeers(down),
+		Timeout:   time.Second,
+		ForwardFailed: func(peer string, err error) {
+			require.Equal(t, down, peer)
+			atomic.AddInt64(&failed, 1)
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	key := ownedBy(t, store, down)
+
+	// the local store enforces the limit until the owner is back
+	info, err := store.Take(key)
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+
+	info, err = store.Take(key)
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+	require.Equal(t, int64(2), atomic.LoadInt64(&failed))
+}
+
+func TestClusterStore_Refresh(t *testing.T) {
+	t.Parallel()
+
+	var peers []string
+	var lock sync.Mutex
+	var refreshErr error
+	discovery := func(_ context.Context) ([]string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return peers, refreshErr
+	}
+
+	var refreshFailed int64
+	store, err := limits.NewClusterStore(limits.NewMemoryStore(), limits.ClusterConfig{
+		Self:            "10.0.0.1:7000",
+		Secret:          testPeerSecret,
+		Discovery:       discovery,
+		RefreshInterval: 10 * time.Millisecond,
+		RefreshFailed: func(err error) {
+			atomic.AddInt64(&refreshFailed, 1)
+		},
+	})
+	require.NoError(t, err)
+	go store.GarbageCollector()
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+	require.Equal(t, []string{"10.0.0.1:7000"}, store.Peers())
+
+	lock.Lock()
+	peers = []string{"10.0.0.2:7000", "10.0.0.3:7000"}
+	lock.Unlock()
+	require.Eventually(t, func() bool {
+		return len(store.Peers()) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	// a failed listing keeps the ring as it was
+	lock.Lock()
+	refreshErr = failure.System("dns is down")
+	lock.Unlock()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&refreshFailed) > 0
+	}, time.Second, 10*time.Millisecond)
+	require.Len(t, store.Peers(), 3)
+}
+
+func TestClusterStore_SlowDiscovery(t *testing.T) {
+	t.Parallel()
+
+	// the discovery only returns once it is given up on
+	discovery := func(ctx context.Context) ([]string, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	var refreshFailed int64
+	created := make(chan *limits.ClusterStore, 1)
+	go func() {
+		store, err := limits.NewClusterStore(limits.NewMemoryStore(), limits.ClusterConfig{
+			Self:            "10.0.0.1:7000",
+			Secret:          testPeerSecret,
+			Discovery:       discovery,
+			RefreshInterval: time.Hour,
+			Timeout:         10 * time.Millisecond,
+			RefreshFailed: func(err error) {
+				atomic.AddInt64(&refreshFailed, 1)
+			},
+		})
+		require.NoError(t, err)
+		created <- store
+	}()
+
+	// the first listing gives up after the timeout, not the refresh interval
+	select {
+	case store := <-created:
+		t.Cleanup(func() {
+			require.NoError(t, store.Close())
+		})
+		require.Equal(t, []string{"10.0.0.1:7000"}, store.Peers())
+		require.Equal(t, int64(1), atomic.LoadInt64(&refreshFailed))
+	case <-time.After(5 * time.Second):
+		t.Fatal("NewClusterStore waited for the refresh interval")
+	}
+}
+
+func TestClusterStore_Invalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := limits.NewClusterStore(nil, limits.ClusterConfig{Self: "127.0.0.1:1"})
+	require.True(t, failure.IsInvalidParam(err))
+
+	_, err = limits.NewClusterStore(limits.NewMemoryStore(), limits.ClusterConfig{})
+	require.True(t, failure.IsInvalidParam(err))
+
+	_, err = limits.NewClusterStore(limits.NewMemoryStore(), limits.ClusterConfig{Self: "127.0.0.1:1"})
+	require.True(t, failure.IsInvalidParam(err))
+}
+
+func TestClusterStore_PeerSecret(t *testing.T) {
+	t.Parallel()
+
+	store, err := limits.NewClusterStore(limits.NewMemoryStore(), limits.ClusterConfig{Self: "127.0.0.1:1", Secret: testPeerSecret})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	call := func(secret string) int {
+		r := httptest.NewRequest(http.MethodPost, limits.ClusterPath, strings.NewReader(`{"op":"set","key":"victim","n":50,"interval":3600000000000}`))
+		if secret != "" {
+			r.Header.Set(limits.PeerSecretHeader, secret)
+		}
+		w := httptest.NewRecorder()
+		store.Handler().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusUnauthorized, call(""))
+	require.Equal(t, http.StatusUnauthorized, call("guess"))
+
+	limit, _, err := store.Get("victim")
+	require.NoError(t, err)
+	require.Zero(t, limit)
+
+	require.Equal(t, http.StatusOK, call(testPeerSecret))
+	limit, _, err = store.Get("victim")
+	require.NoError(t, err)
+	require.Equal(t, uint64(50), limit)
+}
+
+func TestClusterStore_MaxBodySize(t *testing.T) {
+	t.Parallel()
+
+	store, err := limits.NewClusterStore(limits.NewMemoryStore(), limits.ClusterConfig{Self: "127.0.0.1:1", Secret: testPeerSecret})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	call := func(padding int) int {
+		body := `{"op":"take","key":"key","n":1,"padding":"` + strings.Repeat("a", padding) + `"}`
+		r := httptest.NewRequest(http.MethodPost, limits.ClusterPath, strings.NewReader(body))
+		r.Header.Set(limits.PeerSecretHeader, testPeerSecret)
+		w := httptest.NewRecorder()
+		store.Handler().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusOK, call(1024))
+	require.Equal(t, http.StatusBadRequest, call(limits.MaxPeerBodySize))
+}
+
+const testPeerSecret = "peer-secret"
+
+func TestDNSPeers(t *testing.T) {
+	t.Parallel()
+
+	peers, err := limits.DNSPeers(nil, "127.0.0.1", "7000")(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{"127.0.0.1:7000"}, peers)
+
+	_, err = limits.DNSPeers(nil, "limiter.invalid", "7000")(context.Background())
+	require.True(t, failure.IsSystem(err))
+}
+
+// newCluster starts count in-process instances, each serving the cluster
+// handler of its store, and returns the stores with their local stores and
+// addresses
+func newCluster(t *testing.T, count int, config *limits.Config) ([]*limits.ClusterStore, []limits.Store, []string) {
+	t.Helper()
+
+	servers := make([]*httptest.Server, count)
+	addrs := make([]string, count)
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		addrs[i] = servers[i].Listener.Addr().String()
+	}
+
+	stores := make([]*limits.ClusterStore, count)
+	locals := make([]limits.Store, count)
+	for i := range stores {
+		locals[i] = limits.NewMemoryStore(config)
+		store, err := limits.NewClusterStore(locals[i], limits.ClusterConfig{
+			Self:      addrs[i],
+			Secret:    testPeerSecret,
+			Discovery: limits.StaticPeers(addrs...),
+			ForwardFailed: func(peer string, err error) {
+				t.Errorf("forward to (%s) failed: %v", peer, err)
+			},
+		})
+		require.NoError(t, err)
+		stores[i] = store
+
+		servers[i].Config.Handler = store.Handler()
+		servers[i].Start()
+	}
+
+	t.Cleanup(func() {
+		for i := range stores {
+			servers[i].Close()
+			require.NoError(t, stores[i].Close())
+		}
+	})
+
+	return stores, locals, addrs
+}
+
+// ownedBy finds a key owned by the peer
+func ownedBy(t *testing.T, store *limits.ClusterStore, peer string) string {
+	t.Helper()
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if store.Owner(key) == peer {
+			return key
+		}
+	}
+
+	t.Fatalf("no key is owned by (%s)", peer)
+	return ""
+}
+
+// unusedAddr is a local address nothing listens on
+func unusedAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	return addr
+}
@@ -0,0 +1,250 @@
+package limits
+
+import (
+	"github.com/rsb/failure"
+	"sync/atomic"
+	"time"
+)
+
+var _ Store = (*CompositeStore)(nil)
+
+// Tier is a level of a CompositeStore, like per user, per org or global
+//
+// Name  - identifies the tier in errors
+// Store - holds the limits of the tier
+// Key   - maps the key of a request onto the key of the tier, like a user
+// 				 onto its org or every user onto a single global key. The key is
+// 				 used as is when nil
+type Tier struct {
+	Name  string
+	Store Store
+	Key   func(key string) string
+}
+
+func (t Tier) key(key string) string {
+	if t.Key == nil {
+		return key
+	}
+
+	return t.Key(key)
+}
+
+// CompositeStore enforces the limits of several tiers at once, a request is
+// only permitted when every tier has capacity. Tiers are taken in order and
+// the tokens already taken are returned when a later tier rejects the
+// request, so a rejected request never consumes any tier. Concurrent
+// requests may briefly see tokens that are then returned.
+//
+// The RateInfo of an operation is the one of the most restrictive tier: the
+// rejecting tier when the request is rejected, otherwise the tier with the
+// fewest remaining tokens and, on a tie, the latest reset.
+type CompositeStore struct {
+	tiers []Tier
+
+	stopped uint32
+	stop    chan struct{}
+}
+
+// NewCompositeStore creates a store of the tiers, most specific first. The
+// composite owns the stores of the tiers and closes them on Close.
+func NewCompositeStore(tiers ...Tier) (*CompositeStore, error) {
+	if len(tiers) == 0 {
+		return nil, failure.InvalidParam("tiers are empty")
+	}
+
+	for i, t := range tiers {
+		if t.Store == nil {
+			return nil, failure.InvalidParam("store of tier (%d) (%s) is nil", i, t.Name)
+		}
+	}
+
+	return &CompositeStore{
+		tiers: tiers,
+		stop:  make(chan struct{}),
+	}, nil
+}
+
+// Tiers is the number of tiers of the store
+func (c *CompositeStore) Tiers() int {
+	return len(c.tiers)
+}
+
+// Take consumes a single token for the key on every tier
+func (c *CompositeStore) Take(key string) (RateInfo, error) {
+	return c.TakeN(key, 1)
+}
+
+// TakeN consumes n tokens for the key on every tier, or on none of them when
+// a tier can not afford them. The request is delayed by the longest Delay of
+// the tiers, like a leaky bucket tier queueing it.
+func (c *CompositeStore) TakeN(key string, n uint64) (RateInfo, error) {
+	var info RateInfo
+	if atomic.LoadUint32(&c.stopped) == 1 {
+		return info, failure.InvalidState("CompositeStore is stopped")
+	}
+
+	var delay time.Duration
+	for i, t := range c.tiers {
+		tInfo, err := t.Store.TakeN(t.key(key), n)
+		if err != nil {
+			err = failure.Wrap(err, "TakeN failed for tier (%s)", t.Name)
+			if rErr := c.rollback(key, n, i); rErr != nil {
+				err = failure.Append(err, rErr)
+			}
+			return info, err
+		}
+
+		if !tInfo.OperationOk {
+			if rErr := c.rollback(key, n, i); rErr != nil {
+				return tInfo, rErr
+			}
+			return tInfo, nil
+		}
+
+		if i == 0 || MoreRestrictive(tInfo, info) {
+			info = tInfo
+		}
+		if tInfo.Delay > delay {
+			delay = tInfo.Delay
+		}
+	}
+
+	info.Delay = delay
+	return info, nil
+}
+
+// Peek reports the state of the most restrictive tier without taking a
+// token, with the longest Delay of the tiers. OperationOk reports whether
+// every tier could afford a single token.
+func (c *CompositeStore) Peek(key string) (RateInfo, error) {
+	var info RateInfo
+	if atomic.LoadUint32(&c.stopped) == 1 {
+		return info, failure.InvalidState("CompositeStore is stopped")
+	}
+
+	var delay time.Duration
+	for i, t := range c.tiers {
+		tInfo, err := t.Store.Peek(t.key(key))
+		if err != nil {
+			return info, failure.Wrap(err, "Peek failed for tier (%s)", t.Name)
+		}
+
+		if i == 0 || MoreRestrictive(tInfo, info) {
+			info = tInfo
+		}
+		if tInfo.Delay > delay {
+			delay = tInfo.Delay
+		}
+	}
+
+	info.Delay = delay
+	return info, nil
+}
+
+// Return gives n tokens back to the key on every tier
+func (c *CompositeStore) Return(key string, n uint64) error {
+	if atomic.LoadUint32(&c.stopped) == 1 {
+		return failure.InvalidState("CompositeStore is stopped")
+	}
+
+	return c.rollback(key, n, len(c.tiers))
+}
+
+// Get returns the limit and remaining tokens of the tier with the fewest
+// remaining tokens among the tiers holding the key, zero values when none of
+// them hold it
+func (c *CompositeStore) Get(key string) (uint64, uint64, error) {
+	var limit, remaining uint64
+	if atomic.LoadUint32(&c.stopped) == 1 {
+		return limit, remaining, failure.InvalidState("CompositeStore is stopped")
+	}
+
+	found := false
+	for _, t := range c.tiers {
+		tLimit, tRemaining, err := t.Store.Get(t.key(key))
+		if err != nil {
+			return 0, 0, failure.Wrap(err, "Get failed for tier (%s)", t.Name)
+		}
+
+		if tLimit == 0 {
+			continue
+		}
+
+		if !found || tRemaining < remaining {
+			limit, remaining, found = tLimit, tRemaining, true
+		}
+	}
+
+	return limit, remaining, nil
+}
+
+// Set replaces the limit and interval used by the key on the first tier,
+// the most specific one
+func (c *CompositeStore) Set(key string, tokens uint64, interval time.Duration) error {
+	if atomic.LoadUint32(&c.stopped) == 1 {
+		return failure.InvalidState("CompositeStore is stopped")
+	}
+
+	t := c.tiers[0]
+	if err := t.Store.Set(t.key(key), tokens, interval); err != nil {
+		return failure.Wrap(err, "Set failed for tier (%s)", t.Name)
+	}
+
+	return nil
+}
+
+// Close stops the garbage collector and closes the store of every tier
+func (c *CompositeStore) Close() error {
+	if !atomic.CompareAndSwapUint32(&c.stopped, 0, 1) {
+		return nil
+	}
+
+	close(c.stop)
+
+	var err error
+	for _, t := range c.tiers {
+		if cErr := t.Store.Close(); cErr != nil && err == nil {
+			err = failure.Wrap(cErr, "Close failed for tier (%s)", t.Name)
+		}
+	}
+
+	return err
+}
+
+// GarbageCollector runs the garbage collector of every tier until Close is
+// called
+func (c *CompositeStore) GarbageCollector() {
+	for _, t := range c.tiers {
+		go t.Store.GarbageCollector()
+	}
+
+	<-c.stop
+}
+
+// rollback returns n tokens to the first count tiers, last tier first
+func (c *CompositeStore) rollback(key string, n uint64, count int) error {
+	var err error
+	for i := count - 1; i >= 0; i-- {
+		t := c.tiers[i]
+		if rErr := t.Store.Return(t.key(key), n); rErr != nil && err == nil {
+			err = failure.Wrap(rErr, "Return failed for tier (%s)", t.Name)
+		}
+	}
+
+	return err
+}
+
+// MoreRestrictive reports whether a is closer to exhaustion than b: a is
+// not ok while b is, or a has fewer remaining tokens, or the same but a
+// later reset
+func MoreRestrictive(a, b RateInfo) bool {
+	if a.OperationOk != b.OperationOk {
+		return !a.OperationOk
+	}
+
+	if a.Remaining != b.Remaining {
+		return a.Remaining < b.Remaining
+	}
+
+	return a.Reset > b.Reset
+}
@@ -0,0 +1,226 @@
+package limits_test
+
+import (
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/api_rate_limiter/foundation/limits/limitstest"
+	"github.com/rsb/failure"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompositeStore_AllTiers(t *testing.T) {
+	t.Parallel()
+
+	store, users, orgs, global := newCompositeStore(t)
+
+	// two users of the same org share the org tier
+	for i := 0; i < 3; i++ {
+		info, err := store.Take("acme/alice")
+		require.NoError(t, err)
+		require.True(t, info.OperationOk)
+	}
+	info, err := store.Take("acme/bob")
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+
+	// the org tier is the most restrictive with one token left
+	require.Equal(t, uint64(5), info.LimitSize)
+	require.Equal(t, uint64(1), info.Remaining)
+
+	_, remaining, err := users.Get("acme/alice")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), remaining)
+	_, remaining, err = orgs.Get("acme")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), remaining)
+	_, remaining, err = global.Get("global")
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), remaining)
+
+	limit, remaining, err := store.Get("acme/bob")
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), limit)
+	require.Equal(t, uint64(1), remaining)
+}
+
+func TestCompositeStore_Rollback(t *testing.T) {
+	t.Parallel()
+
+	store, users, orgs, global := newCompositeStore(t)
+
+	// alice exhausts her user tier, the rejection takes nothing from the others
+	_, err := store.TakeN("acme/alice", 3)
+	require.NoError(t, err)
+	info, err := store.Take("acme/alice")
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+	require.Equal(t, uint64(3), info.LimitSize)
+
+	// the org tier rejects bob, his user tier gets its tokens back
+	info, err = store.TakeN("acme/bob", 3)
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+	require.Equal(t, uint64(5), info.LimitSize)
+	require.Equal(t, uint64(2), info.Remaining)
+
+	_, remaining, err := users.Get("acme/bob")
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), remaining)
+	_, remaining, err = orgs.Get("acme")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), remaining)
+	_, remaining, err = global.Get("global")
+	require.NoError(t, err)
+	require.Equal(t, uint64(17), remaining)
+
+	// another org still has capacity
+	info, err = store.TakeN("initech/carol", 3)
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+
+	require.NoError(t, store.Return("initech/carol", 3))
+	_, remaining, err = global.Get("global")
+	require.NoError(t, err)
+	require.Equal(t, uint64(17), remaining)
+}
+
+func TestCompositeStore_Peek(t *testing.T) {
+	t.Parallel()
+
+	store, _, _, global := newCompositeStore(t)
+	require.NoError(t, global.Set("global", 1, time.Hour))
+
+	info, err := store.Peek("acme/alice")
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+	require.Equal(t, uint64(1), info.LimitSize)
+
+	_, err = store.Take("acme/alice")
+	require.NoError(t, err)
+
+	// the global tier is exhausted, every key is rejected
+	info, err = store.Peek("initech/carol")
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+	require.Equal(t, uint64(1), info.LimitSize)
+
+	info, err = store.Take("initech/carol")
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+	_, remaining, err := store.Get("initech/carol")
+	require.NoError(t, err)
+	require.Zero(t, remaining)
+}
+
+func TestCompositeStore_Delay(t *testing.T) {
+	t.Parallel()
+
+	// the leaky bucket tier queues the requests, the window tier is the most
+	// restrictive one
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	shaped := limits.NewMemoryStore(&limits.Config{Limit: 10, Interval: time.Second, Algorithm: limits.AlgorithmLeakyBucket, MaxQueue: 5, Clock: clock})
+	window := limits.NewMemoryStore(&limits.Config{Limit: 3, Interval: time.Hour, Clock: clock})
+	store, err := limits.NewCompositeStore(
+		limits.Tier{Name: "shaped", Store: shaped},
+		limits.Tier{Name: "window", Store: window},
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	info, err := store.Take("key")
+	require.NoError(t, err)
+	require.Zero(t, info.Delay)
+
+	info, err = store.Take("key")
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+	require.Equal(t, uint64(3), info.LimitSize)
+	require.Equal(t, 100*time.Millisecond, info.Delay)
+
+	info, err = store.Peek("key")
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), info.LimitSize)
+	require.Equal(t, 200*time.Millisecond, info.Delay)
+}
+
+func TestCompositeStore_Set(t *testing.T) {
+	t.Parallel()
+
+	store, users, _, _ := newCompositeStore(t)
+
+	// an override only applies to the most specific tier
+	require.NoError(t, store.Set("acme/alice", 1, time.Hour))
+	limit, _, err := users.Get("acme/alice")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), limit)
+
+	info, err := store.Take("acme/alice")
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+	require.Zero(t, info.Remaining)
+}
+
+func TestCompositeStore_Closed(t *testing.T) {
+	t.Parallel()
+
+	_, err := limits.NewCompositeStore()
+	require.True(t, failure.IsInvalidParam(err))
+
+	_, err = limits.NewCompositeStore(limits.Tier{Name: "user"})
+	require.True(t, failure.IsInvalidParam(err))
+
+	store, err := limits.NewCompositeStore(limits.Tier{Name: "user", Store: limits.NewMemoryStore()})
+	require.NoError(t, err)
+	require.Equal(t, 1, store.Tiers())
+
+	require.NoError(t, store.Close())
+	require.NoError(t, store.Close())
+
+	_, err = store.Take("key")
+	require.True(t, failure.IsInvalidState(err))
+	_, err = store.Peek("key")
+	require.True(t, failure.IsInvalidState(err))
+	require.True(t, failure.IsInvalidState(store.Return("key", 1)))
+	require.True(t, failure.IsInvalidState(store.Set("key", 1, time.Hour)))
+}
+
+func TestMoreRestrictive(t *testing.T) {
+	t.Parallel()
+
+	ok := limits.RateInfo{Remaining: 5, Reset: 10, OperationOk: true}
+	require.True(t, limits.MoreRestrictive(limits.RateInfo{Remaining: 50}, ok))
+	require.True(t, limits.MoreRestrictive(limits.RateInfo{Remaining: 1, OperationOk: true}, ok))
+	require.True(t, limits.MoreRestrictive(limits.RateInfo{Remaining: 5, Reset: 20, OperationOk: true}, ok))
+	require.False(t, limits.MoreRestrictive(ok, ok))
+}
+
+// newCompositeStore creates a store allowing 3 tokens per user, 5 per org and
+// 20 in total, keys are "org/user"
+func newCompositeStore(t *testing.T) (*limits.CompositeStore, limits.Store, limits.Store, limits.Store) {
+	t.Helper()
+
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	users := limits.NewMemoryStore(&limits.Config{Limit: 3, Interval: time.Hour, Clock: clock})
+	orgs := limits.NewMemoryStore(&limits.Config{Limit: 5, Interval: time.Hour, Clock: clock})
+	global := limits.NewMemoryStore(&limits.Config{Limit: 20, Interval: time.Hour, Clock: clock})
+
+	store, err := limits.NewCompositeStore(
+		limits.Tier{Name: "user", Store: users},
+		limits.Tier{Name: "org", Store: orgs, Key: func(key string) string {
+			return strings.SplitN(key, "/", 2)[0]
+		}},
+		limits.Tier{Name: "global", Store: global, Key: func(string) string {
+			return "global"
+		}},
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	return store, users, orgs, global
+}
@@ -0,0 +1,118 @@
+package limits
+
+import "sync/atomic"
+
+// OverflowPolicy decides what happens to a new key when a store holding
+// Config.MaxKeys keys is full
+type OverflowPolicy string
+
+const (
+	// OverflowEvict evicts the least recently used key to make room
+	OverflowEvict OverflowPolicy = "evict"
+	// OverflowAdmit checks the new key against fresh limits without storing
+	// it, so it is never limited until room frees up
+	OverflowAdmit OverflowPolicy = "admit"
+	// OverflowReject rejects every request of a new key until room frees up
+	OverflowReject OverflowPolicy = "reject"
+
+	DefaultOverflowPolicy = OverflowEvict
+)
+
+func (p OverflowPolicy) String() string {
+	return string(p)
+}
+
+// IsValid reports whether the policy is one supported by this package
+func (p OverflowPolicy) IsValid() bool {
+	switch p {
+	case OverflowEvict, OverflowAdmit, OverflowReject:
+		return true
+	}
+
+	return false
+}
+
+// keyRing tracks the keys of a bounded store for CLOCK eviction, an
+// approximation of LRU that does not reorder a list on every hit. Each key
+// has a reference bit set when it is used. The hand sweeps the ring, clearing
+// set bits, and evicts the first key whose bit is already clear, so a key
+// survives a full turn of the hand after its last use.
+//
+// keys  - the keys in ring order
+// refs  - the reference bit of each key, set atomically under the read lock
+// slots - the position of each key in the ring
+// hand  - the next position the hand looks at
+//
+// touch only needs the store read lock, every other method needs the write lock.
+type keyRing struct {
+	keys  []string
+	refs  []uint32
+	slots map[string]int
+	hand  int
+}
+
+func newKeyRing(size int) *keyRing {
+	return &keyRing{
+		keys:  make([]string, 0, size),
+		refs:  make([]uint32, 0, size),
+		slots: make(map[string]int, size),
+	}
+}
+
+// touch marks the key as recently used
+func (r *keyRing) touch(key string) {
+	if i, ok := r.slots[key]; ok {
+		atomic.StoreUint32(&r.refs[i], 1)
+	}
+}
+
+// add places a new key in the ring, marked as recently used
+func (r *keyRing) add(key string) {
+	r.slots[key] = len(r.keys)
+	r.keys = append(r.keys, key)
+	r.refs = append(r.refs, 1)
+}
+
+// victim moves the hand to the first key not used since the hand last
+// passed it and returns that key
+func (r *keyRing) victim() string {
+	for {
+		if r.hand >= len(r.keys) {
+			r.hand = 0
+		}
+
+		if atomic.LoadUint32(&r.refs[r.hand]) == 0 {
+			return r.keys[r.hand]
+		}
+
+		atomic.StoreUint32(&r.refs[r.hand], 0)
+		r.hand++
+	}
+}
+
+// remove takes the key out of the ring by moving the last key into its slot
+func (r *keyRing) remove(key string) {
+	i, ok := r.slots[key]
+	if !ok {
+		return
+	}
+
+	last := len(r.keys) - 1
+	if i != last {
+		r.keys[i] = r.keys[last]
+		r.refs[i] = atomic.LoadUint32(&r.refs[last])
+		r.slots[r.keys[i]] = i
+	}
+
+	r.keys = r.keys[:last]
+	r.refs = r.refs[:last]
+	delete(r.slots, key)
+}
+
+// reset removes every key
+func (r *keyRing) reset() {
+	r.keys = r.keys[:0]
+	r.refs = r.refs[:0]
+	r.slots = make(map[string]int)
+	r.hand = 0
+}
@@ -0,0 +1,171 @@
+package limits_test
+
+import (
+	"fmt"
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/api_rate_limiter/foundation/limits/limitstest"
+	"github.com/rsb/failure"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore_MaxKeysEvict(t *testing.T) {
+	t.Parallel()
+
+	config := limits.Config{
+		Limit:       1,
+		Interval:    time.Minute,
+		TTLInterval: 24 * time.Hour,
+		MinTTL:      24 * time.Hour,
+		MaxKeys:     3,
+	}
+	store := limits.NewMemoryStore(&config)
+	t.Cleanup(func() {
+		err := store.Close()
+		require.NoError(t, err)
+	})
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		info, err := store.Take(key)
+		require.NoError(t, err)
+		require.True(t, info.OperationOk)
+	}
+	require.Equal(t, 3, store.Len())
+	requireStored(t, store, "a", false)
+
+	// c is used again, b is the least recently used
+	_, err := store.Take("c")
+	require.NoError(t, err)
+
+	_, err = store.Take("e")
+	require.NoError(t, err)
+	require.Equal(t, 3, store.Len())
+	requireStored(t, store, "b", false)
+	requireStored(t, store, "c", true)
+	requireStored(t, store, "d", true)
+	requireStored(t, store, "e", true)
+
+	// setting a new key evicts as well
+	require.NoError(t, store.Set("f", 10, time.Minute))
+	require.Equal(t, 3, store.Len())
+}
+
+func TestMemoryStore_MaxKeysAdmit(t *testing.T) {
+	t.Parallel()
+
+	config := limits.Config{
+		Limit:       1,
+		Interval:    time.Minute,
+		TTLInterval: 24 * time.Hour,
+		MinTTL:      24 * time.Hour,
+		MaxKeys:     2,
+		Overflow:    limits.OverflowAdmit,
+	}
+	store := limits.NewMemoryStore(&config)
+	t.Cleanup(func() {
+		err := store.Close()
+		require.NoError(t, err)
+	})
+
+	for _, key := range []string{"a", "b"} {
+		_, err := store.Take(key)
+		require.NoError(t, err)
+	}
+
+	// the new key gets fresh limits on every request but is never stored
+	for i := 0; i < 3; i++ {
+		info, err := store.Take("c")
+		require.NoError(t, err)
+		require.True(t, info.OperationOk)
+		require.Equal(t, uint64(0), info.Remaining)
+	}
+	require.Equal(t, 2, store.Len())
+	requireStored(t, store, "c", false)
+
+	// stored keys are still limited
+	info, err := store.Take("a")
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+
+	err = store.Set("c", 10, time.Minute)
+	require.True(t, failure.IsOutOfRange(err))
+}
+
+func TestMemoryStore_MaxKeysReject(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	config := limits.Config{
+		Limit:       1,
+		Interval:    time.Minute,
+		TTLInterval: time.Hour,
+		MinTTL:      time.Hour,
+		MaxKeys:     2,
+		Overflow:    limits.OverflowReject,
+		Algorithm:   limits.AlgorithmTokenBucket,
+		Clock:       clock,
+	}
+	store := limits.NewMemoryStore(&config)
+	t.Cleanup(func() {
+		err := store.Close()
+		require.NoError(t, err)
+	})
+
+	for _, key := range []string{"a", "b"} {
+		_, err := store.Take(key)
+		require.NoError(t, err)
+	}
+
+	info, err := store.Take("c")
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+	require.Equal(t, uint64(1), info.LimitSize)
+	require.Equal(t, uint64(time.Minute), info.Reset)
+
+	_, err = store.Reserve("c", 1)
+	require.True(t, failure.IsOutOfRange(err))
+
+	// once the stale keys are swept there is room again
+	clock.Add(2 * time.Hour)
+	store.Sweep()
+
+	info, err = store.Take("c")
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+}
+
+func TestShardedStore_MaxKeys(t *testing.T) {
+	t.Parallel()
+
+	config := limits.Config{
+		Limit:       1,
+		Interval:    time.Minute,
+		TTLInterval: 24 * time.Hour,
+		MinTTL:      24 * time.Hour,
+		Shards:      4,
+		MaxKeys:     8,
+	}
+	store := limits.NewShardedStore(&config)
+	t.Cleanup(func() {
+		err := store.Close()
+		require.NoError(t, err)
+	})
+
+	for i := 0; i < 100; i++ {
+		_, err := store.Take(fmt.Sprintf("key-%d", i))
+		require.NoError(t, err)
+	}
+
+	require.True(t, store.Len() <= 8)
+}
+
+// requireStored checks whether the store holds the key, unknown keys report
+// a zero limit
+func requireStored(t *testing.T, store limits.Store, key string, stored bool) {
+	t.Helper()
+
+	limit, _, err := store.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, stored, limit > 0, "key (%s)", key)
+}
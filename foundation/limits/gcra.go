@@ -0,0 +1,259 @@
+package limits
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// GCRARate holds the parameters of the generic cell rate algorithm. It is
+// shared by every key using the same limit, so the only per key state is the
+// theoretical arrival time kept by GCRA.
+//
+// limit     - the number of requests permitted per interval
+// interval  - the configured interval, emission is rounded down from it
+// burst     - the number of requests that can be made back to back
+// emission  - nanoseconds between two requests at the sustained rate
+// tolerance - nanoseconds a request may arrive ahead of its theoretical
+// 						 arrival time, burst * emission
+// clock     - source of the current time
+type GCRARate struct {
+	clock     Clock
+	limit     uint64
+	interval  time.Duration
+	burst     uint64
+	emission  uint64
+	tolerance uint64
+}
+
+// NewGCRARate spaces limit requests evenly across the interval and allows
+// burst of them to be made back to back. burst defaults to limit. A nil clock
+// uses the SystemClock.
+func NewGCRARate(clock Clock, limit uint64, interval time.Duration, burst uint64) *GCRARate {
+	if burst == 0 {
+		burst = limit
+	}
+
+	emission := uint64(interval) / limit
+	if emission == 0 {
+		emission = 1
+	}
+
+	return &GCRARate{
+		clock:     clockOrSystem(clock),
+		limit:     limit,
+		interval:  interval,
+		burst:     burst,
+		emission:  emission,
+		tolerance: burst * emission,
+	}
+}
+
+// GCRA is the generic cell rate algorithm. Instead of counting tokens it
+// keeps a single theoretical arrival time (tat), the time at which the key
+// would be back to its full burst. Each request pushes the tat forward by the
+// emission interval and is rejected when that would put it further than the
+// tolerance ahead of now. The tat is updated with a compare and swap so no
+// lock is needed.
+type GCRA struct {
+	tat  uint64
+	rate *GCRARate
+}
+
+func NewGCRA(rate *GCRARate) *GCRA {
+	return &GCRA{rate: rate}
+}
+
+func (g *GCRA) Get() (uint64, uint64) {
+	info := g.Peek()
+	return info.LimitSize, info.Remaining
+}
+
+// Peek reports the requests that can be accepted now without moving the
+// theoretical arrival time
+func (g *GCRA) Peek() RateInfo {
+	r := g.rate
+	now := unixNano(r.clock)
+
+	tat := atomic.LoadUint64(&g.tat)
+	if tat < now {
+		tat = now
+	}
+
+	remaining := r.remaining(now, tat)
+	reset := tat
+	if remaining == 0 {
+		reset = tat + r.emission - r.tolerance
+	}
+
+	return RateInfo{
+		LimitSize:   r.burst,
+		Remaining:   remaining,
+		Reset:       reset,
+		OperationOk: remaining > 0,
+	}
+}
+
+// LastActive is the theoretical arrival time, which is never before the
+// last accepted request
+func (g *GCRA) LastActive() uint64 {
+	return atomic.LoadUint64(&g.tat)
+}
+
+// State is the theoretical arrival time and rate as saved in a snapshot
+func (g *GCRA) State() LimiterState {
+	r := g.rate
+	return LimiterState{
+		Limit:    r.limit,
+		Interval: r.interval,
+		Burst:    r.burst,
+		At:       atomic.LoadUint64(&g.tat),
+	}
+}
+
+// restoreGCRA creates a gcra using the rate from its snapshot state
+func restoreGCRA(rate *GCRARate, s LimiterState) *GCRA {
+	return &GCRA{tat: s.At, rate: rate}
+}
+
+// RateInfo accepts a single request, see TakeN
+func (g *GCRA) RateInfo() RateInfo {
+	return g.TakeN(1)
+}
+
+// TakeN accepts a request costing n emission intervals when its theoretical
+// arrival time is within the tolerance. Reset is the time the key is back to
+// its full burst or, when no requests are left, the time the next request
+// will be accepted.
+func (g *GCRA) TakeN(n uint64) RateInfo {
+	r := g.rate
+	for {
+		now := unixNano(r.clock)
+		old := atomic.LoadUint64(&g.tat)
+
+		tat := old
+		if tat < now {
+			tat = now
+		}
+
+		next := tat + n*r.emission
+		if next > now+r.tolerance {
+			return RateInfo{
+				LimitSize:   r.burst,
+				Remaining:   r.remaining(now, old),
+				Reset:       next - r.tolerance,
+				OperationOk: false,
+			}
+		}
+
+		if !atomic.CompareAndSwapUint64(&g.tat, old, next) {
+			continue
+		}
+
+		remaining := r.remaining(now, next)
+		reset := next
+		if remaining == 0 {
+			reset = next + r.emission - r.tolerance
+		}
+
+		return RateInfo{
+			LimitSize:   r.burst,
+			Remaining:   remaining,
+			Reset:       reset,
+			OperationOk: true,
+		}
+	}
+}
+
+// Return moves the theoretical arrival time back by n emission intervals,
+// never before now which is the full burst
+func (g *GCRA) Return(n uint64) {
+	for {
+		now := unixNano(g.rate.clock)
+		old := atomic.LoadUint64(&g.tat)
+		if atomic.CompareAndSwapUint64(&g.tat, old, g.rate.back(old, now, n)) {
+			return
+		}
+	}
+}
+
+// Reserve pushes the theoretical arrival time forward by n emission
+// intervals even when that goes beyond the tolerance. The reservation must
+// wait until the arrival time is back within the tolerance. It is not ok when
+// n is larger than the burst.
+func (g *GCRA) Reserve(n uint64) *Reservation {
+	r := g.rate
+	if n > r.burst {
+		return &Reservation{limit: r.burst, tokens: n}
+	}
+
+	for {
+		now := unixNano(r.clock)
+		old := atomic.LoadUint64(&g.tat)
+
+		tat := old
+		if tat < now {
+			tat = now
+		}
+
+		next := tat + n*r.emission
+		if !atomic.CompareAndSwapUint64(&g.tat, old, next) {
+			continue
+		}
+
+		timeToAct := now
+		if next > now+r.tolerance {
+			timeToAct = next - r.tolerance
+		}
+
+		return &Reservation{
+			clock:     r.clock,
+			ok:        true,
+			limit:     r.burst,
+			tokens:    n,
+			timeToAct: timeToAct,
+			cancel: func() {
+				g.cancel(n, timeToAct)
+			},
+		}
+	}
+}
+
+// cancel moves the theoretical arrival time back by n emission intervals,
+// never before now, as long as the reservation has not been acted on
+func (g *GCRA) cancel(n, timeToAct uint64) {
+	for {
+		now := unixNano(g.rate.clock)
+		if now >= timeToAct {
+			return
+		}
+
+		old := atomic.LoadUint64(&g.tat)
+		if atomic.CompareAndSwapUint64(&g.tat, old, g.rate.back(old, now, n)) {
+			return
+		}
+	}
+}
+
+// back is the theoretical arrival time moved back by n emission intervals,
+// never before now
+func (r *GCRARate) back(tat, now, n uint64) uint64 {
+	if d := n * r.emission; tat > now+d {
+		return tat - d
+	}
+
+	return now
+}
+
+// remaining is the number of requests that can be accepted at now for the
+// given theoretical arrival time
+func (r *GCRARate) remaining(now, tat uint64) uint64 {
+	if tat < now {
+		tat = now
+	}
+
+	if tat >= now+r.tolerance {
+		return 0
+	}
+
+	return (now + r.tolerance - tat) / r.emission
+}
@@ -0,0 +1,110 @@
+package limits_test
+
+import (
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/api_rate_limiter/foundation/limits/limitstest"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGCRA_Burst(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	g := limits.NewGCRA(limits.NewGCRARate(clock, 10, time.Minute, 3))
+
+	for i := uint64(1); i <= 3; i++ {
+		info := g.RateInfo()
+		require.True(t, info.OperationOk)
+		require.Equal(t, uint64(3), info.LimitSize)
+		require.Equal(t, 3-i, info.Remaining)
+	}
+
+	info := g.RateInfo()
+	require.False(t, info.OperationOk)
+	require.Equal(t, uint64(0), info.Remaining)
+
+	// the next request is accepted one emission interval (6s) later
+	wait := time.Duration(info.Reset - uint64(clock.Now().UnixNano()))
+	require.Equal(t, 6*time.Second, wait)
+
+	limit, remaining := g.Get()
+	require.Equal(t, uint64(3), limit)
+	require.Equal(t, uint64(0), remaining)
+}
+
+func TestGCRA_Spacing(t *testing.T) {
+	t.Parallel()
+
+	// one request every 20ms with no burst beyond a single request
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	g := limits.NewGCRA(limits.NewGCRARate(clock, 50, time.Second, 1))
+	require.True(t, g.RateInfo().OperationOk)
+	require.False(t, g.RateInfo().OperationOk)
+
+	clock.Add(20 * time.Millisecond)
+	require.True(t, g.RateInfo().OperationOk)
+	require.False(t, g.RateInfo().OperationOk)
+}
+
+func TestGCRA_Concurrent(t *testing.T) {
+	t.Parallel()
+
+	g := limits.NewGCRA(limits.NewGCRARate(nil, 100, time.Hour, 100))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if g.RateInfo().OperationOk {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, 100, accepted)
+}
+
+func TestMemoryStore_GCRAAlgorithm(t *testing.T) {
+	t.Parallel()
+
+	config := limits.Config{
+		Limit:       5,
+		Interval:    time.Minute,
+		Burst:       2,
+		Algorithm:   limits.AlgorithmGCRA,
+		TTLInterval: 24 * time.Hour,
+		MinTTL:      24 * time.Hour,
+	}
+
+	store := limits.NewMemoryStore(&config)
+	go store.GarbageCollector()
+
+	t.Cleanup(func() {
+		err := store.Close()
+		require.NoError(t, err)
+	})
+
+	for i := 0; i < 2; i++ {
+		info, err := store.Take("my-key")
+		require.NoError(t, err)
+		require.True(t, info.OperationOk)
+	}
+
+	info, err := store.Take("my-key")
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+
+	// other keys have their own arrival time
+	info, err = store.Take("other-key")
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+}
@@ -0,0 +1,804 @@
+package limits
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/rsb/failure"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	GossipPath            = "/limits/v1/gossip"
+	DefaultGossipInterval = 200 * time.Millisecond
+)
+
+// gossipBatch is the max number of entries of a message. The keys are read
+// from requests whose headers are bounded by the server, so a batch stays
+// well under MaxPeerBodySize.
+const gossipBatch = 256
+
+var _ Store = (*GossipStore)(nil)
+
+// GossipConfig controls how an instance exchanges its usage with its peers
+//
+// Self            - host:port the other peers reach the Handler of this
+// 									 instance at, also its id in the counters
+// Secret          - shared by the peers, sent on every call and required by
+// 									 the Handler, which refuses the calls without it
+// Discovery       - lists the peers, no peers when nil
+// Interval        - how often the usage is sent to the peers, defaults to
+// 									 DefaultGossipInterval. The overshoot of a limit is bounded
+// 									 by what the other peers admit during one interval
+// RefreshInterval - how often the peers are listed again, defaults to
+// 									 DefaultClusterRefresh
+// Timeout         - timeout of a call to a peer and of the first listing of
+// 									 the peers, defaults to DefaultClusterTimeout
+// Client          - http client used to call the peers, defaults to a client
+// 									 of the default transport
+// GossipFailed    - called when the usage could not be sent to a peer, it is
+// 									 sent again on the next interval
+// RefreshFailed   - called when the peers could not be listed, the previous
+// 									 peers are kept
+type GossipConfig struct {
+	Self            string
+	Secret          string
+	Discovery       PeerDiscovery
+	Interval        time.Duration
+	RefreshInterval time.Duration
+	Timeout         time.Duration
+	Client          *http.Client
+	GossipFailed    func(peer string, err error)
+	RefreshFailed   func(err error)
+}
+
+// GossipStore enforces approximate global limits with no extra hop on the
+// request path. Every instance admits requests against its local view of
+// the usage of a key and regularly sends the usage of its own requests to
+// its peers, which lower their remaining tokens by it.
+//
+// The usage of a key is a PN-counter: a grow only counter (G-counter) of the
+// tokens taken and another of the tokens returned, each holding a count per
+// peer. Counters are merged by keeping the highest count of every peer, so
+// a usage received twice or out of order is never counted twice. Windows are
+// fixed and aligned on unix epoch so every peer agrees on the current window
+// of a key. Only the counts a peer has not received yet are sent to it, so a
+// peer that is down does not hold back the others, and the usage is sent in
+// batches of messages a peer accepts.
+//
+// A limit is overshot by at most what the other peers admit before their
+// usage is received, roughly one gossip interval of traffic per peer.
+type GossipStore struct {
+	clock    Clock
+	limit    uint64
+	interval time.Duration
+	ttl      TTL
+
+	self     string
+	secret   string
+	discover PeerDiscovery
+	every    time.Duration
+	refresh  time.Duration
+	timeout  time.Duration
+	client   *http.Client
+
+	gossipFailed  func(peer string, err error)
+	refreshFailed func(err error)
+
+	data  map[string]*GCounter
+	peers []string
+	lock  sync.RWMutex
+
+	stopped uint32
+	stop    chan struct{}
+}
+
+// NewGossipStore creates a store using the limit, interval, TTL and clock of
+// the config. Only the fixed window algorithm is supported. The peers are
+// listed once before returning, within Timeout, a failure is reported to
+// RefreshFailed.
+func NewGossipStore(config *Config, gossip GossipConfig) (*GossipStore, error) {
+	defaults := NewDefaultConfig()
+	if config == nil {
+		config = defaults
+	}
+
+	if config.Algorithm != "" && config.Algorithm != AlgorithmFixedWindow {
+		return nil, failure.InvalidParam("algorithm (%s) is not supported by the gossip store, only (%s)", config.Algorithm, AlgorithmFixedWindow)
+	}
+
+	if gossip.Self == "" {
+		return nil, failure.InvalidParam("gossip.Self is empty")
+	}
+
+	if gossip.Secret == "" {
+		return nil, failure.InvalidParam("gossip.Secret is empty")
+	}
+
+	tokens := defaults.Limit
+	if config.Limit > 0 {
+		tokens = config.Limit
+	}
+
+	interval := defaults.Interval
+	if config.Interval > 0 {
+		interval = config.Interval
+	}
+
+	sweepInterval := defaults.TTLInterval
+	if config.TTLInterval > 0 {
+		sweepInterval = config.TTLInterval
+	}
+
+	sweepMinTTL := defaults.MinTTL
+	if config.MinTTL > 0 {
+		sweepMinTTL = config.MinTTL
+	}
+
+	clock := defaults.Clock
+	if config.Clock != nil {
+		clock = config.Clock
+	}
+
+	discover := gossip.Discovery
+	if discover == nil {
+		discover = StaticPeers()
+	}
+
+	every := DefaultGossipInterval
+	if gossip.Interval > 0 {
+		every = gossip.Interval
+	}
+
+	refresh := DefaultClusterRefresh
+	if gossip.RefreshInterval > 0 {
+		refresh = gossip.RefreshInterval
+	}
+
+	timeout := DefaultClusterTimeout
+	if gossip.Timeout > 0 {
+		timeout = gossip.Timeout
+	}
+
+	client := gossip.Client
+	if client == nil {
+		client = &http.Client{}
+	}
+
+	s := GossipStore{
+		clock:         clock,
+		limit:         tokens,
+		interval:      interval,
+		ttl:           NewTTL(sweepInterval, uint64(sweepMinTTL)),
+		self:          gossip.Self,
+		secret:        gossip.Secret,
+		discover:      discover,
+		every:         every,
+		refresh:       refresh,
+		timeout:       timeout,
+		client:        client,
+		gossipFailed:  gossip.GossipFailed,
+		refreshFailed: gossip.RefreshFailed,
+		data:          make(map[string]*GCounter),
+		stop:          make(chan struct{}),
+	}
+
+	s.refreshPeers(s.timeout)
+
+	return &s, nil
+}
+
+// Refresh lists the peers usage is sent to, this instance is never one of
+// them
+func (s *GossipStore) Refresh(ctx context.Context) error {
+	list, err := s.discover(ctx)
+	if err != nil {
+		return failure.Wrap(err, "s.discover failed")
+	}
+
+	unique := make(map[string]struct{}, len(list))
+	peers := make([]string, 0, len(list))
+	for _, p := range list {
+		if _, ok := unique[p]; ok || p == "" || p == s.self {
+			continue
+		}
+		unique[p] = struct{}{}
+		peers = append(peers, p)
+	}
+	sort.Strings(peers)
+
+	s.lock.Lock()
+	s.peers = peers
+	s.lock.Unlock()
+
+	return nil
+}
+
+// Peers is the sorted list of peers usage is sent to
+func (s *GossipStore) Peers() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	peers := make([]string, len(s.peers))
+	copy(peers, s.peers)
+	return peers
+}
+
+// Take consumes a single token for the key
+func (s *GossipStore) Take(key string) (RateInfo, error) {
+	return s.TakeN(key, 1)
+}
+
+// TakeN consumes n tokens for the key when the usage known to this instance
+// leaves room for them
+func (s *GossipStore) TakeN(key string, n uint64) (RateInfo, error) {
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return RateInfo{}, failure.InvalidState("GossipStore is stopped")
+	}
+
+	return s.counter(key).TakeN(unixNano(s.clock), s.self, n), nil
+}
+
+// Peek reports the state of the key known to this instance without taking
+// a token
+func (s *GossipStore) Peek(key string) (RateInfo, error) {
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return RateInfo{}, failure.InvalidState("GossipStore is stopped")
+	}
+
+	s.lock.RLock()
+	c, ok := s.data[key]
+	s.lock.RUnlock()
+
+	if !ok {
+		c = NewGCounter(s.limit, s.interval)
+	}
+
+	return c.Peek(unixNano(s.clock)), nil
+}
+
+// Return gives n tokens back to the key, the peers learn about it on the
+// next interval. It is a no-op for keys the store does not hold.
+func (s *GossipStore) Return(key string, n uint64) error {
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return failure.InvalidState("GossipStore is stopped")
+	}
+
+	s.lock.RLock()
+	c, ok := s.data[key]
+	s.lock.RUnlock()
+
+	if ok {
+		c.Return(unixNano(s.clock), s.self, n)
+	}
+
+	return nil
+}
+
+// Get returns the limit and remaining tokens of the key, zero values when the
+// key has not been seen
+func (s *GossipStore) Get(key string) (uint64, uint64, error) {
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return 0, 0, failure.InvalidState("GossipStore is stopped")
+	}
+
+	s.lock.RLock()
+	c, ok := s.data[key]
+	s.lock.RUnlock()
+
+	if !ok {
+		return 0, 0, nil
+	}
+
+	info := c.Peek(unixNano(s.clock))
+	return info.LimitSize, info.Remaining, nil
+}
+
+// Set replaces the limit and interval used by the key on this instance. The
+// limits are not sent to the peers, every instance must set the same limits
+// for their usage to add up.
+func (s *GossipStore) Set(key string, tokens uint64, interval time.Duration) error {
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return failure.InvalidState("GossipStore is stopped")
+	}
+
+	if tokens == 0 || interval <= 0 {
+		return failure.InvalidParam("tokens (%d) and interval (%s) must be positive", tokens, interval)
+	}
+
+	s.lock.Lock()
+	s.data[key] = NewGCounter(tokens, interval)
+	s.lock.Unlock()
+
+	return nil
+}
+
+// Close stops the garbage collector, the usage not sent yet is lost
+func (s *GossipStore) Close() error {
+	if !atomic.CompareAndSwapUint32(&s.stopped, 0, 1) {
+		return nil
+	}
+
+	close(s.stop)
+
+	s.lock.Lock()
+	s.data = make(map[string]*GCounter)
+	s.lock.Unlock()
+
+	return nil
+}
+
+// GarbageCollector sends the usage to the peers on every gossip interval,
+// lists the peers again on every refresh interval and purges the stale keys
+// on every TTL interval until Close is called
+func (s *GossipStore) GarbageCollector() {
+	gossip := time.NewTicker(s.every)
+	defer gossip.Stop()
+
+	refresh := time.NewTicker(s.refresh)
+	defer refresh.Stop()
+
+	sweep := time.NewTicker(s.ttl.Interval)
+	defer sweep.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-gossip.C:
+			s.gossip()
+		case <-refresh.C:
+			s.refreshPeers(s.refresh)
+		case <-sweep.C:
+			s.Sweep()
+		}
+	}
+}
+
+// Gossip sends to every peer the usage it has not received yet. The usage
+// stays pending for a peer that could not be reached, so it is sent again on
+// the next call, until its window ends.
+func (s *GossipStore) Gossip(ctx context.Context) error {
+	var result error
+	for _, p := range s.Peers() {
+		if err := s.gossipTo(ctx, p); err != nil {
+			result = failure.Append(result, err)
+			if s.gossipFailed != nil {
+				s.gossipFailed(p, err)
+			}
+		}
+	}
+
+	return result
+}
+
+// Handler receives the usage sent by the other peers on GossipPath, the
+// calls without the secret of the peers are refused. It should only be
+// reachable by the peers.
+func (s *GossipStore) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(GossipPath, s.serve)
+	return mux
+}
+
+// Sweep purges the keys whose usage has not changed for longer than the TTL
+// and has been sent to the peers, or whose window ended. The stale keys are
+// found under the read lock, so requests are only held back while they are
+// deleted.
+func (s *GossipStore) Sweep() {
+	now := unixNano(s.clock)
+	peers := s.Peers()
+
+	var stale []string
+	s.lock.RLock()
+	for k, c := range s.data {
+		if c.isStale(now, s.ttl.Value, s.self, peers) {
+			stale = append(stale, k)
+		}
+	}
+	s.lock.RUnlock()
+
+	if len(stale) == 0 {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// The key may have been replaced or used since the read lock was released
+	for _, k := range stale {
+		if c, ok := s.data[k]; ok && c.isStale(now, s.ttl.Value, s.self, peers) {
+			delete(s.data, k)
+		}
+	}
+}
+
+// Len is the number of keys held by the store
+func (s *GossipStore) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return len(s.data)
+}
+
+func (s *GossipStore) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !peerAuthorized(r, s.secret) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var msg gossipMessage
+	body := http.MaxBytesReader(w, r.Body, MaxPeerBodySize)
+	if err := json.NewDecoder(body).Decode(&msg); err != nil || msg.Peer == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if msg.Peer == s.self {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	now := unixNano(s.clock)
+	for _, e := range msg.Entries {
+		s.counter(e.Key).Merge(now, msg.Peer, e.Window, e.Taken, e.Returned)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// counter returns the counter of the key, creating it with the store limits
+// when the key is new
+func (s *GossipStore) counter(key string) *GCounter {
+	s.lock.RLock()
+	c, ok := s.data[key]
+	s.lock.RUnlock()
+	if ok {
+		return c
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if c, ok = s.data[key]; ok {
+		return c
+	}
+
+	c = NewGCounter(s.limit, s.interval)
+	s.data[key] = c
+	return c
+}
+
+// gossipTo sends the usage the peer has not received yet, in batches. The
+// batches sent before a failure are not sent again.
+func (s *GossipStore) gossipTo(ctx context.Context, peer string) error {
+	entries := s.pending(peer)
+	for len(entries) > 0 {
+		n := len(entries)
+		if n > gossipBatch {
+			n = gossipBatch
+		}
+
+		msg := gossipMessage{Peer: s.self, Entries: entries[:n]}
+		body, err := json.Marshal(&msg)
+		if err != nil {
+			return failure.ToSystem(err, "json.Marshal failed")
+		}
+
+		if err = s.send(ctx, peer, body); err != nil {
+			return err
+		}
+
+		s.sent(peer, msg.Entries)
+		entries = entries[n:]
+	}
+
+	return nil
+}
+
+// pending is the usage of this instance the peer has not received yet
+func (s *GossipStore) pending(peer string) []gossipEntry {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var entries []gossipEntry
+	for k, c := range s.data {
+		if e, ok := c.pending(s.self, peer); ok {
+			e.Key = k
+			entries = append(entries, e)
+		}
+	}
+
+	return entries
+}
+
+// sent records the entries as received by the peer
+func (s *GossipStore) sent(peer string, entries []gossipEntry) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, e := range entries {
+		if c, ok := s.data[e.Key]; ok {
+			c.sent(peer, e)
+		}
+	}
+}
+
+func (s *GossipStore) send(ctx context.Context, peer string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+peer+GossipPath, bytes.NewReader(body))
+	if err != nil {
+		return failure.ToSystem(err, "http.NewRequestWithContext failed for (%s)", peer)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(PeerSecretHeader, s.secret)
+
+	resp, err := s.client.Do(r)
+	if err != nil {
+		return failure.ToSystem(err, "s.client.Do failed for (%s)", peer)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return failure.System("peer (%s) failed with status (%d)", peer, resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (s *GossipStore) gossip() {
+	_ = s.Gossip(context.Background())
+}
+
+// refreshPeers lists the peers again, giving up after the timeout
+func (s *GossipStore) refreshPeers(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := s.Refresh(ctx); err != nil && s.refreshFailed != nil {
+		s.refreshFailed(err)
+	}
+}
+
+// gossipMessage is the usage of the sending peer
+type gossipMessage struct {
+	Peer    string        `json:"peer"`
+	Entries []gossipEntry `json:"entries"`
+}
+
+// gossipEntry is the usage of a key by the sending peer in a window
+type gossipEntry struct {
+	Key      string `json:"key"`
+	Window   uint64 `json:"window"`
+	Taken    uint64 `json:"taken"`
+	Returned uint64 `json:"returned,omitempty"`
+}
+
+// GCounter is the usage of a key in its current window, a PN-counter made
+// of a grow only counter of the tokens taken and one of the tokens returned,
+// each holding a count per peer. Windows are aligned on unix epoch.
+//
+// limit      - the max number of tokens in a window
+// interval   - the length of a window
+// window     - the current window, counted from unix epoch
+// taken      - tokens taken in the window by every peer
+// returned   - tokens returned in the window by every peer
+// acked      - the counts of this instance in the window last received by
+// 							every peer
+// lastActive - nanoseconds from unix epoch of the last change
+type GCounter struct {
+	limit      uint64
+	interval   time.Duration
+	window     uint64
+	taken      map[string]uint64
+	returned   map[string]uint64
+	acked      map[string]gossipEntry
+	lastActive uint64
+	lock       sync.Mutex
+}
+
+// NewGCounter creates an empty counter
+func NewGCounter(limit uint64, interval time.Duration) *GCounter {
+	return &GCounter{
+		limit:    limit,
+		interval: interval,
+		taken:    map[string]uint64{},
+		returned: map[string]uint64{},
+		acked:    map[string]gossipEntry{},
+	}
+}
+
+// TakeN adds n to the tokens taken by the peer when the usage of every peer
+// leaves room for them
+func (c *GCounter) TakeN(now uint64, peer string, n uint64) RateInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.roll(now)
+
+	used := c.used()
+	ok := used+n <= c.limit
+	if ok {
+		c.taken[peer] += n
+		c.lastActive = now
+		used += n
+	}
+
+	return c.rateInfo(used, ok)
+}
+
+// Peek reports the usage of the current window without taking a token
+func (c *GCounter) Peek(now uint64) RateInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	window := now / uint64(c.interval)
+	if window > c.window {
+		return c.rateInfoAt(window, 0, c.limit > 0)
+	}
+
+	used := c.used()
+	return c.rateInfo(used, used < c.limit)
+}
+
+// Return adds n to the tokens returned by the peer, never more than it took
+// in the current window
+func (c *GCounter) Return(now uint64, peer string, n uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.roll(now)
+
+	if room := c.taken[peer] - c.returned[peer]; n > room {
+		n = room
+	}
+
+	if n > 0 {
+		c.returned[peer] += n
+		c.lastActive = now
+	}
+}
+
+// Merge keeps the highest counts of the peer for the window. Counts of a
+// window older than the current one are ignored.
+func (c *GCounter) Merge(now uint64, peer string, window, taken, returned uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.roll(now)
+	if window < c.window {
+		return
+	}
+
+	// the peer is ahead, its clock rolled over first
+	if window > c.window {
+		c.reset(window)
+	}
+
+	if taken > c.taken[peer] {
+		c.taken[peer] = taken
+	}
+	if returned > c.returned[peer] {
+		c.returned[peer] = returned
+	}
+	c.lastActive = now
+}
+
+// roll starts the window of now when the current one is over
+func (c *GCounter) roll(now uint64) {
+	if window := now / uint64(c.interval); window > c.window {
+		c.reset(window)
+	}
+}
+
+func (c *GCounter) reset(window uint64) {
+	c.window = window
+	c.taken = map[string]uint64{}
+	c.returned = map[string]uint64{}
+	c.acked = map[string]gossipEntry{}
+}
+
+// used is the tokens taken minus the tokens returned by every peer
+func (c *GCounter) used() uint64 {
+	var taken, returned uint64
+	for _, n := range c.taken {
+		taken += n
+	}
+	for _, n := range c.returned {
+		returned += n
+	}
+
+	if returned > taken {
+		return 0
+	}
+
+	return taken - returned
+}
+
+func (c *GCounter) rateInfo(used uint64, ok bool) RateInfo {
+	return c.rateInfoAt(c.window, used, ok)
+}
+
+func (c *GCounter) rateInfoAt(window, used uint64, ok bool) RateInfo {
+	var remaining uint64
+	if used < c.limit {
+		remaining = c.limit - used
+	}
+
+	return RateInfo{
+		LimitSize:   c.limit,
+		Remaining:   remaining,
+		Reset:       (window + 1) * uint64(c.interval),
+		OperationOk: ok,
+	}
+}
+
+// pending is the usage of self in the current window when the peer has not
+// received it yet
+func (c *GCounter) pending(self, peer string) (gossipEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.unacked(self, peer)
+}
+
+// sent records the usage as received by the peer, unless it already
+// received more recent counts
+func (c *GCounter) sent(peer string, e gossipEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e.Key = ""
+	acked := c.acked[peer]
+	if c.window == e.Window && e.Taken >= acked.Taken && e.Returned >= acked.Returned {
+		c.acked[peer] = e
+	}
+}
+
+// isStale reports whether the counter has not changed for longer than the
+// ttl and either its window ended, the peers drop the usage of an ended
+// window, or every peer received the usage of self
+func (c *GCounter) isStale(now, ttl uint64, self string, peers []string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if now <= c.lastActive || now-c.lastActive <= ttl {
+		return false
+	}
+
+	if now/uint64(c.interval) > c.window {
+		return true
+	}
+
+	for _, p := range peers {
+		if _, ok := c.unacked(self, p); ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// unacked is the usage of self in the current window when the peer has not
+// received it yet, the lock must be held
+func (c *GCounter) unacked(self, peer string) (gossipEntry, bool) {
+	e := gossipEntry{Window: c.window, Taken: c.taken[self], Returned: c.returned[self]}
+	if e.Taken == 0 && e.Returned == 0 {
+		return gossipEntry{}, false
+	}
+
+	return e, c.acked[peer] != e
+}
@@ -0,0 +1,384 @@
+package limits_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/api_rate_limiter/foundation/limits/limitstest"
+	"github.com/rsb/failure"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGossipStore_SharesUsage(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(3600, 0))
+	peers := newGossipCluster(t, 3, &limits.Config{Limit: 10, Interval: time.Hour, Clock: clock})
+
+	for i := 0; i < 3; i++ {
+		_, err := peers[0].Take("key")
+		require.NoError(t, err)
+	}
+	_, err := peers[1].TakeN("key", 2)
+	require.NoError(t, err)
+
+	// before the usage is exchanged each instance only knows its own
+	_, remaining, err := peers[2].Get("key")
+	require.NoError(t, err)
+	require.Zero(t, remaining)
+
+	gossip(t, peers)
+	for _, store := range peers {
+		limit, remaining, err := store.Get("key")
+		require.NoError(t, err)
+		require.Equal(t, uint64(10), limit)
+		require.Equal(t, uint64(5), remaining)
+	}
+
+	// usage received twice is not counted twice
+	_, err = peers[0].Take("key")
+	require.NoError(t, err)
+	gossip(t, peers)
+	gossip(t, peers)
+
+	info, err := peers[2].TakeN("key", 5)
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+	require.Equal(t, uint64(4), info.Remaining)
+	require.Equal(t, uint64(time.Unix(7200, 0).UnixNano()), info.Reset)
+
+	require.NoError(t, peers[0].Return("key", 2))
+	gossip(t, peers)
+	info, err = peers[2].TakeN("key", 6)
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+	require.Zero(t, info.Remaining)
+
+	gossip(t, peers)
+	info, err = peers[1].Peek("key")
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+
+	// windows are aligned on unix epoch, every instance rolls over at once
+	clock.Add(time.Hour)
+	for _, store := range peers {
+		info, err = store.Take("key")
+		require.NoError(t, err)
+		require.True(t, info.OperationOk)
+	}
+	gossip(t, peers)
+	_, remaining, err = peers[0].Get("key")
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), remaining)
+}
+
+func TestGossipStore_BoundedOvershoot(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	peers := newGossipCluster(t, 3, &limits.Config{Limit: 10, Interval: time.Hour, Clock: clock})
+
+	// between two intervals each instance admits against what it knows
+	allowed := 0
+	for round := 0; round < 5; round++ {
+		for _, store := range peers {
+			info, err := store.TakeN("key", 2)
+			require.NoError(t, err)
+			if info.OperationOk {
+				allowed += 2
+			}
+		}
+		gossip(t, peers)
+	}
+
+	require.GreaterOrEqual(t, allowed, 10)
+	require.LessOrEqual(t, allowed, 10+2*(len(peers)-1))
+}
+
+func TestGossipStore_PeerDown(t *testing.T) {
+	t.Parallel()
+
+	down := unusedAddr(t)
+	var failed int64
+	store, err := limits.NewGossipStore(&limits.Config{Limit: 5, Interval: time.Hour}, limits.GossipConfig{
+		Self:      "127.0.0.1:1",
+		Secret:    testPeerSecret,
+		Discovery: limits.StaticPeers(down, "127.0.0.1:1", down),
+		GossipFailed: func(peer string, err error) {
+			require.Equal(t, down, peer)
+			atomic.AddInt64(&failed, 1)
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+	require.Equal(t, []string{down}, store.Peers())
+
+	// nothing to send
+	require.NoError(t, store.Gossip(context.Background()))
+
+	_, err = store.Take("key")
+	require.NoError(t, err)
+
+	// the usage stays pending until a peer receives it
+	require.True(t, failure.IsSystem(store.Gossip(context.Background())))
+	require.Error(t, store.Gossip(context.Background()))
+	require.Equal(t, int64(2), atomic.LoadInt64(&failed))
+}
+
+func TestGossipStore_Sweep(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	config := limits.Config{Limit: 5, Interval: time.Minute, MinTTL: time.Hour, Clock: clock}
+	store, err := limits.NewGossipStore(&config, limits.GossipConfig{
+		Self:      "127.0.0.1:1",
+		Secret:    testPeerSecret,
+		Discovery: limits.StaticPeers(unusedAddr(t)),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	_, err = store.Take("key")
+	require.NoError(t, err)
+	require.NoError(t, store.Set("long", 5, 3*time.Hour))
+	_, err = store.Take("long")
+	require.NoError(t, err)
+	require.NoError(t, store.Set("custom", 50, time.Hour))
+	require.Equal(t, 3, store.Len())
+
+	// the usage of long is pending until sent, the window of key ended and
+	// its usage is dropped by the peers anyway
+	require.Error(t, store.Gossip(context.Background()))
+	clock.Add(2 * time.Hour)
+	store.Sweep()
+	require.Equal(t, 1, store.Len())
+
+	limit, remaining, err := store.Get("long")
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), limit)
+	require.Equal(t, uint64(4), remaining)
+
+	// without peers the usage is sent to no one
+	store, err = limits.NewGossipStore(&config, limits.GossipConfig{Self: "127.0.0.1:1", Secret: testPeerSecret})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	require.NoError(t, store.Set("long", 5, 3*time.Hour))
+	_, err = store.Take("long")
+	require.NoError(t, err)
+	clock.Add(2 * time.Hour)
+	store.Sweep()
+	require.Zero(t, store.Len())
+
+	require.True(t, failure.IsInvalidParam(store.Set("custom", 0, time.Hour)))
+}
+
+func TestGossipStore_SentPerPeer(t *testing.T) {
+	t.Parallel()
+
+	var received int64
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&received, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(live.Close)
+
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	config := limits.Config{Limit: 5, Interval: time.Minute, MinTTL: time.Hour, Clock: clock}
+	store, err := limits.NewGossipStore(&config, limits.GossipConfig{
+		Self:      "127.0.0.1:1",
+		Secret:    testPeerSecret,
+		Discovery: limits.StaticPeers(strings.TrimPrefix(live.URL, "http://"), unusedAddr(t)),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	_, err = store.Take("key")
+	require.NoError(t, err)
+
+	// the peer that is up receives the usage once, the one that is down is
+	// sent it again on every interval
+	require.Error(t, store.Gossip(context.Background()))
+	require.Error(t, store.Gossip(context.Background()))
+	require.Equal(t, int64(1), atomic.LoadInt64(&received))
+
+	_, err = store.Take("key")
+	require.NoError(t, err)
+	require.Error(t, store.Gossip(context.Background()))
+	require.Equal(t, int64(2), atomic.LoadInt64(&received))
+
+	// a peer down for good does not keep the key once its window ended
+	clock.Add(2 * time.Hour)
+	store.Sweep()
+	require.Zero(t, store.Len())
+}
+
+func TestGossipStore_LargeUsage(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	peers := newGossipCluster(t, 2, &limits.Config{Limit: 5, Interval: time.Hour, Clock: clock})
+
+	// the usage is sent in several messages, each under the max body size
+	prefix := strings.Repeat("k", 4096)
+	keys := limits.MaxPeerBodySize/len(prefix) + 1
+	for i := 0; i < keys; i++ {
+		_, err := peers[0].Take(fmt.Sprintf("%s%d", prefix, i))
+		require.NoError(t, err)
+	}
+	gossip(t, peers)
+
+	for i := 0; i < keys; i++ {
+		_, remaining, err := peers[1].Get(fmt.Sprintf("%s%d", prefix, i))
+		require.NoError(t, err)
+		require.Equal(t, uint64(4), remaining)
+	}
+
+	// a single message over the max body size is refused
+	body := `{"peer":"127.0.0.1:2","entries":[],"padding":"` + strings.Repeat("a", limits.MaxPeerBodySize) + `"}`
+	r := httptest.NewRequest(http.MethodPost, limits.GossipPath, strings.NewReader(body))
+	r.Header.Set(limits.PeerSecretHeader, testPeerSecret)
+	w := httptest.NewRecorder()
+	peers[1].Handler().ServeHTTP(w, r)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestGossipStore_SlowDiscovery(t *testing.T) {
+	t.Parallel()
+
+	discovery := func(ctx context.Context) ([]string, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	created := make(chan *limits.GossipStore, 1)
+	go func() {
+		store, err := limits.NewGossipStore(nil, limits.GossipConfig{
+			Self:            "127.0.0.1:1",
+			Secret:          testPeerSecret,
+			Discovery:       discovery,
+			RefreshInterval: time.Hour,
+			Timeout:         10 * time.Millisecond,
+		})
+		require.NoError(t, err)
+		created <- store
+	}()
+
+	// the first listing gives up after the timeout, not the refresh interval
+	select {
+	case store := <-created:
+		t.Cleanup(func() {
+			require.NoError(t, store.Close())
+		})
+		require.Empty(t, store.Peers())
+	case <-time.After(5 * time.Second):
+		t.Fatal("NewGossipStore waited for the refresh interval")
+	}
+}
+
+func TestGossipStore_Invalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := limits.NewGossipStore(nil, limits.GossipConfig{})
+	require.True(t, failure.IsInvalidParam(err))
+
+	_, err = limits.NewGossipStore(&limits.Config{Algorithm: limits.AlgorithmTokenBucket}, limits.GossipConfig{Self: "127.0.0.1:1", Secret: testPeerSecret})
+	require.True(t, failure.IsInvalidParam(err))
+
+	_, err = limits.NewGossipStore(nil, limits.GossipConfig{Self: "127.0.0.1:1"})
+	require.True(t, failure.IsInvalidParam(err))
+}
+
+func TestGossipStore_PeerSecret(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	config := limits.Config{Limit: 5, Interval: time.Minute, Clock: clock}
+	store, err := limits.NewGossipStore(&config, limits.GossipConfig{Self: "127.0.0.1:1", Secret: testPeerSecret})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	send := func(secret string) int {
+		r := httptest.NewRequest(http.MethodPost, limits.GossipPath, strings.NewReader(`{"peer":"127.0.0.1:2","entries":[{"key":"victim","window":0,"taken":5}]}`))
+		if secret != "" {
+			r.Header.Set(limits.PeerSecretHeader, secret)
+		}
+		w := httptest.NewRecorder()
+		store.Handler().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusUnauthorized, send(""))
+	require.Equal(t, http.StatusUnauthorized, send("guess"))
+
+	info, err := store.Peek("victim")
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), info.Remaining)
+
+	require.Equal(t, http.StatusNoContent, send(testPeerSecret))
+	info, err = store.Peek("victim")
+	require.NoError(t, err)
+	require.Zero(t, info.Remaining)
+}
+
+// newGossipCluster starts count in-process instances, each receiving the
+// usage of its peers on its own server
+func newGossipCluster(t *testing.T, count int, config *limits.Config) []*limits.GossipStore {
+	t.Helper()
+
+	servers := make([]*httptest.Server, count)
+	addrs := make([]string, count)
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		addrs[i] = servers[i].Listener.Addr().String()
+	}
+
+	stores := make([]*limits.GossipStore, count)
+	for i := range stores {
+		store, err := limits.NewGossipStore(config, limits.GossipConfig{
+			Self:      addrs[i],
+			Secret:    testPeerSecret,
+			Discovery: limits.StaticPeers(addrs...),
+		})
+		require.NoError(t, err)
+		require.Len(t, store.Peers(), count-1)
+		stores[i] = store
+
+		servers[i].Config.Handler = store.Handler()
+		servers[i].Start()
+	}
+
+	t.Cleanup(func() {
+		for i := range stores {
+			servers[i].Close()
+			require.NoError(t, stores[i].Close())
+		}
+	})
+
+	return stores
+}
+
+// gossip runs one gossip interval on every instance
+func gossip(t *testing.T, stores []*limits.GossipStore) {
+	t.Helper()
+
+	for _, store := range stores {
+		require.NoError(t, store.Gossip(context.Background()))
+	}
+}
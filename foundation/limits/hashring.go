@@ -0,0 +1,123 @@
+package limits
+
+import (
+	"sort"
+	"strconv"
+)
+
+const DefaultReplicas = 128
+
+// HashRing assigns every key to a single peer with consistent hashing. Each
+// peer is placed on the ring Replicas times, so keys spread evenly and a peer
+// joining or leaving only moves the keys of its own points. Every peer given
+// the same list computes the same owners, whatever the order of the list.
+//
+// replicas - number of points of each peer on the ring
+// points   - sorted hashes of the points
+// owners   - the peer of every point
+// peers    - the peers on the ring, sorted
+type HashRing struct {
+	replicas int
+	points   []uint64
+	owners   map[uint64]string
+	peers    []string
+}
+
+// NewHashRing places the peers on the ring, DefaultReplicas times each when
+// replicas is not positive. Duplicate and empty peers are ignored.
+func NewHashRing(replicas int, peers ...string) *HashRing {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+
+	unique := make(map[string]struct{}, len(peers))
+	for _, p := range peers {
+		if p != "" {
+			unique[p] = struct{}{}
+		}
+	}
+
+	r := HashRing{
+		replicas: replicas,
+		points:   make([]uint64, 0, replicas*len(unique)),
+		owners:   make(map[uint64]string, replicas*len(unique)),
+		peers:    make([]string, 0, len(unique)),
+	}
+
+	for p := range unique {
+		r.peers = append(r.peers, p)
+	}
+	sort.Strings(r.peers)
+
+	// peers are placed in order so a collision is resolved the same way on
+	// every peer
+	for _, p := range r.peers {
+		for i := 0; i < replicas; i++ {
+			h := ringHash(strconv.Itoa(i) + "-" + p)
+			if _, ok := r.owners[h]; ok {
+				continue
+			}
+			r.owners[h] = p
+			r.points = append(r.points, h)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+
+	return &r
+}
+
+// Owner is the peer owning the key, the peer of the first point at or after
+// the hash of the key. It is empty when the ring has no peers.
+func (r *HashRing) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.owners[r.points[i]]
+}
+
+// Peers is the sorted list of peers on the ring
+func (r *HashRing) Peers() []string {
+	peers := make([]string, len(r.peers))
+	copy(peers, r.peers)
+	return peers
+}
+
+// Equal reports whether both rings hold the same peers
+func (r *HashRing) Equal(o *HashRing) bool {
+	if o == nil || len(r.peers) != len(o.peers) || r.replicas != o.replicas {
+		return false
+	}
+
+	for i := range r.peers {
+		if r.peers[i] != o.peers[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ringHash is the 64 bit fnv-1a hash of s, followed by the murmur3
+// finalizer so similar strings, like the points of a peer, spread evenly
+func ringHash(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+
+	return h
+}
@@ -0,0 +1,50 @@
+package limits_test
+
+import (
+	"fmt"
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestHashRing_Owner(t *testing.T) {
+	t.Parallel()
+
+	empty := limits.NewHashRing(0)
+	require.Equal(t, "", empty.Owner("key"))
+
+	ring := limits.NewHashRing(0, "c:1", "a:1", "b:1", "a:1", "")
+	require.Equal(t, []string{"a:1", "b:1", "c:1"}, ring.Peers())
+
+	// the order of the peers does not change the owners
+	other := limits.NewHashRing(0, "b:1", "c:1", "a:1")
+	require.True(t, ring.Equal(other))
+
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		owner := ring.Owner(key)
+		require.Equal(t, owner, other.Owner(key))
+		counts[owner]++
+	}
+
+	for peer, count := range counts {
+		require.InDelta(t, 1000, count, 300, "peer (%s)", peer)
+	}
+}
+
+func TestHashRing_PeerLeaves(t *testing.T) {
+	t.Parallel()
+
+	ring := limits.NewHashRing(0, "a:1", "b:1", "c:1")
+	smaller := limits.NewHashRing(0, "a:1", "b:1")
+	require.False(t, ring.Equal(smaller))
+
+	// only the keys of the peer that left move
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if owner := ring.Owner(key); owner != "c:1" {
+			require.Equal(t, owner, smaller.Owner(key), "key (%s)", key)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package limits
+
+import (
+	"sync"
+	"time"
+)
+
+// LeakyBucket shapes traffic instead of rejecting it. Requests are placed in
+// a queue that drains at a constant rate of limit requests per interval and
+// each request is told how long it must wait (RateInfo.Delay) before it can
+// be served. A request is only rejected when the queue is full or its wait
+// would be longer than maxWait.
+//
+// limit    - the number of requests drained every interval
+// drain    - nanoseconds between two requests leaving the queue
+// maxQueue - the max number of requests waiting in the queue
+// maxWait  - the longest a request is allowed to wait in the queue
+// next     - nanoseconds from unix epoch when the next request leaves the queue
+// clock    - source of the current time
+// lock     - mutex lock to guard the struct fields
+type LeakyBucket struct {
+	clock    Clock
+	limit    uint64
+	drain    uint64
+	maxQueue uint64
+	maxWait  time.Duration
+	next     uint64
+	lock     sync.Mutex
+}
+
+// NewLeakyBucket drains limit requests per interval and queues at most
+// maxQueue of them for no longer than maxWait. A nil clock uses the SystemClock.
+func NewLeakyBucket(clock Clock, limit uint64, interval time.Duration, maxQueue uint64, maxWait time.Duration) *LeakyBucket {
+	drain := uint64(interval) / limit
+	if drain == 0 {
+		drain = 1
+	}
+
+	return &LeakyBucket{
+		clock:    clockOrSystem(clock),
+		limit:    limit,
+		drain:    drain,
+		maxQueue: maxQueue,
+		maxWait:  maxWait,
+	}
+}
+
+func (b *LeakyBucket) Get() (uint64, uint64) {
+	info := b.Peek()
+	return info.LimitSize, info.Remaining
+}
+
+// Peek reports the free slots in the queue and the delay a request arriving
+// now would be given, without queueing it
+func (b *LeakyBucket) Peek() RateInfo {
+	now := unixNano(b.clock)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	start := b.start(now)
+	delay := start - now
+	position := b.position(delay)
+	ok := position <= b.maxQueue && time.Duration(delay) <= b.maxWait
+
+	info := RateInfo{
+		LimitSize:   b.maxQueue,
+		Remaining:   b.free(position),
+		Reset:       start,
+		OperationOk: ok,
+	}
+
+	if ok {
+		info.Delay = time.Duration(delay)
+	}
+
+	return info
+}
+
+// LastActive is the time the last queued request leaves the queue
+func (b *LeakyBucket) LastActive() uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.next
+}
+
+// State is the queue as saved in a snapshot
+func (b *LeakyBucket) State() LimiterState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return LimiterState{
+		Limit:    b.limit,
+		Interval: time.Duration(b.drain * b.limit),
+		MaxQueue: b.maxQueue,
+		MaxWait:  b.maxWait,
+		At:       b.next,
+	}
+}
+
+// restoreLeakyBucket creates a leaky bucket from its snapshot state
+func restoreLeakyBucket(clock Clock, s LimiterState) *LeakyBucket {
+	b := NewLeakyBucket(clock, s.Limit, s.Interval, s.MaxQueue, s.MaxWait)
+	b.next = s.At
+
+	return b
+}
+
+// RateInfo queues a single request, see TakeN
+func (b *LeakyBucket) RateInfo() RateInfo {
+	return b.TakeN(1)
+}
+
+// TakeN queues a request that occupies n drain slots. LimitSize is the queue
+// capacity and Remaining the free slots left in it. Reset is the time the
+// queue is empty again or, when the request was rejected, the time enough
+// slots free up.
+func (b *LeakyBucket) TakeN(n uint64) RateInfo {
+	now := unixNano(b.clock)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	start := b.start(now)
+	delay := start - now
+	var last uint64
+	if n > 0 {
+		last = b.position(delay + (n-1)*b.drain)
+	}
+
+	if last > b.maxQueue || time.Duration(delay) > b.maxWait {
+		// compared before subtracting, near the start of the clock the slots
+		// and the wait free up before now
+		reset := now
+		if end, queue := start+n*b.drain, (b.maxQueue+1)*b.drain; end > now+queue {
+			reset = end - queue
+		}
+		if wait := uint64(b.maxWait); start > reset+wait {
+			reset = start - wait
+		}
+
+		return RateInfo{
+			LimitSize:   b.maxQueue,
+			Remaining:   b.free(b.position(delay)),
+			Reset:       reset,
+			OperationOk: false,
+		}
+	}
+
+	b.next = start + n*b.drain
+
+	return RateInfo{
+		LimitSize:   b.maxQueue,
+		Remaining:   b.maxQueue - last,
+		Reset:       b.next,
+		Delay:       time.Duration(delay),
+		OperationOk: true,
+	}
+}
+
+// Return frees the drain slots of n requests, the queue never drains
+// before now
+func (b *LeakyBucket) Return(n uint64) {
+	now := unixNano(b.clock)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if d := n * b.drain; b.next > now+d {
+		b.next -= d
+		return
+	}
+
+	b.next = now
+}
+
+// start is the time a request arriving now would leave the queue
+func (b *LeakyBucket) start(now uint64) uint64 {
+	if b.next < now {
+		return now
+	}
+
+	return b.next
+}
+
+// position is the place in the queue of a request that has to wait delay
+// nanoseconds, a request served immediately is not queued
+func (b *LeakyBucket) position(delay uint64) uint64 {
+	return (delay + b.drain - 1) / b.drain
+}
+
+// free is the number of free slots left in the queue for the given position
+func (b *LeakyBucket) free(position uint64) uint64 {
+	if position > b.maxQueue {
+		return 0
+	}
+
+	return b.maxQueue - position
+}
@@ -0,0 +1,118 @@
+package limits_test
+
+import (
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/api_rate_limiter/foundation/limits/limitstest"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestLeakyBucket_Queue(t *testing.T) {
+	t.Parallel()
+
+	// drains one request every 100ms and queues up to 2
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	b := limits.NewLeakyBucket(clock, 10, time.Second, 2, time.Second)
+
+	info := b.RateInfo()
+	require.True(t, info.OperationOk)
+	require.Equal(t, time.Duration(0), info.Delay)
+	require.Equal(t, uint64(2), info.LimitSize)
+	require.Equal(t, uint64(2), info.Remaining)
+
+	info = b.RateInfo()
+	require.True(t, info.OperationOk)
+	require.Equal(t, 100*time.Millisecond, info.Delay)
+	require.Equal(t, uint64(1), info.Remaining)
+
+	info = b.RateInfo()
+	require.True(t, info.OperationOk)
+	require.Equal(t, 200*time.Millisecond, info.Delay)
+	require.Equal(t, uint64(0), info.Remaining)
+
+	// queue is full
+	info = b.RateInfo()
+	require.False(t, info.OperationOk)
+	require.Equal(t, uint64(0), info.Remaining)
+
+	limit, remaining := b.Get()
+	require.Equal(t, uint64(2), limit)
+	require.Equal(t, uint64(0), remaining)
+
+	// the first request drained, the queue has room for one more
+	clock.Add(100 * time.Millisecond)
+	info = b.RateInfo()
+	require.True(t, info.OperationOk)
+	require.Equal(t, 200*time.Millisecond, info.Delay)
+}
+
+func TestLeakyBucket_MaxWait(t *testing.T) {
+	t.Parallel()
+
+	// a large queue but requests can only wait 150ms
+	b := limits.NewLeakyBucket(nil, 10, time.Second, 100, 150*time.Millisecond)
+
+	require.True(t, b.RateInfo().OperationOk)
+	require.True(t, b.RateInfo().OperationOk)
+	require.False(t, b.RateInfo().OperationOk)
+}
+
+func TestLeakyBucket_ResetNearClockStart(t *testing.T) {
+	t.Parallel()
+
+	// rejected for the wait, the queue frees its slots before the clock
+	// started
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	b := limits.NewLeakyBucket(clock, 10, time.Second, 100, 150*time.Millisecond)
+	require.True(t, b.RateInfo().OperationOk)
+	require.True(t, b.RateInfo().OperationOk)
+
+	info := b.RateInfo()
+	require.False(t, info.OperationOk)
+	require.Equal(t, uint64(50*time.Millisecond), info.Reset)
+
+	// rejected for the queue, the wait is longer than the clock ran
+	clock = limitstest.NewManualClock(time.Unix(0, 0))
+	b = limits.NewLeakyBucket(clock, 10, time.Second, 1, 10*time.Second)
+	require.True(t, b.RateInfo().OperationOk)
+	require.True(t, b.RateInfo().OperationOk)
+
+	info = b.RateInfo()
+	require.False(t, info.OperationOk)
+	require.Equal(t, uint64(100*time.Millisecond), info.Reset)
+}
+
+func TestMemoryStore_LeakyBucketAlgorithm(t *testing.T) {
+	t.Parallel()
+
+	config := limits.Config{
+		Limit:       1,
+		Interval:    time.Minute,
+		Algorithm:   limits.AlgorithmLeakyBucket,
+		MaxQueue:    1,
+		TTLInterval: 24 * time.Hour,
+		MinTTL:      24 * time.Hour,
+	}
+
+	store := limits.NewMemoryStore(&config)
+	go store.GarbageCollector()
+
+	t.Cleanup(func() {
+		err := store.Close()
+		require.NoError(t, err)
+	})
+
+	info, err := store.Take("my-key")
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+
+	info, err = store.Take("my-key")
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+	require.True(t, info.Delay > 59*time.Second)
+
+	info, err = store.Take("my-key")
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+}
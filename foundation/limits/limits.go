@@ -1,5 +1,6 @@
 // Package limits is an example implementation of a rate limits that
-// focuses on Fixed time window rate limit
+// focuses on Fixed time window rate limit. Other algorithms can be selected
+// per store through the Config.Algorithm
 package limits
 
 import (
@@ -15,12 +16,49 @@ const (
 	DefaultTTLInterval       = 6 * time.Hour
 	DefaultMinTTLInterval    = 12 * time.Hour
 	DefaultInitialMapSize    = 4096
+	DefaultAlgorithm         = AlgorithmFixedWindow
 )
 
+// Algorithm identifies the rate limit algorithm used for every key in a store
+type Algorithm string
+
+const (
+	AlgorithmFixedWindow   Algorithm = "fixed-window"
+	AlgorithmTokenBucket   Algorithm = "token-bucket"
+	AlgorithmSlidingWindow Algorithm = "sliding-window"
+	AlgorithmSlidingLog    Algorithm = "sliding-log"
+	AlgorithmGCRA          Algorithm = "gcra"
+	AlgorithmLeakyBucket   Algorithm = "leaky-bucket"
+)
+
+func (a Algorithm) String() string {
+	return string(a)
+}
+
+// IsValid reports whether the algorithm is one supported by this package
+func (a Algorithm) IsValid() bool {
+	switch a {
+	case AlgorithmFixedWindow, AlgorithmTokenBucket, AlgorithmSlidingWindow,
+		AlgorithmSlidingLog, AlgorithmGCRA, AlgorithmLeakyBucket:
+		return true
+	}
+
+	return false
+}
+
+// RateInfo reports the state of a key's limit after an operation
+//
+// LimitSize   - the max number of tokens for the key
+// Remaining   - tokens left after the operation
+// Reset       - nanoseconds from unix epoch when the limit resets
+// Delay       - how long the caller must wait before serving the request,
+// 							 only set by the leaky bucket which shapes instead of rejecting
+// OperationOk - whether the operation was permitted
 type RateInfo struct {
 	LimitSize   uint64
 	Remaining   uint64
 	Reset       uint64
+	Delay       time.Duration
 	OperationOk bool
 }
 
@@ -33,12 +71,42 @@ type RateInfo struct {
 // 							 clearing it from the entries.
 // InitialSize - the size to use for map. Go will automatically
 // 							 expand the buffer. The default is 4096
+// Algorithm   - the algorithm used for every key. default is fixed-window
+// Burst       - capacity of a token bucket or gcra, defaults to Limit.
+// 							 Ignored by the other algorithms
+// MaxQueue    - leaky bucket queue depth, defaults to Limit
+// MaxWait     - longest a request waits in the leaky bucket queue, defaults
+// 							 to Interval
+// Clock       - source of the current time, defaults to the SystemClock
+// Shards      - number of independently locked shards of a ShardedStore,
+// 							 defaults to DefaultShardCount. Ignored by the MemoryStore
+// MaxKeys     - the max number of keys held by the store, unbounded when 0.
+// 							 A ShardedStore splits it evenly across its shards
+// Overflow    - what happens to a new key when the store holds MaxKeys keys.
+// 							 default is evict
+// SnapshotPath     - file the store state is saved to on Close, no snapshot
+// 										when empty
+// SnapshotInterval - how often the garbage collector also saves the snapshot,
+// 										only on Close when 0
+// SnapshotFailed   - called with the error of a failed periodic snapshot
 type Config struct {
 	Limit       uint64
 	Interval    time.Duration
 	TTLInterval time.Duration
 	MinTTL      time.Duration
 	InitialSize int
+	Algorithm   Algorithm
+	Burst       uint64
+	MaxQueue    uint64
+	MaxWait     time.Duration
+	Clock       Clock
+	Shards      int
+	MaxKeys     int
+	Overflow    OverflowPolicy
+
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+	SnapshotFailed   func(err error)
 }
 
 func NewDefaultConfig() *Config {
@@ -48,6 +116,9 @@ func NewDefaultConfig() *Config {
 		TTLInterval: DefaultTTLInterval,
 		MinTTL:      DefaultMinTTLInterval,
 		InitialSize: DefaultInitialMapSize,
+		Algorithm:   DefaultAlgorithm,
+		Clock:       SystemClock,
+		Overflow:    DefaultOverflowPolicy,
 	}
 }
 
@@ -64,17 +135,92 @@ func NewTTL(interval time.Duration, purgeTime uint64) TTL {
 	}
 }
 
+// Store is the behavior the middleware requires from a storage backend
+// used to track rate limits. MemoryStore is the default implementation,
+// other backends or test doubles only need to satisfy this interface.
+//
+// Take 						 - consume a single token for the key
+// TakeN 					 - consume n tokens for the key, all or nothing
+// Peek 						 - the up to date state of the key without taking a token
+// Return 					 - give n tokens back to the key, bounded by its limit
+// Get  						 - the limit and remaining tokens for the key
+// Set  						 - replace the limit and interval used by the key
+// Close 					 - release all resources, the store is unusable afterwards
+// GarbageCollector - blocking maintenance loop, runs until Close is called
+type Store interface {
+	Take(key string) (RateInfo, error)
+	TakeN(key string, n uint64) (RateInfo, error)
+	Peek(key string) (RateInfo, error)
+	Return(key string, n uint64) error
+	Get(key string) (uint64, uint64, error)
+	Set(key string, tokens uint64, interval time.Duration) error
+	Close() error
+	GarbageCollector()
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// Limiter is the per key state kept by a rate limit algorithm
+//
+// RateInfo   - takes a single token and reports the state of the limit
+// TakeN      - takes n tokens when all of them are available, otherwise
+// 							takes nothing and reports the operation as not ok
+// Peek       - the up to date state of the limit without taking a token,
+// 							OperationOk reports whether a single token could be taken
+// Return     - gives n previously taken tokens back, never exceeding the limit
+// Get        - the limit and remaining tokens without taking a token
+// LastActive - nanoseconds from unix epoch of the last activity, used to
+// 							decide when the entry is stale
+// State      - the fields needed to restore the limiter from a snapshot
+type Limiter interface {
+	RateInfo() RateInfo
+	TakeN(n uint64) RateInfo
+	Peek() RateInfo
+	Return(n uint64)
+	Get() (uint64, uint64)
+	LastActive() uint64
+	State() LimiterState
+}
+
+var (
+	_ Limiter = (*Bucket)(nil)
+	_ Limiter = (*TokenBucket)(nil)
+	_ Limiter = (*SlidingWindow)(nil)
+	_ Limiter = (*SlidingLog)(nil)
+	_ Limiter = (*GCRA)(nil)
+	_ Limiter = (*LeakyBucket)(nil)
+
+	_ Reserver = (*Bucket)(nil)
+	_ Reserver = (*TokenBucket)(nil)
+	_ Reserver = (*GCRA)(nil)
+)
+
 type MemoryStore struct {
-	limit    uint64
-	interval time.Duration
+	clock     Clock
+	limit     uint64
+	interval  time.Duration
+	algorithm Algorithm
+	burst     uint64
+	gcra      *GCRARate
+	maxQueue  uint64
+	maxWait   time.Duration
+	maxKeys   int
+	overflow  OverflowPolicy
 
 	ttl TTL
 
-	data map[string]*Bucket
-	lock sync.RWMutex
+	snapshotPath     string
+	snapshotInterval time.Duration
+	snapshotFailed   func(err error)
 
-	stopped uint32
-	stop    chan struct{}
+	data   map[string]Limiter
+	ring   *keyRing
+	lock   sync.RWMutex
+	saving sync.Mutex
+
+	stopped   uint32
+	stop      chan struct{}
+	collector collector
 }
 
 // NewMemoryStore is the main constructor used to create and configure the
@@ -113,29 +259,123 @@ func NewMemoryStore(opts ...*Config) *MemoryStore {
 		size = config.InitialSize
 	}
 
+	algorithm := defaults.Algorithm
+	if config.Algorithm.IsValid() {
+		algorithm = config.Algorithm
+	}
+
+	maxQueue := tokens
+	if config.MaxQueue > 0 {
+		maxQueue = config.MaxQueue
+	}
+
+	maxWait := interval
+	if config.MaxWait > 0 {
+		maxWait = config.MaxWait
+	}
+
+	clock := defaults.Clock
+	if config.Clock != nil {
+		clock = config.Clock
+	}
+
+	overflow := defaults.Overflow
+	if config.Overflow.IsValid() {
+		overflow = config.Overflow
+	}
+
 	store := MemoryStore{
-		limit:    tokens,
-		interval: interval,
-		ttl:      NewTTL(sweepInterval, uint64(sweepMinTTL)),
-		data:     make(map[string]*Bucket, size),
-		stop:     make(chan struct{}),
+		clock:     clock,
+		limit:     tokens,
+		interval:  interval,
+		algorithm: algorithm,
+		burst:     config.Burst,
+		maxQueue:  maxQueue,
+		maxWait:   maxWait,
+		maxKeys:   config.MaxKeys,
+		overflow:  overflow,
+		ttl:       NewTTL(sweepInterval, uint64(sweepMinTTL)),
+		data:      make(map[string]Limiter, size),
+		stop:      make(chan struct{}),
+
+		snapshotPath:     config.SnapshotPath,
+		snapshotInterval: config.SnapshotInterval,
+		snapshotFailed:   config.SnapshotFailed,
+	}
+
+	if algorithm == AlgorithmGCRA {
+		store.gcra = NewGCRARate(clock, tokens, interval, config.Burst)
+	}
+
+	if config.MaxKeys > 0 {
+		if size > config.MaxKeys {
+			size = config.MaxKeys
+		}
+		store.ring = newKeyRing(size)
 	}
 
 	return &store
 }
 
+// newLimiter creates the per key state for the store's algorithm. The burst
+// of a token bucket defaults to the number of tokens when not configured.
+// Keys using the store limits share a single GCRARate.
+func (m *MemoryStore) newLimiter(tokens uint64, interval time.Duration) Limiter {
+	switch m.algorithm {
+	case AlgorithmGCRA:
+		if tokens == m.limit && interval == m.interval {
+			return NewGCRA(m.gcra)
+		}
+		return NewGCRA(NewGCRARate(m.clock, tokens, interval, m.burst))
+	case AlgorithmTokenBucket:
+		burst := tokens
+		if m.burst > 0 {
+			burst = m.burst
+		}
+		return NewTokenBucket(m.clock, tokens, interval, burst)
+	case AlgorithmSlidingWindow:
+		return NewSlidingWindow(m.clock, tokens, interval)
+	case AlgorithmSlidingLog:
+		return NewSlidingLog(m.clock, tokens, interval)
+	case AlgorithmLeakyBucket:
+		return NewLeakyBucket(m.clock, tokens, interval, m.maxQueue, m.maxWait)
+	default:
+		return NewBucket(m.clock, tokens, interval)
+	}
+}
+
+// Take consumes a single token for the key
 func (m *MemoryStore) Take(key string) (RateInfo, error) {
+	return m.TakeN(key, 1)
+}
+
+// TakeN consumes n tokens for the key. It is all or nothing, when the key
+// can not afford n tokens none are taken and the operation is not ok.
+func (m *MemoryStore) TakeN(key string, n uint64) (RateInfo, error) {
 	var info RateInfo
 	if atomic.LoadUint32(&m.stopped) == 1 {
 		return info, failure.InvalidState("MemoryStore is stopped")
 	}
 
+	b, ok := m.limiter(key)
+	if !ok {
+		return m.rejected(), nil
+	}
+
+	return b.TakeN(n), nil
+}
+
+// limiter returns the limiter for the key, creating it with the store
+// limits when the key is new. It is not ok when the store is full and its
+// overflow policy rejects new keys.
+func (m *MemoryStore) limiter(key string) (Limiter, bool) {
 	// Acquire a read lock first - this allows others to concurrently check limits
 	// without full locks
 	m.lock.RLock()
 	if b, ok := m.data[key]; ok {
+		m.touch(key)
 		m.lock.RUnlock()
-		return b.RateInfo(), nil
+		return b, true
 	}
 	m.lock.RUnlock()
 
@@ -143,19 +383,118 @@ func (m *MemoryStore) Take(key string) (RateInfo, error) {
 	// to check if the key exists again, because its possible another
 	// goroutine created it between our shared lock and exclusive lock
 	m.lock.Lock()
+	defer m.lock.Unlock()
 	if b, ok := m.data[key]; ok {
-		m.lock.Unlock()
-		return b.RateInfo(), nil
+		m.touch(key)
+		return b, true
+	}
+
+	// This is a new entry. so create the bucket
+	b := m.newLimiter(m.limit, m.interval)
+	if m.isFull() {
+		switch m.overflow {
+		case OverflowAdmit:
+			return b, true
+		case OverflowReject:
+			return nil, false
+		default:
+			m.evict()
+		}
 	}
 
-	// This is a new entry. so create the bucket and take an initial request
-	b := NewBucket(m.limit, m.interval)
+	m.insert(key, b)
+
+	return b, true
+}
+
+// isFull reports whether a new key would exceed MaxKeys. The write lock
+// must be held.
+func (m *MemoryStore) isFull() bool {
+	return m.maxKeys > 0 && len(m.data) >= m.maxKeys
+}
+
+// touch marks the key as recently used for eviction. The read or write lock
+// must be held.
+func (m *MemoryStore) touch(key string) {
+	if m.ring != nil {
+		m.ring.touch(key)
+	}
+}
+
+// insert stores the limiter of a new key. The write lock must be held.
+func (m *MemoryStore) insert(key string, b Limiter) {
 	m.data[key] = b
-	m.lock.Unlock()
+	if m.ring != nil {
+		m.ring.add(key)
+	}
+}
+
+// remove deletes the key. The write lock must be held.
+func (m *MemoryStore) remove(key string) {
+	delete(m.data, key)
+	if m.ring != nil {
+		m.ring.remove(key)
+	}
+}
+
+// evict removes the least recently used key. The write lock must be held.
+func (m *MemoryStore) evict() {
+	if m.ring == nil || len(m.ring.keys) == 0 {
+		return
+	}
+
+	m.remove(m.ring.victim())
+}
+
+// rejected is the state reported for a new key rejected by a full store
+func (m *MemoryStore) rejected() RateInfo {
+	return RateInfo{
+		LimitSize:   m.limit,
+		Remaining:   0,
+		Reset:       unixNano(m.clock) + uint64(m.interval),
+		OperationOk: false,
+	}
+}
+
+// Peek reports the up to date state of the key without taking a token. A
+// key the store has not seen yet reports the full store limits.
+func (m *MemoryStore) Peek(key string) (RateInfo, error) {
+	var info RateInfo
+	if atomic.LoadUint32(&m.stopped) == 1 {
+		return info, failure.InvalidState("MemoryStore is stopped")
+	}
+
+	m.lock.RLock()
+	b, ok := m.data[key]
+	m.lock.RUnlock()
 
-	return b.RateInfo(), nil
+	if !ok {
+		b = m.newLimiter(m.limit, m.interval)
+	}
+
+	return b.Peek(), nil
 }
 
+// Return gives n tokens back to the key, for requests the client should not
+// be charged for. It is a no-op for keys the store does not hold.
+func (m *MemoryStore) Return(key string, n uint64) error {
+	if atomic.LoadUint32(&m.stopped) == 1 {
+		return failure.InvalidState("MemoryStore is stopped")
+	}
+
+	m.lock.RLock()
+	b, ok := m.data[key]
+	m.lock.RUnlock()
+
+	if ok {
+		b.Return(n)
+	}
+
+	return nil
+}
+
+// Get returns the limit and remaining tokens of the key, zero values when the
+// key has not been seen
 func (m *MemoryStore) Get(key string) (uint64, uint64, error) {
 	var tokens, remaining uint64
 	if atomic.LoadUint32(&m.stopped) == 1 {
@@ -173,63 +512,152 @@ func (m *MemoryStore) Get(key string) (uint64, uint64, error) {
 	return tokens, remaining, nil
 }
 
+// Set replaces the limiter of the key with one using the given limits. A new
+// key in a full store evicts another key, unless the overflow policy does not
+// allow evictions.
 func (m *MemoryStore) Set(key string, tokens uint64, interval time.Duration) error {
 	m.lock.Lock()
-	b := NewBucket(tokens, interval)
-	m.data[key] = b
-	m.lock.Unlock()
+	defer m.lock.Unlock()
+
+	b := m.newLimiter(tokens, interval)
+	if _, ok := m.data[key]; ok {
+		m.data[key] = b
+		m.touch(key)
+		return nil
+	}
+
+	if m.isFull() {
+		if m.overflow != OverflowEvict {
+			return failure.OutOfRange("store is full (%d keys), can not set (%s)", m.maxKeys, key)
+		}
+		m.evict()
+	}
+
+	m.insert(key, b)
 	return nil
 }
 
 // Close stops the memory limits and cleans up any outstanding sessions
 // You should always call this method as it releases the memory consumed
-// by the map and releases the tickets.
+// by the map and releases the tickets. The state is saved to the snapshot
+// path first when one is configured.
 func (m *MemoryStore) Close() error {
 	if !atomic.CompareAndSwapUint32(&m.stopped, 0, 1) {
 		return nil
 	}
 
-	// Close the channel to prevent future purging
-	close(m.stop)
+	// Close the channel to prevent future purging and wait for the garbage
+	// collector, so a periodic snapshot never replaces the final one
+	m.collector.close(m.stop)
+
+	var err error
+	if m.snapshotPath != "" {
+		if sErr := m.SaveFile(m.snapshotPath); sErr != nil {
+			err = failure.Wrap(sErr, "m.SaveFile failed")
+		}
+	}
 
 	// Delete all data
 	m.lock.Lock()
 	for key := range m.data {
 		delete(m.data, key)
 	}
+	if m.ring != nil {
+		m.ring.reset()
+	}
 	m.lock.Unlock()
-	return nil
+	return err
 }
 
 // GarbageCollector continually iterates over the map and purges old values on the provided
-// sweep interval.
+// sweep interval. It also saves the snapshot on the snapshot interval when one is configured.
 func (m *MemoryStore) GarbageCollector() {
+	if !m.collector.start() {
+		return
+	}
+	defer m.collector.done()
+
 	ticker := time.NewTicker(m.ttl.Interval)
 	defer ticker.Stop()
 
+	snapshots, stop := snapshotTicker(m.snapshotPath, m.snapshotInterval)
+	defer stop()
+
 	for {
 		select {
 		case <-m.stop:
 			return
 		case <-ticker.C:
+			m.Sweep()
+		case <-snapshots:
+			m.saveSnapshot()
 		}
+	}
+}
 
-		m.lock.Lock()
-		now := uint64(time.Now().UnixNano())
-		for k, b := range m.data {
-			b.lock.Lock()
-			lastTime := b.startTime + (b.lastTick * uint64(b.interval))
-			b.lock.Unlock()
+// saveSnapshot saves the periodic snapshot, reporting a failure to the
+// snapshot failed callback. Once the store is closing only Close saves it.
+func (m *MemoryStore) saveSnapshot() {
+	if atomic.LoadUint32(&m.stopped) == 1 {
+		return
+	}
 
-			if now-lastTime > m.ttl.Value {
-				delete(m.data, k)
-			}
+	err := m.SaveFile(m.snapshotPath)
+	if err != nil && m.snapshotFailed != nil {
+		m.snapshotFailed(failure.Wrap(err, "m.SaveFile failed"))
+	}
+}
+
+// Sweep purges the entries that have been inactive for longer than the TTL.
+// GarbageCollector calls it on every tick of the sweep interval. Stale keys
+// are found under the read lock so takes are only blocked while deleting.
+func (m *MemoryStore) Sweep() {
+	now := unixNano(m.clock)
+
+	var stale []string
+	m.lock.RLock()
+	for k, b := range m.data {
+		if m.isStale(b, now) {
+			stale = append(stale, k)
+		}
+	}
+	m.lock.RUnlock()
+
+	if len(stale) == 0 {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// The key may have been replaced or used since the read lock was released
+	for _, k := range stale {
+		if b, ok := m.data[k]; ok && m.isStale(b, now) {
+			m.remove(k)
 		}
-		m.lock.Unlock()
 	}
 }
 
-// Bucket holds metadata about the rate limit for a given key
+// isStale reports whether the limiter has been inactive for longer than the TTL
+func (m *MemoryStore) isStale(b Limiter, now uint64) bool {
+	lastTime := b.LastActive()
+	return now > lastTime && now-lastTime > m.ttl.Value
+}
+
+// Len is the number of keys held by the store
+func (m *MemoryStore) Len() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return len(m.data)
+}
+
+// Bucket holds metadata about the fixed window rate limit for a given key.
+// All the tokens are restored at once when the window rolls over.
+//
+// Reservations that can not be served in the current window are packed into
+// the following windows. Windows before the last reserved one are considered
+// fully booked.
 //
 // startTime 				- the number of nanoseconds from unix epoch when the bucket was created
 // maxToken  				- the max number of limit permitted on the bucket at any time. the
@@ -237,19 +665,29 @@ func (m *MemoryStore) GarbageCollector() {
 // interval  				- the time at which a tick should occur
 // availableTokens 	- current number of available limit
 // lastTick  				- the last clock tick. used to re-calculate the number of limit on the bucket
+// reservedTick 		- the last window holding reservations
+// reservedTokens 	- the number of tokens reserved in reservedTick
+// clock 					- source of the current time
 // lock 					  - mutex lock to guard the struct fields
 type Bucket struct {
+	clock           Clock
 	startTime       uint64
 	maxTokens       uint64
 	interval        time.Duration
 	availableTokens uint64
 	lastTick        uint64
+	reservedTick    uint64
+	reservedTokens  uint64
 	lock            sync.Mutex
 }
 
-func NewBucket(tokens uint64, interval time.Duration) *Bucket {
+// NewBucket creates a full bucket that restores tokens every interval. A nil
+// clock uses the SystemClock.
+func NewBucket(clock Clock, tokens uint64, interval time.Duration) *Bucket {
+	clock = clockOrSystem(clock)
 	return &Bucket{
-		startTime:       uint64(time.Now().UnixNano()),
+		clock:           clock,
+		startTime:       unixNano(clock),
 		maxTokens:       tokens,
 		availableTokens: tokens,
 		interval:        interval,
@@ -257,19 +695,80 @@ func NewBucket(tokens uint64, interval time.Duration) *Bucket {
 }
 
 func (b *Bucket) Get() (uint64, uint64) {
+	info := b.Peek()
+	return info.LimitSize, info.Remaining
+}
+
+// Peek reports the tokens available in the current window, applying the
+// refill of a window roll over without modifying the bucket
+func (b *Bucket) Peek() RateInfo {
+	now := unixNano(b.clock)
+	currentTick := IntervalCount(b.startTime, now, b.interval)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	available := b.available(currentTick)
+
+	return RateInfo{
+		LimitSize:   b.maxTokens,
+		Remaining:   available,
+		Reset:       b.startTime + ((currentTick + 1) * uint64(b.interval)),
+		OperationOk: available > 0,
+	}
+}
+
+// LastActive is the start of the last window the bucket was used in
+func (b *Bucket) LastActive() uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.startTime + (b.lastTick * uint64(b.interval))
+}
+
+// State is the bucket as saved in a snapshot
+func (b *Bucket) State() LimiterState {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	return b.maxTokens, b.availableTokens
+	return LimiterState{
+		Limit:          b.maxTokens,
+		Interval:       b.interval,
+		Start:          b.startTime,
+		Tick:           b.lastTick,
+		Available:      b.availableTokens,
+		ReservedTick:   b.reservedTick,
+		ReservedTokens: b.reservedTokens,
+	}
+}
+
+// restoreBucket creates a bucket from its snapshot state
+func restoreBucket(clock Clock, s LimiterState) *Bucket {
+	return &Bucket{
+		clock:           clockOrSystem(clock),
+		startTime:       s.Start,
+		maxTokens:       s.Limit,
+		interval:        s.Interval,
+		availableTokens: s.Available,
+		lastTick:        s.Tick,
+		reservedTick:    s.ReservedTick,
+		reservedTokens:  s.ReservedTokens,
+	}
 }
 
+// RateInfo takes a single token from the bucket
 func (b *Bucket) RateInfo() RateInfo {
+	return b.TakeN(1)
+}
+
+// TakeN takes n tokens when they are all available in the current window
+func (b *Bucket) TakeN(n uint64) RateInfo {
 	var tokens uint64
 	var remaining uint64
 	var reset uint64
 	var ok bool
 
-	now := uint64(time.Now().UnixNano())
+	now := unixNano(b.clock)
 	currentTick := IntervalCount(b.startTime, now, b.interval)
 
 	tokens = b.maxTokens
@@ -278,17 +777,13 @@ func (b *Bucket) RateInfo() RateInfo {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	// If we're on a new tick since last assessment, perform a full reset up to maxTokens
-	if b.lastTick < currentTick {
-		b.availableTokens = b.maxTokens
-		b.lastTick = currentTick
-	}
+	b.refill(currentTick)
 
-	if b.availableTokens > 0 {
-		b.availableTokens--
+	if b.availableTokens >= n {
+		b.availableTokens -= n
 		ok = true
-		remaining = b.availableTokens
 	}
+	remaining = b.availableTokens
 
 	return RateInfo{
 		LimitSize:   tokens,
@@ -298,6 +793,110 @@ func (b *Bucket) RateInfo() RateInfo {
 	}
 }
 
+// Return gives n tokens back to the current window, never more than maxTokens
+func (b *Bucket) Return(n uint64) {
+	now := unixNano(b.clock)
+	currentTick := IntervalCount(b.startTime, now, b.interval)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill(currentTick)
+	b.availableTokens += n
+	if b.availableTokens > b.maxTokens {
+		b.availableTokens = b.maxTokens
+	}
+}
+
+// Reserve takes n tokens from the current window when available, otherwise
+// from the first following window that can hold them. The reservation is not
+// ok when n is larger than the bucket.
+func (b *Bucket) Reserve(n uint64) *Reservation {
+	now := unixNano(b.clock)
+	currentTick := IntervalCount(b.startTime, now, b.interval)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if n > b.maxTokens {
+		return &Reservation{limit: b.maxTokens, tokens: n}
+	}
+
+	b.refill(currentTick)
+
+	if b.reservedTick <= currentTick && b.availableTokens >= n {
+		b.availableTokens -= n
+		return b.reservation(currentTick, n, now)
+	}
+
+	switch {
+	case b.reservedTick <= currentTick:
+		b.reservedTick = currentTick + 1
+		b.reservedTokens = n
+	case b.maxTokens-b.reservedTokens >= n:
+		b.reservedTokens += n
+	default:
+		b.reservedTick++
+		b.reservedTokens = n
+	}
+
+	return b.reservation(b.reservedTick, n, b.startTime+(b.reservedTick*uint64(b.interval)))
+}
+
+// reservation builds a reservation of n tokens in the window of the given
+// tick. Cancelling gives the tokens back as long as the window has not
+// started, or for the current window, as long as it is still current.
+func (b *Bucket) reservation(tick, n, timeToAct uint64) *Reservation {
+	return &Reservation{
+		clock:     b.clock,
+		ok:        true,
+		limit:     b.maxTokens,
+		tokens:    n,
+		timeToAct: timeToAct,
+		cancel: func() {
+			now := unixNano(b.clock)
+			currentTick := IntervalCount(b.startTime, now, b.interval)
+
+			b.lock.Lock()
+			defer b.lock.Unlock()
+
+			switch {
+			case tick == currentTick && b.lastTick == currentTick:
+				b.availableTokens += n
+				if b.availableTokens > b.maxTokens {
+					b.availableTokens = b.maxTokens
+				}
+			case tick > currentTick && tick == b.reservedTick && b.reservedTokens >= n:
+				b.reservedTokens -= n
+			}
+		},
+	}
+}
+
+// refill performs a full reset up to maxTokens when we're on a new tick since
+// last assessment, minus any tokens reserved for that window. Windows before
+// the last reserved one have been handed out to reservations.
+func (b *Bucket) refill(currentTick uint64) {
+	b.availableTokens = b.available(currentTick)
+	if b.lastTick < currentTick {
+		b.lastTick = currentTick
+	}
+}
+
+// available is the number of tokens in the window of the current tick
+func (b *Bucket) available(currentTick uint64) uint64 {
+	switch {
+	case b.lastTick >= currentTick:
+		return b.availableTokens
+	case currentTick < b.reservedTick:
+		return 0
+	case currentTick == b.reservedTick:
+		return b.maxTokens - b.reservedTokens
+	default:
+		return b.maxTokens
+	}
+}
+
 // IntervalCount is the total number times the current interval has occurred between
 // when the time started (start) and the current time (current). For example,
 // if the start time was 12:30pm and its current 1:00pm, and the interval was
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/api_rate_limiter/foundation/limits/limitstest"
 	"github.com/stretchr/testify/require"
 	"sort"
 	"testing"
@@ -17,9 +18,11 @@ func TestMemoryStore_FillRate(t *testing.T) {
 	t.Run("many_tokens_small_interval", func(t *testing.T) {
 		t.Parallel()
 
+		clock := limitstest.NewManualClock(time.Unix(0, 0))
 		config := limits.Config{
 			Limit:    65525,
 			Interval: time.Second,
+			Clock:    clock,
 		}
 		store := limits.NewMemoryStore(&config)
 		go store.GarbageCollector()
@@ -28,7 +31,7 @@ func TestMemoryStore_FillRate(t *testing.T) {
 			info, err := store.Take("key")
 			require.NoError(t, err)
 			require.False(t, info.Remaining < (info.LimitSize-uint64(i)-1))
-			time.Sleep(100 * time.Millisecond)
+			clock.Add(100 * time.Millisecond)
 		}
 	})
 }
@@ -47,15 +50,18 @@ func TestMemoryStore_Take(t *testing.T) {
 	}
 
 	for _, tt := range cases {
+		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 
 			key := testKey(t)
+			clock := limitstest.NewManualClock(time.Unix(0, 0))
 			config := limits.Config{
 				Interval:    tt.interval,
 				Limit:       tt.tokens,
 				TTLInterval: 24 * time.Hour,
 				MinTTL:      24 * time.Hour,
+				Clock:       clock,
 			}
 			store := limits.NewMemoryStore(&config)
 			go store.GarbageCollector()
@@ -81,7 +87,7 @@ func TestMemoryStore_Take(t *testing.T) {
 					rs := result{
 						limit:     info.LimitSize,
 						remaining: info.Remaining,
-						reset:     time.Duration(uint64(time.Now().Unix()) - info.Reset),
+						reset:     time.Duration(info.Reset - uint64(clock.Now().UnixNano())),
 						ok:        info.OperationOk,
 						err:       err,
 					}
@@ -110,7 +116,7 @@ func TestMemoryStore_Take(t *testing.T) {
 			for i, rs := range results {
 				require.NoError(t, rs.err)
 				require.Equal(t, rs.limit, tt.tokens)
-				require.True(t, rs.reset < tt.interval)
+				require.Equal(t, tt.interval, rs.reset)
 
 				// first half should pass 2nd half should fail
 				if uint64(i) < tt.tokens {
@@ -122,8 +128,8 @@ func TestMemoryStore_Take(t *testing.T) {
 				}
 			}
 
-			// Wait for the bucket to have entries again
-			time.Sleep(tt.interval)
+			// Roll the window over for the bucket to have entries again
+			clock.Add(tt.interval)
 
 			info, err := store.Take(key)
 			require.NoError(t, err)
@@ -286,6 +292,7 @@ func TestIntervalCount(t *testing.T) {
 	}
 
 	for _, tt := range tests {
+		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 			count := limits.IntervalCount(tt.start, tt.current, tt.interval)
@@ -293,3 +300,228 @@ func TestIntervalCount(t *testing.T) {
 		})
 	}
 }
+
+func TestMemoryStore_TakeN(t *testing.T) {
+	t.Parallel()
+
+	algorithms := []limits.Algorithm{
+		limits.AlgorithmFixedWindow,
+		limits.AlgorithmTokenBucket,
+		limits.AlgorithmSlidingWindow,
+		limits.AlgorithmSlidingLog,
+		limits.AlgorithmGCRA,
+	}
+
+	for _, alg := range algorithms {
+		alg := alg
+		t.Run(alg.String(), func(t *testing.T) {
+			t.Parallel()
+
+			config := limits.Config{
+				Limit:       5,
+				Interval:    time.Hour,
+				Algorithm:   alg,
+				TTLInterval: 24 * time.Hour,
+				MinTTL:      24 * time.Hour,
+			}
+			store := limits.NewMemoryStore(&config)
+			t.Cleanup(func() {
+				err := store.Close()
+				require.NoError(t, err)
+			})
+
+			info, err := store.TakeN("key", 3)
+			require.NoError(t, err)
+			require.True(t, info.OperationOk)
+			require.Equal(t, uint64(2), info.Remaining)
+
+			// all or nothing, the 2 remaining tokens are left untouched
+			info, err = store.TakeN("key", 3)
+			require.NoError(t, err)
+			require.False(t, info.OperationOk)
+			require.Equal(t, uint64(2), info.Remaining)
+
+			info, err = store.TakeN("key", 2)
+			require.NoError(t, err)
+			require.True(t, info.OperationOk)
+			require.Equal(t, uint64(0), info.Remaining)
+		})
+	}
+}
+
+func TestMemoryStore_Peek(t *testing.T) {
+	t.Parallel()
+
+	algorithms := []limits.Algorithm{
+		limits.AlgorithmFixedWindow,
+		limits.AlgorithmTokenBucket,
+		limits.AlgorithmSlidingWindow,
+		limits.AlgorithmSlidingLog,
+		limits.AlgorithmGCRA,
+	}
+
+	for _, alg := range algorithms {
+		alg := alg
+		t.Run(alg.String(), func(t *testing.T) {
+			t.Parallel()
+
+			config := limits.Config{
+				Limit:       3,
+				Interval:    time.Hour,
+				Algorithm:   alg,
+				TTLInterval: 24 * time.Hour,
+				MinTTL:      24 * time.Hour,
+			}
+			store := limits.NewMemoryStore(&config)
+			t.Cleanup(func() {
+				err := store.Close()
+				require.NoError(t, err)
+			})
+
+			// an unknown key reports the full limit and is not created
+			info, err := store.Peek("key")
+			require.NoError(t, err)
+			require.True(t, info.OperationOk)
+			require.Equal(t, uint64(3), info.LimitSize)
+			require.Equal(t, uint64(3), info.Remaining)
+			require.True(t, info.Reset > 0)
+
+			limit, _, err := store.Get("key")
+			require.NoError(t, err)
+			require.Equal(t, uint64(0), limit)
+
+			taken, err := store.TakeN("key", 3)
+			require.NoError(t, err)
+			require.True(t, taken.OperationOk)
+
+			// peeking never takes a token
+			for i := 0; i < 2; i++ {
+				info, err = store.Peek("key")
+				require.NoError(t, err)
+				require.False(t, info.OperationOk)
+				require.Equal(t, uint64(0), info.Remaining)
+				require.Equal(t, taken.LimitSize, info.LimitSize)
+				require.True(t, info.Reset > uint64(time.Now().UnixNano()))
+			}
+		})
+	}
+}
+
+func TestBucket_PeekAfterWindowRollover(t *testing.T) {
+	t.Parallel()
+
+	interval := 100 * time.Millisecond
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	b := limits.NewBucket(clock, 2, interval)
+	require.True(t, b.TakeN(2).OperationOk)
+
+	_, remaining := b.Get()
+	require.Equal(t, uint64(0), remaining)
+
+	clock.Add(interval)
+
+	// the window rolled over, get and peek see the refill before any take
+	_, remaining = b.Get()
+	require.Equal(t, uint64(2), remaining)
+
+	info := b.Peek()
+	require.True(t, info.OperationOk)
+	require.Equal(t, uint64(2), info.Remaining)
+	require.Equal(t, uint64(2*interval), info.Reset)
+}
+
+func TestMemoryStore_Return(t *testing.T) {
+	t.Parallel()
+
+	algorithms := []limits.Algorithm{
+		limits.AlgorithmFixedWindow,
+		limits.AlgorithmTokenBucket,
+		limits.AlgorithmSlidingWindow,
+		limits.AlgorithmSlidingLog,
+		limits.AlgorithmGCRA,
+	}
+
+	for _, alg := range algorithms {
+		alg := alg
+		t.Run(alg.String(), func(t *testing.T) {
+			t.Parallel()
+
+			config := limits.Config{
+				Limit:       3,
+				Interval:    time.Hour,
+				Algorithm:   alg,
+				TTLInterval: 24 * time.Hour,
+				MinTTL:      24 * time.Hour,
+			}
+			store := limits.NewMemoryStore(&config)
+			t.Cleanup(func() {
+				err := store.Close()
+				require.NoError(t, err)
+			})
+
+			// unknown keys are ignored
+			require.NoError(t, store.Return("key", 1))
+			limit, _, err := store.Get("key")
+			require.NoError(t, err)
+			require.Equal(t, uint64(0), limit)
+
+			info, err := store.TakeN("key", 3)
+			require.NoError(t, err)
+			require.True(t, info.OperationOk)
+
+			require.NoError(t, store.Return("key", 2))
+			_, remaining, err := store.Get("key")
+			require.NoError(t, err)
+			require.Equal(t, uint64(2), remaining)
+
+			// bounded by the limit
+			require.NoError(t, store.Return("key", 10))
+			_, remaining, err = store.Get("key")
+			require.NoError(t, err)
+			require.Equal(t, uint64(3), remaining)
+		})
+	}
+}
+
+func TestMemoryStore_Sweep(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	config := limits.Config{
+		Limit:       1,
+		Interval:    time.Minute,
+		TTLInterval: time.Hour,
+		MinTTL:      time.Hour,
+		Clock:       clock,
+	}
+	store := limits.NewMemoryStore(&config)
+	t.Cleanup(func() {
+		err := store.Close()
+		require.NoError(t, err)
+	})
+
+	_, err := store.Take("stale")
+	require.NoError(t, err)
+
+	clock.Add(30 * time.Minute)
+	_, err = store.Take("active")
+	require.NoError(t, err)
+
+	// stale was last active in the window starting at 0, over an hour ago
+	clock.Add(31 * time.Minute)
+	store.Sweep()
+
+	// unknown keys report no limit
+	limit, _, err := store.Get("stale")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), limit)
+
+	limit, _, err = store.Get("active")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), limit)
+
+	// a swept key starts over with a full window
+	info, err := store.Take("stale")
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+}
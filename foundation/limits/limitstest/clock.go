@@ -0,0 +1,51 @@
+// Package limitstest provides test helpers for code built on the limits
+// package
+package limitstest
+
+import (
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"sync"
+	"time"
+)
+
+var _ limits.Clock = (*ManualClock)(nil)
+
+// ManualClock is a limits.Clock that only moves when told to. It lets tests
+// roll windows over, refill buckets and expire entries without sleeping.
+//
+// now  - the time reported by the clock
+// lock - mutex lock to guard now
+type ManualClock struct {
+	now  time.Time
+	lock sync.Mutex
+}
+
+// NewManualClock creates a clock stopped at start
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+// Now is the time the clock is stopped at
+func (c *ManualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+// Add moves the clock forward by d and returns the new time
+func (c *ManualClock) Add(d time.Duration) time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+// Set stops the clock at t
+func (c *ManualClock) Set(t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = t
+}
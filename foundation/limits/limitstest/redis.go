@@ -0,0 +1,198 @@
+package limitstest
+
+import (
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/api_rate_limiter/foundation/resp/resptest"
+	"github.com/rsb/failure"
+	"strconv"
+)
+
+// HandleRedisScripts registers Go equivalents of the RedisStore lua scripts
+// with the stand-in server, so a RedisStore can be tested without redis
+func HandleRedisScripts(s *resptest.Server) {
+	s.HandleScript(limits.RedisTakeScript, redisTake)
+	s.HandleScript(limits.RedisPeekScript, redisPeek)
+	s.HandleScript(limits.RedisReturnScript, redisReturn)
+	s.HandleScript(limits.RedisSetScript, redisSet)
+}
+
+// window is the fixed window state the scripts keep in a hash
+type window struct {
+	limit     int64
+	interval  int64
+	start     int64
+	tick      int64
+	available int64
+	exists    bool
+}
+
+func loadWindow(tx *resptest.Tx, key string, now, limit, interval int64) (window, error) {
+	w := window{limit: limit, interval: interval, start: now, available: limit}
+
+	reply, err := tx.Call("HMGET", key, "limit", "interval", "start", "tick", "available")
+	if err != nil {
+		return w, err
+	}
+
+	values := reply.([]interface{})
+	if values[0] == nil {
+		return w, nil
+	}
+
+	fields := make([]int64, len(values))
+	for i, v := range values {
+		s, _ := v.(string)
+		if fields[i], err = strconv.ParseInt(s, 10, 64); err != nil {
+			return w, failure.ToInvalidState(err, "field (%d) of (%s) is not a number", i, key)
+		}
+	}
+
+	return window{
+		limit:     fields[0],
+		interval:  fields[1],
+		start:     fields[2],
+		tick:      fields[3],
+		available: fields[4],
+		exists:    true,
+	}, nil
+}
+
+// current is the tick of now, refilling the window when it rolled over
+func (w *window) current(now int64) int64 {
+	var current int64
+	if now > w.start {
+		current = (now - w.start) / w.interval
+	}
+
+	if current > w.tick {
+		w.tick, w.available = current, w.limit
+	}
+
+	return current
+}
+
+func (w window) save(tx *resptest.Tx, key string, ttl int64) error {
+	_, err := tx.Call("HSET", key,
+		"limit", format(w.limit),
+		"interval", format(w.interval),
+		"start", format(w.start),
+		"tick", format(w.tick),
+		"available", format(w.available),
+	)
+	if err != nil {
+		return err
+	}
+
+	if ms := (w.interval + 999) / 1000; ms > ttl {
+		ttl = ms
+	}
+	_, err = tx.Call("PEXPIRE", key, format(ttl))
+	return err
+}
+
+func redisTake(tx *resptest.Tx, keys, args []string) (interface{}, error) {
+	a, err := parse(args, 5)
+	if err != nil {
+		return nil, err
+	}
+	now, n, ttl := a[0], a[3], a[4]
+
+	w, err := loadWindow(tx, keys[0], now, a[1], a[2])
+	if err != nil {
+		return nil, err
+	}
+
+	current := w.current(now)
+	ok := int64(0)
+	if w.available >= n {
+		w.available -= n
+		ok = 1
+	}
+
+	if err = w.save(tx, keys[0], ttl); err != nil {
+		return nil, err
+	}
+
+	return []interface{}{w.limit, w.available, w.start + (current+1)*w.interval, ok}, nil
+}
+
+func redisPeek(tx *resptest.Tx, keys, args []string) (interface{}, error) {
+	a, err := parse(args, 3)
+	if err != nil {
+		return nil, err
+	}
+	now := a[0]
+
+	w, err := loadWindow(tx, keys[0], now, a[1], a[2])
+	if err != nil {
+		return nil, err
+	}
+
+	current := w.current(now)
+	return []interface{}{w.limit, w.available, w.start + (current+1)*w.interval, w.exists}, nil
+}
+
+func redisReturn(tx *resptest.Tx, keys, args []string) (interface{}, error) {
+	a, err := parse(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	now, n := a[0], a[1]
+
+	w, err := loadWindow(tx, keys[0], now, 0, 0)
+	if err != nil || !w.exists {
+		return int64(0), err
+	}
+
+	w.current(now)
+	w.available += n
+	if w.available > w.limit {
+		w.available = w.limit
+	}
+
+	_, err = tx.Call("HSET", keys[0], "tick", format(w.tick), "available", format(w.available))
+	if err != nil {
+		return nil, err
+	}
+
+	return int64(1), nil
+}
+
+func redisSet(tx *resptest.Tx, keys, args []string) (interface{}, error) {
+	a, err := parse(args, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = tx.Call("DEL", keys[0]); err != nil {
+		return nil, err
+	}
+
+	w := window{limit: a[1], interval: a[2], start: a[0], available: a[1]}
+	if err = w.save(tx, keys[0], a[3]); err != nil {
+		return nil, err
+	}
+
+	return int64(1), nil
+}
+
+func parse(args []string, n int) ([]int64, error) {
+	if len(args) != n {
+		return nil, failure.InvalidParam("expected (%d) arguments, got (%d)", n, len(args))
+	}
+
+	values := make([]int64, n)
+	for i, arg := range args {
+		v, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return nil, failure.ToInvalidParam(err, "argument (%d) is not a number", i)
+		}
+		values[i] = v
+	}
+
+	return values, nil
+}
+
+func format(v int64) string {
+	return strconv.FormatInt(v, 10)
+}
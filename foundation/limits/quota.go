@@ -0,0 +1,690 @@
+package limits
+
+import (
+	"github.com/rsb/failure"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	_ Store       = (*QuotaStore)(nil)
+	_ Snapshotter = (*QuotaStore)(nil)
+)
+
+// Period is the calendar period a quota is measured against
+type Period string
+
+const (
+	PeriodDaily   Period = "daily"
+	PeriodMonthly Period = "monthly"
+)
+
+func (p Period) String() string {
+	return string(p)
+}
+
+// IsValid reports whether the period is one supported by this package
+func (p Period) IsValid() bool {
+	switch p {
+	case PeriodDaily, PeriodMonthly:
+		return true
+	}
+
+	return false
+}
+
+// Bounds is the start and the end of the period holding t, aligned on the
+// calendar of loc: midnight for a daily period and midnight of the first of
+// the month for a monthly one. Days are 23 or 25 hours long when daylight
+// saving time changes.
+func (p Period) Bounds(t time.Time, loc *time.Location) (time.Time, time.Time) {
+	t = t.In(loc)
+
+	if p == PeriodMonthly {
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 1, 0)
+	}
+
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// algorithm identifies the snapshots of a QuotaStore of this period
+func (p Period) algorithm() Algorithm {
+	return Algorithm("quota-" + string(p))
+}
+
+// QuotaConfig controls the calendar a QuotaStore aligns its periods on
+//
+// Period      - daily or monthly, defaults to daily
+// Location    - time zone of the calendar, defaults to UTC
+// KeyLocation - time zone of the calendar of a key, like the one of its
+// 							 tenant. Location is used when nil or when it returns nil
+type QuotaConfig struct {
+	Period      Period
+	Location    *time.Location
+	KeyLocation func(key string) *time.Location
+}
+
+// QuotaStore enforces long horizon quotas, like a daily or monthly billing
+// quota, aligned on calendar boundaries instead of the first request of a
+// key. Every key of the same time zone resets at once, at midnight or on the
+// first of the month. The usage of a key is kept until its period ends, so
+// the TTL only purges the keys of ended periods, and it survives restarts
+// through the snapshot configured like the one of a MemoryStore. A quota set
+// for a key with Set is kept across periods and restarts, it is never purged
+// by the TTL. Like the MemoryStore it holds at most MaxKeys keys, a new key
+// in a full store is handled by the overflow policy.
+type QuotaStore struct {
+	clock       Clock
+	limit       uint64
+	ttl         TTL
+	period      Period
+	location    *time.Location
+	keyLocation func(key string) *time.Location
+	maxKeys     int
+	overflow    OverflowPolicy
+
+	snapshotPath     string
+	snapshotInterval time.Duration
+	snapshotFailed   func(err error)
+
+	data   map[string]*Quota
+	ring   *keyRing
+	lock   sync.RWMutex
+	saving sync.Mutex
+
+	stopped   uint32
+	stop      chan struct{}
+	collector collector
+}
+
+// NewQuotaStore creates a store using the limit, TTL, clock, initial size,
+// max keys, overflow policy and snapshot of the config, the interval and
+// algorithm are replaced by the calendar period of the quota.
+func NewQuotaStore(config *Config, quota QuotaConfig) (*QuotaStore, error) {
+	defaults := NewDefaultConfig()
+	if config == nil {
+		config = defaults
+	}
+
+	period := PeriodDaily
+	if quota.Period != "" {
+		period = quota.Period
+	}
+
+	if !period.IsValid() {
+		return nil, failure.InvalidParam("quota period (%s) is not supported", period)
+	}
+
+	location := time.UTC
+	if quota.Location != nil {
+		location = quota.Location
+	}
+
+	tokens := defaults.Limit
+	if config.Limit > 0 {
+		tokens = config.Limit
+	}
+
+	sweepInterval := defaults.TTLInterval
+	if config.TTLInterval > 0 {
+		sweepInterval = config.TTLInterval
+	}
+
+	sweepMinTTL := defaults.MinTTL
+	if config.MinTTL > 0 {
+		sweepMinTTL = config.MinTTL
+	}
+
+	size := defaults.InitialSize
+	if config.InitialSize > 0 {
+		size = config.InitialSize
+	}
+
+	clock := defaults.Clock
+	if config.Clock != nil {
+		clock = config.Clock
+	}
+
+	overflow := defaults.Overflow
+	if config.Overflow.IsValid() {
+		overflow = config.Overflow
+	}
+
+	store := QuotaStore{
+		clock:            clock,
+		limit:            tokens,
+		ttl:              NewTTL(sweepInterval, uint64(sweepMinTTL)),
+		period:           period,
+		location:         location,
+		keyLocation:      quota.KeyLocation,
+		maxKeys:          config.MaxKeys,
+		overflow:         overflow,
+		snapshotPath:     config.SnapshotPath,
+		snapshotInterval: config.SnapshotInterval,
+		snapshotFailed:   config.SnapshotFailed,
+		data:             make(map[string]*Quota, size),
+		stop:             make(chan struct{}),
+	}
+
+	if config.MaxKeys > 0 {
+		if size > config.MaxKeys {
+			size = config.MaxKeys
+		}
+		store.ring = newKeyRing(size)
+	}
+
+	return &store, nil
+}
+
+// Period is the calendar period of the quotas
+func (s *QuotaStore) Period() Period {
+	return s.period
+}
+
+// Take consumes a single token for the key
+func (s *QuotaStore) Take(key string) (RateInfo, error) {
+	return s.TakeN(key, 1)
+}
+
+// TakeN consumes n tokens of the key's quota for the current period, or none
+// when the quota can not afford them
+func (s *QuotaStore) TakeN(key string, n uint64) (RateInfo, error) {
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return RateInfo{}, failure.InvalidState("QuotaStore is stopped")
+	}
+
+	q, ok := s.quota(key)
+	if !ok {
+		return s.rejected(key), nil
+	}
+
+	return q.TakeN(s.clock.Now(), n), nil
+}
+
+// Peek reports the state of the key's quota without taking a token. A key
+// the store has not seen yet reports the full store limit.
+func (s *QuotaStore) Peek(key string) (RateInfo, error) {
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return RateInfo{}, failure.InvalidState("QuotaStore is stopped")
+	}
+
+	s.lock.RLock()
+	q, ok := s.data[key]
+	s.lock.RUnlock()
+
+	if !ok {
+		q = NewQuota(s.limit, s.period, s.locationOf(key))
+	}
+
+	return q.Peek(s.clock.Now()), nil
+}
+
+// Return gives n tokens back to the key's quota for the current period. It
+// is a no-op for keys the store does not hold.
+func (s *QuotaStore) Return(key string, n uint64) error {
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return failure.InvalidState("QuotaStore is stopped")
+	}
+
+	s.lock.RLock()
+	q, ok := s.data[key]
+	s.lock.RUnlock()
+
+	if ok {
+		q.Return(s.clock.Now(), n)
+	}
+
+	return nil
+}
+
+// Get returns the limit and remaining tokens of the key, zero values when
+// the key has not been seen
+func (s *QuotaStore) Get(key string) (uint64, uint64, error) {
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return 0, 0, failure.InvalidState("QuotaStore is stopped")
+	}
+
+	s.lock.RLock()
+	q, ok := s.data[key]
+	s.lock.RUnlock()
+
+	if !ok {
+		return 0, 0, nil
+	}
+
+	info := q.Peek(s.clock.Now())
+	return info.LimitSize, info.Remaining, nil
+}
+
+// Set replaces the quota of the key, like the quota of a tenant's plan. The
+// interval is ignored, the quota keeps the period of the store. The usage of
+// the current period is kept and the quota applies to the following periods.
+// A new key in a full store evicts another key, unless the overflow policy
+// does not allow evictions.
+func (s *QuotaStore) Set(key string, tokens uint64, _ time.Duration) error {
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return failure.InvalidState("QuotaStore is stopped")
+	}
+
+	if tokens == 0 {
+		return failure.InvalidParam("tokens must be positive")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	q, ok := s.data[key]
+	if !ok {
+		if s.isFull() {
+			if s.overflow != OverflowEvict {
+				return failure.OutOfRange("store is full (%d keys), can not set (%s)", s.maxKeys, key)
+			}
+			s.evict()
+		}
+
+		q = NewQuota(s.limit, s.period, s.locationOf(key))
+		s.insert(key, q)
+	}
+
+	s.touch(key)
+	q.setLimit(s.clock.Now(), tokens)
+	return nil
+}
+
+// Close stops the garbage collector and waits for it to return, then saves
+// the snapshot when a snapshot path is configured
+func (s *QuotaStore) Close() error {
+	if !atomic.CompareAndSwapUint32(&s.stopped, 0, 1) {
+		return nil
+	}
+
+	s.collector.close(s.stop)
+
+	var err error
+	if s.snapshotPath != "" {
+		if sErr := s.SaveFile(s.snapshotPath); sErr != nil {
+			err = failure.Wrap(sErr, "s.SaveFile failed")
+		}
+	}
+
+	s.lock.Lock()
+	s.data = make(map[string]*Quota)
+	if s.ring != nil {
+		s.ring.reset()
+	}
+	s.lock.Unlock()
+
+	return err
+}
+
+// GarbageCollector purges the keys of ended periods on every TTL interval
+// and saves the snapshot on every snapshot interval until Close is called
+func (s *QuotaStore) GarbageCollector() {
+	if !s.collector.start() {
+		return
+	}
+	defer s.collector.done()
+
+	sweep := time.NewTicker(s.ttl.Interval)
+	defer sweep.Stop()
+
+	snapshot, stopSnapshot := snapshotTicker(s.snapshotPath, s.snapshotInterval)
+	defer stopSnapshot()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-sweep.C:
+			s.Sweep()
+		case <-snapshot:
+			if atomic.LoadUint32(&s.stopped) == 1 {
+				continue
+			}
+			if err := s.SaveFile(s.snapshotPath); err != nil && s.snapshotFailed != nil {
+				s.snapshotFailed(err)
+			}
+		}
+	}
+}
+
+// Sweep purges the keys whose period ended and that have been inactive for
+// longer than the TTL, apart from the keys with a quota of their own
+func (s *QuotaStore) Sweep() {
+	now := s.clock.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for k, q := range s.data {
+		if q.isStale(now, s.ttl.Value, s.limit) {
+			s.remove(k)
+		}
+	}
+}
+
+// Len is the number of keys held by the store
+func (s *QuotaStore) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return len(s.data)
+}
+
+// Snapshot writes the quota of every key to w
+func (s *QuotaStore) Snapshot(w io.Writer) error {
+	s.lock.RLock()
+	entries := make([]SnapshotEntry, 0, len(s.data))
+	for k, q := range s.data {
+		entries = append(entries, SnapshotEntry{Key: k, State: q.State()})
+	}
+	s.lock.RUnlock()
+
+	return writeSnapshot(w, s.period.algorithm(), unixNano(s.clock), entries)
+}
+
+// Restore loads the quotas of a snapshot written by Snapshot and returns how
+// many were restored. The usage of a period that ended while the store was
+// down is dropped, the keys without a custom quota and without usage are not
+// restored.
+func (s *QuotaStore) Restore(r io.Reader) (int, error) {
+	snap, err := readSnapshot(r, s.period.algorithm())
+	if err != nil {
+		return 0, failure.Wrap(err, "readSnapshot failed")
+	}
+
+	now := s.clock.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	count := 0
+	for _, e := range snap.Entries {
+		if _, ok := s.data[e.Key]; ok || e.State.Limit == 0 {
+			continue
+		}
+
+		if s.isFull() {
+			break
+		}
+
+		q := NewQuota(e.State.Limit, s.period, s.locationOf(e.Key))
+		if !q.restore(now, e.State) {
+			continue
+		}
+
+		if e.State.Limit == s.limit && q.used == 0 {
+			continue
+		}
+
+		s.insert(e.Key, q)
+		count++
+	}
+
+	return count, nil
+}
+
+// SaveFile writes a snapshot to path, see MemoryStore.SaveFile
+func (s *QuotaStore) SaveFile(path string) error {
+	s.saving.Lock()
+	defer s.saving.Unlock()
+
+	return saveSnapshot(path, s.Snapshot)
+}
+
+// LoadFile restores the snapshot at path and returns how many keys were
+// restored. A missing file restores nothing and is not an error.
+func (s *QuotaStore) LoadFile(path string) (int, error) {
+	return loadSnapshot(path, s.Restore)
+}
+
+// quota returns the quota of the key, creating it with the store limit when
+// the key is new. It is not ok when the store is full and its overflow policy
+// rejects new keys.
+func (s *QuotaStore) quota(key string) (*Quota, bool) {
+	s.lock.RLock()
+	if q, ok := s.data[key]; ok {
+		s.touch(key)
+		s.lock.RUnlock()
+		return q, true
+	}
+	s.lock.RUnlock()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if q, ok := s.data[key]; ok {
+		s.touch(key)
+		return q, true
+	}
+
+	q := NewQuota(s.limit, s.period, s.locationOf(key))
+	if s.isFull() {
+		switch s.overflow {
+		case OverflowAdmit:
+			return q, true
+		case OverflowReject:
+			return nil, false
+		default:
+			s.evict()
+		}
+	}
+
+	s.insert(key, q)
+	return q, true
+}
+
+// isFull reports whether a new key would exceed MaxKeys. The write lock
+// must be held.
+func (s *QuotaStore) isFull() bool {
+	return s.maxKeys > 0 && len(s.data) >= s.maxKeys
+}
+
+// touch marks the key as recently used for eviction. The read or write lock
+// must be held.
+func (s *QuotaStore) touch(key string) {
+	if s.ring != nil {
+		s.ring.touch(key)
+	}
+}
+
+// insert stores the quota of a new key. The write lock must be held.
+func (s *QuotaStore) insert(key string, q *Quota) {
+	s.data[key] = q
+	if s.ring != nil {
+		s.ring.add(key)
+	}
+}
+
+// remove deletes the key. The write lock must be held.
+func (s *QuotaStore) remove(key string) {
+	delete(s.data, key)
+	if s.ring != nil {
+		s.ring.remove(key)
+	}
+}
+
+// evict removes the least recently used key. The write lock must be held.
+func (s *QuotaStore) evict() {
+	if s.ring == nil || len(s.ring.keys) == 0 {
+		return
+	}
+
+	s.remove(s.ring.victim())
+}
+
+// rejected is the state reported for a new key rejected by a full store, its
+// quota is available again once the period ends
+func (s *QuotaStore) rejected(key string) RateInfo {
+	_, end := s.period.Bounds(s.clock.Now(), s.locationOf(key))
+	return RateInfo{
+		LimitSize:   s.limit,
+		Remaining:   0,
+		Reset:       uint64(end.UnixNano()),
+		OperationOk: false,
+	}
+}
+
+// locationOf is the time zone of the calendar of the key
+func (s *QuotaStore) locationOf(key string) *time.Location {
+	if s.keyLocation != nil {
+		if loc := s.keyLocation(key); loc != nil {
+			return loc
+		}
+	}
+
+	return s.location
+}
+
+// Quota is the usage of a single key during the current calendar period.
+// The usage starts over when a new period begins.
+//
+// limit      - the max number of tokens of a period
+// used       - the tokens taken during the current period
+// period     - the calendar period
+// location   - the time zone of the calendar
+// start      - the beginning of the current period
+// end        - the beginning of the next period
+// lastActive - the last time tokens were taken or returned
+type Quota struct {
+	limit      uint64
+	used       uint64
+	period     Period
+	location   *time.Location
+	start      time.Time
+	end        time.Time
+	lastActive time.Time
+	lock       sync.Mutex
+}
+
+// NewQuota creates the quota of a key, the period is set on first use
+func NewQuota(limit uint64, period Period, location *time.Location) *Quota {
+	return &Quota{
+		limit:    limit,
+		period:   period,
+		location: location,
+	}
+}
+
+// TakeN takes n tokens when the quota of the period holding now can afford
+// them, otherwise it takes nothing and reports the operation as not ok
+func (q *Quota) TakeN(now time.Time, n uint64) RateInfo {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.roll(now)
+	q.lastActive = now
+
+	ok := q.limit-q.used >= n
+	if ok {
+		q.used += n
+	}
+
+	return q.info(ok)
+}
+
+// Peek reports the state of the quota without taking a token
+func (q *Quota) Peek(now time.Time) RateInfo {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.roll(now)
+	return q.info(q.used < q.limit)
+}
+
+// Return gives n tokens back to the quota of the current period
+func (q *Quota) Return(now time.Time, n uint64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.roll(now)
+	q.lastActive = now
+
+	if n > q.used {
+		n = q.used
+	}
+	q.used -= n
+}
+
+// State is the quota of the current period, Start is the beginning of the
+// period, Available the tokens left and At the last activity
+func (q *Quota) State() LimiterState {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return LimiterState{
+		Limit:     q.limit,
+		Interval:  q.end.Sub(q.start),
+		Start:     uint64(q.start.UnixNano()),
+		Available: q.limit - q.used,
+		At:        uint64(q.lastActive.UnixNano()),
+	}
+}
+
+// restore sets the usage of the state when it belongs to the period holding
+// now, the usage of an ended period is dropped. It is not ok when the usage
+// exceeds the limit.
+func (q *Quota) restore(now time.Time, s LimiterState) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.roll(now)
+	q.lastActive = time.Unix(0, int64(s.At))
+	if s.Start != uint64(q.start.UnixNano()) {
+		return true
+	}
+
+	if s.Available > q.limit {
+		return false
+	}
+
+	q.used = q.limit - s.Available
+	return true
+}
+
+// setLimit replaces the limit, the usage of the period holding now is kept
+func (q *Quota) setLimit(now time.Time, limit uint64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.roll(now)
+	q.lastActive = now
+	q.limit = limit
+	if q.used > limit {
+		q.used = limit
+	}
+}
+
+// isStale reports whether the quota uses the store limit, its period ended
+// and it has been inactive for longer than ttl nanoseconds. A quota with a
+// limit of its own is never stale.
+func (q *Quota) isStale(now time.Time, ttl, limit uint64) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.limit == limit && !now.Before(q.end) && now.Sub(q.lastActive) > time.Duration(ttl)
+}
+
+// roll starts a new period once now reaches the end of the current one, a
+// clock going backwards stays in the current period. The lock must be held.
+func (q *Quota) roll(now time.Time) {
+	if !q.end.IsZero() && now.Before(q.end) {
+		return
+	}
+
+	q.start, q.end = q.period.Bounds(now, q.location)
+	q.used = 0
+}
+
+// info reports the state of the quota. The lock must be held.
+func (q *Quota) info(ok bool) RateInfo {
+	return RateInfo{
+		LimitSize:   q.limit,
+		Remaining:   q.limit - q.used,
+		Reset:       uint64(q.end.UnixNano()),
+		OperationOk: ok,
+	}
+}
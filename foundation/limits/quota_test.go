@@ -0,0 +1,383 @@
+package limits_test
+
+import (
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/api_rate_limiter/foundation/limits/limitstest"
+	"github.com/rsb/failure"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPeriod_Bounds(t *testing.T) {
+	t.Parallel()
+
+	tokyo := time.FixedZone("JST", 9*60*60)
+	tests := map[string]struct {
+		period limits.Period
+		at     time.Time
+		loc    *time.Location
+		start  time.Time
+		end    time.Time
+	}{
+		"daily utc": {
+			period: limits.PeriodDaily,
+			at:     time.Date(2022, 6, 1, 23, 59, 59, 0, time.UTC),
+			loc:    time.UTC,
+			start:  time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC),
+			end:    time.Date(2022, 6, 2, 0, 0, 0, 0, time.UTC),
+		},
+		"daily tokyo": {
+			period: limits.PeriodDaily,
+			at:     time.Date(2022, 6, 1, 16, 0, 0, 0, time.UTC),
+			loc:    tokyo,
+			start:  time.Date(2022, 6, 2, 0, 0, 0, 0, tokyo),
+			end:    time.Date(2022, 6, 3, 0, 0, 0, 0, tokyo),
+		},
+		"monthly": {
+			period: limits.PeriodMonthly,
+			at:     time.Date(2022, 2, 28, 12, 0, 0, 0, time.UTC),
+			loc:    time.UTC,
+			start:  time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC),
+			end:    time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC),
+		},
+		"monthly year end": {
+			period: limits.PeriodMonthly,
+			at:     time.Date(2022, 12, 31, 23, 0, 0, 0, time.UTC),
+			loc:    time.UTC,
+			start:  time.Date(2022, 12, 1, 0, 0, 0, 0, time.UTC),
+			end:    time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			start, end := tt.period.Bounds(tt.at, tt.loc)
+			require.True(t, tt.start.Equal(start), start)
+			require.True(t, tt.end.Equal(end), end)
+		})
+	}
+}
+
+func TestQuotaStore_Daily(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Date(2022, 6, 1, 23, 0, 0, 0, time.UTC))
+	store, err := limits.NewQuotaStore(&limits.Config{Limit: 3, Clock: clock}, limits.QuotaConfig{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+	require.Equal(t, limits.PeriodDaily, store.Period())
+
+	midnight := uint64(time.Date(2022, 6, 2, 0, 0, 0, 0, time.UTC).UnixNano())
+	info, err := store.TakeN("key", 3)
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+	require.Zero(t, info.Remaining)
+	require.Equal(t, midnight, info.Reset)
+
+	info, err = store.Take("key")
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+
+	require.NoError(t, store.Return("key", 1))
+	info, err = store.Peek("key")
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+	require.Equal(t, uint64(1), info.Remaining)
+
+	// every key resets at midnight, not a day after its first request
+	clock.Add(time.Hour)
+	limit, remaining, err := store.Get("key")
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), limit)
+	require.Equal(t, uint64(3), remaining)
+
+	info, err = store.Take("key")
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+	require.Equal(t, midnight+uint64(24*time.Hour), info.Reset)
+}
+
+func TestQuotaStore_Monthly(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Date(2022, 1, 31, 12, 0, 0, 0, time.UTC))
+	store, err := limits.NewQuotaStore(&limits.Config{Limit: 100, Clock: clock}, limits.QuotaConfig{Period: limits.PeriodMonthly})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	info, err := store.TakeN("key", 60)
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+	require.Equal(t, uint64(time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC).UnixNano()), info.Reset)
+
+	// a tenant's plan is raised for the rest of the month
+	require.NoError(t, store.Set("key", 200, 0))
+	info, err = store.TakeN("key", 100)
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+	require.Equal(t, uint64(40), info.Remaining)
+
+	clock.Add(12 * time.Hour)
+	info, err = store.Peek("key")
+	require.NoError(t, err)
+	require.Equal(t, uint64(200), info.Remaining)
+	require.Equal(t, uint64(time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC).UnixNano()), info.Reset)
+}
+
+func TestQuotaStore_KeyLocation(t *testing.T) {
+	t.Parallel()
+
+	tokyo := time.FixedZone("JST", 9*60*60)
+	clock := limitstest.NewManualClock(time.Date(2022, 6, 1, 14, 0, 0, 0, time.UTC))
+	store, err := limits.NewQuotaStore(&limits.Config{Limit: 1, Clock: clock}, limits.QuotaConfig{
+		KeyLocation: func(key string) *time.Location {
+			if key == "tokyo" {
+				return tokyo
+			}
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	for _, key := range []string{"tokyo", "london"} {
+		info, err := store.Take(key)
+		require.NoError(t, err)
+		require.True(t, info.OperationOk)
+	}
+
+	// it is past midnight in tokyo but not in utc
+	clock.Add(2 * time.Hour)
+	info, err := store.Take("tokyo")
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+	require.Equal(t, uint64(time.Date(2022, 6, 3, 0, 0, 0, 0, tokyo).UnixNano()), info.Reset)
+
+	info, err = store.Take("london")
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+	require.Equal(t, uint64(time.Date(2022, 6, 2, 0, 0, 0, 0, time.UTC).UnixNano()), info.Reset)
+}
+
+func TestQuotaStore_SnapshotAcrossRestarts(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	config := &limits.Config{Limit: 5, Clock: clock, SnapshotPath: filepath.Join(t.TempDir(), "quota.json")}
+
+	store, err := limits.NewQuotaStore(config, limits.QuotaConfig{})
+	require.NoError(t, err)
+	_, err = store.TakeN("used", 4)
+	require.NoError(t, err)
+	require.NoError(t, store.Set("custom", 10, 0))
+	_, err = store.Peek("unused")
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	// the usage of the day survives the restart
+	clock.Add(time.Hour)
+	store, err = limits.NewQuotaStore(config, limits.QuotaConfig{})
+	require.NoError(t, err)
+	count, err := store.LoadFile(config.SnapshotPath)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	_, remaining, err := store.Get("used")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), remaining)
+	limit, _, err := store.Get("custom")
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), limit)
+	require.NoError(t, store.Close())
+
+	// a snapshot of a previous day only restores the custom quotas
+	clock.Add(24 * time.Hour)
+	store, err = limits.NewQuotaStore(config, limits.QuotaConfig{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+	count, err = store.LoadFile(config.SnapshotPath)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	limit, remaining, err = store.Get("custom")
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), limit)
+	require.Equal(t, uint64(10), remaining)
+	limit, _, err = store.Get("used")
+	require.NoError(t, err)
+	require.Zero(t, limit)
+
+	// a snapshot of another period is refused
+	monthly, err := limits.NewQuotaStore(&limits.Config{Clock: clock}, limits.QuotaConfig{Period: limits.PeriodMonthly})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, monthly.Close())
+	})
+	_, err = monthly.LoadFile(config.SnapshotPath)
+	require.True(t, failure.IsInvalidState(err))
+}
+
+func TestQuotaStore_SnapshotCloseWaitsForCollector(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	clock := &gatedClock{entered: make(chan struct{}), release: make(chan struct{})}
+	config := &limits.Config{
+		Limit:            5,
+		Clock:            clock,
+		SnapshotPath:     filepath.Join(dir, "quota.json"),
+		SnapshotInterval: time.Millisecond,
+	}
+
+	store, err := limits.NewQuotaStore(config, limits.QuotaConfig{})
+	require.NoError(t, err)
+	_, err = store.TakeN("key", 2)
+	require.NoError(t, err)
+
+	// hold a periodic snapshot while it is being written
+	atomic.StoreInt32(&clock.armed, 1)
+	go store.GarbageCollector()
+	<-clock.entered
+
+	closed := make(chan error)
+	go func() {
+		closed <- store.Close()
+	}()
+
+	select {
+	case err = <-closed:
+		t.Fatalf("Close returned before the garbage collector: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(clock.release)
+	require.NoError(t, <-closed)
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	restored, err := limits.NewQuotaStore(&limits.Config{Limit: 5}, limits.QuotaConfig{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, restored.Close())
+	})
+
+	count, err := restored.LoadFile(config.SnapshotPath)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+}
+
+func TestQuotaStore_Sweep(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	store, err := limits.NewQuotaStore(&limits.Config{Limit: 5, MinTTL: time.Hour, Clock: clock}, limits.QuotaConfig{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	_, err = store.Take("key")
+	require.NoError(t, err)
+	require.NoError(t, store.Set("custom", 10, 0))
+
+	// inactive for longer than the ttl, the usage is kept until midnight
+	clock.Add(12 * time.Hour)
+	store.Sweep()
+	require.Equal(t, 2, store.Len())
+
+	// a custom quota is kept across periods
+	clock.Add(2 * time.Hour)
+	store.Sweep()
+	require.Equal(t, 1, store.Len())
+
+	clock.Add(30 * 24 * time.Hour)
+	store.Sweep()
+	limit, remaining, err := store.Get("custom")
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), limit)
+	require.Equal(t, uint64(10), remaining)
+}
+
+func TestQuotaStore_MaxKeys(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	newStore := func(overflow limits.OverflowPolicy) *limits.QuotaStore {
+		store, err := limits.NewQuotaStore(&limits.Config{Limit: 1, MaxKeys: 2, Overflow: overflow, Clock: clock}, limits.QuotaConfig{})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, store.Close())
+		})
+
+		for _, key := range []string{"a", "b"} {
+			info, err := store.Take(key)
+			require.NoError(t, err)
+			require.True(t, info.OperationOk)
+		}
+		return store
+	}
+
+	// b is used again, a is the least recently used
+	store := newStore(limits.OverflowEvict)
+	_, err := store.Take("b")
+	require.NoError(t, err)
+	_, err = store.Take("c")
+	require.NoError(t, err)
+	require.Equal(t, 2, store.Len())
+	limit, _, err := store.Get("a")
+	require.NoError(t, err)
+	require.Zero(t, limit)
+
+	require.NoError(t, store.Set("d", 10, 0))
+	require.Equal(t, 2, store.Len())
+
+	// the new key is checked against a fresh quota but never stored
+	store = newStore(limits.OverflowAdmit)
+	for i := 0; i < 2; i++ {
+		info, err := store.Take("c")
+		require.NoError(t, err)
+		require.True(t, info.OperationOk)
+	}
+	require.Equal(t, 2, store.Len())
+
+	// the new key is rejected until room frees up
+	store = newStore(limits.OverflowReject)
+	info, err := store.Take("c")
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+	require.Equal(t, uint64(time.Date(2022, 6, 2, 0, 0, 0, 0, time.UTC).UnixNano()), info.Reset)
+	require.True(t, failure.IsOutOfRange(store.Set("c", 10, 0)))
+	require.Equal(t, 2, store.Len())
+}
+
+func TestQuotaStore_Invalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := limits.NewQuotaStore(nil, limits.QuotaConfig{Period: "weekly"})
+	require.True(t, failure.IsInvalidParam(err))
+
+	store, err := limits.NewQuotaStore(nil, limits.QuotaConfig{})
+	require.NoError(t, err)
+	require.True(t, failure.IsInvalidParam(store.Set("key", 0, 0)))
+
+	require.NoError(t, store.Close())
+	_, err = store.Take("key")
+	require.True(t, failure.IsInvalidState(err))
+}
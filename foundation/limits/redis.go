@@ -0,0 +1,384 @@
+package limits
+
+import (
+	"context"
+	"github.com/rsb/api_rate_limiter/foundation/resp"
+	"github.com/rsb/failure"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultRedisPrefix = "limits:"
+
+// The scripts keep a fixed window per key in a hash holding its limit,
+// interval, start, tick and available tokens. Times are microseconds from
+// unix epoch so they are exact in the doubles used by lua. The current time
+// is sent by the caller, a script never reads the server clock, so every
+// instance sharing the server must have a synchronized clock.
+const (
+	// RedisTakeScript takes n tokens when they are all available in the
+	// current window, creating the key with the given limits when it is new.
+	// KEYS[1] key, ARGV now, limit, interval, n, ttl in ms.
+	// Returns limit, available, reset and 1 when the tokens were taken.
+	RedisTakeScript = `local now = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local interval = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+local ttl = tonumber(ARGV[5])
+local start, tick, available = now, 0, limit
+local s = redis.call('HMGET', KEYS[1], 'limit', 'interval', 'start', 'tick', 'available')
+if s[1] then
+  limit, interval = tonumber(s[1]), tonumber(s[2])
+  start, tick, available = tonumber(s[3]), tonumber(s[4]), tonumber(s[5])
+end
+local current = 0
+if now > start then
+  current = math.floor((now - start) / interval)
+end
+if current > tick then
+  tick, available = current, limit
+end
+local ok = 0
+if available >= n then
+  available, ok = available - n, 1
+end
+redis.call('HSET', KEYS[1], 'limit', limit, 'interval', interval, 'start', start, 'tick', tick, 'available', available)
+redis.call('PEXPIRE', KEYS[1], math.max(ttl, math.ceil(interval / 1000)))
+return {limit, available, start + (current + 1) * interval, ok}`
+
+	// RedisPeekScript reports the tokens available in the current window
+	// without modifying the key.
+	// KEYS[1] key, ARGV now, limit, interval.
+	// Returns limit, available, reset and 1 when the key exists.
+	RedisPeekScript = `local now = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local interval = tonumber(ARGV[3])
+local start, tick, available = now, 0, limit
+local s = redis.call('HMGET', KEYS[1], 'limit', 'interval', 'start', 'tick', 'available')
+local exists = 0
+if s[1] then
+  limit, interval = tonumber(s[1]), tonumber(s[2])
+  start, tick, available = tonumber(s[3]), tonumber(s[4]), tonumber(s[5])
+  exists = 1
+end
+local current = 0
+if now > start then
+  current = math.floor((now - start) / interval)
+end
+if current > tick then
+  available = limit
+end
+return {limit, available, start + (current + 1) * interval, exists}`
+
+	// RedisReturnScript gives n tokens back to the current window of an
+	// existing key, never more than its limit.
+	// KEYS[1] key, ARGV now, n.
+	// Returns 1 when the key exists.
+	RedisReturnScript = `local now = tonumber(ARGV[1])
+local n = tonumber(ARGV[2])
+local s = redis.call('HMGET', KEYS[1], 'limit', 'interval', 'start', 'tick', 'available')
+if not s[1] then
+  return 0
+end
+local limit, interval = tonumber(s[1]), tonumber(s[2])
+local start, tick, available = tonumber(s[3]), tonumber(s[4]), tonumber(s[5])
+local current = 0
+if now > start then
+  current = math.floor((now - start) / interval)
+end
+if current > tick then
+  tick, available = current, limit
+end
+available = math.min(limit, available + n)
+redis.call('HSET', KEYS[1], 'tick', tick, 'available', available)
+return 1`
+
+	// RedisSetScript replaces the key with a full window of the given limits.
+	// KEYS[1] key, ARGV now, limit, interval, ttl in ms.
+	RedisSetScript = `local now = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local interval = tonumber(ARGV[3])
+local ttl = tonumber(ARGV[4])
+redis.call('DEL', KEYS[1])
+redis.call('HSET', KEYS[1], 'limit', limit, 'interval', interval, 'start', now, 'tick', 0, 'available', limit)
+redis.call('PEXPIRE', KEYS[1], math.max(ttl, math.ceil(interval / 1000)))
+return 1`
+)
+
+var (
+	_ Store = (*RedisStore)(nil)
+
+	redisTake   = resp.NewScript(RedisTakeScript)
+	redisPeek   = resp.NewScript(RedisPeekScript)
+	redisReturn = resp.NewScript(RedisReturnScript)
+	redisSet    = resp.NewScript(RedisSetScript)
+)
+
+// RedisStore keeps the fixed window of every key on a redis compatible
+// server, so instances sharing the server share their limits. Every
+// operation is a single script, atomic on the server. Keys expire on the
+// server once inactive for MinTTL, or their interval when it is longer, so
+// the garbage collector has nothing to do.
+//
+// Only the fixed window algorithm is supported, and reservations, snapshots,
+// MaxKeys and Shards do not apply.
+type RedisStore struct {
+	client   *resp.Client
+	prefix   string
+	clock    Clock
+	limit    uint64
+	interval time.Duration
+	ttl      time.Duration
+
+	stopped uint32
+	stop    chan struct{}
+}
+
+// NewRedisStore creates a store using the client, every key is stored under
+// the prefix. The store owns the client and closes it on Close.
+func NewRedisStore(client *resp.Client, prefix string, opts ...*Config) (*RedisStore, error) {
+	if client == nil {
+		return nil, failure.InvalidParam("client(*resp.Client) is nil")
+	}
+
+	var config *Config
+	defaults := NewDefaultConfig()
+	if len(opts) > 0 && opts[0] != nil {
+		config = opts[0]
+	} else {
+		config = defaults
+	}
+
+	if config.Algorithm != "" && config.Algorithm != AlgorithmFixedWindow {
+		return nil, failure.InvalidParam("algorithm (%s) is not supported by the redis store, only (%s)", config.Algorithm, AlgorithmFixedWindow)
+	}
+
+	tokens := defaults.Limit
+	if config.Limit > 0 {
+		tokens = config.Limit
+	}
+
+	interval := defaults.Interval
+	if config.Interval > 0 {
+		interval = config.Interval
+	}
+
+	ttl := defaults.MinTTL
+	if config.MinTTL > 0 {
+		ttl = config.MinTTL
+	}
+
+	clock := defaults.Clock
+	if config.Clock != nil {
+		clock = config.Clock
+	}
+
+	if interval < time.Microsecond {
+		return nil, failure.InvalidParam("interval (%s) is shorter than a microsecond", interval)
+	}
+
+	if prefix == "" {
+		prefix = DefaultRedisPrefix
+	}
+
+	return &RedisStore{
+		client:   client,
+		prefix:   prefix,
+		clock:    clock,
+		limit:    tokens,
+		interval: interval,
+		ttl:      ttl,
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+// Prefix is prepended to every key stored on the server
+func (r *RedisStore) Prefix() string {
+	return r.prefix
+}
+
+// Take consumes a single token for the key
+func (r *RedisStore) Take(key string) (RateInfo, error) {
+	return r.TakeN(key, 1)
+}
+
+// TakeN consumes n tokens for the key. It is all or nothing, when the key
+// can not afford n tokens none are taken and the operation is not ok.
+func (r *RedisStore) TakeN(key string, n uint64) (RateInfo, error) {
+	var info RateInfo
+	if atomic.LoadUint32(&r.stopped) == 1 {
+		return info, failure.InvalidState("RedisStore is stopped")
+	}
+
+	reply, err := r.run(redisTake, key,
+		r.now(),
+		strconv.FormatUint(r.limit, 10),
+		micros(r.interval),
+		strconv.FormatUint(n, 10),
+		millis(r.ttl),
+	)
+	if err != nil {
+		return info, failure.Wrap(err, "take script failed for (%s)", key)
+	}
+
+	info, _, err = rateInfo(reply)
+	if err != nil {
+		return info, failure.Wrap(err, "take script reply is not valid for (%s)", key)
+	}
+
+	return info, nil
+}
+
+// Peek reports the up to date state of the key without taking a token. A
+// key the server does not hold reports the full store limits.
+func (r *RedisStore) Peek(key string) (RateInfo, error) {
+	var info RateInfo
+	if atomic.LoadUint32(&r.stopped) == 1 {
+		return info, failure.InvalidState("RedisStore is stopped")
+	}
+
+	info, _, err := r.peek(key)
+	if err != nil {
+		return info, err
+	}
+
+	info.OperationOk = info.Remaining > 0
+	return info, nil
+}
+
+// Return gives n tokens back to the key, for requests the client should not
+// be charged for. It is a no-op for keys the server does not hold.
+func (r *RedisStore) Return(key string, n uint64) error {
+	if atomic.LoadUint32(&r.stopped) == 1 {
+		return failure.InvalidState("RedisStore is stopped")
+	}
+
+	_, err := r.run(redisReturn, key, r.now(), strconv.FormatUint(n, 10))
+	if err != nil {
+		return failure.Wrap(err, "return script failed for (%s)", key)
+	}
+
+	return nil
+}
+
+// Get returns the limit and remaining tokens of the key, zero values when the
+// server does not hold the key
+func (r *RedisStore) Get(key string) (uint64, uint64, error) {
+	if atomic.LoadUint32(&r.stopped) == 1 {
+		return 0, 0, failure.InvalidState("RedisStore is stopped")
+	}
+
+	info, exists, err := r.peek(key)
+	if err != nil || !exists {
+		return 0, 0, err
+	}
+
+	return info.LimitSize, info.Remaining, nil
+}
+
+// Set replaces the key with a full window using the given limits
+func (r *RedisStore) Set(key string, tokens uint64, interval time.Duration) error {
+	if atomic.LoadUint32(&r.stopped) == 1 {
+		return failure.InvalidState("RedisStore is stopped")
+	}
+
+	if tokens == 0 || interval < time.Microsecond {
+		return failure.InvalidParam("tokens (%d) must be positive and interval (%s) at least a microsecond", tokens, interval)
+	}
+
+	_, err := r.run(redisSet, key,
+		r.now(),
+		strconv.FormatUint(tokens, 10),
+		micros(interval),
+		millis(r.ttl),
+	)
+	if err != nil {
+		return failure.Wrap(err, "set script failed for (%s)", key)
+	}
+
+	return nil
+}
+
+// Close stops the store and closes its client. The keys stay on the server.
+func (r *RedisStore) Close() error {
+	if !atomic.CompareAndSwapUint32(&r.stopped, 0, 1) {
+		return nil
+	}
+
+	close(r.stop)
+
+	if err := r.client.Close(); err != nil {
+		return failure.Wrap(err, "r.client.Close failed")
+	}
+
+	return nil
+}
+
+// GarbageCollector blocks until Close is called, the server expires inactive
+// keys on its own
+func (r *RedisStore) GarbageCollector() {
+	<-r.stop
+}
+
+// peek runs the peek script, reporting whether the server holds the key
+func (r *RedisStore) peek(key string) (RateInfo, bool, error) {
+	reply, err := r.run(redisPeek, key,
+		r.now(),
+		strconv.FormatUint(r.limit, 10),
+		micros(r.interval),
+	)
+	if err != nil {
+		return RateInfo{}, false, failure.Wrap(err, "peek script failed for (%s)", key)
+	}
+
+	info, exists, err := rateInfo(reply)
+	if err != nil {
+		return info, false, failure.Wrap(err, "peek script reply is not valid for (%s)", key)
+	}
+
+	return info, exists, nil
+}
+
+func (r *RedisStore) run(script *resp.Script, key string, args ...string) (interface{}, error) {
+	return script.Run(context.Background(), r.client, []string{r.prefix + key}, args...)
+}
+
+// now is the current time in microseconds from unix epoch
+func (r *RedisStore) now() string {
+	return strconv.FormatUint(unixNano(r.clock)/uint64(time.Microsecond), 10)
+}
+
+// rateInfo decodes the limit, available, reset and flag returned by the take
+// and peek scripts
+func rateInfo(reply interface{}) (RateInfo, bool, error) {
+	var info RateInfo
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 4 {
+		return info, false, failure.InvalidState("reply (%v) is not an array of 4 values", reply)
+	}
+
+	n := make([]int64, len(values))
+	for i, v := range values {
+		if n[i], ok = v.(int64); !ok || n[i] < 0 {
+			return info, false, failure.InvalidState("reply value (%v) is not a positive integer", v)
+		}
+	}
+
+	info = RateInfo{
+		LimitSize:   uint64(n[0]),
+		Remaining:   uint64(n[1]),
+		Reset:       uint64(n[2]) * uint64(time.Microsecond),
+		OperationOk: n[3] == 1,
+	}
+
+	return info, n[3] == 1, nil
+}
+
+func micros(d time.Duration) string {
+	return strconv.FormatInt(d.Microseconds(), 10)
+}
+
+func millis(d time.Duration) string {
+	return strconv.FormatInt(d.Milliseconds(), 10)
+}
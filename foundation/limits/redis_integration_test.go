@@ -0,0 +1,161 @@
+//go:build redis
+
+package limits_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/api_rate_limiter/foundation/limits/limitstest"
+	"github.com/rsb/api_rate_limiter/foundation/resp"
+	"github.com/rsb/api_rate_limiter/foundation/resp/resptest"
+	"github.com/stretchr/testify/require"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The integration tests run the lua scripts on the real server at
+// LIMITS_REDIS_ADDR, built with the redis tag:
+//
+//	LIMITS_REDIS_ADDR=127.0.0.1:6379 go test -tags redis ./foundation/limits/
+
+func TestRedisStore_LuaMatchesStandIn(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(1_700_000_000, 123_456_000))
+	config := limits.Config{Limit: 3, Interval: time.Minute, MinTTL: time.Hour, Clock: clock}
+
+	srv, err := resptest.NewServer()
+	require.NoError(t, err)
+	limitstest.HandleRedisScripts(srv)
+	t.Cleanup(func() {
+		require.NoError(t, srv.Close())
+	})
+
+	stores := []*limits.RedisStore{
+		connectRedisStore(t, integrationRedisAddr(t), redisTestPrefix(t), &config),
+		connectRedisStore(t, srv.Addr(), "", &config),
+	}
+
+	// every step runs on both stores after the clock moved on, the lua
+	// scripts and their Go equivalents must agree on every reply
+	steps := []struct {
+		name    string
+		advance time.Duration
+		run     func(s *limits.RedisStore) (interface{}, error)
+	}{
+		{"peek missing", 0, func(s *limits.RedisStore) (interface{}, error) { return s.Peek("key") }},
+		{"get missing", 0, func(s *limits.RedisStore) (interface{}, error) { return get(s, "key") }},
+		{"return missing", 0, func(s *limits.RedisStore) (interface{}, error) { return nil, s.Return("key", 1) }},
+		{"take", 0, func(s *limits.RedisStore) (interface{}, error) { return s.Take("key") }},
+		{"take n", 0, func(s *limits.RedisStore) (interface{}, error) { return s.TakeN("key", 2) }},
+		{"take empty", 0, func(s *limits.RedisStore) (interface{}, error) { return s.Take("key") }},
+		{"take n empty", 0, func(s *limits.RedisStore) (interface{}, error) { return s.TakeN("key", 2) }},
+		{"peek empty", 0, func(s *limits.RedisStore) (interface{}, error) { return s.Peek("key") }},
+		{"return", 0, func(s *limits.RedisStore) (interface{}, error) { return nil, s.Return("key", 1) }},
+		{"get", 0, func(s *limits.RedisStore) (interface{}, error) { return get(s, "key") }},
+		{"return over limit", 0, func(s *limits.RedisStore) (interface{}, error) { return nil, s.Return("key", 10) }},
+		{"get full", 0, func(s *limits.RedisStore) (interface{}, error) { return get(s, "key") }},
+		{"take all", 0, func(s *limits.RedisStore) (interface{}, error) { return s.TakeN("key", 3) }},
+		{"next window", time.Minute + time.Second, func(s *limits.RedisStore) (interface{}, error) { return s.Peek("key") }},
+		{"take next window", 0, func(s *limits.RedisStore) (interface{}, error) { return s.Take("key") }},
+		{"skip windows", 5*time.Minute + 7*time.Microsecond, func(s *limits.RedisStore) (interface{}, error) { return s.TakeN("key", 2) }},
+		{"return skipped window", 2 * time.Minute, func(s *limits.RedisStore) (interface{}, error) { return nil, s.Return("key", 1) }},
+		{"get skipped window", 0, func(s *limits.RedisStore) (interface{}, error) { return get(s, "key") }},
+		{"set", 0, func(s *limits.RedisStore) (interface{}, error) { return nil, s.Set("key", 5, 90*time.Second) }},
+		{"take set", 0, func(s *limits.RedisStore) (interface{}, error) { return s.TakeN("key", 4) }},
+		{"peek set", 0, func(s *limits.RedisStore) (interface{}, error) { return s.Peek("key") }},
+		{"take set empty", 0, func(s *limits.RedisStore) (interface{}, error) { return s.TakeN("key", 2) }},
+		{"set window", 90 * time.Second, func(s *limits.RedisStore) (interface{}, error) { return s.Take("key") }},
+		{"take more than limit", 0, func(s *limits.RedisStore) (interface{}, error) { return s.TakeN("other", 4) }},
+	}
+
+	for _, step := range steps {
+		clock.Add(step.advance)
+
+		replies := make([]interface{}, len(stores))
+		for i, store := range stores {
+			reply, err := step.run(store)
+			require.NoError(t, err, step.name)
+			replies[i] = reply
+		}
+
+		require.Equal(t, replies[1], replies[0], step.name)
+	}
+}
+
+func TestRedisStore_LuaKeys(t *testing.T) {
+	t.Parallel()
+
+	addr := integrationRedisAddr(t)
+	now := time.Unix(1_700_000_000, 123_456_789)
+	clock := limitstest.NewManualClock(now)
+	config := limits.Config{Limit: 3, Interval: 2 * time.Hour, MinTTL: time.Hour, Clock: clock}
+	prefix := redisTestPrefix(t)
+	store := connectRedisStore(t, addr, prefix, &config)
+
+	client := resp.NewClient(resp.ClientConfig{Addr: addr})
+	t.Cleanup(func() {
+		_, _ = client.Do(context.Background(), "DEL", prefix+"key", prefix+"set")
+		require.NoError(t, client.Close())
+	})
+
+	// the scripts are loaded with EVAL the first time the server does not
+	// know them
+	_, err := client.Do(context.Background(), "SCRIPT", "FLUSH")
+	require.NoError(t, err)
+
+	info, err := store.Take("key")
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+	require.Equal(t, uint64(2), info.Remaining)
+
+	// times are kept as exact microseconds, never in the exponent notation
+	// of a lua number
+	reply, err := client.Do(context.Background(), "HGETALL", prefix+"key")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []interface{}{
+		"limit", "3",
+		"interval", strconv.FormatInt((2 * time.Hour).Microseconds(), 10),
+		"start", strconv.FormatInt(now.UnixMicro(), 10),
+		"tick", "0",
+		"available", "2",
+	}, reply)
+	require.Equal(t, uint64(now.Truncate(time.Microsecond).Add(2*time.Hour).UnixNano()), info.Reset)
+
+	// a key expires after MinTTL, or its interval when it is longer
+	ttl, err := client.Do(context.Background(), "PTTL", prefix+"key")
+	require.NoError(t, err)
+	require.InDelta(t, (2 * time.Hour).Milliseconds(), ttl, float64(time.Minute.Milliseconds()))
+
+	require.NoError(t, store.Set("set", 1, time.Second))
+	ttl, err = client.Do(context.Background(), "PTTL", prefix+"set")
+	require.NoError(t, err)
+	require.InDelta(t, time.Hour.Milliseconds(), ttl, float64(time.Minute.Milliseconds()))
+}
+
+// integrationRedisAddr is the address of the real server the integration
+// tests run against
+func integrationRedisAddr(t *testing.T) string {
+	t.Helper()
+
+	addr := os.Getenv(redisAddrEnv)
+	if addr == "" {
+		t.Fatalf("%s must be set to run the redis integration tests", redisAddrEnv)
+	}
+
+	return addr
+}
+
+// redisTestPrefix is a prefix of the test's own, so runs sharing a server do
+// not collide
+func redisTestPrefix(t *testing.T) string {
+	return fmt.Sprintf("limits-test:%s:%d:", t.Name(), time.Now().UnixNano())
+}
+
+func get(store *limits.RedisStore, key string) (interface{}, error) {
+	limit, remaining, err := store.Get(key)
+	return [2]uint64{limit, remaining}, err
+}
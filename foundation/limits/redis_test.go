@@ -0,0 +1,234 @@
+package limits_test
+
+import (
+	"fmt"
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/api_rate_limiter/foundation/limits/limitstest"
+	"github.com/rsb/api_rate_limiter/foundation/resp"
+	"github.com/rsb/api_rate_limiter/foundation/resp/resptest"
+	"github.com/rsb/failure"
+	"github.com/stretchr/testify/require"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The redis store tests run against the in-process stand-in, or against the
+// redis compatible server at LIMITS_REDIS_ADDR when it is set. The tests
+// built with the redis tag always run the lua scripts on that server.
+const redisAddrEnv = "LIMITS_REDIS_ADDR"
+
+func TestRedisStore_Take(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(1000, 0))
+	config := limits.Config{Limit: 3, Interval: time.Minute, Clock: clock}
+	store, _ := newRedisStore(t, &config)
+
+	for i := 2; i >= 0; i-- {
+		info, err := store.Take("key")
+		require.NoError(t, err)
+		require.True(t, info.OperationOk)
+		require.Equal(t, uint64(3), info.LimitSize)
+		require.Equal(t, uint64(i), info.Remaining)
+		require.Equal(t, uint64(time.Unix(1060, 0).UnixNano()), info.Reset)
+	}
+
+	info, err := store.Take("key")
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+
+	// all or nothing
+	clock.Add(time.Minute)
+	info, err = store.TakeN("key", 4)
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+	require.Equal(t, uint64(3), info.Remaining)
+
+	info, err = store.TakeN("key", 3)
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+	require.Equal(t, uint64(0), info.Remaining)
+	require.Equal(t, uint64(time.Unix(1120, 0).UnixNano()), info.Reset)
+}
+
+func TestRedisStore_PeekGetReturn(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(1000, 0))
+	config := limits.Config{Limit: 2, Interval: time.Minute, Clock: clock}
+	store, _ := newRedisStore(t, &config)
+
+	info, err := store.Peek("key")
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+	require.Equal(t, uint64(2), info.Remaining)
+
+	limit, remaining, err := store.Get("key")
+	require.NoError(t, err)
+	require.Zero(t, limit)
+	require.Zero(t, remaining)
+
+	require.NoError(t, store.Return("key", 1))
+	_, remaining, err = store.Get("key")
+	require.NoError(t, err)
+	require.Zero(t, remaining)
+
+	_, err = store.TakeN("key", 2)
+	require.NoError(t, err)
+
+	info, err = store.Peek("key")
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+
+	require.NoError(t, store.Return("key", 5))
+	limit, remaining, err = store.Get("key")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), limit)
+	require.Equal(t, uint64(2), remaining)
+}
+
+func TestRedisStore_Set(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(1000, 0))
+	config := limits.Config{Limit: 2, Interval: time.Minute, Clock: clock}
+	store, _ := newRedisStore(t, &config)
+
+	require.NoError(t, store.Set("custom", 10, time.Hour))
+	info, err := store.TakeN("custom", 5)
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+	require.Equal(t, uint64(10), info.LimitSize)
+	require.Equal(t, uint64(5), info.Remaining)
+	require.Equal(t, uint64(time.Unix(1000, 0).Add(time.Hour).UnixNano()), info.Reset)
+
+	err = store.Set("custom", 0, time.Hour)
+	require.True(t, failure.IsInvalidParam(err))
+}
+
+func TestRedisStore_SharedAcrossInstances(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(1000, 0))
+	config := limits.Config{Limit: 50, Interval: time.Minute, Clock: clock}
+	first, addr := newRedisStore(t, &config)
+	second := connectRedisStore(t, addr, first.Prefix(), &config)
+
+	var wg sync.WaitGroup
+	var allowed int64
+	for i := 0; i < 100; i++ {
+		store := first
+		if i%2 == 1 {
+			store = second
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			info, err := store.Take("shared")
+			if err == nil && info.OperationOk {
+				atomic.AddInt64(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, int64(50), allowed)
+}
+
+func TestRedisStore_Expires(t *testing.T) {
+	t.Parallel()
+
+	if os.Getenv(redisAddrEnv) != "" {
+		t.Skip("expiry follows the clock of the real server")
+	}
+
+	clock := limitstest.NewManualClock(time.Unix(1000, 0))
+	config := limits.Config{Limit: 2, Interval: time.Minute, MinTTL: time.Hour, Clock: clock}
+
+	srv, err := resptest.NewServer()
+	require.NoError(t, err)
+	srv.SetNow(clock.Now)
+	limitstest.HandleRedisScripts(srv)
+	t.Cleanup(func() {
+		require.NoError(t, srv.Close())
+	})
+
+	store := connectRedisStore(t, srv.Addr(), "", &config)
+	_, err = store.Take("key")
+	require.NoError(t, err)
+	require.NoError(t, store.Set("long", 2, 2*time.Hour))
+	require.Equal(t, 2, srv.Keys())
+
+	clock.Add(time.Hour)
+	require.Equal(t, 1, srv.Keys())
+
+	clock.Add(time.Hour)
+	require.Equal(t, 0, srv.Keys())
+}
+
+func TestRedisStore_Invalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := limits.NewRedisStore(nil, "")
+	require.True(t, failure.IsInvalidParam(err))
+
+	client := resp.NewClient(resp.ClientConfig{Addr: "127.0.0.1:0"})
+	for _, algorithm := range []limits.Algorithm{
+		limits.AlgorithmTokenBucket,
+		limits.AlgorithmSlidingWindow,
+		limits.AlgorithmSlidingLog,
+		limits.AlgorithmGCRA,
+		limits.AlgorithmLeakyBucket,
+		"unknown",
+	} {
+		_, err = limits.NewRedisStore(client, "", &limits.Config{Algorithm: algorithm})
+		require.True(t, failure.IsInvalidParam(err), algorithm)
+	}
+
+	store, err := limits.NewRedisStore(client, "")
+	require.NoError(t, err)
+	require.Equal(t, limits.DefaultRedisPrefix, store.Prefix())
+
+	_, err = store.Take("key")
+	require.Error(t, err)
+
+	require.NoError(t, store.Close())
+	_, err = store.Take("key")
+	require.True(t, failure.IsInvalidState(err))
+}
+
+// newRedisStore creates a store with a prefix of its own, on the server at
+// LIMITS_REDIS_ADDR or a new stand-in. It returns the server address.
+func newRedisStore(t *testing.T, config *limits.Config) (*limits.RedisStore, string) {
+	t.Helper()
+
+	addr := os.Getenv(redisAddrEnv)
+	if addr == "" {
+		srv, err := resptest.NewServer()
+		require.NoError(t, err)
+		limitstest.HandleRedisScripts(srv)
+		t.Cleanup(func() {
+			require.NoError(t, srv.Close())
+		})
+		addr = srv.Addr()
+	}
+
+	prefix := fmt.Sprintf("limits-test:%s:%d:", t.Name(), time.Now().UnixNano())
+	return connectRedisStore(t, addr, prefix, config), addr
+}
+
+func connectRedisStore(t *testing.T, addr, prefix string, config *limits.Config) *limits.RedisStore {
+	t.Helper()
+
+	store, err := limits.NewRedisStore(resp.NewClient(resp.ClientConfig{Addr: addr}), prefix, config)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	return store
+}
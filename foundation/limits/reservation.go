@@ -0,0 +1,132 @@
+package limits
+
+import (
+	"context"
+	"github.com/rsb/failure"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reserver is implemented by the limiters able to hand out tokens ahead of
+// time. Callers that would rather wait for a token than busy poll TakeN use
+// it through MemoryStore.Reserve and MemoryStore.Wait.
+type Reserver interface {
+	Reserve(n uint64) *Reservation
+}
+
+// Reservation holds tokens taken ahead of time. The caller must wait for
+// Delay before acting on the reservation, or Cancel it to give the tokens
+// back when it decides not to act.
+//
+// clock     - source of the current time, used to compute the delay
+// ok        - whether the tokens could be reserved at all
+// limit     - the max number of tokens for the key
+// tokens    - the number of tokens reserved
+// timeToAct - nanoseconds from unix epoch when the tokens are available
+// cancel    - gives the tokens back to the limiter
+type Reservation struct {
+	clock     Clock
+	ok        bool
+	limit     uint64
+	tokens    uint64
+	timeToAct uint64
+	cancel    func()
+	once      sync.Once
+}
+
+// OK reports whether the tokens were reserved. It is false when more tokens
+// were requested than the limiter can ever hold.
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Limit is the max number of tokens for the key
+func (r *Reservation) Limit() uint64 {
+	return r.limit
+}
+
+// Tokens is the number of tokens reserved
+func (r *Reservation) Tokens() uint64 {
+	return r.tokens
+}
+
+// Delay is how long the caller must wait before acting on the reservation
+func (r *Reservation) Delay() time.Duration {
+	if !r.ok {
+		return 0
+	}
+
+	now := unixNano(r.clock)
+	if r.timeToAct <= now {
+		return 0
+	}
+
+	return time.Duration(r.timeToAct - now)
+}
+
+// Cancel gives the reserved tokens back to the limiter, as far as the
+// limiter is able to. Calling it more than once has no effect.
+func (r *Reservation) Cancel() {
+	if !r.ok || r.cancel == nil {
+		return
+	}
+
+	r.once.Do(r.cancel)
+}
+
+// Reserve takes n tokens for the key ahead of time. It fails when the
+// store's algorithm does not support reservations.
+func (m *MemoryStore) Reserve(key string, n uint64) (*Reservation, error) {
+	if atomic.LoadUint32(&m.stopped) == 1 {
+		return nil, failure.InvalidState("MemoryStore is stopped")
+	}
+
+	b, ok := m.limiter(key)
+	if !ok {
+		return nil, failure.OutOfRange("store is full (%d keys), (%s) was rejected", m.maxKeys, key)
+	}
+
+	r, ok := b.(Reserver)
+	if !ok {
+		return nil, failure.InvalidState("algorithm (%s) does not support reservations", m.algorithm)
+	}
+
+	return r.Reserve(n), nil
+}
+
+// Wait blocks until n tokens are available for the key or the context is
+// done. The reservation is cancelled when the context is done first or its
+// deadline would expire before the tokens are available. The delay is
+// computed with the store clock but waited for in real time.
+func (m *MemoryStore) Wait(ctx context.Context, key string, n uint64) error {
+	r, err := m.Reserve(key, n)
+	if err != nil {
+		return failure.Wrap(err, "m.Reserve failed for (%s)", key)
+	}
+
+	if !r.OK() {
+		return failure.OutOfRange("(%d) tokens exceeds the limit (%d) for (%s)", n, r.Limit(), key)
+	}
+
+	delay := r.Delay()
+	if delay == 0 {
+		return nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(time.Now().Add(delay)) {
+		r.Cancel()
+		return failure.Timeout("context deadline expires before tokens are available in (%s) for (%s)", delay, key)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return failure.ToTimeout(ctx.Err(), "context done while waiting for (%s)", key)
+	}
+}
@@ -0,0 +1,164 @@
+package limits_test
+
+import (
+	"context"
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/api_rate_limiter/foundation/limits/limitstest"
+	"github.com/rsb/failure"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestBucket_Reserve(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	b := limits.NewBucket(clock, 2, time.Hour)
+
+	r := b.Reserve(2)
+	require.True(t, r.OK())
+	require.Equal(t, time.Duration(0), r.Delay())
+
+	// the current window is empty, the reservation lands in the next one
+	next := b.Reserve(1)
+	require.True(t, next.OK())
+	require.Equal(t, time.Hour, next.Delay())
+
+	// more than the bucket can ever hold
+	require.False(t, b.Reserve(3).OK())
+
+	// cancelling the current window reservation gives the tokens back
+	r.Cancel()
+	r.Cancel()
+	_, remaining := b.Get()
+	require.Equal(t, uint64(2), remaining)
+
+	// the next window starts with the reserved token already handed out
+	clock.Add(time.Hour)
+	require.Equal(t, time.Duration(0), next.Delay())
+	_, remaining = b.Get()
+	require.Equal(t, uint64(1), remaining)
+}
+
+func TestTokenBucket_Reserve(t *testing.T) {
+	t.Parallel()
+
+	// one token every 10ms
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	b := limits.NewTokenBucket(clock, 100, time.Second, 1)
+
+	require.Equal(t, time.Duration(0), b.Reserve(1).Delay())
+
+	r := b.Reserve(1)
+	require.True(t, r.OK())
+	require.Equal(t, 10*time.Millisecond, r.Delay())
+
+	// the debt must be paid before a take is accepted
+	require.False(t, b.RateInfo().OperationOk)
+
+	r.Cancel()
+	require.False(t, b.Reserve(2).OK())
+}
+
+func TestGCRA_Reserve(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	g := limits.NewGCRA(limits.NewGCRARate(clock, 1, time.Hour, 1))
+
+	require.Equal(t, time.Duration(0), g.Reserve(1).Delay())
+
+	r := g.Reserve(1)
+	require.True(t, r.OK())
+	require.Equal(t, time.Hour, r.Delay())
+
+	r.Cancel()
+
+	// after cancelling, the second reservation is the only one ahead
+	r = g.Reserve(1)
+	require.Equal(t, time.Hour, r.Delay())
+}
+
+func TestMemoryStore_Wait(t *testing.T) {
+	t.Parallel()
+
+	config := limits.Config{
+		Limit:       20,
+		Interval:    time.Second,
+		Burst:       1,
+		Algorithm:   limits.AlgorithmTokenBucket,
+		TTLInterval: 24 * time.Hour,
+		MinTTL:      24 * time.Hour,
+	}
+
+	store := limits.NewMemoryStore(&config)
+	t.Cleanup(func() {
+		err := store.Close()
+		require.NoError(t, err)
+	})
+
+	ctx := context.Background()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, store.Wait(ctx, "key", 1))
+	}
+
+	// one token every 50ms, the 2nd and 3rd calls had to wait
+	require.True(t, time.Since(start) >= 90*time.Millisecond)
+
+	err := store.Wait(ctx, "key", 2)
+	require.True(t, failure.IsOutOfRange(err))
+}
+
+func TestMemoryStore_WaitContext(t *testing.T) {
+	t.Parallel()
+
+	config := limits.Config{
+		Limit:       1,
+		Interval:    time.Hour,
+		TTLInterval: 24 * time.Hour,
+		MinTTL:      24 * time.Hour,
+	}
+
+	store := limits.NewMemoryStore(&config)
+	t.Cleanup(func() {
+		err := store.Close()
+		require.NoError(t, err)
+	})
+
+	require.NoError(t, store.Wait(context.Background(), "key", 1))
+
+	// the next token is an hour away, the deadline fails fast
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := store.Wait(ctx, "key", 1)
+	require.True(t, failure.IsTimeout(err))
+
+	// cancellation while waiting gives the reservation back
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	err = store.Wait(ctx, "key", 1)
+	require.True(t, failure.IsTimeout(err))
+
+	r, err := store.Reserve("key", 1)
+	require.NoError(t, err)
+	require.True(t, r.Delay() <= time.Hour)
+}
+
+func TestMemoryStore_ReserveUnsupported(t *testing.T) {
+	t.Parallel()
+
+	config := limits.Config{Algorithm: limits.AlgorithmSlidingLog}
+	store := limits.NewMemoryStore(&config)
+	t.Cleanup(func() {
+		err := store.Close()
+		require.NoError(t, err)
+	})
+
+	_, err := store.Reserve("key", 1)
+	require.True(t, failure.IsInvalidState(err))
+}
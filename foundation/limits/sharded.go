@@ -0,0 +1,281 @@
+package limits
+
+import (
+	"context"
+	"github.com/rsb/failure"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultShardCount = 32
+
+var _ Store = (*ShardedStore)(nil)
+
+// ShardedStore spreads keys across independently locked MemoryStore shards.
+// Creating a key or sweeping stale entries only locks the shard holding the
+// key, so requests for keys in the other shards are never stalled. The
+// garbage collector sweeps one shard per tick instead of the whole store at
+// once. A snapshot holds the keys of every shard.
+//
+// shards    - the memory stores holding the keys, selected by hashing the key
+// interval  - how often a single shard is swept
+// snapshot  - snapshot path, interval and failure callback of the store, the
+// 						 shards never save a snapshot of their own
+// saving    - serializes the saves of the snapshot
+// stopped   - set once the store is closed
+// stop      - closed to end the garbage collector
+// collector - lets Close wait for the garbage collector to return
+type ShardedStore struct {
+	shards   []*MemoryStore
+	interval time.Duration
+
+	snapshotPath     string
+	snapshotInterval time.Duration
+	snapshotFailed   func(err error)
+	saving           sync.Mutex
+
+	stopped   uint32
+	stop      chan struct{}
+	collector collector
+}
+
+// NewShardedStore creates Config.Shards memory stores, DefaultShardCount when
+// not configured, each sized for its share of Config.InitialSize and
+// Config.MaxKeys.
+func NewShardedStore(opts ...*Config) *ShardedStore {
+	config := NewDefaultConfig()
+	if len(opts) > 0 && opts[0] != nil {
+		c := *opts[0]
+		config = &c
+	}
+
+	count := DefaultShardCount
+	if config.Shards > 0 {
+		count = config.Shards
+	}
+
+	size := DefaultInitialMapSize
+	if config.InitialSize > 0 {
+		size = config.InitialSize
+	}
+	config.InitialSize = size/count + 1
+
+	if config.MaxKeys > 0 {
+		config.MaxKeys = (config.MaxKeys + count - 1) / count
+	}
+
+	snapshotPath, snapshotInterval, snapshotFailed := config.SnapshotPath, config.SnapshotInterval, config.SnapshotFailed
+	config.SnapshotPath, config.SnapshotInterval, config.SnapshotFailed = "", 0, nil
+
+	shards := make([]*MemoryStore, count)
+	for i := range shards {
+		shards[i] = NewMemoryStore(config)
+	}
+
+	// every shard is swept once per TTL interval
+	interval := shards[0].ttl.Interval / time.Duration(count)
+	if interval <= 0 {
+		interval = shards[0].ttl.Interval
+	}
+
+	return &ShardedStore{
+		shards:           shards,
+		interval:         interval,
+		snapshotPath:     snapshotPath,
+		snapshotInterval: snapshotInterval,
+		snapshotFailed:   snapshotFailed,
+		stop:             make(chan struct{}),
+	}
+}
+
+// Take consumes a single token for the key
+func (s *ShardedStore) Take(key string) (RateInfo, error) {
+	return s.TakeN(key, 1)
+}
+
+// TakeN consumes n tokens for the key from the shard holding it
+func (s *ShardedStore) TakeN(key string, n uint64) (RateInfo, error) {
+	return s.shard(key).TakeN(key, n)
+}
+
+// Peek reports the up to date state of the key without taking a token
+func (s *ShardedStore) Peek(key string) (RateInfo, error) {
+	return s.shard(key).Peek(key)
+}
+
+// Return gives n tokens back to the key
+func (s *ShardedStore) Return(key string, n uint64) error {
+	return s.shard(key).Return(key, n)
+}
+
+// Get returns the limit and remaining tokens of the key
+func (s *ShardedStore) Get(key string) (uint64, uint64, error) {
+	return s.shard(key).Get(key)
+}
+
+// Set replaces the limit and interval used by the key
+func (s *ShardedStore) Set(key string, tokens uint64, interval time.Duration) error {
+	return s.shard(key).Set(key, tokens, interval)
+}
+
+// Reserve takes n tokens for the key ahead of time, see MemoryStore.Reserve
+func (s *ShardedStore) Reserve(key string, n uint64) (*Reservation, error) {
+	return s.shard(key).Reserve(key, n)
+}
+
+// Wait blocks until n tokens are available for the key, see MemoryStore.Wait
+func (s *ShardedStore) Wait(ctx context.Context, key string, n uint64) error {
+	return s.shard(key).Wait(ctx, key, n)
+}
+
+// Close stops the garbage collector and waits for it to return, saves the
+// snapshot when a path is configured and closes every shard
+func (s *ShardedStore) Close() error {
+	if !atomic.CompareAndSwapUint32(&s.stopped, 0, 1) {
+		return nil
+	}
+
+	s.collector.close(s.stop)
+
+	var err error
+	if s.snapshotPath != "" {
+		if sErr := s.SaveFile(s.snapshotPath); sErr != nil {
+			err = failure.Wrap(sErr, "s.SaveFile failed")
+		}
+	}
+
+	for i, shard := range s.shards {
+		if cErr := shard.Close(); cErr != nil && err == nil {
+			err = failure.Wrap(cErr, "shard.Close failed for shard (%d)", i)
+		}
+	}
+
+	return err
+}
+
+// GarbageCollector sweeps a single shard on every tick, moving round robin
+// through the shards so each one is swept once per TTL interval. It runs
+// until Close is called.
+func (s *ShardedStore) GarbageCollector() {
+	if !s.collector.start() {
+		return
+	}
+	defer s.collector.done()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	snapshots, stop := snapshotTicker(s.snapshotPath, s.snapshotInterval)
+	defer stop()
+
+	next := 0
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.shards[next].Sweep()
+			next = (next + 1) % len(s.shards)
+		case <-snapshots:
+			if atomic.LoadUint32(&s.stopped) == 1 {
+				continue
+			}
+			err := s.SaveFile(s.snapshotPath)
+			if err != nil && s.snapshotFailed != nil {
+				s.snapshotFailed(failure.Wrap(err, "s.SaveFile failed"))
+			}
+		}
+	}
+}
+
+// Snapshot writes the state of the keys of every shard to w
+func (s *ShardedStore) Snapshot(w io.Writer) error {
+	var entries []SnapshotEntry
+	for _, shard := range s.shards {
+		entries = append(entries, shard.entries()...)
+	}
+
+	first := s.shards[0]
+	return writeSnapshot(w, first.algorithm, unixNano(first.clock), entries)
+}
+
+// Restore loads a snapshot written by Snapshot, each key going to the shard
+// it hashes into. See MemoryStore.Restore
+func (s *ShardedStore) Restore(r io.Reader) (int, error) {
+	snap, err := readSnapshot(r, s.shards[0].algorithm)
+	if err != nil {
+		return 0, failure.Wrap(err, "readSnapshot failed")
+	}
+
+	entries := make([][]SnapshotEntry, len(s.shards))
+	for _, e := range snap.Entries {
+		i := s.index(e.Key)
+		entries[i] = append(entries[i], e)
+	}
+
+	count := 0
+	for i, shard := range s.shards {
+		count += shard.restore(entries[i])
+	}
+
+	return count, nil
+}
+
+// SaveFile writes a snapshot to path, see MemoryStore.SaveFile
+func (s *ShardedStore) SaveFile(path string) error {
+	s.saving.Lock()
+	defer s.saving.Unlock()
+
+	return saveSnapshot(path, s.Snapshot)
+}
+
+// LoadFile restores the snapshot at path, see MemoryStore.LoadFile
+func (s *ShardedStore) LoadFile(path string) (int, error) {
+	return loadSnapshot(path, s.Restore)
+}
+
+// Sweep purges the stale entries of every shard, one shard at a time
+func (s *ShardedStore) Sweep() {
+	for _, shard := range s.shards {
+		shard.Sweep()
+	}
+}
+
+// Len is the number of keys held across all shards
+func (s *ShardedStore) Len() int {
+	total := 0
+	for _, shard := range s.shards {
+		total += shard.Len()
+	}
+
+	return total
+}
+
+// shard is the memory store the key hashes into
+func (s *ShardedStore) shard(key string) *MemoryStore {
+	return s.shards[s.index(key)]
+}
+
+// index is the position of the shard the key hashes into
+func (s *ShardedStore) index(key string) int {
+	return int(fnv32a(key) % uint32(len(s.shards)))
+}
+
+// fnv32a is the 32 bit FNV-1a hash of the key. It is inlined instead of using
+// hash/fnv to avoid allocating on every request.
+func fnv32a(key string) uint32 {
+	const (
+		offset = 2166136261
+		prime  = 16777619
+	)
+
+	hash := uint32(offset)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= prime
+	}
+
+	return hash
+}
@@ -0,0 +1,192 @@
+package limits_test
+
+import (
+	"fmt"
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/api_rate_limiter/foundation/limits/limitstest"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShardedStore_Take(t *testing.T) {
+	t.Parallel()
+
+	config := limits.Config{
+		Limit:       3,
+		Interval:    time.Minute,
+		TTLInterval: 24 * time.Hour,
+		MinTTL:      24 * time.Hour,
+		Shards:      8,
+	}
+	store := limits.NewShardedStore(&config)
+	go store.GarbageCollector()
+
+	t.Cleanup(func() {
+		err := store.Close()
+		require.NoError(t, err)
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 3; j++ {
+				info, err := store.Take(key)
+				require.NoError(t, err)
+				require.True(t, info.OperationOk)
+			}
+
+			info, err := store.Take(key)
+			require.NoError(t, err)
+			require.False(t, info.OperationOk)
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, 100, store.Len())
+
+	limit, remaining, err := store.Get("key-42")
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), limit)
+	require.Equal(t, uint64(0), remaining)
+
+	require.NoError(t, store.Return("key-42", 1))
+	info, err := store.Peek("key-42")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), info.Remaining)
+}
+
+func TestShardedStore_Sweep(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	config := limits.Config{
+		Limit:       1,
+		Interval:    time.Minute,
+		TTLInterval: time.Hour,
+		MinTTL:      time.Hour,
+		Clock:       clock,
+		Shards:      4,
+	}
+	store := limits.NewShardedStore(&config)
+	t.Cleanup(func() {
+		err := store.Close()
+		require.NoError(t, err)
+	})
+
+	for i := 0; i < 20; i++ {
+		_, err := store.Take(fmt.Sprintf("stale-%d", i))
+		require.NoError(t, err)
+	}
+
+	clock.Add(30 * time.Minute)
+	_, err := store.Take("active")
+	require.NoError(t, err)
+
+	clock.Add(31 * time.Minute)
+	store.Sweep()
+
+	require.Equal(t, 1, store.Len())
+}
+
+func TestShardedStore_Close(t *testing.T) {
+	t.Parallel()
+
+	store := limits.NewShardedStore()
+	require.NoError(t, store.Close())
+	require.NoError(t, store.Close())
+
+	_, err := store.Take("key")
+	require.Error(t, err)
+}
+
+// The benchmarks compare a single MemoryStore with a ShardedStore. Run them
+// with -cpu to see how each one scales, for example:
+//
+//	go test -run XXX -bench Parallel -cpu 1,4,16 ./foundation/limits
+func BenchmarkMemoryStore_TakeParallel(b *testing.B) {
+	benchmarkTakeParallel(b, limits.NewMemoryStore(benchmarkConfig()))
+}
+
+func BenchmarkShardedStore_TakeParallel(b *testing.B) {
+	benchmarkTakeParallel(b, limits.NewShardedStore(benchmarkConfig()))
+}
+
+func BenchmarkMemoryStore_TakeParallelWithSweep(b *testing.B) {
+	store := limits.NewMemoryStore(benchmarkConfig())
+	benchmarkTakeParallelWithSweep(b, store, store.Sweep)
+}
+
+func BenchmarkShardedStore_TakeParallelWithSweep(b *testing.B) {
+	store := limits.NewShardedStore(benchmarkConfig())
+	benchmarkTakeParallelWithSweep(b, store, store.Sweep)
+}
+
+func benchmarkConfig() *limits.Config {
+	return &limits.Config{
+		Limit:       1000,
+		Interval:    time.Second,
+		TTLInterval: time.Hour,
+		MinTTL:      time.Hour,
+	}
+}
+
+// benchmarkKeys are a large pool of keys so most takes hit existing keys
+// while new keys keep being created, like a busy api seeing many clients
+var benchmarkKeys = func() []string {
+	keys := make([]string, 1<<16)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff)
+	}
+
+	return keys
+}()
+
+func benchmarkTakeParallel(b *testing.B, store limits.Store) {
+	b.Cleanup(func() { _ = store.Close() })
+
+	var seed uint32
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint32(&seed, 7919))
+		for pb.Next() {
+			_, _ = store.Take(benchmarkKeys[i&(len(benchmarkKeys)-1)])
+			i++
+		}
+	})
+}
+
+// benchmarkTakeParallelWithSweep runs sweeps back to back while taking, the
+// worst case for a store sweeping all its keys under one lock
+func benchmarkTakeParallelWithSweep(b *testing.B, store limits.Store, sweep func()) {
+	for _, key := range benchmarkKeys {
+		_, _ = store.Take(key)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				sweep()
+			}
+		}
+	}()
+
+	b.Cleanup(func() {
+		close(done)
+		<-stopped
+	})
+
+	benchmarkTakeParallel(b, store)
+}
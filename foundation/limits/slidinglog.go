@@ -0,0 +1,241 @@
+package limits
+
+import (
+	"sync"
+	"time"
+)
+
+// SlidingLog keeps the timestamp of every accepted request and gives exact
+// "no more than limit in any rolling interval" semantics. Timestamps are
+// stored in a ring buffer bounded by the limit, since there can never be more
+// than limit accepted requests inside the interval. The ring starts empty and
+// grows with the requests up to the limit, so a key with a large limit only
+// holds memory for the requests it logged. The ring of a log restored from a
+// snapshot starts at the size of the store limit.
+//
+// limit     - the max number of requests permitted in any rolling interval
+// interval  - the length of the rolling interval
+// entries   - ring buffer of nanoseconds from unix epoch, one per request
+// head      - index of the oldest entry in the ring
+// size      - number of entries currently in the ring
+// createdAt - nanoseconds from unix epoch when the log was created
+// clock     - source of the current time
+// lock      - mutex lock to guard the struct fields
+type SlidingLog struct {
+	clock     Clock
+	limit     uint64
+	interval  time.Duration
+	entries   []uint64
+	head      int
+	size      int
+	createdAt uint64
+	lock      sync.Mutex
+}
+
+// NewSlidingLog permits limit requests in any rolling interval. A nil clock
+// uses the SystemClock.
+func NewSlidingLog(clock Clock, limit uint64, interval time.Duration) *SlidingLog {
+	clock = clockOrSystem(clock)
+	return &SlidingLog{
+		clock:     clock,
+		limit:     limit,
+		interval:  interval,
+		createdAt: unixNano(clock),
+	}
+}
+
+func (l *SlidingLog) Get() (uint64, uint64) {
+	info := l.Peek()
+	return info.LimitSize, info.Remaining
+}
+
+// Peek reports the entries still inside the rolling interval without
+// logging a request or dropping the expired entries
+func (l *SlidingLog) Peek() RateInfo {
+	now := unixNano(l.clock)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	expired := l.expired(now)
+	active := uint64(l.size - expired)
+
+	reset := now + uint64(l.interval)
+	if active > 0 {
+		reset = l.entries[l.index(expired)] + uint64(l.interval)
+	}
+
+	return RateInfo{
+		LimitSize:   l.limit,
+		Remaining:   l.limit - active,
+		Reset:       reset,
+		OperationOk: active < l.limit,
+	}
+}
+
+// LastActive is the timestamp of the newest entry in the log
+func (l *SlidingLog) LastActive() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.size == 0 {
+		return l.createdAt
+	}
+
+	return l.entries[l.index(l.size-1)]
+}
+
+// State is the log as saved in a snapshot, entries oldest first
+func (l *SlidingLog) State() LimiterState {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	log := make([]uint64, l.size)
+	for i := range log {
+		log[i] = l.entries[l.index(i)]
+	}
+
+	return LimiterState{
+		Limit:    l.limit,
+		Interval: l.interval,
+		Start:    l.createdAt,
+		Log:      log,
+	}
+}
+
+// restoreSlidingLog creates a sliding log from its snapshot state, keeping
+// the newest entries when there are more than the limit. The limit of the
+// state is not trusted for the allocation: the ring holds at most capacity
+// entries, or the entries of the state, and grows up to the limit when used.
+func restoreSlidingLog(clock Clock, s LimiterState, capacity uint64) *SlidingLog {
+	log := s.Log
+	if uint64(len(log)) > s.Limit {
+		log = log[uint64(len(log))-s.Limit:]
+	}
+
+	size := s.Limit
+	if size > capacity {
+		size = capacity
+	}
+	if uint64(len(log)) > size {
+		size = uint64(len(log))
+	}
+
+	l := SlidingLog{
+		clock:     clockOrSystem(clock),
+		limit:     s.Limit,
+		interval:  s.Interval,
+		entries:   make([]uint64, size),
+		createdAt: s.Start,
+	}
+	l.size = copy(l.entries, log)
+
+	return &l
+}
+
+// RateInfo logs a single request, see TakeN
+func (l *SlidingLog) RateInfo() RateInfo {
+	return l.TakeN(1)
+}
+
+// TakeN drops the entries that fell out of the rolling interval and logs n
+// entries for the request when there is room for all of them. Reset is the
+// time the oldest entry in the log expires, freeing a slot. A rejected request
+// reports when enough entries expire to make room for n.
+func (l *SlidingLog) TakeN(n uint64) RateInfo {
+	var ok bool
+
+	now := unixNano(l.clock)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.evict(now)
+
+	if uint64(l.size)+n <= l.limit {
+		l.reserve(l.size + int(n))
+		for i := uint64(0); i < n; i++ {
+			l.entries[l.index(l.size)] = now
+			l.size++
+		}
+		ok = true
+	}
+
+	reset := now + uint64(l.interval)
+	if l.size > 0 {
+		oldest := 0
+		if !ok && n <= l.limit {
+			oldest = l.size + int(n) - int(l.limit) - 1
+		}
+		reset = l.entries[l.index(oldest)] + uint64(l.interval)
+	}
+
+	return RateInfo{
+		LimitSize:   l.limit,
+		Remaining:   l.limit - uint64(l.size),
+		Reset:       reset,
+		OperationOk: ok,
+	}
+}
+
+// Return removes the n newest entries from the log
+func (l *SlidingLog) Return(n uint64) {
+	now := unixNano(l.clock)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.evict(now)
+	if n > uint64(l.size) {
+		n = uint64(l.size)
+	}
+	l.size -= int(n)
+}
+
+// expired counts the entries, starting from the oldest, that are outside
+// the rolling interval ending now
+func (l *SlidingLog) expired(now uint64) int {
+	count := 0
+	for count < l.size && l.entries[l.index(count)]+uint64(l.interval) <= now {
+		count++
+	}
+
+	return count
+}
+
+func (l *SlidingLog) evict(now uint64) {
+	count := l.expired(now)
+	if count == 0 {
+		return
+	}
+
+	l.head = l.index(count)
+	l.size -= count
+}
+
+// reserve grows the ring so it holds size entries, oldest first, never
+// beyond the limit
+func (l *SlidingLog) reserve(size int) {
+	if size <= len(l.entries) {
+		return
+	}
+
+	grown := 2 * len(l.entries)
+	if grown < size {
+		grown = size
+	}
+	if uint64(grown) > l.limit {
+		grown = int(l.limit)
+	}
+
+	entries := make([]uint64, grown)
+	for i := 0; i < l.size; i++ {
+		entries[i] = l.entries[l.index(i)]
+	}
+	l.entries, l.head = entries, 0
+}
+
+// index converts a position relative to the oldest entry into a ring index
+func (l *SlidingLog) index(pos int) int {
+	return (l.head + pos) % len(l.entries)
+}
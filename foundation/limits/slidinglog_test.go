@@ -0,0 +1,114 @@
+package limits_test
+
+import (
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/api_rate_limiter/foundation/limits/limitstest"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSlidingLog_RateInfo(t *testing.T) {
+	t.Parallel()
+
+	interval := 300 * time.Millisecond
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	l := limits.NewSlidingLog(clock, 3, interval)
+
+	first := l.RateInfo()
+	require.True(t, first.OperationOk)
+	require.Equal(t, uint64(2), first.Remaining)
+
+	clock.Add(100 * time.Millisecond)
+	require.True(t, l.RateInfo().OperationOk)
+	require.True(t, l.RateInfo().OperationOk)
+
+	info := l.RateInfo()
+	require.False(t, info.OperationOk)
+	require.Equal(t, uint64(0), info.Remaining)
+
+	// reset is when the oldest entry expires
+	require.Equal(t, first.Reset, info.Reset)
+
+	// only the first entry has expired, one slot is free
+	clock.Set(time.Unix(0, int64(info.Reset)))
+
+	_, remaining := l.Get()
+	require.Equal(t, uint64(1), remaining)
+	require.True(t, l.RateInfo().OperationOk)
+	require.False(t, l.RateInfo().OperationOk)
+}
+
+func TestSlidingLog_RingWrapsAround(t *testing.T) {
+	t.Parallel()
+
+	interval := 50 * time.Millisecond
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	l := limits.NewSlidingLog(clock, 2, interval)
+
+	for round := 0; round < 4; round++ {
+		require.True(t, l.RateInfo().OperationOk)
+		require.True(t, l.RateInfo().OperationOk)
+		require.False(t, l.RateInfo().OperationOk)
+		clock.Add(interval)
+	}
+}
+
+func TestSlidingLog_GrowsLazily(t *testing.T) {
+	t.Parallel()
+
+	// a ring of the whole limit could never be allocated
+	limit := uint64(1) << 40
+	interval := time.Minute
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	l := limits.NewSlidingLog(clock, limit, interval)
+
+	info := l.Peek()
+	require.Equal(t, limit, info.Remaining)
+
+	require.True(t, l.RateInfo().OperationOk)
+	clock.Add(time.Second)
+	second := clock.Now()
+	require.True(t, l.RateInfo().OperationOk)
+
+	// the ring grows after the oldest entry expired, keeping the order
+	clock.Add(interval - time.Millisecond)
+	info = l.TakeN(3)
+	require.True(t, info.OperationOk)
+	require.Equal(t, limit-4, info.Remaining)
+	require.Equal(t, uint64(second.Add(interval).UnixNano()), info.Reset)
+
+	clock.Add(time.Second)
+	info = l.Peek()
+	require.Equal(t, limit-3, info.Remaining)
+}
+
+func TestMemoryStore_SlidingLogAlgorithm(t *testing.T) {
+	t.Parallel()
+
+	config := limits.Config{
+		Limit:       2,
+		Interval:    time.Minute,
+		Algorithm:   limits.AlgorithmSlidingLog,
+		TTLInterval: 24 * time.Hour,
+		MinTTL:      24 * time.Hour,
+	}
+
+	store := limits.NewMemoryStore(&config)
+	go store.GarbageCollector()
+
+	t.Cleanup(func() {
+		err := store.Close()
+		require.NoError(t, err)
+	})
+
+	for i := 0; i < 2; i++ {
+		info, err := store.Take("my-key")
+		require.NoError(t, err)
+		require.True(t, info.OperationOk)
+	}
+
+	info, err := store.Take("my-key")
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+}
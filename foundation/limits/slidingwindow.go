@@ -0,0 +1,219 @@
+package limits
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// SlidingWindow is a sliding window counter. It keeps the count of the
+// current and previous fixed windows and estimates the number of requests in
+// the rolling interval as a weighted mix of the two: the previous count is
+// weighted by how much of the previous window still overlaps the rolling
+// interval. It smooths the burst allowed at the edge of a fixed window while
+// keeping two counters per key instead of a log of timestamps.
+//
+// startTime - the number of nanoseconds from unix epoch when the window was created
+// limit     - the max number of requests permitted in the rolling interval
+// interval  - the length of a window
+// window    - the tick of the current window, see IntervalCount
+// previous  - number of requests counted in the previous window
+// current   - number of requests counted in the current window
+// clock     - source of the current time
+// lock      - mutex lock to guard the struct fields
+type SlidingWindow struct {
+	clock     Clock
+	startTime uint64
+	limit     uint64
+	interval  time.Duration
+	window    uint64
+	previous  uint64
+	current   uint64
+	lock      sync.Mutex
+}
+
+// NewSlidingWindow permits limit requests in any rolling interval. A nil
+// clock uses the SystemClock.
+func NewSlidingWindow(clock Clock, limit uint64, interval time.Duration) *SlidingWindow {
+	clock = clockOrSystem(clock)
+	return &SlidingWindow{
+		clock:     clock,
+		startTime: unixNano(clock),
+		limit:     limit,
+		interval:  interval,
+	}
+}
+
+func (w *SlidingWindow) Get() (uint64, uint64) {
+	info := w.Peek()
+	return info.LimitSize, info.Remaining
+}
+
+// Peek reports the estimated count as of now without counting a request
+func (w *SlidingWindow) Peek() RateInfo {
+	now := unixNano(w.clock)
+	tick := IntervalCount(w.startTime, now, w.interval)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	previous, current := w.counts(tick)
+	estimate := w.estimate(now, tick, previous, current)
+	remaining := w.remaining(estimate)
+
+	return RateInfo{
+		LimitSize:   w.limit,
+		Remaining:   remaining,
+		Reset:       w.reset(tick, previous, current, remaining, 1),
+		OperationOk: estimate+1 <= float64(w.limit),
+	}
+}
+
+// LastActive is the start of the last window the counter was used in
+func (w *SlidingWindow) LastActive() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.startTime + (w.window * uint64(w.interval))
+}
+
+// State is the window as saved in a snapshot
+func (w *SlidingWindow) State() LimiterState {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return LimiterState{
+		Limit:    w.limit,
+		Interval: w.interval,
+		Start:    w.startTime,
+		Tick:     w.window,
+		Previous: w.previous,
+		Current:  w.current,
+	}
+}
+
+// restoreSlidingWindow creates a sliding window from its snapshot state
+func restoreSlidingWindow(clock Clock, s LimiterState) *SlidingWindow {
+	return &SlidingWindow{
+		clock:     clockOrSystem(clock),
+		startTime: s.Start,
+		limit:     s.Limit,
+		interval:  s.Interval,
+		window:    s.Tick,
+		previous:  s.Previous,
+		current:   s.Current,
+	}
+}
+
+// RateInfo counts a single request, see TakeN
+func (w *SlidingWindow) RateInfo() RateInfo {
+	return w.TakeN(1)
+}
+
+// TakeN counts a request of weight n when the estimated count leaves room for
+// all of it. Reset is the end of the current window or, when no requests are
+// left, the earliest time the estimate allows the next request.
+func (w *SlidingWindow) TakeN(n uint64) RateInfo {
+	var ok bool
+
+	now := unixNano(w.clock)
+	tick := IntervalCount(w.startTime, now, w.interval)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.previous, w.current = w.counts(tick)
+	w.window = tick
+
+	estimate := w.estimate(now, tick, w.previous, w.current)
+	if estimate+float64(n) <= float64(w.limit) {
+		w.current += n
+		estimate += float64(n)
+		ok = true
+	}
+
+	remaining := w.remaining(estimate)
+	next := uint64(1)
+	if !ok {
+		next = n
+	}
+
+	return RateInfo{
+		LimitSize:   w.limit,
+		Remaining:   remaining,
+		Reset:       w.reset(tick, w.previous, w.current, remaining, next),
+		OperationOk: ok,
+	}
+}
+
+// Return removes n requests from the counts, starting with the current
+// window. The counts never go below zero.
+func (w *SlidingWindow) Return(n uint64) {
+	now := unixNano(w.clock)
+	tick := IntervalCount(w.startTime, now, w.interval)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.previous, w.current = w.counts(tick)
+	w.window = tick
+
+	if n <= w.current {
+		w.current -= n
+		return
+	}
+
+	n -= w.current
+	w.current = 0
+	if n > w.previous {
+		n = w.previous
+	}
+	w.previous -= n
+}
+
+// counts returns the previous and current counts as seen from the given tick
+// without modifying the window
+func (w *SlidingWindow) counts(tick uint64) (uint64, uint64) {
+	switch {
+	case tick == w.window:
+		return w.previous, w.current
+	case tick == w.window+1:
+		return w.current, 0
+	default:
+		return 0, 0
+	}
+}
+
+// estimate is the weighted count of requests in the rolling interval ending now
+func (w *SlidingWindow) estimate(now, tick, previous, current uint64) float64 {
+	windowStart := w.startTime + (tick * uint64(w.interval))
+	weight := 1 - float64(now-windowStart)/float64(w.interval)
+
+	return float64(previous)*weight + float64(current)
+}
+
+func (w *SlidingWindow) remaining(estimate float64) uint64 {
+	used := uint64(math.Ceil(estimate))
+	if used >= w.limit {
+		return 0
+	}
+
+	return w.limit - used
+}
+
+// reset is the end of the current window, or when the limit is exhausted,
+// the time the previous window has decayed enough to allow a request of
+// weight n
+func (w *SlidingWindow) reset(tick, previous, current, remaining, n uint64) uint64 {
+	windowStart := w.startTime + (tick * uint64(w.interval))
+	windowEnd := windowStart + uint64(w.interval)
+	if remaining >= n || previous == 0 || current+n > w.limit {
+		return windowEnd
+	}
+
+	// solve previous * (1 - elapsed/interval) + current + n <= limit for elapsed
+	allowed := float64(w.limit-current-n) / float64(previous)
+	elapsed := uint64(math.Ceil((1 - allowed) * float64(w.interval)))
+
+	return windowStart + elapsed
+}
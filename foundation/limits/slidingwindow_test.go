@@ -0,0 +1,92 @@
+package limits_test
+
+import (
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/api_rate_limiter/foundation/limits/limitstest"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSlidingWindow_RateInfo(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	w := limits.NewSlidingWindow(clock, 4, time.Minute)
+	for i := uint64(1); i <= 4; i++ {
+		info := w.RateInfo()
+		require.True(t, info.OperationOk)
+		require.Equal(t, uint64(4), info.LimitSize)
+		require.Equal(t, 4-i, info.Remaining)
+	}
+
+	info := w.RateInfo()
+	require.False(t, info.OperationOk)
+	require.Equal(t, uint64(0), info.Remaining)
+	require.Equal(t, uint64(clock.Now().Add(time.Minute).UnixNano()), info.Reset)
+
+	limit, remaining := w.Get()
+	require.Equal(t, uint64(4), limit)
+	require.Equal(t, uint64(0), remaining)
+}
+
+func TestSlidingWindow_PreviousWindowWeight(t *testing.T) {
+	t.Parallel()
+
+	interval := 200 * time.Millisecond
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	w := limits.NewSlidingWindow(clock, 10, interval)
+	for i := 0; i < 10; i++ {
+		require.True(t, w.RateInfo().OperationOk)
+	}
+
+	// 10% into the next window 90% of the previous count still applies, a
+	// fixed window would hand out all 10 tokens again.
+	clock.Add(interval + 20*time.Millisecond)
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if w.RateInfo().OperationOk {
+			allowed++
+		}
+	}
+
+	require.Equal(t, 1, allowed)
+
+	// half way through the window half of the previous count has decayed
+	clock.Add(80 * time.Millisecond)
+	info := w.Peek()
+	require.True(t, info.OperationOk)
+	require.Equal(t, uint64(4), info.Remaining)
+}
+
+func TestMemoryStore_SlidingWindowAlgorithm(t *testing.T) {
+	t.Parallel()
+
+	config := limits.Config{
+		Limit:       3,
+		Interval:    time.Minute,
+		Algorithm:   limits.AlgorithmSlidingWindow,
+		TTLInterval: 24 * time.Hour,
+		MinTTL:      24 * time.Hour,
+	}
+
+	store := limits.NewMemoryStore(&config)
+	go store.GarbageCollector()
+
+	t.Cleanup(func() {
+		err := store.Close()
+		require.NoError(t, err)
+	})
+
+	for i := 0; i < 3; i++ {
+		info, err := store.Take("my-key")
+		require.NoError(t, err)
+		require.True(t, info.OperationOk)
+	}
+
+	info, err := store.Take("my-key")
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+	require.Equal(t, uint64(3), info.LimitSize)
+}
@@ -0,0 +1,364 @@
+package limits
+
+import (
+	"encoding/json"
+	"github.com/rsb/failure"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SnapshotVersion is the version of the snapshot format written by this
+// package. Snapshots of any other version are refused.
+const SnapshotVersion = 1
+
+var (
+	_ Snapshotter = (*MemoryStore)(nil)
+	_ Snapshotter = (*ShardedStore)(nil)
+)
+
+// Snapshotter is implemented by the stores able to save their state to a
+// file and restore it after a restart
+type Snapshotter interface {
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) (int, error)
+	SaveFile(path string) error
+	LoadFile(path string) (int, error)
+}
+
+// Snapshot is the versioned format used to save the state of a store to a
+// file and restore it after a restart.
+//
+// Version   - the format version, see SnapshotVersion
+// Algorithm - the algorithm of every entry, a store only restores a snapshot
+// 						 of its own algorithm
+// SavedAt   - nanoseconds from unix epoch when the snapshot was taken
+// Entries   - the state of every key, most recently active first
+type Snapshot struct {
+	Version   int             `json:"version"`
+	Algorithm Algorithm       `json:"algorithm"`
+	SavedAt   uint64          `json:"saved_at"`
+	Entries   []SnapshotEntry `json:"entries"`
+}
+
+// SnapshotEntry is the state of the limiter of a single key
+type SnapshotEntry struct {
+	Key   string       `json:"key"`
+	State LimiterState `json:"state"`
+}
+
+// LimiterState holds the fields needed to restore a limiter. Each algorithm
+// only uses the fields it needs, times are nanoseconds from unix epoch.
+//
+// Limit          - the limit of the key
+// Interval       - the interval the limit is measured against
+// Burst          - token bucket and gcra burst
+// MaxQueue       - leaky bucket queue depth
+// MaxWait        - leaky bucket longest wait
+// Start          - when the fixed or sliding window, or the sliding log, was created
+// Tick           - the last window used by a fixed or sliding window
+// Available      - tokens left in the current fixed window
+// ReservedTick   - the last fixed window holding reservations
+// ReservedTokens - tokens reserved in ReservedTick
+// Previous       - sliding window count of the previous window
+// Current        - sliding window count of the current window
+// Tokens         - token bucket level, negative when tokens are reserved
+// At             - token bucket last refill, gcra theoretical arrival time or
+// 									leaky bucket time the next request leaves the queue
+// Log            - sliding log entries, oldest first
+type LimiterState struct {
+	Limit          uint64        `json:"limit"`
+	Interval       time.Duration `json:"interval"`
+	Burst          uint64        `json:"burst,omitempty"`
+	MaxQueue       uint64        `json:"max_queue,omitempty"`
+	MaxWait        time.Duration `json:"max_wait,omitempty"`
+	Start          uint64        `json:"start,omitempty"`
+	Tick           uint64        `json:"tick,omitempty"`
+	Available      uint64        `json:"available,omitempty"`
+	ReservedTick   uint64        `json:"reserved_tick,omitempty"`
+	ReservedTokens uint64        `json:"reserved_tokens,omitempty"`
+	Previous       uint64        `json:"previous,omitempty"`
+	Current        uint64        `json:"current,omitempty"`
+	Tokens         float64       `json:"tokens,omitempty"`
+	At             uint64        `json:"at,omitempty"`
+	Log            []uint64      `json:"log,omitempty"`
+}
+
+// Snapshot writes the state of every key to w
+func (m *MemoryStore) Snapshot(w io.Writer) error {
+	return writeSnapshot(w, m.algorithm, unixNano(m.clock), m.entries())
+}
+
+// Restore loads the keys of a snapshot written by Snapshot and returns how
+// many were restored. Entries that expired while the store was down, or that
+// would be no different from a new key, are dropped. A full store stops
+// restoring once it holds MaxKeys keys.
+func (m *MemoryStore) Restore(r io.Reader) (int, error) {
+	snap, err := readSnapshot(r, m.algorithm)
+	if err != nil {
+		return 0, failure.Wrap(err, "readSnapshot failed")
+	}
+
+	return m.restore(snap.Entries), nil
+}
+
+// SaveFile writes a snapshot to path. The snapshot is written to a temporary
+// file first and renamed, so a crash never leaves a partial snapshot behind.
+// Saves of the store are serialized.
+func (m *MemoryStore) SaveFile(path string) error {
+	m.saving.Lock()
+	defer m.saving.Unlock()
+
+	return saveSnapshot(path, m.Snapshot)
+}
+
+// LoadFile restores the snapshot at path and returns how many keys were
+// restored. A missing file restores nothing and is not an error.
+func (m *MemoryStore) LoadFile(path string) (int, error) {
+	return loadSnapshot(path, m.Restore)
+}
+
+// entries is the state of every key held by the store
+func (m *MemoryStore) entries() []SnapshotEntry {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	entries := make([]SnapshotEntry, 0, len(m.data))
+	for k, b := range m.data {
+		entries = append(entries, SnapshotEntry{Key: k, State: b.State()})
+	}
+
+	return entries
+}
+
+// restore adds the limiters of the entries the store does not hold yet
+func (m *MemoryStore) restore(entries []SnapshotEntry) int {
+	now := unixNano(m.clock)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	count := 0
+	for _, e := range entries {
+		if _, ok := m.data[e.Key]; ok {
+			continue
+		}
+
+		if m.isFull() {
+			break
+		}
+
+		b, ok := m.restoreLimiter(e.State)
+		if !ok || m.isStale(b, now) || m.isFresh(b, e.State) {
+			continue
+		}
+
+		m.insert(e.Key, b)
+		count++
+	}
+
+	return count
+}
+
+// restoreLimiter creates a limiter of the store algorithm from its state. It
+// is not ok when the state can not be used.
+func (m *MemoryStore) restoreLimiter(s LimiterState) (Limiter, bool) {
+	if s.Limit == 0 || s.Interval <= 0 {
+		return nil, false
+	}
+
+	switch m.algorithm {
+	case AlgorithmGCRA:
+		rate := m.gcra
+		if s.Limit != m.limit || s.Interval != m.interval || s.Burst != rate.burst {
+			rate = NewGCRARate(m.clock, s.Limit, s.Interval, s.Burst)
+		}
+		return restoreGCRA(rate, s), true
+	case AlgorithmTokenBucket:
+		return restoreTokenBucket(m.clock, s), true
+	case AlgorithmSlidingWindow:
+		return restoreSlidingWindow(m.clock, s), true
+	case AlgorithmSlidingLog:
+		return restoreSlidingLog(m.clock, s, m.limit), true
+	case AlgorithmLeakyBucket:
+		return restoreLeakyBucket(m.clock, s), true
+	default:
+		return restoreBucket(m.clock, s), true
+	}
+}
+
+// isFresh reports whether the limiter uses the store limits and holds all
+// its tokens, in which case it is no different from a new key
+func (m *MemoryStore) isFresh(b Limiter, s LimiterState) bool {
+	if s.Limit != m.limit || s.Interval != m.interval {
+		return false
+	}
+
+	info := b.Peek()
+	return info.Remaining == info.LimitSize
+}
+
+// writeSnapshot encodes the entries, most recently active first so a full
+// store keeps the most active keys when restoring
+func writeSnapshot(w io.Writer, algorithm Algorithm, now uint64, entries []SnapshotEntry) error {
+	sort.Slice(entries, func(i, j int) bool {
+		return lastActive(entries[i].State) > lastActive(entries[j].State)
+	})
+
+	snap := Snapshot{
+		Version:   SnapshotVersion,
+		Algorithm: algorithm,
+		SavedAt:   now,
+		Entries:   entries,
+	}
+
+	if err := json.NewEncoder(w).Encode(&snap); err != nil {
+		return failure.ToSystem(err, "json.Encode failed for snapshot")
+	}
+
+	return nil
+}
+
+// readSnapshot decodes a snapshot and checks it can be used by a store of
+// the given algorithm
+func readSnapshot(r io.Reader, algorithm Algorithm) (Snapshot, error) {
+	var snap Snapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return snap, failure.ToInvalidParam(err, "json.Decode failed for snapshot")
+	}
+
+	if snap.Version != SnapshotVersion {
+		return snap, failure.InvalidParam("snapshot version (%d) is not supported, expected (%d)", snap.Version, SnapshotVersion)
+	}
+
+	if snap.Algorithm != algorithm {
+		return snap, failure.InvalidState("snapshot algorithm (%s) does not match the store algorithm (%s)", snap.Algorithm, algorithm)
+	}
+
+	return snap, nil
+}
+
+// saveSnapshot writes a snapshot to a temporary file next to path and renames
+// it over path
+func saveSnapshot(path string, snapshot func(w io.Writer) error) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	f, err := os.CreateTemp(dir, base+".tmp*")
+	if err != nil {
+		return failure.ToSystem(err, "os.CreateTemp failed for (%s)", path)
+	}
+	tmp := f.Name()
+	defer func() { _ = os.Remove(tmp) }()
+
+	if err = snapshot(f); err != nil {
+		_ = f.Close()
+		return failure.Wrap(err, "snapshot failed for (%s)", path)
+	}
+
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return failure.ToSystem(err, "f.Sync failed for (%s)", tmp)
+	}
+
+	if err = f.Close(); err != nil {
+		return failure.ToSystem(err, "f.Close failed for (%s)", tmp)
+	}
+
+	if err = os.Rename(tmp, path); err != nil {
+		return failure.ToSystem(err, "os.Rename failed (%s) to (%s)", tmp, path)
+	}
+
+	return nil
+}
+
+// loadSnapshot opens the snapshot at path and restores it
+func loadSnapshot(path string, restore func(r io.Reader) (int, error)) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, failure.ToSystem(err, "os.Open failed for (%s)", path)
+	}
+	defer func() { _ = f.Close() }()
+
+	count, err := restore(f)
+	if err != nil {
+		return 0, failure.Wrap(err, "restore failed for (%s)", path)
+	}
+
+	return count, nil
+}
+
+// lastActive is the most recent time found in the state, used to order the
+// entries of a snapshot
+func lastActive(s LimiterState) uint64 {
+	last := s.Start + s.Tick*uint64(s.Interval)
+	if s.At > last {
+		last = s.At
+	}
+	if n := len(s.Log); n > 0 && s.Log[n-1] > last {
+		last = s.Log[n-1]
+	}
+
+	return last
+}
+
+// snapshotTicker ticks on the snapshot interval, it never ticks when there
+// is no path or interval. The returned func stops the ticker.
+func snapshotTicker(path string, interval time.Duration) (<-chan time.Time, func()) {
+	if path == "" || interval <= 0 {
+		return nil, func() {}
+	}
+
+	ticker := time.NewTicker(interval)
+	return ticker.C, ticker.Stop
+}
+
+// collector tracks the garbage collector of a store, so Close can wait for it
+// to return before taking the final snapshot
+//
+// lock    - guards closed and the start of a garbage collector
+// closed  - set once the store is closing, no garbage collector starts after
+// running - the garbage collectors that have not returned yet
+type collector struct {
+	lock    sync.Mutex
+	closed  bool
+	running sync.WaitGroup
+}
+
+// start registers a running garbage collector, it is not ok once the store
+// is closing
+func (c *collector) start() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return false
+	}
+
+	c.running.Add(1)
+	return true
+}
+
+// done is called by the garbage collector when it returns
+func (c *collector) done() {
+	c.running.Done()
+}
+
+// close closes stop to end the garbage collectors and waits for them to
+// return
+func (c *collector) close(stop chan struct{}) {
+	c.lock.Lock()
+	c.closed = true
+	close(stop)
+	c.lock.Unlock()
+
+	c.running.Wait()
+}
@@ -0,0 +1,429 @@
+package limits_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/api_rate_limiter/foundation/limits/limitstest"
+	"github.com/rsb/failure"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore_SnapshotRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	algorithms := []limits.Algorithm{
+		limits.AlgorithmFixedWindow,
+		limits.AlgorithmTokenBucket,
+		limits.AlgorithmSlidingWindow,
+		limits.AlgorithmSlidingLog,
+		limits.AlgorithmGCRA,
+		limits.AlgorithmLeakyBucket,
+	}
+
+	for _, algorithm := range algorithms {
+		algorithm := algorithm
+		t.Run(algorithm.String(), func(t *testing.T) {
+			t.Parallel()
+
+			clock := limitstest.NewManualClock(time.Unix(1000, 0))
+			config := limits.Config{
+				Limit:       5,
+				Interval:    time.Minute,
+				TTLInterval: time.Hour,
+				MinTTL:      time.Hour,
+				Algorithm:   algorithm,
+				Clock:       clock,
+			}
+
+			store := limits.NewMemoryStore(&config)
+			for i := 0; i < 3; i++ {
+				_, err := store.Take("three")
+				require.NoError(t, err)
+			}
+			_, err := store.Take("one")
+			require.NoError(t, err)
+			require.NoError(t, store.Set("custom", 50, time.Hour))
+
+			path := filepath.Join(t.TempDir(), "limits.json")
+			require.NoError(t, store.SaveFile(path))
+
+			clock.Add(time.Second)
+			restored := limits.NewMemoryStore(&config)
+			t.Cleanup(func() {
+				require.NoError(t, store.Close())
+				require.NoError(t, restored.Close())
+			})
+
+			count, err := restored.LoadFile(path)
+			require.NoError(t, err)
+			require.Equal(t, 3, count)
+
+			for _, key := range []string{"three", "one", "custom"} {
+				want, err := store.Peek(key)
+				require.NoError(t, err)
+				got, err := restored.Peek(key)
+				require.NoError(t, err)
+				require.Equal(t, want, got, "key (%s)", key)
+			}
+		})
+	}
+}
+
+func TestMemoryStore_SnapshotGCRAUnevenInterval(t *testing.T) {
+	t.Parallel()
+
+	// a minute is not a whole number of nanoseconds per request
+	clock := limitstest.NewManualClock(time.Unix(1000, 0))
+	config := limits.Config{
+		Limit:       7,
+		Interval:    time.Minute,
+		TTLInterval: time.Hour,
+		MinTTL:      time.Hour,
+		Algorithm:   limits.AlgorithmGCRA,
+		Clock:       clock,
+	}
+
+	store := limits.NewMemoryStore(&config)
+	_, err := store.Take("idle")
+	require.NoError(t, err)
+
+	clock.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		_, err = store.Take("busy")
+		require.NoError(t, err)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, store.Snapshot(&buf))
+
+	var snap limits.Snapshot
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &snap))
+	require.Len(t, snap.Entries, 2)
+	for _, e := range snap.Entries {
+		require.Equal(t, time.Minute, e.State.Interval, "key (%s)", e.Key)
+	}
+
+	// idle is back to its full burst and no different from a new key
+	restored := limits.NewMemoryStore(&config)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+		require.NoError(t, restored.Close())
+	})
+
+	count, err := restored.Restore(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	want, err := store.Peek("busy")
+	require.NoError(t, err)
+	got, err := restored.Peek("busy")
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+}
+
+func TestMemoryStore_RestoreSlidingLogLimit(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(1000, 0))
+	config := limits.Config{
+		Limit:       5,
+		Interval:    time.Minute,
+		TTLInterval: time.Hour,
+		MinTTL:      time.Hour,
+		Algorithm:   limits.AlgorithmSlidingLog,
+		Clock:       clock,
+	}
+
+	// a snapshot claiming a huge limit must not allocate a ring that large
+	now := uint64(clock.Now().UnixNano())
+	snap := limits.Snapshot{
+		Version:   limits.SnapshotVersion,
+		Algorithm: limits.AlgorithmSlidingLog,
+		SavedAt:   now,
+		Entries: []limits.SnapshotEntry{
+			{Key: "huge", State: limits.LimiterState{Limit: 1 << 60, Interval: time.Minute, Start: now, Log: []uint64{now, now}}},
+		},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, json.NewEncoder(&buf).Encode(&snap))
+
+	store := limits.NewMemoryStore(&config)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	count, err := store.Restore(&buf)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	info, err := store.Peek("huge")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1<<60-2), info.Remaining)
+
+	// the ring grows past the store limit as the key is used
+	for i := 0; i < 10; i++ {
+		info, err = store.Take("huge")
+		require.NoError(t, err)
+		require.True(t, info.OperationOk)
+	}
+	require.Equal(t, uint64(1<<60-12), info.Remaining)
+
+	// the ring wraps once the first entries expire and keeps its entries in
+	// order when it grows again
+	clock.Add(time.Minute)
+	for i := 0; i < 30; i++ {
+		info, err = store.Take("huge")
+		require.NoError(t, err)
+		require.True(t, info.OperationOk)
+		clock.Add(time.Second)
+	}
+	require.Equal(t, uint64(1<<60-30), info.Remaining)
+
+	clock.Add(40 * time.Second)
+	info, err = store.Peek("huge")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1<<60-19), info.Remaining)
+}
+
+func TestMemoryStore_RestoreDropsExpired(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(1000, 0))
+	config := limits.Config{
+		Limit:       5,
+		Interval:    time.Minute,
+		TTLInterval: time.Hour,
+		MinTTL:      time.Hour,
+		Algorithm:   limits.AlgorithmTokenBucket,
+		Clock:       clock,
+	}
+
+	store := limits.NewMemoryStore(&config)
+	_, err := store.Take("old")
+	require.NoError(t, err)
+
+	clock.Add(10 * time.Second)
+	for i := 0; i < 5; i++ {
+		_, err = store.Take("recent")
+		require.NoError(t, err)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, store.Snapshot(&buf))
+	require.NoError(t, store.Close())
+
+	// the bucket of old is full again and no different from a new key
+	clock.Add(30 * time.Second)
+	restored := limits.NewMemoryStore(&config)
+	count, err := restored.Restore(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	require.Equal(t, 1, restored.Len())
+	require.NoError(t, restored.Close())
+
+	// both keys have been inactive for longer than the min ttl
+	clock.Add(2 * time.Hour)
+	restored = limits.NewMemoryStore(&config)
+	count, err = restored.Restore(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+	require.NoError(t, restored.Close())
+}
+
+func TestMemoryStore_RestoreInvalid(t *testing.T) {
+	t.Parallel()
+
+	store := limits.NewMemoryStore(&limits.Config{Algorithm: limits.AlgorithmGCRA})
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	_, err := store.Restore(strings.NewReader(`{"version":99,"algorithm":"gcra"}`))
+	require.True(t, failure.IsInvalidParam(err))
+
+	_, err = store.Restore(strings.NewReader(`{"version":1,"algorithm":"fixed-window"}`))
+	require.True(t, failure.IsInvalidState(err))
+
+	_, err = store.Restore(strings.NewReader(`not json`))
+	require.True(t, failure.IsInvalidParam(err))
+
+	count, err := store.LoadFile(filepath.Join(t.TempDir(), "missing.json"))
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+}
+
+func TestMemoryStore_SnapshotOnClose(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "limits.json")
+	config := limits.Config{
+		Limit:        2,
+		Interval:     time.Hour,
+		SnapshotPath: path,
+	}
+
+	store := limits.NewMemoryStore(&config)
+	_, err := store.Take("key")
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	_, err = os.Stat(path)
+	require.NoError(t, err)
+
+	// the restarted store picks up where the previous one left off
+	restored := limits.NewMemoryStore(&config)
+	t.Cleanup(func() {
+		require.NoError(t, restored.Close())
+	})
+
+	count, err := restored.LoadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	info, err := restored.Take("key")
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+	require.Equal(t, uint64(0), info.Remaining)
+}
+
+func TestMemoryStore_SnapshotInterval(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "limits.json")
+	config := limits.Config{
+		Limit:            2,
+		Interval:         time.Hour,
+		SnapshotPath:     path,
+		SnapshotInterval: 10 * time.Millisecond,
+		SnapshotFailed: func(err error) {
+			t.Errorf("snapshot failed: %v", err)
+		},
+	}
+
+	store := limits.NewMemoryStore(&config)
+	go store.GarbageCollector()
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	_, err := store.Take("key")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+// gatedClock blocks the first read of the time after it is armed, until it
+// is released
+type gatedClock struct {
+	armed   int32
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (c *gatedClock) Now() time.Time {
+	if atomic.CompareAndSwapInt32(&c.armed, 1, 0) {
+		close(c.entered)
+		<-c.release
+	}
+
+	return time.Now()
+}
+
+func TestMemoryStore_SnapshotCloseWaitsForCollector(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "limits.json")
+	clock := &gatedClock{entered: make(chan struct{}), release: make(chan struct{})}
+	config := limits.Config{
+		Limit:            2,
+		Interval:         time.Hour,
+		Clock:            clock,
+		SnapshotPath:     path,
+		SnapshotInterval: time.Millisecond,
+	}
+
+	store := limits.NewMemoryStore(&config)
+	_, err := store.Take("key")
+	require.NoError(t, err)
+
+	// hold a periodic snapshot before it reads the keys
+	atomic.StoreInt32(&clock.armed, 1)
+	go store.GarbageCollector()
+	<-clock.entered
+
+	closed := make(chan error)
+	go func() {
+		closed <- store.Close()
+	}()
+
+	select {
+	case err = <-closed:
+		t.Fatalf("Close returned before the garbage collector: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(clock.release)
+	require.NoError(t, <-closed)
+
+	// no periodic snapshot is still being written
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	// the periodic snapshot did not replace the final one
+	restored := limits.NewMemoryStore(&limits.Config{Limit: 2, Interval: time.Hour})
+	t.Cleanup(func() {
+		require.NoError(t, restored.Close())
+	})
+
+	count, err := restored.LoadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+}
+
+func TestShardedStore_SnapshotRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "limits.json")
+	config := limits.Config{
+		Limit:        2,
+		Interval:     time.Hour,
+		Shards:       4,
+		SnapshotPath: path,
+	}
+
+	store := limits.NewShardedStore(&config)
+	for i := 0; i < 20; i++ {
+		_, err := store.Take(fmt.Sprintf("key-%d", i))
+		require.NoError(t, err)
+	}
+	require.NoError(t, store.Close())
+
+	// a different shard count still finds every key
+	config.Shards = 3
+	restored := limits.NewShardedStore(&config)
+	t.Cleanup(func() {
+		require.NoError(t, restored.Close())
+	})
+
+	count, err := restored.LoadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, 20, count)
+
+	_, remaining, err := restored.Get("key-7")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), remaining)
+}
@@ -0,0 +1,252 @@
+package limits
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// TokenBucket is a continuously refilling token bucket. Unlike the fixed
+// window Bucket, tokens are added gradually based on the nanoseconds elapsed
+// since the last refill, at a rate of limit tokens per interval. The bucket
+// never holds more than its burst capacity, which prevents clients from
+// doubling their limit across a window edge.
+//
+// limit    - the number of tokens produced every interval
+// burst    - the max number of tokens the bucket can hold at any time
+// interval - the duration over which limit tokens are produced
+// tokens   - current number of available tokens, fractions are kept so no
+// 						refill time is lost between requests. It goes negative when
+// 						tokens are reserved ahead of time
+// last     - nanoseconds from unix epoch of the last refill
+// clock    - source of the current time
+// lock     - mutex lock to guard the struct fields
+type TokenBucket struct {
+	clock    Clock
+	limit    uint64
+	burst    uint64
+	interval time.Duration
+	tokens   float64
+	last     uint64
+	lock     sync.Mutex
+}
+
+// NewTokenBucket creates a full bucket that produces tokens per interval and
+// holds at most burst tokens. A nil clock uses the SystemClock.
+func NewTokenBucket(clock Clock, tokens uint64, interval time.Duration, burst uint64) *TokenBucket {
+	if burst == 0 {
+		burst = tokens
+	}
+
+	clock = clockOrSystem(clock)
+	return &TokenBucket{
+		clock:    clock,
+		limit:    tokens,
+		burst:    burst,
+		interval: interval,
+		tokens:   float64(burst),
+		last:     unixNano(clock),
+	}
+}
+
+func (b *TokenBucket) Get() (uint64, uint64) {
+	info := b.Peek()
+	return info.LimitSize, info.Remaining
+}
+
+// Peek reports the tokens available now, including the tokens produced since
+// the last refill, without modifying the bucket
+func (b *TokenBucket) Peek() RateInfo {
+	now := unixNano(b.clock)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	tokens := b.level(now)
+	remaining := whole(tokens)
+	target := float64(b.burst)
+	if remaining == 0 {
+		target = 1
+	}
+
+	return RateInfo{
+		LimitSize:   b.burst,
+		Remaining:   remaining,
+		Reset:       now + b.durationFor(target-tokens),
+		OperationOk: remaining > 0,
+	}
+}
+
+// LastActive is the time of the last refill, which happens on every take
+func (b *TokenBucket) LastActive() uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.last
+}
+
+// State is the bucket as saved in a snapshot
+func (b *TokenBucket) State() LimiterState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return LimiterState{
+		Limit:    b.limit,
+		Interval: b.interval,
+		Burst:    b.burst,
+		Tokens:   b.tokens,
+		At:       b.last,
+	}
+}
+
+// restoreTokenBucket creates a token bucket from its snapshot state
+func restoreTokenBucket(clock Clock, s LimiterState) *TokenBucket {
+	b := NewTokenBucket(clock, s.Limit, s.Interval, s.Burst)
+	b.tokens = s.Tokens
+	b.last = s.At
+
+	return b
+}
+
+// RateInfo refills the bucket for the time elapsed and takes a single token.
+func (b *TokenBucket) RateInfo() RateInfo {
+	return b.TakeN(1)
+}
+
+// TakeN refills the bucket for the time elapsed and takes n tokens when they
+// are all available. Reset is the time the bucket will be full again or, when
+// no tokens are left, the time the next token becomes available. A rejected
+// request reports when n tokens will be available.
+func (b *TokenBucket) TakeN(n uint64) RateInfo {
+	var ok bool
+
+	now := unixNano(b.clock)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill(now)
+
+	if b.tokens >= float64(n) {
+		b.tokens -= float64(n)
+		ok = true
+	}
+
+	remaining := whole(b.tokens)
+	target := float64(b.burst)
+	switch {
+	case !ok:
+		target = float64(n)
+	case remaining == 0:
+		target = 1
+	}
+
+	return RateInfo{
+		LimitSize:   b.burst,
+		Remaining:   remaining,
+		Reset:       now + b.durationFor(target-b.tokens),
+		OperationOk: ok,
+	}
+}
+
+// Return puts n tokens back in the bucket, never more than the burst
+func (b *TokenBucket) Return(n uint64) {
+	now := unixNano(b.clock)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill(now)
+	b.tokens += float64(n)
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+}
+
+// Reserve takes n tokens now, going into debt when they are not available
+// yet. The reservation must wait for the debt to be refilled. It is not ok
+// when n is larger than the burst.
+func (b *TokenBucket) Reserve(n uint64) *Reservation {
+	now := unixNano(b.clock)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if n > b.burst {
+		return &Reservation{limit: b.burst, tokens: n}
+	}
+
+	b.refill(now)
+	b.tokens -= float64(n)
+
+	timeToAct := now
+	if b.tokens < 0 {
+		timeToAct += b.durationFor(-b.tokens)
+	}
+
+	return &Reservation{
+		ok:        true,
+		clock:     b.clock,
+		limit:     b.burst,
+		tokens:    n,
+		timeToAct: timeToAct,
+		cancel: func() {
+			now := unixNano(b.clock)
+
+			b.lock.Lock()
+			defer b.lock.Unlock()
+
+			if now >= timeToAct {
+				return
+			}
+
+			b.refill(now)
+			b.tokens = math.Min(b.tokens+float64(n), float64(b.burst))
+		},
+	}
+}
+
+// whole is the number of whole tokens available
+func whole(tokens float64) uint64 {
+	if tokens < 1 {
+		return 0
+	}
+
+	return uint64(tokens)
+}
+
+// refill adds the tokens produced between the last refill and now, capped
+// at the burst capacity
+func (b *TokenBucket) refill(now uint64) {
+	if now <= b.last {
+		return
+	}
+
+	b.tokens = b.level(now)
+	b.last = now
+}
+
+// level is the number of tokens in the bucket at now
+func (b *TokenBucket) level(now uint64) float64 {
+	if now <= b.last {
+		return b.tokens
+	}
+
+	elapsed := float64(now - b.last)
+	tokens := b.tokens + elapsed*float64(b.limit)/float64(b.interval)
+	if tokens > float64(b.burst) {
+		tokens = float64(b.burst)
+	}
+
+	return tokens
+}
+
+// durationFor is the number of nanoseconds needed to produce the given
+// number of tokens
+func (b *TokenBucket) durationFor(tokens float64) uint64 {
+	if tokens <= 0 {
+		return 0
+	}
+
+	return uint64(tokens * float64(b.interval) / float64(b.limit))
+}
@@ -0,0 +1,88 @@
+package limits_test
+
+import (
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/api_rate_limiter/foundation/limits/limitstest"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket_Burst(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	b := limits.NewTokenBucket(clock, 10, time.Second, 3)
+
+	for i := uint64(1); i <= 3; i++ {
+		info := b.RateInfo()
+		require.True(t, info.OperationOk)
+		require.Equal(t, uint64(3), info.LimitSize)
+		require.Equal(t, 3-i, info.Remaining)
+	}
+
+	info := b.RateInfo()
+	require.False(t, info.OperationOk)
+	require.Equal(t, uint64(0), info.Remaining)
+
+	// with no tokens left reset points to the next token, 100ms at 10/sec
+	wait := time.Duration(info.Reset - uint64(clock.Now().UnixNano()))
+	require.Equal(t, 100*time.Millisecond, wait)
+}
+
+func TestTokenBucket_ContinuousRefill(t *testing.T) {
+	t.Parallel()
+
+	// one token every 20ms
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	b := limits.NewTokenBucket(clock, 50, time.Second, 50)
+	for i := 0; i < 50; i++ {
+		require.True(t, b.RateInfo().OperationOk)
+	}
+	require.False(t, b.RateInfo().OperationOk)
+
+	// a fixed window would refill nothing until a full second has passed
+	clock.Add(50 * time.Millisecond)
+
+	require.True(t, b.RateInfo().OperationOk)
+	require.True(t, b.RateInfo().OperationOk)
+	require.False(t, b.RateInfo().OperationOk)
+}
+
+func TestMemoryStore_TokenBucketAlgorithm(t *testing.T) {
+	t.Parallel()
+
+	config := limits.Config{
+		Limit:       5,
+		Interval:    time.Minute,
+		Burst:       2,
+		Algorithm:   limits.AlgorithmTokenBucket,
+		TTLInterval: 24 * time.Hour,
+		MinTTL:      24 * time.Hour,
+	}
+
+	store := limits.NewMemoryStore(&config)
+	go store.GarbageCollector()
+
+	t.Cleanup(func() {
+		err := store.Close()
+		require.NoError(t, err)
+	})
+
+	key := "my-key"
+	for i := 0; i < 2; i++ {
+		info, err := store.Take(key)
+		require.NoError(t, err)
+		require.True(t, info.OperationOk)
+		require.Equal(t, uint64(2), info.LimitSize)
+	}
+
+	info, err := store.Take(key)
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+
+	limit, remaining, err := store.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), limit)
+	require.Equal(t, uint64(0), remaining)
+}
@@ -0,0 +1,127 @@
+package limits
+
+import (
+	"github.com/rsb/failure"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Window is one of the limits enforced on the same key, like 10 per second
+// and 1000 per hour
+type Window struct {
+	Limit    uint64
+	Interval time.Duration
+}
+
+// ParseWindow parses a window written as limit/interval, like 10/1s or
+// 1000/1h
+func ParseWindow(s string) (Window, error) {
+	var w Window
+
+	limit, interval, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return w, failure.InvalidParam("window (%s) is not limit/interval", s)
+	}
+
+	n, err := strconv.ParseUint(strings.TrimSpace(limit), 10, 64)
+	if err != nil {
+		return w, failure.ToInvalidParam(err, "limit of window (%s) is not a number", s)
+	}
+
+	d, err := time.ParseDuration(strings.TrimSpace(interval))
+	if err != nil {
+		return w, failure.ToInvalidParam(err, "interval of window (%s) is not a duration", s)
+	}
+
+	w = Window{Limit: n, Interval: d}
+	if err = w.Validate(); err != nil {
+		return Window{}, err
+	}
+
+	return w, nil
+}
+
+// Validate reports an invalid param error when the limit or interval is not
+// positive
+func (w Window) Validate() error {
+	if w.Limit == 0 {
+		return failure.InvalidParam("limit of window (%s) is zero", w)
+	}
+
+	if w.Interval <= 0 {
+		return failure.InvalidParam("interval of window (%s) is not positive", w)
+	}
+
+	return nil
+}
+
+func (w Window) String() string {
+	return strconv.FormatUint(w.Limit, 10) + "/" + w.Interval.String()
+}
+
+// WindowStoreFunc creates the store of a single window. The config is a copy
+// of the config given to NewWindowStore with the limit and interval of the
+// window.
+type WindowStoreFunc func(config *Config, w Window) (Store, error)
+
+// NewWindowStore enforces every window on each key, a request is permitted
+// only when every window has capacity, see CompositeStore. Each window is a
+// tier of its own store, created by newStore or a MemoryStore when nil, and
+// the RateInfo returned is the one of the window closest to exhaustion.
+// Windows must have distinct intervals.
+func NewWindowStore(config *Config, windows []Window, newStore WindowStoreFunc) (*CompositeStore, error) {
+	if len(windows) == 0 {
+		return nil, failure.InvalidParam("windows are empty")
+	}
+
+	seen := make(map[time.Duration]struct{}, len(windows))
+	for _, w := range windows {
+		if err := w.Validate(); err != nil {
+			return nil, err
+		}
+
+		if _, ok := seen[w.Interval]; ok {
+			return nil, failure.InvalidParam("interval (%s) is used by more than one window", w.Interval)
+		}
+		seen[w.Interval] = struct{}{}
+	}
+
+	if newStore == nil {
+		newStore = func(c *Config, _ Window) (Store, error) {
+			return NewMemoryStore(c), nil
+		}
+	}
+
+	tiers := make([]Tier, 0, len(windows))
+	closeTiers := func() {
+		for _, t := range tiers {
+			_ = t.Store.Close()
+		}
+	}
+
+	for _, w := range windows {
+		c := Config{}
+		if config != nil {
+			c = *config
+		}
+		c.Limit = w.Limit
+		c.Interval = w.Interval
+
+		store, err := newStore(&c, w)
+		if err != nil {
+			closeTiers()
+			return nil, failure.Wrap(err, "store of window (%s) failed", w)
+		}
+
+		tiers = append(tiers, Tier{Name: w.String(), Store: store})
+	}
+
+	store, err := NewCompositeStore(tiers...)
+	if err != nil {
+		closeTiers()
+		return nil, failure.Wrap(err, "NewCompositeStore failed")
+	}
+
+	return store, nil
+}
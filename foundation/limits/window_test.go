@@ -0,0 +1,112 @@
+package limits_test
+
+import (
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/api_rate_limiter/foundation/limits/limitstest"
+	"github.com/rsb/failure"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	t.Parallel()
+
+	w, err := limits.ParseWindow(" 1000 / 1h ")
+	require.NoError(t, err)
+	require.Equal(t, limits.Window{Limit: 1000, Interval: time.Hour}, w)
+	require.Equal(t, "1000/1h0m0s", w.String())
+
+	for _, s := range []string{"", "10", "ten/1s", "10/second", "0/1s", "10/0s", "10/-1s"} {
+		_, err = limits.ParseWindow(s)
+		require.True(t, failure.IsInvalidParam(err), s)
+	}
+}
+
+func TestWindowStore_ClosestToExhaustion(t *testing.T) {
+	t.Parallel()
+
+	clock := limitstest.NewManualClock(time.Unix(0, 0))
+	store, err := limits.NewWindowStore(&limits.Config{Clock: clock}, []limits.Window{
+		{Limit: 3, Interval: time.Second},
+		{Limit: 5, Interval: time.Hour},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	// the burst window is the closest to exhaustion
+	info, err := store.TakeN("key", 2)
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+	require.Equal(t, uint64(3), info.LimitSize)
+	require.Equal(t, uint64(1), info.Remaining)
+	require.Equal(t, uint64(time.Unix(1, 0).UnixNano()), info.Reset)
+
+	// the burst window rejects without consuming the hourly window
+	info, err = store.TakeN("key", 2)
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+	require.Equal(t, uint64(3), info.LimitSize)
+
+	// once the burst window rolls over the hourly window is the closest
+	clock.Add(time.Second)
+	info, err = store.TakeN("key", 2)
+	require.NoError(t, err)
+	require.True(t, info.OperationOk)
+	require.Equal(t, uint64(5), info.LimitSize)
+	require.Equal(t, uint64(1), info.Remaining)
+
+	clock.Add(time.Second)
+	info, err = store.TakeN("key", 2)
+	require.NoError(t, err)
+	require.False(t, info.OperationOk)
+	require.Equal(t, uint64(5), info.LimitSize)
+	require.Equal(t, uint64(time.Unix(3600, 0).UnixNano()), info.Reset)
+}
+
+func TestWindowStore_NewStore(t *testing.T) {
+	t.Parallel()
+
+	var configs []limits.Config
+	store, err := limits.NewWindowStore(&limits.Config{Limit: 1, Interval: time.Minute, MaxKeys: 10}, []limits.Window{
+		{Limit: 10, Interval: time.Second},
+		{Limit: 1000, Interval: time.Hour},
+	}, func(c *limits.Config, w limits.Window) (limits.Store, error) {
+		configs = append(configs, *c)
+		return limits.NewMemoryStore(c), nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+	require.Equal(t, 2, store.Tiers())
+
+	// every window keeps the config apart from its limit and interval
+	require.Len(t, configs, 2)
+	require.Equal(t, uint64(10), configs[0].Limit)
+	require.Equal(t, time.Second, configs[0].Interval)
+	require.Equal(t, uint64(1000), configs[1].Limit)
+	require.Equal(t, time.Hour, configs[1].Interval)
+	require.Equal(t, 10, configs[1].MaxKeys)
+
+	_, err = limits.NewWindowStore(nil, []limits.Window{{Limit: 1, Interval: time.Second}}, func(*limits.Config, limits.Window) (limits.Store, error) {
+		return nil, failure.System("store is down")
+	})
+	require.True(t, failure.IsSystem(err))
+}
+
+func TestWindowStore_Invalid(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string][]limits.Window{
+		"empty":     nil,
+		"no limit":  {{Interval: time.Second}},
+		"no period": {{Limit: 1}},
+		"duplicate": {{Limit: 1, Interval: time.Second}, {Limit: 2, Interval: time.Second}},
+	}
+
+	for name, windows := range tests {
+		_, err := limits.NewWindowStore(nil, windows, nil)
+		require.True(t, failure.IsInvalidParam(err), name)
+	}
+}
@@ -0,0 +1,255 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/rsb/failure"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPoolSize    = 16
+	DefaultDialTimeout = 5 * time.Second
+	DefaultTimeout     = 1 * time.Second
+)
+
+// ClientConfig controls how the client connects to the server
+//
+// Addr        - host:port of the server
+// Password    - sent with AUTH when a connection is opened, no AUTH when empty
+// DB          - database selected when a connection is opened
+// PoolSize    - max number of idle connections kept open, defaults to 16
+// DialTimeout - timeout for opening a connection, defaults to 5s
+// Timeout     - timeout of a single command when the context has no
+// 							 deadline, defaults to 1s
+type ClientConfig struct {
+	Addr        string
+	Password    string
+	DB          int
+	PoolSize    int
+	DialTimeout time.Duration
+	Timeout     time.Duration
+}
+
+// Client sends commands to a redis compatible server over a pool of
+// connections. It is safe for concurrent use.
+type Client struct {
+	config ClientConfig
+	idle   chan *conn
+
+	closed bool
+	lock   sync.Mutex
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// NewClient creates a client, connections are opened when first needed
+func NewClient(config ClientConfig) *Client {
+	if config.PoolSize <= 0 {
+		config.PoolSize = DefaultPoolSize
+	}
+
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = DefaultDialTimeout
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+
+	return &Client{
+		config: config,
+		idle:   make(chan *conn, config.PoolSize),
+	}
+}
+
+// Do sends the command and returns its reply, see ReadReply for the reply
+// types. An error reply is returned as an Error.
+func (c *Client) Do(ctx context.Context, args ...string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, failure.InvalidParam("command is empty")
+	}
+
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, failure.Wrap(err, "c.get failed")
+	}
+
+	reply, err := cn.do(ctx, c.config.Timeout, args...)
+	if err != nil {
+		_ = cn.Close()
+		return nil, failure.Wrap(err, "cn.do failed for (%s)", args[0])
+	}
+
+	c.put(cn)
+
+	if e, ok := reply.(Error); ok {
+		return nil, e
+	}
+
+	return reply, nil
+}
+
+// Close closes the idle connections, connections in use are closed when
+// they are given back
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	for {
+		select {
+		case cn := <-c.idle:
+			_ = cn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// get takes an idle connection or opens a new one
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	c.lock.Lock()
+	closed := c.closed
+	c.lock.Unlock()
+
+	if closed {
+		return nil, failure.Shutdown("client is closed")
+	}
+
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+
+	return c.dial(ctx)
+}
+
+// put keeps the connection for later use, closing it when the pool is full
+// or the client is closed
+func (c *Client) put(cn *conn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		_ = cn.Close()
+		return
+	}
+
+	select {
+	case c.idle <- cn:
+	default:
+		_ = cn.Close()
+	}
+}
+
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	d := net.Dialer{Timeout: c.config.DialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", c.config.Addr)
+	if err != nil {
+		return nil, failure.ToSystem(err, "d.DialContext failed for (%s)", c.config.Addr)
+	}
+
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+
+	var setup [][]string
+	if c.config.Password != "" {
+		setup = append(setup, []string{"AUTH", c.config.Password})
+	}
+	if c.config.DB > 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.config.DB)})
+	}
+
+	for _, args := range setup {
+		reply, err := cn.do(ctx, c.config.DialTimeout, args...)
+		if err == nil {
+			if e, ok := reply.(Error); ok {
+				err = e
+			}
+		}
+
+		if err != nil {
+			_ = cn.Close()
+			return nil, failure.Wrap(err, "(%s) failed for (%s)", args[0], c.config.Addr)
+		}
+	}
+
+	return cn, nil
+}
+
+// do writes the command and reads its reply within the context deadline, or
+// the timeout when the context has none
+func (cn *conn) do(ctx context.Context, timeout time.Duration, args ...string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(timeout)
+	}
+
+	if err := cn.SetDeadline(deadline); err != nil {
+		return nil, failure.ToSystem(err, "cn.SetDeadline failed")
+	}
+
+	if err := WriteCommand(cn.w, args...); err != nil {
+		return nil, err
+	}
+
+	if err := cn.w.Flush(); err != nil {
+		return nil, failure.ToSystem(err, "cn.w.Flush failed")
+	}
+
+	return ReadReply(cn.r)
+}
+
+// Script is a lua script run on the server with EVALSHA, falling back to
+// EVAL the first time the server does not know the script. Scripts run
+// atomically on the server.
+type Script struct {
+	src string
+	sha string
+}
+
+// NewScript computes the sha1 of the script source used by EVALSHA
+func NewScript(src string) *Script {
+	sum := sha1.Sum([]byte(src))
+	return &Script{src: src, sha: hex.EncodeToString(sum[:])}
+}
+
+// Source is the lua source of the script
+func (s *Script) Source() string {
+	return s.src
+}
+
+// SHA is the sha1 of the script source
+func (s *Script) SHA() string {
+	return s.sha
+}
+
+// Run runs the script with the given keys and arguments
+func (s *Script) Run(ctx context.Context, c *Client, keys []string, args ...string) (interface{}, error) {
+	cmd := make([]string, 0, 3+len(keys)+len(args))
+	cmd = append(cmd, "EVALSHA", s.sha, strconv.Itoa(len(keys)))
+	cmd = append(cmd, keys...)
+	cmd = append(cmd, args...)
+
+	reply, err := c.Do(ctx, cmd...)
+	if e, ok := err.(Error); ok && e.Prefix() == "NOSCRIPT" {
+		cmd[0], cmd[1] = "EVAL", s.src
+		reply, err = c.Do(ctx, cmd...)
+	}
+
+	return reply, err
+}
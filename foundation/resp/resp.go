@@ -0,0 +1,215 @@
+// Package resp implements the subset of the redis serialization protocol
+// (RESP) needed to talk to any redis compatible server: commands are sent as
+// arrays of bulk strings and every reply type can be read back.
+package resp
+
+import (
+	"bufio"
+	"github.com/rsb/failure"
+	"io"
+	"strconv"
+)
+
+// Error is an error reply sent by the server, like "ERR unknown command" or
+// "NOSCRIPT No matching script"
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Prefix is the first word of the error, the error kind used by redis
+func (e Error) Prefix() string {
+	for i := 0; i < len(e); i++ {
+		if e[i] == ' ' {
+			return string(e[:i])
+		}
+	}
+
+	return string(e)
+}
+
+// WriteCommand writes the command as an array of bulk strings. The writer is
+// not flushed.
+func WriteCommand(w *bufio.Writer, args ...string) error {
+	if err := writeHeader(w, '*', int64(len(args))); err != nil {
+		return err
+	}
+
+	for _, arg := range args {
+		if err := writeBulk(w, arg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteReply writes a reply. Supported values are nil (null bulk string),
+// string (bulk string), int64, int, bool (1 or 0), Error, SimpleString and
+// []interface{} of those. The writer is not flushed.
+func WriteReply(w *bufio.Writer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		_, err := w.WriteString("$-1\r\n")
+		return err
+	case SimpleString:
+		return writeLine(w, '+', string(v))
+	case Error:
+		return writeLine(w, '-', string(v))
+	case string:
+		return writeBulk(w, v)
+	case int64:
+		return writeHeader(w, ':', v)
+	case int:
+		return writeHeader(w, ':', int64(v))
+	case bool:
+		if v {
+			return writeHeader(w, ':', 1)
+		}
+		return writeHeader(w, ':', 0)
+	case []interface{}:
+		if err := writeHeader(w, '*', int64(len(v))); err != nil {
+			return err
+		}
+		for _, item := range v {
+			if err := WriteReply(w, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return failure.InvalidParam("reply type (%T) is not supported", v)
+	}
+}
+
+// SimpleString is a status reply, like OK or PONG
+type SimpleString string
+
+// ReadReply reads a single reply. Simple strings are returned as
+// SimpleString, bulk strings as string, integers as int64, arrays as
+// []interface{}, null bulk strings and arrays as nil and error replies as an
+// Error value, not as the returned error which is reserved for protocol and
+// network failures.
+func ReadReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 {
+		return nil, failure.InvalidState("empty reply line")
+	}
+
+	switch line[0] {
+	case '+':
+		return SimpleString(line[1:]), nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			return nil, failure.ToInvalidState(err, "integer reply (%s) is not valid", line)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, failure.ToInvalidState(err, "bulk length (%s) is not valid", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, failure.ToSystem(err, "io.ReadFull failed for bulk string")
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, failure.ToInvalidState(err, "array length (%s) is not valid", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = ReadReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, failure.InvalidState("reply type (%q) is not supported", line[0])
+	}
+}
+
+// ReadCommand reads a command sent as an array of bulk strings, used by
+// servers
+func ReadCommand(r *bufio.Reader) ([]string, error) {
+	reply, err := ReadReply(r)
+	if err != nil {
+		return nil, err
+	}
+
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, failure.InvalidState("command is not an array (%T)", reply)
+	}
+
+	args := make([]string, len(items))
+	for i, item := range items {
+		if args[i], ok = item.(string); !ok {
+			return nil, failure.InvalidState("command argument (%d) is not a bulk string (%T)", i, item)
+		}
+	}
+
+	return args, nil
+}
+
+func writeHeader(w *bufio.Writer, kind byte, n int64) error {
+	return writeLine(w, kind, strconv.FormatInt(n, 10))
+}
+
+func writeLine(w *bufio.Writer, kind byte, s string) error {
+	if err := w.WriteByte(kind); err != nil {
+		return failure.ToSystem(err, "w.WriteByte failed")
+	}
+	if _, err := w.WriteString(s); err != nil {
+		return failure.ToSystem(err, "w.WriteString failed")
+	}
+	if _, err := w.WriteString("\r\n"); err != nil {
+		return failure.ToSystem(err, "w.WriteString failed")
+	}
+
+	return nil
+}
+
+func writeBulk(w *bufio.Writer, s string) error {
+	if err := writeHeader(w, '$', int64(len(s))); err != nil {
+		return err
+	}
+	if _, err := w.WriteString(s); err != nil {
+		return failure.ToSystem(err, "w.WriteString failed")
+	}
+	if _, err := w.WriteString("\r\n"); err != nil {
+		return failure.ToSystem(err, "w.WriteString failed")
+	}
+
+	return nil
+}
+
+// readLine reads a line without its trailing \r\n
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, failure.ToSystem(err, "r.ReadSlice failed")
+	}
+
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, failure.InvalidState("line is not terminated by \\r\\n")
+	}
+
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,191 @@
+package resp_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/rsb/api_rate_limiter/foundation/resp"
+	"github.com/rsb/api_rate_limiter/foundation/resp/resptest"
+	"github.com/rsb/failure"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestReadReply(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		input string
+		want  interface{}
+	}{
+		{name: "simple string", input: "+OK\r\n", want: resp.SimpleString("OK")},
+		{name: "error", input: "-ERR bad\r\n", want: resp.Error("ERR bad")},
+		{name: "integer", input: ":-42\r\n", want: int64(-42)},
+		{name: "bulk string", input: "$5\r\nhe\r\no\r\n", want: "he\r\no"},
+		{name: "null bulk string", input: "$-1\r\n", want: nil},
+		{name: "array", input: "*2\r\n:1\r\n$1\r\na\r\n", want: []interface{}{int64(1), "a"}},
+		{name: "null array", input: "*-1\r\n", want: nil},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := resp.ReadReply(bufio.NewReader(strings.NewReader(tt.input)))
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestReadReply_Invalid(t *testing.T) {
+	t.Parallel()
+
+	for _, input := range []string{"", "OK\r\n", ":1\n", ":abc\r\n", "$3\r\na"} {
+		_, err := resp.ReadReply(bufio.NewReader(strings.NewReader(input)))
+		require.Error(t, err, "input (%q)", input)
+	}
+}
+
+func TestWriteCommand_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	require.NoError(t, resp.WriteCommand(w, "SET", "key", ""))
+	require.NoError(t, w.Flush())
+	require.Equal(t, "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$0\r\n\r\n", buf.String())
+
+	args, err := resp.ReadCommand(bufio.NewReader(&buf))
+	require.NoError(t, err)
+	require.Equal(t, []string{"SET", "key", ""}, args)
+}
+
+func TestError_Prefix(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, "NOSCRIPT", resp.Error("NOSCRIPT No matching script").Prefix())
+	require.Equal(t, "ERR", resp.Error("ERR").Prefix())
+}
+
+func TestClient_Do(t *testing.T) {
+	t.Parallel()
+
+	srv := newServer(t)
+	client := resp.NewClient(resp.ClientConfig{Addr: srv.Addr()})
+	t.Cleanup(func() {
+		require.NoError(t, client.Close())
+	})
+
+	ctx := context.Background()
+	reply, err := client.Do(ctx, "PING")
+	require.NoError(t, err)
+	require.Equal(t, resp.SimpleString("PONG"), reply)
+
+	_, err = client.Do(ctx, "SET", "key", "value")
+	require.NoError(t, err)
+
+	reply, err = client.Do(ctx, "GET", "key")
+	require.NoError(t, err)
+	require.Equal(t, "value", reply)
+
+	reply, err = client.Do(ctx, "GET", "missing")
+	require.NoError(t, err)
+	require.Nil(t, reply)
+
+	_, err = client.Do(ctx, "HGET", "key", "field")
+	var e resp.Error
+	require.ErrorAs(t, err, &e)
+	require.Equal(t, "WRONGTYPE", e.Prefix())
+
+	// the connection is still usable after an error reply
+	reply, err = client.Do(ctx, "DEL", "key")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), reply)
+
+	_, err = client.Do(ctx)
+	require.True(t, failure.IsInvalidParam(err))
+}
+
+func TestClient_Auth(t *testing.T) {
+	t.Parallel()
+
+	srv := newServer(t)
+	srv.RequirePassword("secret")
+
+	ctx := context.Background()
+	client := resp.NewClient(resp.ClientConfig{Addr: srv.Addr()})
+	_, err := client.Do(ctx, "GET", "key")
+	var e resp.Error
+	require.ErrorAs(t, err, &e)
+	require.Equal(t, "NOAUTH", e.Prefix())
+	require.NoError(t, client.Close())
+
+	client = resp.NewClient(resp.ClientConfig{Addr: srv.Addr(), Password: "wrong"})
+	_, err = client.Do(ctx, "GET", "key")
+	require.Error(t, err)
+	require.NoError(t, client.Close())
+
+	client = resp.NewClient(resp.ClientConfig{Addr: srv.Addr(), Password: "secret", DB: 1})
+	_, err = client.Do(ctx, "GET", "key")
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+
+	_, err = client.Do(ctx, "GET", "key")
+	require.True(t, failure.IsShutdown(err))
+}
+
+func TestScript_Run(t *testing.T) {
+	t.Parallel()
+
+	srv := newServer(t)
+	script := resp.NewScript("return redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])")
+	srv.HandleScript(script.Source(), func(tx *resptest.Tx, keys, args []string) (interface{}, error) {
+		return tx.Call("HSET", keys[0], args[0], args[1])
+	})
+
+	client := resp.NewClient(resp.ClientConfig{Addr: srv.Addr()})
+	t.Cleanup(func() {
+		require.NoError(t, client.Close())
+	})
+
+	ctx := context.Background()
+	exists, err := client.Do(ctx, "SCRIPT", "EXISTS", script.SHA())
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{int64(0)}, exists)
+
+	// the first run falls back to EVAL, which loads the script
+	reply, err := script.Run(ctx, client, []string{"hash"}, "field", "1")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), reply)
+
+	exists, err = client.Do(ctx, "SCRIPT", "EXISTS", script.SHA())
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{int64(1)}, exists)
+
+	reply, err = script.Run(ctx, client, []string{"hash"}, "field", "2")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), reply)
+
+	reply, err = client.Do(ctx, "HGET", "hash", "field")
+	require.NoError(t, err)
+	require.Equal(t, "2", reply)
+
+	_, err = resp.NewScript("return 1").Run(ctx, client, nil)
+	require.Error(t, err)
+}
+
+func newServer(t *testing.T) *resptest.Server {
+	t.Helper()
+
+	srv, err := resptest.NewServer()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, srv.Close())
+	})
+
+	return srv
+}
@@ -0,0 +1,495 @@
+// Package resptest provides an in-process stand-in for a redis compatible
+// server, used to test code built on the resp package without running redis.
+//
+// The stand-in keeps strings and hashes in memory and understands the
+// commands listed in Server. It can not run lua, scripts are registered with
+// a Go implementation under their source and are then run by EVAL and
+// EVALSHA exactly like redis would: atomically, and by sha only once loaded.
+package resptest
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/rsb/api_rate_limiter/foundation/resp"
+	"github.com/rsb/failure"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScriptFunc is the Go implementation of a lua script. It runs with the
+// server locked, so it is atomic like a script run by redis.
+type ScriptFunc func(tx *Tx, keys, args []string) (interface{}, error)
+
+// Server is a RESP server holding its data in memory. It supports PING,
+// ECHO, AUTH, SELECT, GET, SET, DEL, EXISTS, PEXPIRE, PTTL, HGET, HSET,
+// HMGET, HGETALL, FLUSHALL, EVAL, EVALSHA and SCRIPT LOAD|EXISTS|FLUSH.
+type Server struct {
+	listener net.Listener
+	password string
+
+	data    map[string]*entry
+	scripts map[string]ScriptFunc
+	loaded  map[string]bool
+	now     func() time.Time
+	lock    sync.Mutex
+
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+type entry struct {
+	str      *string
+	hash     map[string]string
+	expireAt time.Time
+}
+
+// NewServer starts a server listening on a random local port
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, failure.ToSystem(err, "net.Listen failed")
+	}
+
+	s := &Server{
+		listener: l,
+		data:     map[string]*entry{},
+		scripts:  map[string]ScriptFunc{},
+		loaded:   map[string]bool{},
+		now:      time.Now,
+		conns:    map[net.Conn]struct{}{},
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+// Addr is the host:port the server listens on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// RequirePassword makes connections AUTH with the password before any other
+// command
+func (s *Server) RequirePassword(password string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.password = password
+}
+
+// SetNow replaces the time source used to expire keys
+func (s *Server) SetNow(now func() time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.now = now
+}
+
+// HandleScript registers the Go implementation of the lua source
+func (s *Server) HandleScript(src string, fn ScriptFunc) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.scripts[sha(src)] = fn
+}
+
+// Keys is the number of keys that have not expired
+func (s *Server) Keys() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tx := &Tx{s: s}
+	count := 0
+	for k := range s.data {
+		if tx.entry(k) != nil {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Close stops listening and closes every connection
+func (s *Server) Close() error {
+	err := s.listener.Close()
+
+	s.lock.Lock()
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.lock.Unlock()
+
+	s.wg.Wait()
+	if err != nil {
+		return failure.ToSystem(err, "s.listener.Close failed")
+	}
+
+	return nil
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.lock.Lock()
+		s.conns[c] = struct{}{}
+		s.lock.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(c)
+	}
+}
+
+func (s *Server) handle(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, c)
+		s.lock.Unlock()
+		_ = c.Close()
+	}()
+
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+
+	s.lock.Lock()
+	authenticated := s.password == ""
+	s.lock.Unlock()
+
+	for {
+		args, err := resp.ReadCommand(r)
+		if err != nil {
+			return
+		}
+
+		var reply interface{}
+		cmd := strings.ToUpper(args[0])
+		switch {
+		case cmd == "AUTH":
+			reply = s.auth(args)
+			authenticated = reply == resp.SimpleString("OK")
+		case !authenticated:
+			reply = resp.Error("NOAUTH Authentication required.")
+		default:
+			reply = s.exec(cmd, args[1:])
+		}
+
+		if err = resp.WriteReply(w, reply); err != nil {
+			return
+		}
+
+		if err = w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) auth(args []string) interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(args) != 2 || args[1] != s.password {
+		return resp.Error("WRONGPASS invalid username-password pair")
+	}
+
+	return resp.SimpleString("OK")
+}
+
+// exec runs a single command with the server locked
+func (s *Server) exec(cmd string, args []string) interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tx := &Tx{s: s}
+	switch cmd {
+	case "PING":
+		if len(args) > 0 {
+			return args[0]
+		}
+		return resp.SimpleString("PONG")
+	case "ECHO":
+		if len(args) != 1 {
+			return arity(cmd)
+		}
+		return args[0]
+	case "SELECT":
+		return resp.SimpleString("OK")
+	case "FLUSHALL":
+		s.data = map[string]*entry{}
+		return resp.SimpleString("OK")
+	case "EVAL", "EVALSHA":
+		return s.eval(tx, cmd, args)
+	case "SCRIPT":
+		return s.script(args)
+	}
+
+	reply, err := tx.Call(append([]string{cmd}, args...)...)
+	if err != nil {
+		if e, ok := err.(resp.Error); ok {
+			return e
+		}
+		return resp.Error("ERR " + err.Error())
+	}
+
+	return reply
+}
+
+func (s *Server) eval(tx *Tx, cmd string, args []string) interface{} {
+	if len(args) < 2 {
+		return arity(cmd)
+	}
+
+	id := args[0]
+	if cmd == "EVAL" {
+		id = sha(args[0])
+	}
+
+	fn, ok := s.scripts[id]
+	if !ok || (cmd == "EVALSHA" && !s.loaded[id]) {
+		if cmd == "EVALSHA" {
+			return resp.Error("NOSCRIPT No matching script. Please use EVAL.")
+		}
+		return resp.Error("ERR the stand-in has no Go implementation of this script")
+	}
+	s.loaded[id] = true
+
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 0 || n > len(args)-2 {
+		return resp.Error("ERR Number of keys can't be greater than number of args")
+	}
+
+	reply, err := fn(tx, args[2:2+n], args[2+n:])
+	if err != nil {
+		if e, ok := err.(resp.Error); ok {
+			return e
+		}
+		return resp.Error("ERR Error running script: " + err.Error())
+	}
+
+	return reply
+}
+
+func (s *Server) script(args []string) interface{} {
+	if len(args) == 0 {
+		return arity("SCRIPT")
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "LOAD":
+		if len(args) != 2 {
+			return arity("SCRIPT LOAD")
+		}
+		id := sha(args[1])
+		if _, ok := s.scripts[id]; !ok {
+			return resp.Error("ERR the stand-in has no Go implementation of this script")
+		}
+		s.loaded[id] = true
+		return id
+	case "EXISTS":
+		exists := make([]interface{}, len(args)-1)
+		for i, id := range args[1:] {
+			exists[i] = s.loaded[id]
+		}
+		return exists
+	case "FLUSH":
+		s.loaded = map[string]bool{}
+		return resp.SimpleString("OK")
+	default:
+		return resp.Error("ERR unknown SCRIPT subcommand '" + args[0] + "'")
+	}
+}
+
+// Tx gives scripts access to the data while the server is locked
+type Tx struct {
+	s *Server
+}
+
+// Call runs a data command, like redis.call in a lua script. Supported
+// commands are GET, SET, DEL, EXISTS, PEXPIRE, PTTL, HGET, HSET, HMGET and
+// HGETALL.
+func (tx *Tx) Call(args ...string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, resp.Error("ERR empty command")
+	}
+
+	cmd := strings.ToUpper(args[0])
+	args = args[1:]
+	switch cmd {
+	case "GET":
+		if len(args) != 1 {
+			return nil, arity(cmd)
+		}
+		e := tx.entry(args[0])
+		if e == nil {
+			return nil, nil
+		}
+		if e.str == nil {
+			return nil, wrongType()
+		}
+		return *e.str, nil
+	case "SET":
+		if len(args) != 2 {
+			return nil, arity(cmd)
+		}
+		v := args[1]
+		tx.s.data[args[0]] = &entry{str: &v}
+		return resp.SimpleString("OK"), nil
+	case "DEL", "EXISTS":
+		count := int64(0)
+		for _, k := range args {
+			if tx.entry(k) != nil {
+				count++
+				if cmd == "DEL" {
+					delete(tx.s.data, k)
+				}
+			}
+		}
+		return count, nil
+	case "PEXPIRE":
+		if len(args) != 2 {
+			return nil, arity(cmd)
+		}
+		ms, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil, notInteger()
+		}
+		e := tx.entry(args[0])
+		if e == nil {
+			return int64(0), nil
+		}
+		e.expireAt = tx.s.now().Add(time.Duration(ms) * time.Millisecond)
+		return int64(1), nil
+	case "PTTL":
+		if len(args) != 1 {
+			return nil, arity(cmd)
+		}
+		e := tx.entry(args[0])
+		switch {
+		case e == nil:
+			return int64(-2), nil
+		case e.expireAt.IsZero():
+			return int64(-1), nil
+		default:
+			return int64(e.expireAt.Sub(tx.s.now()) / time.Millisecond), nil
+		}
+	case "HGET":
+		if len(args) != 2 {
+			return nil, arity(cmd)
+		}
+		h, err := tx.hash(args[0], false)
+		if err != nil || h == nil {
+			return nil, err
+		}
+		if v, ok := h[args[1]]; ok {
+			return v, nil
+		}
+		return nil, nil
+	case "HMGET":
+		if len(args) < 2 {
+			return nil, arity(cmd)
+		}
+		h, err := tx.hash(args[0], false)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, len(args)-1)
+		for i, f := range args[1:] {
+			if v, ok := h[f]; ok {
+				values[i] = v
+			}
+		}
+		return values, nil
+	case "HSET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return nil, arity(cmd)
+		}
+		h, err := tx.hash(args[0], true)
+		if err != nil {
+			return nil, err
+		}
+		added := int64(0)
+		for i := 1; i < len(args); i += 2 {
+			if _, ok := h[args[i]]; !ok {
+				added++
+			}
+			h[args[i]] = args[i+1]
+		}
+		return added, nil
+	case "HGETALL":
+		if len(args) != 1 {
+			return nil, arity(cmd)
+		}
+		h, err := tx.hash(args[0], false)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, 0, 2*len(h))
+		for f, v := range h {
+			values = append(values, f, v)
+		}
+		return values, nil
+	default:
+		return nil, resp.Error("ERR unknown command '" + cmd + "'")
+	}
+}
+
+// entry returns the key, deleting it first when it has expired
+func (tx *Tx) entry(key string) *entry {
+	e, ok := tx.s.data[key]
+	if !ok {
+		return nil
+	}
+
+	if !e.expireAt.IsZero() && !tx.s.now().Before(e.expireAt) {
+		delete(tx.s.data, key)
+		return nil
+	}
+
+	return e
+}
+
+// hash returns the hash stored at key, creating it when asked to
+func (tx *Tx) hash(key string, create bool) (map[string]string, error) {
+	e := tx.entry(key)
+	if e == nil {
+		if !create {
+			return nil, nil
+		}
+		e = &entry{hash: map[string]string{}}
+		tx.s.data[key] = e
+	}
+
+	if e.hash == nil {
+		return nil, wrongType()
+	}
+
+	return e.hash, nil
+}
+
+func sha(src string) string {
+	sum := sha1.Sum([]byte(src))
+	return hex.EncodeToString(sum[:])
+}
+
+func arity(cmd string) resp.Error {
+	return resp.Error("ERR wrong number of arguments for '" + strings.ToLower(cmd) + "' command")
+}
+
+func wrongType() resp.Error {
+	return resp.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func notInteger() resp.Error {
+	return resp.Error("ERR value is not an integer or out of range")
+}
@@ -3,20 +3,30 @@
 package tests
 
 import (
+	"context"
+	"fmt"
 	"github.com/gofiber/fiber/v2"
 	"github.com/rsb/api_rate_limiter/app"
+	"github.com/rsb/api_rate_limiter/app/api/middle/limiter"
 	"github.com/rsb/api_rate_limiter/app/conf"
 	"github.com/rsb/api_rate_limiter/app/construct"
+	"github.com/rsb/api_rate_limiter/foundation/limits"
+	"github.com/rsb/api_rate_limiter/foundation/limits/limitstest"
+	"github.com/rsb/failure"
+	"github.com/rsb/api_rate_limiter/foundation/resp/resptest"
 	"github.com/stretchr/testify/require"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 )
 
-func NewAPI(t *testing.T, config conf.API) (*fiber.App, app.Dependencies) {
+func NewAPI(t *testing.T, config conf.API, store limits.Store) (*fiber.App, app.Dependencies) {
 	logger, err := construct.NewLogger("testing")
 	require.NoError(t, err, "construct.NewLogger should not failed")
 
@@ -24,7 +34,7 @@ func NewAPI(t *testing.T, config conf.API) (*fiber.App, app.Dependencies) {
 		Logger: logger,
 	}
 
-	app := construct.NewAPIMux(config, logger)
+	app := construct.NewAPIMux(config, logger, store)
 	app = construct.AddAllRoutes(app, &depend)
 
 	return app, depend
@@ -36,7 +46,16 @@ func TestRateLimiting(t *testing.T) {
 		RateLimitInterval: 2 * time.Second,
 	}
 
-	app, _ := NewAPI(t, config)
+	clock := limitstest.NewManualClock(time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC))
+	lc := construct.NewLimiterConfig(config)
+	lc.Clock = clock
+	store := limits.NewMemoryStore(limiter.ToLimitsConfig(lc))
+	t.Cleanup(func() {
+		err := store.Close()
+		require.NoError(t, err)
+	})
+
+	app, _ := NewAPI(t, config, store)
 
 	var wg sync.WaitGroup
 	singleRequest := func(wg *sync.WaitGroup) {
@@ -61,10 +80,1696 @@ func TestRateLimiting(t *testing.T) {
 	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
 	require.NoError(t, err)
 	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "0", resp.Header.Get(limiter.HeaderRateLimitRemaining))
+	require.Equal(t, "Wed, 01 Jun 2022 12:00:02 UTC", resp.Header.Get(limiter.HeaderRateLimitReset))
+	require.Equal(t, "Wed, 01 Jun 2022 12:00:02 UTC", resp.Header.Get(limiter.HeaderRetryAfter))
+
+	// roll the window over
+	clock.Add(3 * time.Second)
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "49", resp.Header.Get(limiter.HeaderRateLimitRemaining))
+	require.Equal(t, "Wed, 01 Jun 2022 12:00:04 UTC", resp.Header.Get(limiter.HeaderRateLimitReset))
+}
+
+// stubStore is a test double used to prove the middleware only depends on
+// the limits.Store interface.
+type stubStore struct {
+	mu    sync.Mutex
+	takes map[string]int
+	allow bool
+}
+
+func (s *stubStore) Take(key string) (limits.RateInfo, error) {
+	return s.TakeN(key, 1)
+}
+
+func (s *stubStore) TakeN(key string, n uint64) (limits.RateInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.takes[key] += int(n)
+
+	return limits.RateInfo{
+		LimitSize:   1,
+		Remaining:   0,
+		Reset:       uint64(time.Now().Add(time.Minute).UnixNano()),
+		OperationOk: s.allow,
+	}, nil
+}
+
+func (s *stubStore) Peek(_ string) (limits.RateInfo, error) {
+	return limits.RateInfo{LimitSize: 1}, nil
+}
+
+func (s *stubStore) Return(_ string, _ uint64) error { return nil }
+
+func (s *stubStore) Get(_ string) (uint64, uint64, error) { return 1, 0, nil }
+
+func (s *stubStore) Set(_ string, _ uint64, _ time.Duration) error { return nil }
+
+func (s *stubStore) Close() error { return nil }
+
+func (s *stubStore) GarbageCollector() {}
+
+func TestRateLimiting_InjectedStore(t *testing.T) {
+	store := &stubStore{takes: map[string]int{}, allow: true}
+
+	app := fiber.New()
+	app.Use(limiter.New(limiter.Config{
+		Store: store,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			return "stub-key"
+		},
+	}))
+	app = construct.AddPingRoutes(app, nil)
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get(limiter.HeaderRateLimitLimit))
+
+	store.mu.Lock()
+	store.allow = false
+	store.mu.Unlock()
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, 2, store.takes["stub-key"])
+}
+
+func TestRateLimiting_LeakyBucketDelays(t *testing.T) {
+	config := conf.API{
+		RateLimit:          10,
+		RateLimitInterval:  time.Second,
+		RateLimitAlgorithm: string(limits.AlgorithmLeakyBucket),
+		RateLimitMaxQueue:  2,
+	}
+
+	app, _ := NewAPI(t, config, nil)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// the 2nd and 3rd request were held while the queue drained at 100ms
+	require.True(t, time.Since(start) >= 150*time.Millisecond)
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+			require.NoError(t, err)
+			codes <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	rejected := 0
+	for code := range codes {
+		if code == http.StatusTooManyRequests {
+			rejected++
+		}
+	}
+	require.True(t, rejected > 0)
+}
+
+func TestRateLimiting_WeightedCost(t *testing.T) {
+	app := fiber.New()
+	app.Use(limiter.New(limiter.Config{
+		Limit:    10,
+		Interval: time.Minute,
+		Cost: func(c *fiber.Ctx) uint64 {
+			if c.Path() == "/export" {
+				return 4
+			}
+			return 1
+		},
+	}))
+	app = construct.AddPingRoutes(app, nil)
+	app.Get("/export", func(c *fiber.Ctx) error {
+		return c.SendStatus(http.StatusOK)
+	})
+
+	for i, remaining := range []string{"6", "2"} {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/export", nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, "export %d", i)
+		require.Equal(t, remaining, resp.Header.Get(limiter.HeaderRateLimitRemaining))
+	}
+
+	// the export can not afford its full cost, nothing is taken
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/export", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "2", resp.Header.Get(limiter.HeaderRateLimitRemaining))
+
+	for _, remaining := range []string{"1", "0"} {
+		resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, remaining, resp.Header.Get(limiter.HeaderRateLimitRemaining))
+	}
+}
+
+func TestRateLimiting_SkipFailedRequests(t *testing.T) {
+	app := fiber.New()
+	app.Use(limiter.New(limiter.Config{
+		Limit:              2,
+		Interval:           time.Minute,
+		SkipFailedRequests: true,
+	}))
+	app = construct.AddPingRoutes(app, nil)
+	app.Get("/fail", func(c *fiber.Ctx) error {
+		return c.SendStatus(http.StatusInternalServerError)
+	})
+
+	// failed requests are refunded and never exhaust the limit
+	for i := 0; i < 5; i++ {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/fail", nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+
+func TestRateLimiting_SkipSuccessfulRequests(t *testing.T) {
+	app := fiber.New()
+	app.Use(limiter.New(limiter.Config{
+		Limit:                  1,
+		Interval:               time.Minute,
+		SkipSuccessfulRequests: true,
+	}))
+	app = construct.AddPingRoutes(app, nil)
+
+	for i := 0; i < 3; i++ {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// not found counts against the limit
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/missing", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+
+func TestRateLimiting_ShardedStore(t *testing.T) {
+	config := conf.API{
+		RateLimit:         3,
+		RateLimitInterval: time.Minute,
+		RateLimitShards:   8,
+	}
+
+	app, _ := NewAPI(t, config, nil)
+
+	for _, remaining := range []string{"2", "1", "0"} {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, remaining, resp.Header.Get(limiter.HeaderRateLimitRemaining))
+	}
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+
+func TestRateLimiting_MaxKeysReject(t *testing.T) {
+	app := fiber.New()
+	app.Use(limiter.New(limiter.Config{
+		Limit:    5,
+		Interval: time.Minute,
+		MaxKeys:  1,
+		Overflow: limits.OverflowReject,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			return c.Get("X-Client")
+		},
+	}))
+	app = construct.AddPingRoutes(app, nil)
+
+	request := func(client string) int {
+		req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		req.Header.Set("X-Client", client)
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, request("first"))
+
+	// the store is full, new clients are turned away
+	require.Equal(t, http.StatusTooManyRequests, request("second"))
+	require.Equal(t, http.StatusOK, request("first"))
+}
+
+func TestRateLimiting_KeyGeneratorCopied(t *testing.T) {
+	store := &stubStore{takes: map[string]int{}, allow: true}
+
+	app := fiber.New()
+	app.Use(limiter.New(limiter.Config{
+		Store: store,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			return c.Get("X-Client")
+		},
+	}))
+	app = construct.AddPingRoutes(app, nil)
+
+	// the header values live in memory fiber reuses for the next requests
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		req.Header.Set("X-Client", fmt.Sprintf("client-%02d", i))
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for i := 0; i < 20; i++ {
+		require.Equal(t, 1, store.takes[fmt.Sprintf("client-%02d", i)])
+	}
+}
+
+func TestRateLimiting_SnapshotAcrossRestarts(t *testing.T) {
+	logger, err := construct.NewLogger("testing")
+	require.NoError(t, err)
+
+	config := conf.API{
+		RateLimit:         3,
+		RateLimitInterval: time.Hour,
+		RateLimitSnapshot: conf.Filepath{Path: filepath.Join(t.TempDir(), "limits.json")},
+	}
+
+	store, err := construct.NewLimitsStore(config, logger)
+	require.NoError(t, err)
+	app, _ := NewAPI(t, config, store)
+	for _, remaining := range []string{"2", "1"} {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+		require.NoError(t, err)
+		require.Equal(t, remaining, resp.Header.Get(limiter.HeaderRateLimitRemaining))
+	}
+	require.NoError(t, store.Close())
 
-	time.Sleep(3 * time.Second)
+	// the restarted api does not hand out a fresh quota
+	store, err = construct.NewLimitsStore(config, logger)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	app, _ = NewAPI(t, config, store)
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "0", resp.Header.Get(limiter.HeaderRateLimitRemaining))
 
 	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
 	require.NoError(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+
+func TestRateLimiting_RedisStoreSharedAcrossInstances(t *testing.T) {
+	srv, err := resptest.NewServer()
+	require.NoError(t, err)
+	limitstest.HandleRedisScripts(srv)
+	t.Cleanup(func() {
+		require.NoError(t, srv.Close())
+	})
+
+	logger, err := construct.NewLogger("testing")
+	require.NoError(t, err)
+
+	config := conf.API{
+		RateLimit:            3,
+		RateLimitInterval:    time.Hour,
+		RateLimitStore:       conf.StoreRedis,
+		RateLimitRedisAddr:   srv.Addr(),
+		RateLimitRedisPrefix: "limits:",
+	}
+
+	// two instances of the api share the limits held by the server
+	var apps []*fiber.App
+	for i := 0; i < 2; i++ {
+		store, err := construct.NewLimitsStore(config, logger)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, store.Close())
+		})
+
+		app, _ := NewAPI(t, config, store)
+		apps = append(apps, app)
+	}
+
+	for i, remaining := range []string{"2", "1", "0"} {
+		resp, err := apps[i%2].Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, remaining, resp.Header.Get(limiter.HeaderRateLimitRemaining))
+	}
+
+	resp, err := apps[1].Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	config.RateLimitAlgorithm = string(limits.AlgorithmTokenBucket)
+	_, err = construct.NewLimitsStore(config, logger)
+	require.Error(t, err)
+}
+
+func TestRateLimiting_ClusterSharedAcrossInstances(t *testing.T) {
+	logger, err := construct.NewLogger("testing")
+	require.NoError(t, err)
+
+	// every instance serves the calls forwarded by its peers on its own server
+	servers := make([]*httptest.Server, 3)
+	peers := make([]string, len(servers))
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		peers[i] = servers[i].Listener.Addr().String()
+	}
+
+	var apps []*fiber.App
+	for i := range servers {
+		config := conf.LimiterAPI{
+			API: conf.API{
+				RateLimit:                 4,
+				RateLimitInterval:         time.Hour,
+				RateLimitStore:            conf.StoreCluster,
+				RateLimitClusterSecret:    "peer-secret",
+				RateLimitClusterAdvertise: peers[i],
+				RateLimitClusterPeers:     peers,
+			},
+		}
+
+		local, err := construct.NewLimitsStore(config.API, logger)
+		require.NoError(t, err)
+		store, err := construct.NewClusterStore(config, local, logger)
+		require.NoError(t, err)
+		require.Len(t, store.Peers(), len(peers))
+
+		server := servers[i]
+		server.Config.Handler = store.Handler()
+		server.Start()
+		t.Cleanup(func() {
+			server.Close()
+			require.NoError(t, store.Close())
+		})
+
+		app, _ := NewAPI(t, config.API, store)
+		apps = append(apps, app)
+	}
+
+	for i, remaining := range []string{"3", "2", "1", "0"} {
+		resp, err := apps[i%3].Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, remaining, resp.Header.Get(limiter.HeaderRateLimitRemaining))
+	}
+
+	resp, err := apps[2].Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+
+func TestRateLimiting_GossipSharedAcrossInstances(t *testing.T) {
+	logger, err := construct.NewLogger("testing")
+	require.NoError(t, err)
+
+	servers := make([]*httptest.Server, 2)
+	peers := make([]string, len(servers))
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		peers[i] = servers[i].Listener.Addr().String()
+	}
+
+	var apps []*fiber.App
+	var stores []*limits.GossipStore
+	for i := range servers {
+		config := conf.LimiterAPI{
+			API: conf.API{
+				RateLimit:                 4,
+				RateLimitInterval:         time.Hour,
+				RateLimitStore:            conf.StoreGossip,
+				RateLimitClusterSecret:    "peer-secret",
+				RateLimitClusterAdvertise: peers[i],
+				RateLimitClusterPeers:     peers,
+			},
+		}
+
+		store, handler, err := construct.NewRateLimitStore(config, logger)
+		require.NoError(t, err)
+		require.NotNil(t, handler)
+
+		server := servers[i]
+		server.Config.Handler = handler
+		server.Start()
+		t.Cleanup(func() {
+			server.Close()
+			require.NoError(t, store.Close())
+		})
+
+		app, _ := NewAPI(t, config.API, store)
+		apps = append(apps, app)
+		stores = append(stores, store.(*limits.GossipStore))
+	}
+
+	for _, app := range apps {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+		require.NoError(t, err)
+		require.Equal(t, "3", resp.Header.Get(limiter.HeaderRateLimitRemaining))
+	}
+
+	// once the usage is exchanged every instance knows about both requests
+	for _, store := range stores {
+		require.NoError(t, store.Gossip(context.Background()))
+	}
+
+	resp, err := apps[0].Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get(limiter.HeaderRateLimitRemaining))
+}
+
+func TestRateLimiting_ClusterPeers(t *testing.T) {
+	logger, err := construct.NewLogger("testing")
+	require.NoError(t, err)
+
+	// the peers are served on localhost unless a host or a pod ip is set
+	config := conf.LimiterAPI{API: conf.API{RateLimitStore: conf.StoreCluster, RateLimitClusterAdvertise: "127.0.0.1:7000"}}
+	require.Equal(t, "127.0.0.1:7000", config.ClusterHost())
+
+	config.Kubernetes.PodIP = "10.0.0.7"
+	require.Equal(t, "10.0.0.7:7000", config.ClusterHost())
+
+	config.API.RateLimitClusterHost = "0.0.0.0:7100"
+	require.Equal(t, "0.0.0.0:7100", config.ClusterHost())
+
+	// the peers must share a secret
+	for _, store := range []string{conf.StoreCluster, conf.StoreGossip} {
+		config.API.RateLimitStore = store
+		_, _, err = construct.NewRateLimitStore(config, logger)
+		require.True(t, failure.IsInvalidParam(err), store)
+
+		config.API.RateLimitClusterSecret = "peer-secret"
+		rateStore, handler, err := construct.NewRateLimitStore(config, logger)
+		require.NoError(t, err, store)
+		require.NotNil(t, handler, store)
+		require.NoError(t, rateStore.Close())
+		config.API.RateLimitClusterSecret = ""
+	}
+}
+
+func TestRateLimiting_Windows(t *testing.T) {
+	clock := limitstest.NewManualClock(time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC))
+	app := fiber.New()
+	app.Use(limiter.New(limiter.Config{
+		Clock: clock,
+		Windows: []limits.Window{
+			{Limit: 2, Interval: time.Second},
+			{Limit: 3, Interval: time.Hour},
+		},
+	}))
+	app = construct.AddPingRoutes(app, nil)
+
+	request := func() *http.Response {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+		require.NoError(t, err)
+		return resp
+	}
+
+	// the burst window is the closest to exhaustion
+	for _, remaining := range []string{"1", "0"} {
+		resp := request()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "2", resp.Header.Get(limiter.HeaderRateLimitLimit))
+		require.Equal(t, remaining, resp.Header.Get(limiter.HeaderRateLimitRemaining))
+	}
+	resp := request()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "Wed, 01 Jun 2022 12:00:01 UTC", resp.Header.Get(limiter.HeaderRetryAfter))
+
+	// the next second only the hourly window is left to exhaust
+	clock.Add(time.Second)
+	resp = request()
 	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "3", resp.Header.Get(limiter.HeaderRateLimitLimit))
+	require.Equal(t, "0", resp.Header.Get(limiter.HeaderRateLimitRemaining))
+
+	resp = request()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "3", resp.Header.Get(limiter.HeaderRateLimitLimit))
+	require.Equal(t, "Wed, 01 Jun 2022 13:00:00 UTC", resp.Header.Get(limiter.HeaderRetryAfter))
+}
+
+func TestRateLimiting_WindowsConfig(t *testing.T) {
+	logger, err := construct.NewLogger("testing")
+	require.NoError(t, err)
+
+	config := conf.API{
+		RateLimitWindows:  []string{"2/1m", "3/1h"},
+		RateLimitSnapshot: conf.Filepath{Path: filepath.Join(t.TempDir(), "limits.json")},
+	}
+
+	store, err := construct.NewLimitsStore(config, logger)
+	require.NoError(t, err)
+	app, _ := NewAPI(t, config, store)
+	for _, remaining := range []string{"1", "0"} {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, remaining, resp.Header.Get(limiter.HeaderRateLimitRemaining))
+	}
+	require.NoError(t, store.Close())
+
+	// every window is restored from its own snapshot
+	store, err = construct.NewLimitsStore(config, logger)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	app, _ = NewAPI(t, config, store)
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "2", resp.Header.Get(limiter.HeaderRateLimitLimit))
+
+	config.RateLimitWindows = []string{"2/1m", "3"}
+	_, err = construct.NewLimitsStore(config, logger)
+	require.Error(t, err)
+}
+
+func TestRateLimiting_QuotaAcrossRestarts(t *testing.T) {
+	logger, err := construct.NewLogger("testing")
+	require.NoError(t, err)
+
+	config := conf.API{
+		RateLimit:              10,
+		RateLimitInterval:      time.Second,
+		RateLimitQuota:         3,
+		RateLimitQuotaPeriod:   string(limits.PeriodDaily),
+		RateLimitQuotaTimezone: "UTC",
+		RateLimitSnapshot:      conf.Filepath{Path: filepath.Join(t.TempDir(), "limits.json")},
+	}
+
+	store, err := construct.NewLimitsStore(config, logger)
+	require.NoError(t, err)
+	app, _ := NewAPI(t, config, store)
+	for _, remaining := range []string{"2", "1"} {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "3", resp.Header.Get(limiter.HeaderRateLimitLimit))
+		require.Equal(t, remaining, resp.Header.Get(limiter.HeaderRateLimitRemaining))
+	}
+	require.NoError(t, store.Close())
+
+	// the quota of the day is not handed out again after a restart
+	store, err = construct.NewLimitsStore(config, logger)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	app, _ = NewAPI(t, config, store)
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "0", resp.Header.Get(limiter.HeaderRateLimitRemaining))
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	config.RateLimitQuotaTimezone = "Mars/Olympus_Mons"
+	_, err = construct.NewLimitsStore(config, logger)
+	require.Error(t, err)
+}
+
+func TestRateLimiting_TrustedProxies(t *testing.T) {
+	config := conf.API{
+		RateLimit:               1,
+		RateLimitInterval:       time.Minute,
+		RateLimitTrustedProxies: []string{"0.0.0.0", "10.0.0.0/8"},
+	}
+
+	app, _ := NewAPI(t, config, nil)
+	request := func(header, value string) int {
+		req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		req.Header.Set(header, value)
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	// every client behind the proxies has its own bucket
+	require.Equal(t, http.StatusOK, request(limiter.HeaderXForwardedFor, "203.0.113.1, 10.0.0.7"))
+	require.Equal(t, http.StatusTooManyRequests, request(limiter.HeaderXForwardedFor, "203.0.113.1"))
+	require.Equal(t, http.StatusOK, request(limiter.HeaderXForwardedFor, "203.0.113.2"))
+
+	// hops added by the client itself are ignored
+	require.Equal(t, http.StatusTooManyRequests, request(limiter.HeaderXForwardedFor, "198.51.100.9, 203.0.113.2"))
+
+	// only X-Forwarded-For is read by default, any other header is keyed on
+	// the proxy
+	require.Equal(t, http.StatusOK, request(limiter.HeaderXRealIP, "203.0.113.3"))
+	require.Equal(t, http.StatusTooManyRequests, request(limiter.HeaderXRealIP, "203.0.113.4"))
+
+	config.RateLimitProxyHeaders = []string{limiter.HeaderForwarded}
+	app, _ = NewAPI(t, config, nil)
+	require.Equal(t, http.StatusOK, request(limiter.HeaderForwarded, `for="[2001:db8::1]:4711";proto=https, for=10.0.0.7`))
+	require.Equal(t, http.StatusTooManyRequests, request(limiter.HeaderForwarded, `for="[2001:db8::1]"`))
+
+	config.RateLimitProxyHeaders = []string{limiter.HeaderXRealIP}
+	app, _ = NewAPI(t, config, nil)
+	require.Equal(t, http.StatusOK, request(limiter.HeaderXRealIP, "203.0.113.3"))
+	require.Equal(t, http.StatusTooManyRequests, request(limiter.HeaderXRealIP, "203.0.113.3"))
+}
+
+func TestRateLimiting_ProxyHeaderSpoofing(t *testing.T) {
+	app := fiber.New()
+	app.Use(limiter.New(limiter.Config{
+		Limit:          1,
+		Interval:       time.Minute,
+		TrustedProxies: []string{"0.0.0.0"},
+		ProxyHeaders:   []string{limiter.HeaderXRealIP},
+	}))
+	app = construct.AddPingRoutes(app, nil)
+
+	// the proxy only writes X-Real-IP, the client adds its own X-Forwarded-For
+	request := func(spoofed string) int {
+		req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		req.Header.Set(limiter.HeaderXForwardedFor, spoofed)
+		req.Header.Set(limiter.HeaderXRealIP, "203.0.113.1")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, request("198.51.100.1"))
+	require.Equal(t, http.StatusTooManyRequests, request("198.51.100.2"))
+
+	// reading several headers would let the client pick the one it sends
+	_, err := limiter.NewClientIP(limiter.ClientIPConfig{
+		ProxyHeaders: []string{limiter.HeaderXForwardedFor, limiter.HeaderXRealIP},
+	})
+	require.True(t, failure.IsInvalidParam(err))
+}
+
+func TestRateLimiting_UntrustedProxy(t *testing.T) {
+	app := fiber.New()
+	app.Use(limiter.New(limiter.Config{
+		Limit:          1,
+		Interval:       time.Minute,
+		TrustedProxies: []string{"10.0.0.0/8"},
+	}))
+	app = construct.AddPingRoutes(app, nil)
+
+	request := func(client string) int {
+		req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		req.Header.Set(limiter.HeaderXForwardedFor, client)
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	// the connection does not come from a trusted proxy, its headers are ignored
+	require.Equal(t, http.StatusOK, request("203.0.113.1"))
+	require.Equal(t, http.StatusTooManyRequests, request("203.0.113.2"))
+
+	require.Panics(t, func() {
+		limiter.New(limiter.Config{TrustedProxies: []string{"10.0.0.0/33"}})
+	})
+}
+
+func TestRateLimiting_PrefixAggregation(t *testing.T) {
+	config := conf.API{
+		RateLimit:               1,
+		RateLimitInterval:       time.Minute,
+		RateLimitTrustedProxies: []string{"0.0.0.0"},
+		RateLimitIPv4Prefix:     24,
+		RateLimitIPv6Prefix:     64,
+	}
+
+	app, _ := NewAPI(t, config, nil)
+	request := func(client string) int {
+		req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		req.Header.Set(limiter.HeaderXForwardedFor, client)
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	// rotating through the addresses of a /64 does not get a fresh bucket
+	require.Equal(t, http.StatusOK, request("2001:db8:0:1::1"))
+	require.Equal(t, http.StatusTooManyRequests, request("2001:db8:0:1:ffff:ffff:ffff:ffff"))
+	require.Equal(t, http.StatusOK, request("2001:db8:0:2::1"))
+
+	require.Equal(t, http.StatusOK, request("203.0.113.1"))
+	require.Equal(t, http.StatusTooManyRequests, request("203.0.113.254"))
+	require.Equal(t, http.StatusTooManyRequests, request("::ffff:203.0.113.9"))
+	require.Equal(t, http.StatusOK, request("203.0.114.1"))
+
+	// without prefixes every address has a bucket of its own
+	config.RateLimitIPv4Prefix, config.RateLimitIPv6Prefix = 0, 0
+	app, _ = NewAPI(t, config, nil)
+	require.Equal(t, http.StatusOK, request("2001:db8:0:1::1"))
+	require.Equal(t, http.StatusOK, request("2001:db8:0:1::2"))
+	require.Equal(t, http.StatusTooManyRequests, request("2001:db8:0:1::1"))
+}
+
+func TestClientIP_Key(t *testing.T) {
+	resolver, err := limiter.NewClientIP(limiter.ClientIPConfig{IPv6Prefix: 56})
+	require.NoError(t, err)
+	require.Equal(t, "2001:db8:0:ff00::/56", resolver.Key(net.ParseIP("2001:db8:0:ffab::1")))
+	require.Equal(t, "203.0.113.7", resolver.Key(net.ParseIP("203.0.113.7")))
+
+	resolver, err = limiter.NewClientIP(limiter.ClientIPConfig{IPv4Prefix: 32, IPv6Prefix: 128})
+	require.NoError(t, err)
+	require.Equal(t, "2001:db8::1", resolver.Key(net.ParseIP("2001:db8::1")))
+
+	_, err = limiter.NewClientIP(limiter.ClientIPConfig{IPv4Prefix: 33})
+	require.Error(t, err)
+	_, err = limiter.NewClientIP(limiter.ClientIPConfig{IPv6Prefix: -1})
+	require.Error(t, err)
+	_, err = limiter.NewClientIP(limiter.ClientIPConfig{ProxyHeaders: []string{"X-Client-IP"}})
+	require.Error(t, err)
+}
+
+func TestRateLimiting_RuleSetFirstMatch(t *testing.T) {
+	rules, err := limiter.NewRuleSet(limiter.RuleSetConfig{
+		Rules: []limiter.Rule{
+			{
+				Name:   "ping",
+				Path:   "/ping",
+				Config: limiter.Config{Limit: 3, Interval: time.Minute},
+			},
+			{
+				Name:    "auth",
+				Path:    "/auth/**",
+				Methods: []string{http.MethodPost},
+				Config:  limiter.Config{Limit: 1, Interval: time.Minute},
+			},
+			{
+				Name:    "bulk",
+				Path:    "/tenants/:tenant/bulk",
+				Headers: map[string]string{"X-Api-Key": "*"},
+				Key:     "header:X-Api-Key",
+				Config: limiter.Config{Limit: 10, Interval: time.Minute, Cost: func(c *fiber.Ctx) uint64 {
+					return 4
+				}},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, rules.Close())
+	})
+
+	app := fiber.New()
+	app.Use(rules.Handler())
+	app.All("/*", func(c *fiber.Ctx) error {
+		return c.SendStatus(http.StatusOK)
+	})
+
+	request := func(method, path, key string) *http.Response {
+		req := httptest.NewRequest(method, path, nil)
+		if key != "" {
+			req.Header.Set("X-Api-Key", key)
+		}
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := request(http.MethodGet, "/ping", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "3", resp.Header.Get(limiter.HeaderRateLimitLimit))
+
+	require.Equal(t, http.StatusOK, request(http.MethodPost, "/auth/login", "").StatusCode)
+	require.Equal(t, http.StatusTooManyRequests, request(http.MethodPost, "/auth/token/refresh", "").StatusCode)
+
+	// other methods and routes are not limited
+	resp = request(http.MethodGet, "/auth/login", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Get(limiter.HeaderRateLimitLimit))
+
+	// bulk requests are charged per api key
+	for _, remaining := range []string{"6", "2"} {
+		resp = request(http.MethodPost, "/tenants/acme/bulk", "key-1")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, remaining, resp.Header.Get(limiter.HeaderRateLimitRemaining))
+	}
+	require.Equal(t, http.StatusTooManyRequests, request(http.MethodPost, "/tenants/acme/bulk", "key-1").StatusCode)
+	require.Equal(t, http.StatusOK, request(http.MethodPost, "/tenants/initech/bulk", "key-2").StatusCode)
+
+	// without the header the bulk rule does not match
+	resp = request(http.MethodPost, "/tenants/acme/bulk", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Get(limiter.HeaderRateLimitLimit))
+}
+
+func TestRateLimiting_RuleSetMatchAll(t *testing.T) {
+	rules, err := limiter.NewRuleSet(limiter.RuleSetConfig{
+		MatchAll: true,
+		Rules: []limiter.Rule{
+			{
+				Name:   "per-client",
+				Path:   "/**",
+				Config: limiter.Config{Limit: 3, Interval: time.Minute},
+			},
+			{
+				Name:   "ping",
+				Path:   "/ping",
+				Key:    "global",
+				Config: limiter.Config{Limit: 10, Interval: time.Minute},
+			},
+			{
+				Name:   "health",
+				Path:   "/readiness",
+				Key:    "global",
+				Config: limiter.Config{Limit: 1, Interval: time.Minute},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, rules.Close())
+	})
+
+	app := fiber.New()
+	app.Use(rules.Handler())
+	app = construct.AddPingRoutes(app, nil)
+	app.Get("/readiness", func(c *fiber.Ctx) error {
+		return c.SendStatus(http.StatusOK)
+	})
+
+	request := func(path string) *http.Response {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, path, nil))
+		require.NoError(t, err)
+		return resp
+	}
+
+	// the headers report the most restrictive rule
+	resp := request("/ping")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "3", resp.Header.Get(limiter.HeaderRateLimitLimit))
+	require.Equal(t, "2", resp.Header.Get(limiter.HeaderRateLimitRemaining))
+
+	resp = request("/readiness")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get(limiter.HeaderRateLimitLimit))
+	require.Equal(t, "0", resp.Header.Get(limiter.HeaderRateLimitRemaining))
+
+	// the health rule rejects, the client is not charged by its own rule
+	resp = request("/readiness")
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get(limiter.HeaderRateLimitLimit))
+
+	resp = request("/ping")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "0", resp.Header.Get(limiter.HeaderRateLimitRemaining))
+
+	resp = request("/ping")
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "3", resp.Header.Get(limiter.HeaderRateLimitLimit))
+}
+
+func TestRateLimiting_RuleSetPathVariants(t *testing.T) {
+	newApp := func(config fiber.Config) *fiber.App {
+		rules, err := limiter.NewRuleSet(limiter.RuleSetConfig{
+			Rules: []limiter.Rule{
+				{Name: "ping", Path: "/ping", Config: limiter.Config{Limit: 1, Interval: time.Minute}},
+				{Name: "tenant", Path: "/tenants/:tenant/", Config: limiter.Config{Limit: 1, Interval: time.Minute}},
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, rules.Close())
+		})
+
+		app := fiber.New(config)
+		app.Use(rules.Handler())
+		app.All("/*", func(c *fiber.Ctx) error {
+			return c.SendStatus(http.StatusOK)
+		})
+		return app
+	}
+
+	request := func(app *fiber.App, path string) *http.Response {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, path, nil))
+		require.NoError(t, err)
+		return resp
+	}
+
+	// the default router is case insensitive and ignores a trailing slash
+	app := newApp(fiber.Config{})
+	require.Equal(t, http.StatusOK, request(app, "/ping").StatusCode)
+	for _, path := range []string{"/ping", "/ping/", "/PING", "/Ping/", "/ping//"} {
+		resp := request(app, path)
+		require.Equal(t, http.StatusTooManyRequests, resp.StatusCode, path)
+		require.Equal(t, "1", resp.Header.Get(limiter.HeaderRateLimitLimit), path)
+	}
+
+	require.Equal(t, http.StatusOK, request(app, "/tenants/acme").StatusCode)
+	require.Equal(t, http.StatusTooManyRequests, request(app, "/TENANTS/acme/").StatusCode)
+
+	// a case sensitive and strict router routes the variants elsewhere
+	app = newApp(fiber.Config{CaseSensitive: true, StrictRouting: true})
+	require.Equal(t, http.StatusOK, request(app, "/ping").StatusCode)
+	require.Equal(t, http.StatusTooManyRequests, request(app, "/ping").StatusCode)
+	for _, path := range []string{"/ping/", "/PING"} {
+		resp := request(app, path)
+		require.Equal(t, http.StatusOK, resp.StatusCode, path)
+		require.Empty(t, resp.Header.Get(limiter.HeaderRateLimitLimit), path)
+	}
+}
+
+func TestRateLimiting_RuleSetInvalid(t *testing.T) {
+	tests := map[string][]limiter.Rule{
+		"no name":   {{Path: "/ping"}},
+		"duplicate": {{Name: "ping"}, {Name: "ping"}},
+		"path":      {{Name: "ping", Path: "ping"}},
+		"wildcard":  {{Name: "ping", Path: "/**/ping"}},
+		"key":       {{Name: "ping", Key: "cookie:session"}},
+		"algorithm": {{Name: "ping", Config: limiter.Config{Algorithm: "random"}}},
+		"windows":   {{Name: "ping", Config: limiter.Config{Windows: []limits.Window{{Limit: 1}}}}},
+	}
+
+	for name, rules := range tests {
+		_, err := limiter.NewRuleSet(limiter.RuleSetConfig{Rules: rules})
+		require.Error(t, err, name)
+	}
+
+	_, err := limiter.NewRuleSet(limiter.RuleSetConfig{ClientIP: limiter.ClientIPConfig{IPv6Prefix: 129}})
+	require.Error(t, err)
+}
+
+func TestRateLimiting_RuleSetTiersAndOverrides(t *testing.T) {
+	rules, err := limiter.NewRuleSet(limiter.RuleSetConfig{
+		Rules: []limiter.Rule{
+			{
+				Name: "api",
+				Path: "/api/**",
+				Key:  "header:X-Api-Key",
+				Tiers: []limiter.Tier{
+					{Name: "key", Key: "header:X-Api-Key", Config: limiter.Config{Limit: 2, Interval: time.Minute}},
+					{Name: "tenant", Key: "header:X-Tenant", Config: limiter.Config{Limit: 3, Interval: time.Minute}},
+				},
+				Overrides: []limiter.Override{
+					{Keys: []string{"premium"}, Config: limiter.Config{Limit: 5, Interval: time.Minute}},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, rules.Close())
+	})
+
+	app := fiber.New()
+	app.Use(rules.Handler())
+	app.All("/*", func(c *fiber.Ctx) error {
+		return c.SendStatus(http.StatusOK)
+	})
+
+	request := func(key, tenant string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/api/orders", nil)
+		req.Header.Set("X-Api-Key", key)
+		req.Header.Set("X-Tenant", tenant)
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	require.Equal(t, http.StatusOK, request("key-1", "acme").StatusCode)
+	require.Equal(t, http.StatusOK, request("key-1", "acme").StatusCode)
+	require.Equal(t, http.StatusTooManyRequests, request("key-1", "acme").StatusCode)
+
+	// the tenant tier is shared by the keys of the tenant
+	resp := request("key-2", "acme")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "3", resp.Header.Get(limiter.HeaderRateLimitLimit))
+	require.Equal(t, "0", resp.Header.Get(limiter.HeaderRateLimitRemaining))
+	require.Equal(t, http.StatusTooManyRequests, request("key-2", "acme").StatusCode)
+	require.Equal(t, http.StatusOK, request("key-2", "initech").StatusCode)
+
+	// the premium key has limits of its own
+	for i := 0; i < 5; i++ {
+		resp = request("premium", "acme")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "5", resp.Header.Get(limiter.HeaderRateLimitLimit))
+	}
+	require.Equal(t, http.StatusTooManyRequests, request("premium", "acme").StatusCode)
+}
+
+func TestRateLimiting_RuleSetTierKeys(t *testing.T) {
+	rules, err := limiter.NewRuleSet(limiter.RuleSetConfig{
+		Rules: []limiter.Rule{
+			{
+				Name: "api",
+				Key:  "query:user",
+				Tiers: []limiter.Tier{
+					{Name: "user", Key: "query:user", Config: limiter.Config{Limit: 100, Interval: time.Minute}},
+					{Name: "org", Key: "query:org", Config: limiter.Config{Limit: 2, Interval: time.Minute}},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, rules.Close())
+	})
+
+	app := fiber.New()
+	app.Use(rules.Handler())
+	app.All("/*", func(c *fiber.Ctx) error {
+		return c.SendStatus(http.StatusOK)
+	})
+
+	request := func(query string) *http.Response {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/orders?"+query, nil))
+		require.NoError(t, err)
+		return resp
+	}
+
+	// a value can not shift the keys into the tier of another client
+	for _, query := range []string{
+		"user=evil%1Fvictim&org=mine",
+		"user=evil%1Fquery:victim&org=mine",
+		"user=4:evil6:victim&org=mine",
+	} {
+		for i := 0; i < 2; i++ {
+			request(query)
+		}
+	}
+
+	require.Equal(t, http.StatusOK, request("user=alice&org=victim").StatusCode)
+	require.Equal(t, http.StatusOK, request("user=bob&org=victim").StatusCode)
+	require.Equal(t, http.StatusTooManyRequests, request("user=carol&org=victim").StatusCode)
+}
+
+func TestRateLimiting_RuleSetIPOverrides(t *testing.T) {
+	newApp := func(keys ...string) *fiber.App {
+		rules, err := limiter.NewRuleSet(limiter.RuleSetConfig{
+			Rules: []limiter.Rule{
+				{
+					Name:      "ping",
+					Overrides: []limiter.Override{{Keys: keys, Config: limiter.Config{Limit: 3, Interval: time.Minute}}},
+					Config:    limiter.Config{Limit: 1, Interval: time.Minute},
+				},
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, rules.Close())
+		})
+
+		app := fiber.New()
+		app.Use(rules.Handler())
+		app.Get("/ping", func(c *fiber.Ctx) error {
+			return c.SendStatus(http.StatusOK)
+		})
+		return app
+	}
+
+	request := func(app *fiber.App) *http.Response {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+		require.NoError(t, err)
+		return resp
+	}
+
+	// the client ip of app.Test is 0.0.0.0, held by the networks of the override
+	for _, keys := range [][]string{{"0.0.0.0/0"}, {"10.0.0.0/8", "0.0.0.0/8"}, {"0.0.0.0"}} {
+		app := newApp(keys...)
+		for i := 0; i < 3; i++ {
+			resp := request(app)
+			require.Equal(t, http.StatusOK, resp.StatusCode, keys)
+			require.Equal(t, "3", resp.Header.Get(limiter.HeaderRateLimitLimit), keys)
+		}
+		require.Equal(t, http.StatusTooManyRequests, request(app).StatusCode, keys)
+	}
+
+	app := newApp("10.0.0.0/8")
+	resp := request(app)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get(limiter.HeaderRateLimitLimit))
+
+	_, err := limiter.NewRuleSet(limiter.RuleSetConfig{
+		Rules: []limiter.Rule{{Name: "ping", Overrides: []limiter.Override{{Keys: []string{"premium"}}}}},
+	})
+	require.Error(t, err)
+}
+
+const testPolicyTOML = `match = "first"
+
+[keys]
+api_key = "header:X-Api-Key"
+tenant = "header:X-Tenant"
+
+[[rules]]
+name = "auth"
+path = "/auth/**"
+methods = ["POST"]
+algorithm = "gcra"
+limit = 1
+interval = "1m"
+
+[[rules]]
+name = "api"
+path = "/api/**"
+key = "api_key"
+
+  [[rules.tiers]]
+  name = "key"
+  key = "api_key"
+  limit = 2
+  interval = "1m"
+
+  [[rules.tiers]]
+  name = "tenant"
+  key = "tenant"
+  windows = ["10/1m", "100/24h"]
+
+  [[rules.overrides]]
+  keys = ["premium"]
+  limit = 5
+  interval = "1m"
+`
+
+const testPolicyYAML = `match: first
+keys:
+  api_key: header:X-Api-Key
+  tenant: header:X-Tenant
+rules:
+  - name: auth
+    path: /auth/**
+    methods: [POST]
+    algorithm: gcra
+    limit: 1
+    interval: 1m
+  - name: api
+    path: /api/**
+    key: api_key
+    tiers:
+      - name: key
+        key: api_key
+        limit: 2
+        interval: 1m
+      - name: tenant
+        key: tenant
+        windows: [10/1m, 100/24h]
+    overrides:
+      - keys: [premium]
+        limit: 5
+        interval: 1m
+`
+
+func TestRateLimiting_Policy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits-policy.toml")
+	require.NoError(t, os.WriteFile(path, []byte(testPolicyTOML), 0o600))
+
+	logger, err := construct.NewLogger("testing")
+	require.NoError(t, err)
+
+	config := conf.API{RateLimitPolicy: conf.Filepath{Path: path}}
+	rules, err := construct.NewRuleSet(config, logger)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, rules.Close())
+	})
+
+	app := construct.NewAPIMuxWithLimiter(config, logger, rules.Handler())
+	app.All("/*", func(c *fiber.Ctx) error {
+		return c.SendStatus(http.StatusOK)
+	})
+
+	request := func(method, path, key string) *http.Response {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-Api-Key", key)
+		req.Header.Set("X-Tenant", "acme")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	require.Equal(t, http.StatusOK, request(http.MethodPost, "/auth/login", "").StatusCode)
+	require.Equal(t, http.StatusTooManyRequests, request(http.MethodPost, "/auth/login", "").StatusCode)
+
+	require.Equal(t, http.StatusOK, request(http.MethodGet, "/api/orders", "key-1").StatusCode)
+	require.Equal(t, http.StatusOK, request(http.MethodGet, "/api/orders", "key-1").StatusCode)
+	require.Equal(t, http.StatusTooManyRequests, request(http.MethodGet, "/api/orders", "key-1").StatusCode)
+
+	resp := request(http.MethodGet, "/api/orders", "premium")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "5", resp.Header.Get(limiter.HeaderRateLimitLimit))
+
+	// the same policy in yaml
+	fromTOML, err := limiter.ParsePolicy("policy.toml", limiter.PolicyFormatTOML, []byte(testPolicyTOML))
+	require.NoError(t, err)
+	fromYAML, err := limiter.ParsePolicy("policy.yaml", limiter.PolicyFormatYAML, []byte(testPolicyYAML))
+	require.NoError(t, err)
+	require.Equal(t, fromTOML, fromYAML)
+	require.Equal(t, "header:X-Api-Key", fromYAML.Rules[1].Key)
+	require.Len(t, fromYAML.Rules[1].Tiers[1].Config.Windows, 2)
+}
+
+func TestRateLimiting_PolicyMaxKeys(t *testing.T) {
+	policy := `
+[[rules]]
+name     = "api"
+path     = "/api/**"
+key      = "header:X-Api-Key"
+limit    = 10
+interval = "1m"
+
+[[rules]]
+name     = "bulk"
+path     = "/bulk"
+key      = "header:X-Api-Key"
+limit    = 10
+interval = "1m"
+max_keys = 2
+overflow = "reject"
+`
+	path := filepath.Join(t.TempDir(), "limits-policy.toml")
+	require.NoError(t, os.WriteFile(path, []byte(policy), 0o600))
+
+	logger, err := construct.NewLogger("testing")
+	require.NoError(t, err)
+
+	// the rules without max keys of their own are bounded like the default store
+	config := conf.API{
+		RateLimitPolicy:   conf.Filepath{Path: path},
+		RateLimitMaxKeys:  1,
+		RateLimitOverflow: string(limits.OverflowReject),
+	}
+	rules, err := construct.NewRuleSet(config, logger)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, rules.Close())
+	})
+
+	app := construct.NewAPIMuxWithLimiter(config, logger, rules.Handler())
+	app.All("/*", func(c *fiber.Ctx) error {
+		return c.SendStatus(http.StatusOK)
+	})
+
+	request := func(path, key string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Api-Key", key)
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, request("/api/orders", "first"))
+	require.Equal(t, http.StatusTooManyRequests, request("/api/orders", "second"))
+	require.Equal(t, http.StatusOK, request("/api/orders", "first"))
+
+	require.Equal(t, http.StatusOK, request("/bulk", "first"))
+	require.Equal(t, http.StatusOK, request("/bulk", "second"))
+	require.Equal(t, http.StatusTooManyRequests, request("/bulk", "third"))
+}
+
+func TestRateLimiting_PolicyIgnoredSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits-policy.toml")
+	require.NoError(t, os.WriteFile(path, []byte(testPolicyTOML), 0o600))
+
+	logger, err := construct.NewLogger("testing")
+	require.NoError(t, err)
+
+	// the rules are kept in memory, a shared store would silently be ignored
+	config := conf.API{
+		RateLimitPolicy:   conf.Filepath{Path: path},
+		RateLimitStore:    conf.StoreRedis,
+		RateLimitSnapshot: conf.Filepath{Path: filepath.Join(t.TempDir(), "limits.json")},
+		RateLimitQuota:    100,
+	}
+	_, err = construct.NewRuleSet(config, logger)
+	require.True(t, failure.IsInvalidParam(err))
+	require.Contains(t, err.Error(), "API_RATE_LIMIT_STORE=redis, API_RATE_LIMIT_SNAPSHOT, API_RATE_LIMIT_QUOTA")
+
+	_, _, err = construct.NewPolicyReloader(config, logger)
+	require.True(t, failure.IsInvalidParam(err))
+
+	config = conf.API{RateLimitPolicy: conf.Filepath{Path: path}, RateLimitStore: conf.StoreMemory}
+	rules, err := construct.NewRuleSet(config, logger)
+	require.NoError(t, err)
+	require.NoError(t, rules.Close())
+}
+
+func TestRateLimiting_PolicyInvalid(t *testing.T) {
+	tests := map[string]struct {
+		format string
+		policy string
+		err    string
+	}{
+		"toml syntax": {
+			format: limiter.PolicyFormatTOML,
+			policy: "match = \"first\"\n[[rules]\n",
+			err:    "policy:2:",
+		},
+		"yaml syntax": {
+			format: limiter.PolicyFormatYAML,
+			policy: "match: first\n rules: []\n",
+			err:    "policy:2:",
+		},
+		"unknown field": {
+			format: limiter.PolicyFormatTOML,
+			policy: "[[rules]]\nname = \"auth\"\nlimit = 1\ninterval = \"1s\"\nlimt = 2\n",
+			err:    "policy:5: field (limt) of rule is not supported",
+		},
+		"interval": {
+			format: limiter.PolicyFormatYAML,
+			policy: "rules:\n  - name: auth\n    limit: 1\n    interval: soon\n",
+			err:    "policy:4: interval (soon) is not a duration",
+		},
+		"duplicate rule": {
+			format: limiter.PolicyFormatYAML,
+			policy: "rules:\n  - name: auth\n    limit: 1\n    interval: 1s\n  - name: auth\n    limit: 1\n    interval: 1s\n",
+			err:    "policy:5: rule (auth) is defined more than once",
+		},
+		"key strategy": {
+			format: limiter.PolicyFormatTOML,
+			policy: "[[rules]]\nname = \"api\"\nkey = \"api_key\"\nlimit = 1\ninterval = \"1s\"\n",
+			err:    "policy:3: key (api_key) is not a key strategy",
+		},
+		"no limit": {
+			format: limiter.PolicyFormatTOML,
+			policy: "[[rules]]\nname = \"api\"\npath = \"/api/**\"\n",
+			err:    "policy:1: rule (api) has no limit, windows or tiers",
+		},
+		"window": {
+			format: limiter.PolicyFormatYAML,
+			policy: "rules:\n  - name: api\n    windows: [10/1s, 20/1s]\n",
+			err:    "policy:3: interval (1s) is used by more than one window",
+		},
+		"tier": {
+			format: limiter.PolicyFormatTOML,
+			policy: "[[rules]]\nname = \"api\"\n\n  [[rules.tiers]]\n  name = \"key\"\n  algorithm = \"random\"\n  limit = 1\n  interval = \"1s\"\n",
+			err:    "policy:6: algorithm (random) of tier (key) of rule (api) is not supported",
+		},
+		"client ip": {
+			format: limiter.PolicyFormatYAML,
+			policy: "client_ip:\n  ipv6_prefix: 129\nrules:\n  - name: api\n    limit: 1\n    interval: 1s\n",
+			err:    "policy:2: client_ip is invalid",
+		},
+		"no rules": {
+			format: limiter.PolicyFormatYAML,
+			policy: "match: all\n",
+			err:    "policy:1: policy has no rules",
+		},
+		"overflow": {
+			format: limiter.PolicyFormatYAML,
+			policy: "rules:\n  - name: api\n    limit: 1\n    interval: 1s\n    overflow: drop\n",
+			err:    "policy:5: overflow (drop) of rule (api) is not evict, admit or reject",
+		},
+		"max keys": {
+			format: limiter.PolicyFormatTOML,
+			policy: "[[rules]]\nname = \"api\"\nlimit = 1\ninterval = \"1s\"\nmax_keys = -1\n",
+			err:    "policy:5: max_keys is not a positive integer",
+		},
+	}
+
+	for name, tt := range tests {
+		_, err := limiter.ParsePolicy("policy", tt.format, []byte(tt.policy))
+		require.True(t, failure.IsInvalidParam(err), name)
+		require.Contains(t, err.Error(), tt.err, name)
+	}
+
+	_, err := limiter.LoadPolicy("policy.json")
+	require.True(t, failure.IsInvalidParam(err))
+}
+
+func TestRateLimiting_PolicyReload(t *testing.T) {
+	config := func(authLimit, bulkLimit uint64) limiter.RuleSetConfig {
+		return limiter.RuleSetConfig{
+			Rules: []limiter.Rule{
+				{Name: "auth", Path: "/auth/**", Config: limiter.Config{Limit: authLimit, Interval: time.Minute}},
+				{Name: "bulk", Path: "/bulk", Config: limiter.Config{Limit: bulkLimit, Interval: time.Minute}},
+			},
+		}
+	}
+
+	reloader, err := limiter.NewReloader(config(1, 1))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, reloader.Close())
+	})
+
+	app := fiber.New()
+	app.Use(reloader.Handler())
+	app.All("/*", func(c *fiber.Ctx) error {
+		return c.SendStatus(http.StatusOK)
+	})
+
+	request := func(path string) *http.Response {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, path, nil))
+		require.NoError(t, err)
+		return resp
+	}
+
+	for _, path := range []string{"/auth/login", "/bulk"} {
+		require.Equal(t, http.StatusOK, request(path).StatusCode)
+		require.Equal(t, http.StatusTooManyRequests, request(path).StatusCode)
+	}
+
+	// the bulk limit is raised, the auth rule keeps the state of its keys
+	result, err := reloader.Reload(config(1, 3))
+	require.NoError(t, err)
+	require.Equal(t, limiter.ReloadResult{Rules: 2, Kept: 1, Created: 1, Closed: 1}, result)
+
+	require.Equal(t, http.StatusTooManyRequests, request("/auth/login").StatusCode)
+	resp := request("/bulk")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "3", resp.Header.Get(limiter.HeaderRateLimitLimit))
+	require.Equal(t, "2", resp.Header.Get(limiter.HeaderRateLimitRemaining))
+
+	// an invalid config keeps the current rules
+	invalid := config(1, 3)
+	invalid.Rules = append(invalid.Rules, limiter.Rule{Name: "auth"})
+	_, err = reloader.Reload(invalid)
+	require.True(t, failure.IsInvalidParam(err))
+
+	resp = request("/bulk")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get(limiter.HeaderRateLimitRemaining))
+
+	// removing a rule closes its store
+	result, err = reloader.Reload(limiter.RuleSetConfig{Rules: config(1, 3).Rules[:1]})
+	require.NoError(t, err)
+	require.Equal(t, limiter.ReloadResult{Rules: 1, Kept: 1, Closed: 1}, result)
+	require.Equal(t, http.StatusOK, request("/bulk").StatusCode)
+	require.Empty(t, request("/bulk").Header.Get(limiter.HeaderRateLimitLimit))
+}
+
+func TestRateLimiting_PolicyReloadConcurrent(t *testing.T) {
+	config := func(limit uint64) limiter.RuleSetConfig {
+		return limiter.RuleSetConfig{
+			Rules: []limiter.Rule{
+				{Name: "all", Key: "global", Config: limiter.Config{Limit: 1000000, Interval: time.Minute}},
+				{Name: "ping", Path: "/ping", Config: limiter.Config{Limit: limit, Interval: time.Minute}},
+			},
+			MatchAll: true,
+		}
+	}
+
+	reloader, err := limiter.NewReloader(config(1000))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, reloader.Close())
+	})
+
+	app := fiber.New()
+	app.Use(reloader.Handler())
+	app = construct.AddPingRoutes(app, nil)
+
+	// requests served while the rules are swapped never hit a closed store
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+				require.NoError(t, err)
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		_, err := reloader.Reload(config(uint64(1000 + i)))
+		require.NoError(t, err)
+	}
+	wg.Wait()
+
+	require.NoError(t, reloader.Close())
+	_, err = reloader.Reload(config(1))
+	require.True(t, failure.IsInvalidState(err))
+}
+
+func TestRateLimiting_PolicyReloadSlowRequest(t *testing.T) {
+	config := func(limit uint64) limiter.RuleSetConfig {
+		return limiter.RuleSetConfig{
+			Rules: []limiter.Rule{
+				{Name: "slow", Path: "/slow", Config: limiter.Config{Limit: limit, Interval: time.Minute, SkipSuccessfulRequests: true}},
+			},
+		}
+	}
+
+	reloader, err := limiter.NewReloader(config(10))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, reloader.Close())
+	})
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	app := fiber.New()
+	app.Use(reloader.Handler())
+	app.Get("/slow", func(c *fiber.Ctx) error {
+		close(entered)
+		<-release
+		return c.SendStatus(http.StatusOK)
+	})
+
+	done := make(chan int, 1)
+	go func() {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/slow", nil), -1)
+		if err != nil {
+			done <- 0
+			return
+		}
+		done <- resp.StatusCode
+	}()
+	<-entered
+
+	// the reload closes the store of the slow request without waiting for it
+	reloaded := make(chan error, 1)
+	go func() {
+		result, err := reloader.Reload(config(20))
+		if err == nil && result.Closed != 1 {
+			err = fmt.Errorf("closed (%d) stores, expected 1", result.Closed)
+		}
+		reloaded <- err
+	}()
+
+	select {
+	case err = <-reloaded:
+		require.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Reload waited for the slow request")
+	}
+
+	// its refund is dropped, the store is closed
+	close(release)
+	require.Equal(t, http.StatusOK, <-done)
+}
+
+func TestRateLimiting_PolicyWatcher(t *testing.T) {
+	policy := func(limit int) []byte {
+		return []byte(fmt.Sprintf("[[rules]]\nname = \"ping\"\npath = \"/ping\"\nlimit = %d\ninterval = \"1m\"\n", limit))
+	}
+
+	path := filepath.Join(t.TempDir(), "limits-policy.toml")
+	require.NoError(t, os.WriteFile(path, policy(1), 0o600))
+
+	config, err := limiter.LoadPolicy(path)
+	require.NoError(t, err)
+	reloader, err := limiter.NewReloader(config)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, reloader.Close())
+	})
+
+	events := make(chan limiter.ReloadEvent, 10)
+	watcher, err := limiter.NewPolicyWatcher(limiter.PolicyWatcherConfig{
+		Path:     path,
+		Reloader: reloader,
+		Debounce: 10 * time.Millisecond,
+		OnReload: func(e limiter.ReloadEvent) {
+			events <- e
+		},
+	})
+	require.NoError(t, err)
+	go watcher.Run()
+	t.Cleanup(func() {
+		require.NoError(t, watcher.Close())
+	})
+
+	app := fiber.New()
+	app.Use(reloader.Handler())
+	app = construct.AddPingRoutes(app, nil)
+
+	limit := func() string {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+		require.NoError(t, err)
+		return resp.Header.Get(limiter.HeaderRateLimitLimit)
+	}
+
+	next := func() limiter.ReloadEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "no reload")
+		}
+		return limiter.ReloadEvent{}
+	}
+
+	require.Equal(t, "1", limit())
+
+	// the file changes
+	require.NoError(t, os.WriteFile(path, policy(5), 0o600))
+	e := next()
+	require.NoError(t, e.Err)
+	require.Equal(t, limiter.ReloadTriggerFile, e.Trigger)
+	require.Equal(t, limiter.ReloadResult{Rules: 1, Created: 1, Closed: 1}, e.Result)
+	require.Equal(t, "5", limit())
+
+	// an invalid policy keeps the rules
+	require.NoError(t, os.WriteFile(path, []byte("[[rules]]\nname = \"ping\"\nlimit = 0\ninterval = \"1m\"\n"), 0o600))
+	e = next()
+	require.True(t, failure.IsInvalidParam(e.Err))
+	require.Contains(t, e.Err.Error(), "limits-policy.toml:3: limit of rule (ping) is zero")
+	require.Equal(t, "5", limit())
+
+	// the fixed policy has the limits still enforced
+	require.NoError(t, os.WriteFile(path, policy(5), 0o600))
+	e = next()
+	require.NoError(t, e.Err)
+	require.Equal(t, limiter.ReloadResult{Rules: 1, Kept: 1}, e.Result)
+
+	// a signal reloads the unchanged file
+
+	watcher.Reload(limiter.ReloadTriggerSignal)
+	e = next()
+	require.NoError(t, e.Err)
+	require.Equal(t, limiter.ReloadTriggerSignal, e.Trigger)
+	require.Equal(t, limiter.ReloadResult{Rules: 1, Kept: 1}, e.Result)
 }